@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// agentSink agent://host[:port]/path streams files to a `watch serve`
+// receiver over TLS, agent+tcp:// without it (for VPNs and SSH tunnels).
+// The shared secret comes from the URL password or WATCH_AGENT_TOKEN;
+// ?ca=file trusts a private CA, ?compress=0 turns gzip off. Files the
+// receiver already has a large older version of are sent as a delta.
+type agentSink struct {
+	addr  string
+	root  string
+	token string
+	tls   *tls.Config
+	gzip  bool
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+const (
+	agentPort    = "7433"
+	agentTimeout = 30 * time.Second
+)
+
+// agentRequest One request line. A put is followed by a record stream, gzip
+// compressed if Gzip is set.
+type agentRequest struct {
+	Op      string    `json:"op"`
+	Path    string    `json:"path,omitempty"`
+	Token   string    `json:"token,omitempty"`
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mtime,omitempty"`
+	Gzip    bool      `json:"gzip,omitempty"`
+	Delta   bool      `json:"delta,omitempty"`
+}
+
+// agentResponse One response line. An answer to sigs is followed by Blocks
+// signature records.
+type agentResponse struct {
+	Error    string    `json:"error,omitempty"`
+	NotExist bool      `json:"not_exist,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	ModTime  time.Time `json:"mtime,omitempty"`
+	Sha256   string    `json:"sha256,omitempty"`
+	Blocks   int       `json:"blocks,omitempty"`
+}
+
+// Records of a put: literal data, a block of the old file, end of file.
+const (
+	agentLiteral = 'L'
+	agentBlock   = 'B'
+	agentEnd     = 'E'
+)
+
+func newAgentSink(u *url.URL) (Sink, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%s: missing host", u.Redacted())
+	}
+	port := u.Port()
+	if port == "" {
+		port = agentPort
+	}
+
+	s := &agentSink{
+		addr:  net.JoinHostPort(u.Hostname(), port),
+		root:  u.Path,
+		token: os.Getenv("WATCH_AGENT_TOKEN"),
+		gzip:  u.Query().Get("compress") != "0",
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			s.token = pass
+		}
+	}
+	if s.token == "" {
+		return nil, fmt.Errorf("%s: needs WATCH_AGENT_TOKEN", u.Redacted())
+	}
+
+	if u.Scheme == "agent" {
+		s.tls = &tls.Config{ServerName: u.Hostname()}
+		if ca := u.Query().Get("ca"); ca != "" {
+			pem, err := os.ReadFile(ca)
+			if err != nil {
+				return nil, err
+			}
+			s.tls.RootCAs = x509.NewCertPool()
+			if !s.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s: no certificates in %s", u.Redacted(), ca)
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *agentSink) connect() error {
+	raw, err := net.DialTimeout("tcp", s.addr, agentTimeout)
+	if err != nil {
+		return err
+	}
+	conn := net.Conn(&idleConn{Conn: raw, timeout: agentTimeout})
+	if s.tls != nil {
+		conn = tls.Client(conn, s.tls)
+	}
+	s.conn, s.r, s.w = conn, bufio.NewReader(conn), bufio.NewWriterSize(conn, 1<<20)
+
+	if _, err = s.roundTrip(agentRequest{Op: "hello", Token: s.token}, nil); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+func (s *agentSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn, s.r, s.w = nil, nil, nil
+}
+
+// roundTrip Send a request, then body if any, and read the response line.
+func (s *agentSink) roundTrip(req agentRequest, body func(w io.Writer) error) (agentResponse, error) {
+	var resp agentResponse
+	if err := json.NewEncoder(s.w).Encode(req); err != nil {
+		return resp, err
+	}
+	if body != nil {
+		if err := body(s.w); err != nil {
+			return resp, err
+		}
+	}
+	if err := s.w.Flush(); err != nil {
+		return resp, err
+	}
+
+	line, err := s.r.ReadBytes('\n')
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(line, &resp); err != nil {
+		return resp, fmt.Errorf("agent %s: bad response %q", s.addr, line)
+	}
+	if resp.NotExist {
+		return resp, os.ErrNotExist
+	}
+	if resp.Error != "" {
+		return resp, fmt.Errorf("agent %s: %s %s: %s", s.addr, req.Op, req.Path, resp.Error)
+	}
+	return resp, nil
+}
+
+// session Run fn on a connection. After a network error the connection is
+// reopened and fn tried once more; errors from the receiver are returned.
+func (s *agentSink) session(fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for attempt := 1; attempt <= 2; attempt++ {
+		if s.conn == nil {
+			if err = s.connect(); err != nil {
+				continue
+			}
+		}
+		err = fn()
+		var network net.Error
+		if !errors.As(err, &network) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		// the receiver drops connections that sit idle, so this is routine
+		debugf("agent %s: %v, reconnecting", s.addr, err)
+		s.close()
+	}
+	return err
+}
+
+func (s *agentSink) remote(name string) string {
+	return path.Join(s.root, name)
+}
+
+func (s *agentSink) EnsureDir(dir string) error {
+	return s.session(func() error {
+		_, err := s.roundTrip(agentRequest{Op: "mkdir", Path: s.remote(dir)}, nil)
+		return err
+	})
+}
+
+func (s *agentSink) Remove(name string) error {
+	return s.session(func() error {
+		_, err := s.roundTrip(agentRequest{Op: "remove", Path: s.remote(name)}, nil)
+		return err
+	})
+}
+
+func (s *agentSink) Stat(name string) (sinkStat, error) {
+	var st sinkStat
+	err := s.session(func() error {
+		resp, err := s.roundTrip(agentRequest{Op: "stat", Path: s.remote(name)}, nil)
+		st = sinkStat{Size: resp.Size, ModTime: resp.ModTime}
+		return err
+	})
+	return st, err
+}
+
+// Sha256 Ask the receiver for the checksum of name.
+func (s *agentSink) Sha256(name string) (string, error) {
+	var sum string
+	err := s.session(func() error {
+		resp, err := s.roundTrip(agentRequest{Op: "sum", Path: s.remote(name)}, nil)
+		sum = resp.Sha256
+		return err
+	})
+	return sum, err
+}
+
+// WriteFile Stream src to the receiver, as a delta against its old copy
+// when that is at least --delta-threshold big.
+func (s *agentSink) WriteFile(name string, src string) error {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	return s.session(func() error {
+		remote := s.remote(name)
+		var sigs map[uint32][]blockSig
+		old, err := s.roundTrip(agentRequest{Op: "stat", Path: remote}, nil)
+		if err == nil && old.Size >= deltaThreshold {
+			if sigs, err = s.signatures(remote); err != nil {
+				return err
+			}
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		req := agentRequest{Op: "put", Path: remote, Size: stat.Size(), ModTime: stat.ModTime(), Gzip: s.gzip, Delta: sigs != nil}
+		_, err = s.roundTrip(req, func(w io.Writer) error {
+			return sendRecords(w, src, s.gzip, sigs)
+		})
+		return err
+	})
+}
+
+// signatures Fetch the block signatures of the receiver's copy of name.
+func (s *agentSink) signatures(name string) (map[uint32][]blockSig, error) {
+	resp, err := s.roundTrip(agentRequest{Op: "sigs", Path: name}, nil)
+	if err != nil {
+		return nil, err
+	}
+	sigs := make(map[uint32][]blockSig, resp.Blocks)
+	rec := make([]byte, 4+8+32)
+	for i := 0; i < resp.Blocks; i++ {
+		if _, err = io.ReadFull(s.r, rec); err != nil {
+			return nil, err
+		}
+		sig := blockSig{index: int64(binary.BigEndian.Uint64(rec[4:12]))}
+		copy(sig.strong[:], rec[12:])
+		weak := binary.BigEndian.Uint32(rec[:4])
+		sigs[weak] = append(sigs[weak], sig)
+	}
+	return sigs, nil
+}
+
+// sendRecords Write the put record stream for src: only literal data, or a
+// delta against sigs.
+func sendRecords(w io.Writer, src string, compress bool, sigs map[uint32][]blockSig) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var zw *gzip.Writer
+	if compress {
+		zw, _ = gzip.NewWriterLevel(w, gzip.BestSpeed)
+		w = zw
+	}
+	out := &agentRecords{w: w}
+
+	r := bufio.NewReaderSize(throttle(f), copyBufferSize)
+	if sigs != nil {
+		matched, literal, err := deltaCopy(out, r, sigs, deltaBlock)
+		if err != nil {
+			return err
+		}
+		debugf("delta %s: %d bytes reused, %d bytes sent", src, matched, literal)
+	} else if _, err = io.Copy(out, r); err != nil {
+		return err
+	}
+
+	if _, err = w.Write([]byte{agentEnd}); err != nil {
+		return err
+	}
+	if zw != nil {
+		return zw.Close()
+	}
+	return nil
+}
+
+// agentRecords Encodes deltaCopy's output, and plain writes, as records.
+type agentRecords struct {
+	w io.Writer
+}
+
+func (a *agentRecords) Write(p []byte) (int, error) {
+	if err := a.Literal(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (a *agentRecords) Literal(p []byte) error {
+	var hdr [5]byte
+	hdr[0] = agentLiteral
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(p)))
+	if _, err := a.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := a.w.Write(p)
+	return err
+}
+
+func (a *agentRecords) Block(index int64) error {
+	var rec [9]byte
+	rec[0] = agentBlock
+	binary.BigEndian.PutUint64(rec[1:], uint64(index))
+	_, err := a.w.Write(rec[:])
+	return err
+}
+
+// idleConn A connection that times out only when nothing moves for
+// timeout, however long a transfer takes.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/botsphp/fsnotify"
+)
+
+// The commands that manage a running watcher, shared by the --control-socket
+// and the /api endpoints of --http.
+
+var (
+	// activeWatcher The watcher, for adding and removing watched folders.
+	activeWatcher *fsnotify.Watcher
+
+	// apiToken The bearer token the /api endpoints want, from --api-token or
+	// WATCH_API_TOKEN; without one they are off.
+	apiToken string
+
+	errUnknownJob = errors.New("no such job")
+)
+
+// jobsNamed The job called name, or every job for "".
+func jobsNamed(name string) ([]*job, error) {
+	if name == "" {
+		return runningJobs(), nil
+	}
+	for _, j := range runningJobs() {
+		if j.Name == name || (j.Alias != "" && j.Alias == name) {
+			return []*job{j}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %s", errUnknownJob, name)
+}
+
+// pauseJobs Hold the queues of the named job or of all, or let them go
+// again. Changes keep being queued meanwhile.
+func pauseJobs(name string, held bool) (string, error) {
+	found, err := jobsNamed(name)
+	if err != nil {
+		return "", err
+	}
+	var changed []string
+	for _, j := range found {
+		if !j.queue.hold(held) {
+			continue
+		}
+		changed = append(changed, j.Name)
+		if held {
+			infof("job %s: paused, %d copies waiting", j.Name, j.queue.len())
+		} else {
+			infof("job %s: resumed, %d copies waiting", j.Name, j.queue.len())
+		}
+	}
+	verb := "resumed"
+	if held {
+		verb = "paused"
+	}
+	if len(changed) == 0 {
+		return "nothing " + verb, nil
+	}
+	return verb + " " + strings.Join(changed, ", "), nil
+}
+
+// resyncJobs Start a full sync of the named job or of all in the
+// background, except of those syncing already.
+func resyncJobs(name string) (string, error) {
+	found, err := jobsNamed(name)
+	if err != nil {
+		return "", err
+	}
+	var started, busy []string
+	for _, j := range found {
+		if j.twoWay != nil && j != j.twoWay.fwd {
+			continue // a pair is reconciled by its forward job
+		}
+		if !atomic.CompareAndSwapInt32(&j.syncing, 0, 1) {
+			busy = append(busy, j.Name)
+			continue
+		}
+		started = append(started, j.Name)
+		go func(j *job) {
+			defer atomic.StoreInt32(&j.syncing, 0)
+			j.syncNow("requested")
+		}(j)
+	}
+	reply := "resync started for " + strings.Join(started, ", ")
+	if len(started) == 0 {
+		reply = "no resync started"
+	}
+	if len(busy) > 0 {
+		reply += "; already syncing: " + strings.Join(busy, ", ")
+	}
+	return reply, nil
+}
+
+// resyncOnHangup Start a full sync of every job on SIGHUP, for operators
+// who suspect a destination drifted from its source.
+func resyncOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		reply, _ := resyncJobs("")
+		infof("SIGHUP: %s", reply)
+	}
+}
+
+// flushJobs Copy everything waiting in the queues of the named job or of
+// all now, without waiting for files to settle or for retries to come due.
+func flushJobs(name string) (string, error) {
+	found, err := jobsNamed(name)
+	if err != nil {
+		return "", err
+	}
+	n := 0
+	for _, j := range found {
+		n += j.queue.flush()
+	}
+	return fmt.Sprintf("%d copies due now", n), nil
+}
+
+// sourcePath p in the form the watcher reports paths of the source it is
+// in, which may be relative, or false when it is in no job's source.
+func sourcePath(p string) (string, bool) {
+	if len(jobsFor(p)) > 0 {
+		return filepath.Clean(p), true
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", false
+	}
+	for _, j := range runningJobs() {
+		root, err := filepath.Abs(j.Source)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return filepath.Join(j.Source, rel), true
+	}
+	return "", false
+}
+
+// addWatchPath Watch the folder p and the folders in it, for example one
+// left out by --no-recurse or by path remove. It must be in a job's source,
+// which decides where its files go.
+func addWatchPath(p string) (string, error) {
+	path, ok := sourcePath(p)
+	if !ok {
+		return "", fmt.Errorf("%s is in no job's source", p)
+	}
+	if !IsDir(path) {
+		return "", fmt.Errorf("%s is not a folder", p)
+	}
+	overridesMu.Lock()
+	addedPaths[path] = true
+	for r := range removedPaths {
+		if under(r, path) {
+			delete(removedPaths, r)
+		}
+	}
+	overridesMu.Unlock()
+
+	added, _, err := updateWatches()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("watching %d more folders", added), nil
+}
+
+// removeWatchPath Stop watching the folder p and the folders in it, so
+// changes there aren't copied until it is added again. Full syncs still
+// cover it.
+func removeWatchPath(p string) (string, error) {
+	path, ok := sourcePath(p)
+	if !ok {
+		return "", fmt.Errorf("%s is in no job's source", p)
+	}
+	watched := false
+	for _, dir := range watchedPaths() {
+		watched = watched || under(dir, path)
+	}
+	if !watched {
+		return "", fmt.Errorf("%s is not watched", p)
+	}
+	overridesMu.Lock()
+	removedPaths[path] = true
+	for a := range addedPaths {
+		if under(a, path) {
+			delete(addedPaths, a)
+		}
+	}
+	overridesMu.Unlock()
+
+	_, removed, err := updateWatches()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("stopped watching %d folders", removed), nil
+}
+
+// watchedPaths The watched folders, sorted.
+func watchedPaths() []string {
+	rootsMu.Lock()
+	list := make([]string, 0, len(roots))
+	for dir := range roots {
+		list = append(list, dir)
+	}
+	rootsMu.Unlock()
+	sort.Strings(list)
+	return list
+}
+
+// setAPIToken Take the token of the /api endpoints from --api-token or the
+// environment.
+func setAPIToken() {
+	apiToken = opts.APIToken
+	if apiToken == "" {
+		apiToken = os.Getenv("WATCH_API_TOKEN")
+	}
+}
+
+type apiReply struct {
+	OK      bool        `json:"ok"`
+	Message string      `json:"message,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// checkToken The status code and error to refuse a request with, or 0 when
+// it carries the token.
+func checkToken(w http.ResponseWriter, req *http.Request) (int, string) {
+	if apiToken == "" {
+		return http.StatusForbidden, "the API is off, start the watcher with --api-token"
+	}
+	if !hasToken(req) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="watch"`)
+		return http.StatusUnauthorized, "missing or wrong token"
+	}
+	return 0, ""
+}
+
+// hasToken The request carries the --api-token.
+func hasToken(req *http.Request) bool {
+	given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return apiToken != "" && subtle.ConstantTimeCompare([]byte(given), []byte(apiToken)) == 1
+}
+
+// serveAPI /api/...: manage the watcher over HTTP, with the token as
+// "Authorization: Bearer <token>".
+//
+//	GET    /api/stats                the status, as /status
+//	POST   /api/pause[?job=NAME]     hold the queues
+//	POST   /api/resume[?job=NAME]    let them go again
+//	POST   /api/resync[?job=NAME]    start a full sync
+//	POST   /api/flush[?job=NAME]     copy what is queued now
+//	POST   /api/reload               reread the config, update the watches
+//	GET    /api/maintenance          whether maintenance is on
+//	POST   /api/maintenance          stop writing to the destinations
+//	DELETE /api/maintenance          write to them again
+//	GET    /api/paths                the watched folders
+//	POST   /api/paths?path=DIR       watch a folder of a source
+//	DELETE /api/paths?path=DIR       stop watching it
+func serveAPI(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	answer := func(code int, r apiReply) {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(r)
+	}
+
+	if code, msg := checkToken(w, req); code != 0 {
+		answer(code, apiReply{Error: msg})
+		return
+	}
+
+	method := map[string]string{
+		"/api/stats": http.MethodGet, "/api/pause": http.MethodPost, "/api/resume": http.MethodPost,
+		"/api/resync": http.MethodPost, "/api/flush": http.MethodPost, "/api/reload": http.MethodPost, "/api/paths": "",
+		"/api/maintenance": "",
+	}
+	want, known := method[req.URL.Path]
+	if !known {
+		answer(http.StatusNotFound, apiReply{Error: "no such endpoint " + req.URL.Path})
+		return
+	}
+	if want != "" && req.Method != want {
+		w.Header().Set("Allow", want)
+		answer(http.StatusMethodNotAllowed, apiReply{Error: req.URL.Path + " takes " + want})
+		return
+	}
+
+	name := req.URL.Query().Get("job")
+	var message string
+	var err error
+	switch req.URL.Path {
+	case "/api/stats":
+		answer(http.StatusOK, apiReply{OK: true, Data: status()})
+		return
+	case "/api/pause":
+		message, err = pauseJobs(name, true)
+	case "/api/resume":
+		message, err = pauseJobs(name, false)
+	case "/api/resync":
+		message, err = resyncJobs(name)
+	case "/api/flush":
+		message, err = flushJobs(name)
+	case "/api/reload":
+		message, err = reloadWatches()
+	case "/api/maintenance":
+		switch req.Method {
+		case http.MethodGet:
+			message = maintenanceState()
+		case http.MethodPost:
+			message = startMaintenance()
+		case http.MethodDelete:
+			message = endMaintenance()
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			answer(http.StatusMethodNotAllowed, apiReply{Error: "/api/maintenance takes GET, POST or DELETE"})
+			return
+		}
+	case "/api/paths":
+		p := req.URL.Query().Get("path")
+		switch {
+		case req.Method == http.MethodGet:
+			answer(http.StatusOK, apiReply{OK: true, Data: watchedPaths()})
+			return
+		case p == "":
+			err = errors.New("path is missing")
+		case req.Method == http.MethodPost:
+			message, err = addWatchPath(p)
+		case req.Method == http.MethodDelete:
+			message, err = removeWatchPath(p)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			answer(http.StatusMethodNotAllowed, apiReply{Error: "/api/paths takes GET, POST or DELETE"})
+			return
+		}
+	}
+
+	switch {
+	case errors.Is(err, errUnknownJob):
+		answer(http.StatusNotFound, apiReply{Error: err.Error()})
+	case err != nil:
+		answer(http.StatusBadRequest, apiReply{Error: err.Error()})
+	default:
+		answer(http.StatusOK, apiReply{OK: true, Message: message})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// archiver Appends changed files of one job into the archive of the current
+// --archive-window (one tar or zip per hour, day, ...) instead of a mirror.
+type archiver struct {
+	mu     sync.Mutex
+	window time.Time
+	file   *os.File
+	tw     *tar.Writer
+	zw     *zip.Writer
+}
+
+var archivers sync.Map
+
+func validArchive(kind string) error {
+	switch kind {
+	case "", "tar", "zip":
+		return nil
+	}
+	return fmt.Errorf("unknown --archive %s (tar, zip)", kind)
+}
+
+// archiveFile Add srcFileName to the job's current archive.
+func (j *job) archiveFile(srcFileName string) error {
+	a, _ := archivers.LoadOrStore(j.Name, &archiver{})
+	ar := a.(*archiver)
+
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+
+	window := time.Now().Truncate(archiveWindow)
+	if ar.file == nil || !window.Equal(ar.window) {
+		if err := ar.close(); err != nil {
+			return err
+		}
+		if err := ar.open(j, window); err != nil {
+			return err
+		}
+	}
+
+	stat, err := os.Stat(srcFileName)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(srcFileName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	name := j.archiveName(srcFileName)
+	if ar.tw != nil {
+		hdr, err := tar.FileInfoHeader(stat, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if err = ar.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err = io.Copy(ar.tw, throttle(src)); err != nil {
+			return err
+		}
+		// every entry is complete on disk, even if the window never closes
+		return ar.tw.Flush()
+	}
+
+	hdr, err := zip.FileInfoHeader(stat)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Method = zip.Deflate
+	w, err := ar.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, throttle(src))
+	return err
+}
+
+// archiveName The entry name: the path below the watch root, under its alias.
+func (j *job) archiveName(srcFileName string) string {
+	rel, err := filepath.Rel(j.root(), srcFileName)
+	if err != nil {
+		rel = filepath.Base(srcFileName)
+	}
+	return filepath.ToSlash(filepath.Join(j.rootAlias(), rel))
+}
+
+func (ar *archiver) open(j *job, window time.Time) error {
+	base := filepath.Join(j.Dest, fmt.Sprintf("%s-%s", j.Name, window.Format("2006-01-02T15-04")))
+	path := base + "." + opts.Archive
+	// an archive of this window from an earlier run is left alone
+	for n := 2; IsFile(path); n++ {
+		path = fmt.Sprintf("%s-%d.%s", base, n, opts.Archive)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
+	ar.file = f
+	ar.window = window
+	if opts.Archive == "zip" {
+		ar.zw = zip.NewWriter(f)
+	} else {
+		ar.tw = tar.NewWriter(f)
+	}
+	infof("archiving to %s", path)
+
+	// finish the archive when its window ends, not when the next file comes:
+	// a zip is unreadable until then
+	time.AfterFunc(time.Until(window.Add(archiveWindow)), func() {
+		ar.mu.Lock()
+		defer ar.mu.Unlock()
+		if ar.file != nil && ar.window.Equal(window) {
+			if err := ar.close(); err != nil {
+				errorf("%v", err)
+			}
+		}
+	})
+	return nil
+}
+
+func (ar *archiver) close() error {
+	if ar.file == nil {
+		return nil
+	}
+
+	var err error
+	if ar.tw != nil {
+		err = ar.tw.Close()
+	}
+	if ar.zw != nil {
+		err = ar.zw.Close()
+	}
+	if cerr := ar.file.Close(); err == nil {
+		err = cerr
+	}
+	ar.file, ar.tw, ar.zw = nil, nil, nil
+	return err
+}
+
+// closeArchives Finish every open archive, on shutdown.
+func closeArchives() {
+	archivers.Range(func(_, a interface{}) bool {
+		ar := a.(*archiver)
+		ar.mu.Lock()
+		if err := ar.close(); err != nil {
+			errorf("%v", err)
+		}
+		ar.mu.Unlock()
+		return true
+	})
+}
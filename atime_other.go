@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !windows
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+func fileAtime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
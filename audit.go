@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog --audit-log: an append-only trail of one JSON line per event,
+// decision and copy result, enough to trace where any destination file came
+// from. The file is rotated at --audit-max-size into file.1, file.2, ...,
+// keeping --audit-keep of them.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+	max  int64
+	keep int
+}
+
+// auditEntry One line of the audit log. Kind is event for changes seen,
+// decision for what the watcher chose to do about one, and result for how a
+// copy ended.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Op     string    `json:"op"`
+	Path   string    `json:"path,omitempty"`
+	Job    string    `json:"job,omitempty"`
+	Dest   string    `json:"dest,omitempty"`
+	Bytes  int64     `json:"bytes,omitempty"`
+	Sha256 string    `json:"sha256,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+var audit *auditLog
+
+func openAudit(path string, max int64, keep int) (*auditLog, error) {
+	a := &auditLog{path: path, max: max, keep: keep}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	if err := guardSource(a.path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.size = f, stat.Size()
+	return nil
+}
+
+func (a *auditLog) write(e auditEntry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+	if a.max > 0 && a.size+int64(len(line)) > a.max && a.size > 0 {
+		if err = a.rotate(); err != nil {
+			// logging the failure would come back here through logAt
+			fmt.Fprintln(os.Stderr, "audit log:", err)
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "audit log:", err)
+	}
+}
+
+// rotate Shift file.N to file.N+1, dropping the oldest, and start afresh.
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", a.path, a.keep))
+	for n := a.keep - 1; n >= 1; n-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, n), fmt.Sprintf("%s.%d", a.path, n+1))
+	}
+	if a.keep > 0 {
+		if err := os.Rename(a.path, a.path+".1"); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(a.path)
+	}
+	return a.open()
+}
+
+func (a *auditLog) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+// auditMessage Log an event or copy outcome. A copy is logged with the
+// size and checksum of what was copied.
+func auditMessage(msg eventMessage) {
+	e := auditEntry{Time: msg.Time, Kind: "event", Op: msg.Op, Path: msg.Path, Job: msg.Job, Dest: msg.Dest, Error: msg.Error}
+	if msg.outcome() {
+		e.Kind = "result"
+	}
+	if msg.Op == "copied" {
+		e.Bytes, e.Sha256 = msg.Size, msg.Sha256
+	}
+	audit.write(e)
+}
+
+// auditDecision Log what the job decided to do about path and why.
+func (j *job) auditDecision(op string, path string, dest string, reason string) {
+	if audit == nil {
+		return
+	}
+	audit.write(auditEntry{Time: time.Now(), Kind: "decision", Op: op, Path: path, Job: j.Name, Dest: dest, Reason: reason})
+}
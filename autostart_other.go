@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+)
+
+const wizardOnDoubleClick = false
+
+func registerAutostart(exe string, configPath string) error {
+	return errors.New("not supported on this platform")
+}
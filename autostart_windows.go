@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// wizardOnDoubleClick Explorer starts the binary without arguments.
+const wizardOnDoubleClick = true
+
+// registerAutostart Add a Run key for the current user.
+func registerAutostart(exe string, configPath string) error {
+	value := fmt.Sprintf(`"%s" --config "%s"`, exe, configPath)
+	out, err := exec.Command("reg", "add", `HKCU\Software\Microsoft\Windows\CurrentVersion\Run`,
+		"/v", "watch", "/t", "REG_SZ", "/d", value, "/f").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsProvider Keys for signing requests, fetched again shortly before
+// temporary ones expire.
+type awsProvider struct {
+	source string
+	fetch  func() (awsCreds, time.Time, error)
+
+	mu     sync.Mutex
+	creds  awsCreds
+	expiry time.Time // zero for keys that don't expire
+}
+
+// awsMetadataClient For the instance and container metadata endpoints, which
+// answer at once or not at all.
+var awsMetadataClient = &http.Client{Timeout: 5 * time.Second}
+
+func (p *awsProvider) get() (awsCreds, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.creds.AccessKey != "" && (p.expiry.IsZero() || time.Now().Before(p.expiry.Add(-5*time.Minute))) {
+		return p.creds, nil
+	}
+	creds, expiry, err := p.fetch()
+	if err != nil {
+		return awsCreds{}, fmt.Errorf("AWS credentials from %s: %v", p.source, err)
+	}
+	p.creds, p.expiry = creds, expiry
+	return creds, nil
+}
+
+// awsCredentials Look up credentials the way the AWS SDKs do: the
+// environment, a web identity token (EKS), the shared credentials and config
+// files, the ECS container endpoint, and the EC2 instance metadata service.
+// profile (--profile, else AWS_PROFILE) picks the section of the shared
+// files; naming one skips the environment keys.
+func awsCredentials(profile string, region string) (*awsProvider, error) {
+	explicit := profile != ""
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	if key, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); !explicit && key != "" && secret != "" {
+		creds := awsCreds{AccessKey: key, SecretKey: secret, Token: os.Getenv("AWS_SESSION_TOKEN")}
+		return &awsProvider{source: "environment", fetch: func() (awsCreds, time.Time, error) {
+			return creds, time.Time{}, nil
+		}}, nil
+	}
+
+	if tokenFile, role := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN"); !explicit && tokenFile != "" && role != "" {
+		return &awsProvider{source: "web identity " + role, fetch: func() (awsCreds, time.Time, error) {
+			return assumeRoleWithWebIdentity(tokenFile, role, region)
+		}}, nil
+	}
+
+	shared, err := awsSharedConfig(profile)
+	if err != nil {
+		return nil, err
+	}
+	if shared == nil && explicit {
+		return nil, fmt.Errorf("profile %s not found in %s or %s", profile, awsSharedFile("AWS_SHARED_CREDENTIALS_FILE", "credentials"), awsSharedFile("AWS_CONFIG_FILE", "config"))
+	}
+	if shared["aws_access_key_id"] != "" && shared["aws_secret_access_key"] != "" {
+		creds := awsCreds{AccessKey: shared["aws_access_key_id"], SecretKey: shared["aws_secret_access_key"], Token: shared["aws_session_token"]}
+		return &awsProvider{source: "profile " + profile, fetch: func() (awsCreds, time.Time, error) {
+			return creds, time.Time{}, nil
+		}}, nil
+	}
+	if command := shared["credential_process"]; command != "" {
+		return &awsProvider{source: "profile " + profile + " credential_process", fetch: func() (awsCreds, time.Time, error) {
+			return awsCredentialProcess(command)
+		}}, nil
+	}
+	if explicit {
+		return nil, fmt.Errorf("profile %s has no aws_access_key_id or credential_process", profile)
+	}
+
+	if relative, full := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"), os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); relative != "" || full != "" {
+		target := full
+		if relative != "" {
+			target = "http://169.254.170.2" + relative
+		}
+		return &awsProvider{source: "container endpoint", fetch: func() (awsCreds, time.Time, error) {
+			req, err := http.NewRequest("GET", target, nil)
+			if err != nil {
+				return awsCreds{}, time.Time{}, err
+			}
+			if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+				req.Header.Set("Authorization", token)
+			}
+			return awsMetadataCreds(req)
+		}}, nil
+	}
+
+	return &awsProvider{source: "instance metadata", fetch: awsInstanceCreds}, nil
+}
+
+// awsSharedFile The path of a shared file: from env, or under ~/.aws.
+func awsSharedFile(env string, name string) string {
+	if file := os.Getenv(env); file != "" {
+		return file
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".aws", name)
+}
+
+// awsSharedConfig The settings of a profile, from the credentials file
+// ([name]) over the config file ([profile name], or [default]). It is nil
+// when neither file has the profile.
+func awsSharedConfig(profile string) (map[string]string, error) {
+	configSection := "profile " + profile
+	if profile == "default" {
+		configSection = "default"
+	}
+
+	var settings map[string]string
+	for _, f := range []struct{ file, section string }{
+		{awsSharedFile("AWS_CONFIG_FILE", "config"), configSection},
+		{awsSharedFile("AWS_SHARED_CREDENTIALS_FILE", "credentials"), profile},
+	} {
+		section, err := iniSection(f.file, f.section)
+		if err != nil {
+			return nil, err
+		}
+		if section == nil {
+			continue
+		}
+		if settings == nil {
+			settings = make(map[string]string)
+		}
+		for k, v := range section {
+			settings[k] = v
+		}
+	}
+	return settings, nil
+}
+
+// iniSection The key = value pairs of one [section] of an INI file, nil when
+// the file or section is missing.
+func iniSection(file string, name string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var section map[string]string
+	in := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			in = strings.TrimSpace(line[1:len(line)-1]) == name
+			if in && section == nil {
+				section = make(map[string]string)
+			}
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok && in {
+			section[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+		}
+	}
+	return section, scanner.Err()
+}
+
+// awsCredentialJSON What credential_process programs and the metadata
+// endpoints answer.
+type awsCredentialJSON struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	SessionToken    string    `json:"SessionToken"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func (c awsCredentialJSON) creds() (awsCreds, time.Time, error) {
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return awsCreds{}, time.Time{}, errors.New("answer without keys")
+	}
+	token := c.SessionToken
+	if token == "" {
+		token = c.Token
+	}
+	return awsCreds{AccessKey: c.AccessKeyID, SecretKey: c.SecretAccessKey, Token: token}, c.Expiration, nil
+}
+
+func awsCredentialProcess(command string) (awsCreds, time.Time, error) {
+	cmd := exec.Command("sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return awsCreds{}, time.Time{}, err
+	}
+	var answer awsCredentialJSON
+	if err = json.Unmarshal(out, &answer); err != nil {
+		return awsCreds{}, time.Time{}, err
+	}
+	return answer.creds()
+}
+
+func awsMetadataCreds(req *http.Request) (awsCreds, time.Time, error) {
+	resp, err := awsMetadataClient.Do(req)
+	if err != nil {
+		return awsCreds{}, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsCreds{}, time.Time{}, fmt.Errorf("%s %s", req.URL.Host, resp.Status)
+	}
+	var answer awsCredentialJSON
+	if err = json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return awsCreds{}, time.Time{}, err
+	}
+	return answer.creds()
+}
+
+// awsInstanceCreds The EC2 instance role's keys over IMDSv2.
+// AWS_EC2_METADATA_SERVICE_ENDPOINT overrides the address.
+func awsInstanceCreds() (awsCreds, time.Time, error) {
+	endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "http://169.254.169.254"
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	req, err := http.NewRequest("PUT", endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return awsCreds{}, time.Time{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	resp, err := awsMetadataClient.Do(req)
+	if err != nil {
+		return awsCreds{}, time.Time{}, fmt.Errorf("no credentials in the environment, profile or instance metadata: %v", err)
+	}
+	token, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsCreds{}, time.Time{}, fmt.Errorf("metadata token: %s", resp.Status)
+	}
+
+	get := func(path string) (*http.Request, error) {
+		req, err := http.NewRequest("GET", endpoint+"/latest/meta-data/iam/security-credentials/"+path, nil)
+		if err == nil {
+			req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		}
+		return req, err
+	}
+
+	req, err = get("")
+	if err != nil {
+		return awsCreds{}, time.Time{}, err
+	}
+	resp, err = awsMetadataClient.Do(req)
+	if err != nil {
+		return awsCreds{}, time.Time{}, err
+	}
+	roles, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if resp.StatusCode != http.StatusOK || role == "" {
+		return awsCreds{}, time.Time{}, errors.New("the instance has no IAM role")
+	}
+
+	if req, err = get(role); err != nil {
+		return awsCreds{}, time.Time{}, err
+	}
+	return awsMetadataCreds(req)
+}
+
+// assumeRoleWithWebIdentity Trade the service account token Kubernetes
+// mounts (EKS IAM roles for service accounts) for the role's keys.
+func assumeRoleWithWebIdentity(tokenFile string, role string, region string) (awsCreds, time.Time, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return awsCreds{}, time.Time{}, err
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = fmt.Sprintf("watch-%d", time.Now().Unix())
+	}
+
+	endpoint := os.Getenv("AWS_STS_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://sts." + region + ".amazonaws.com"
+	}
+	resp, err := http.PostForm(strings.TrimSuffix(endpoint, "/")+"/", url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	})
+	if err != nil {
+		return awsCreds{}, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return awsCreds{}, time.Time{}, fmt.Errorf("sts: %s %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var answer struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return awsCreds{}, time.Time{}, err
+	}
+	c := answer.Credentials
+	return awsCredentialJSON{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expiration: c.Expiration}.creds()
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// azureBlock Blobs bigger than one block are uploaded block by block.
+const azureBlock = 64 << 20
+
+const azureVersion = "2021-08-06"
+
+// azureSink azblob://account/container/prefix. Credentials are tried in the
+// order of Azure's SDKs: AZURE_STORAGE_KEY (shared key), AZURE_STORAGE_SAS_TOKEN,
+// a service principal in AZURE_TENANT_ID, AZURE_CLIENT_ID and
+// AZURE_CLIENT_SECRET, a workload identity token in AZURE_FEDERATED_TOKEN_FILE,
+// then the managed identity of the VM or container.
+// ?endpoint= targets Azurite or a sovereign cloud.
+type azureSink struct {
+	client    *http.Client
+	endpoint  string
+	account   string
+	container string
+	prefix    string
+	key       []byte
+	sas       string
+	token     *bearerToken
+}
+
+func newAzureSink(u *url.URL) (Sink, error) {
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if u.Host == "" || parts[0] == "" {
+		return nil, fmt.Errorf("%s: use azblob://account/container/prefix", u.Redacted())
+	}
+
+	s := &azureSink{
+		client:    &http.Client{Timeout: 10 * time.Minute},
+		endpoint:  fmt.Sprintf("https://%s.blob.core.windows.net", u.Host),
+		account:   u.Host,
+		container: parts[0],
+	}
+	if len(parts) == 2 {
+		s.prefix = parts[1]
+	}
+	if endpoint := u.Query().Get("endpoint"); endpoint != "" {
+		s.endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		var err error
+		if s.key, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return nil, fmt.Errorf("AZURE_STORAGE_KEY: %v", err)
+		}
+	} else if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		s.sas = strings.TrimPrefix(sas, "?")
+	} else {
+		s.token = azureCredentials()
+	}
+	return s, nil
+}
+
+// azureCredentials A service principal from the environment, a workload
+// identity, or else the managed identity.
+func azureCredentials() *bearerToken {
+	tenant, client, secret := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_CLIENT_SECRET")
+	if tenant != "" && client != "" && secret != "" {
+		return &bearerToken{fetch: func() (*http.Request, error) {
+			return formRequest("https://login.microsoftonline.com/"+tenant+"/oauth2/v2.0/token", url.Values{
+				"grant_type":    {"client_credentials"},
+				"client_id":     {client},
+				"client_secret": {secret},
+				"scope":         {"https://storage.azure.com/.default"},
+			})
+		}}
+	}
+
+	// AKS workload identity mounts a federated token to trade for an access token
+	if tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); tenant != "" && client != "" && tokenFile != "" {
+		authority := os.Getenv("AZURE_AUTHORITY_HOST")
+		if authority == "" {
+			authority = "https://login.microsoftonline.com/"
+		}
+		return &bearerToken{fetch: func() (*http.Request, error) {
+			// the file is rotated, so it is read for every token
+			assertion, err := os.ReadFile(tokenFile)
+			if err != nil {
+				return nil, err
+			}
+			return formRequest(strings.TrimSuffix(authority, "/")+"/"+tenant+"/oauth2/v2.0/token", url.Values{
+				"grant_type":            {"client_credentials"},
+				"client_id":             {client},
+				"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+				"client_assertion":      {strings.TrimSpace(string(assertion))},
+				"scope":                 {"https://storage.azure.com/.default"},
+			})
+		}}
+	}
+
+	return &bearerToken{fetch: func() (*http.Request, error) {
+		target := "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=" + url.QueryEscape("https://storage.azure.com/")
+		if client != "" {
+			target += "&client_id=" + url.QueryEscape(client)
+		}
+		req, err := http.NewRequest("GET", target, nil)
+		if err == nil {
+			req.Header.Set("Metadata", "true")
+		}
+		return req, err
+	}}
+}
+
+func (s *azureSink) blobURL(name string, query url.Values) string {
+	blob := (&url.URL{Path: path.Join(s.container, s.prefix, name)}).EscapedPath()
+	target := s.endpoint + "/" + blob
+	raw := query.Encode()
+	if s.sas != "" {
+		raw = strings.TrimPrefix(raw+"&"+s.sas, "&")
+	}
+	if raw != "" {
+		target += "?" + raw
+	}
+	return target
+}
+
+func (s *azureSink) do(method string, name string, query url.Values, body func() (io.Reader, int64), header http.Header) (*http.Response, error) {
+	return sinkRequest(s.client, func() (*http.Request, error) {
+		req, err := newBodyRequest(method, s.blobURL(name, query), body)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("x-ms-version", azureVersion)
+		req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+
+		switch {
+		case s.key != nil:
+			s.signSharedKey(req)
+		case s.token != nil:
+			token, err := s.token.get()
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return req, nil
+	})
+}
+
+// signSharedKey Authorize req with the account key.
+func (s *azureSink) signSharedKey(req *http.Request) {
+	length := ""
+	if req.ContentLength > 0 {
+		length = fmt.Sprint(req.ContentLength)
+	}
+
+	names := make([]string, 0)
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-ms-") {
+			names = append(names, lk)
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	resource := "/" + s.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(k) + ":" + strings.Join(values, ",")
+	}
+
+	toSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		headers.String() + resource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(toSign))
+	req.Header.Set("Authorization", "SharedKey "+s.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// EnsureDir Containers have no folders.
+func (s *azureSink) EnsureDir(dir string) error {
+	return nil
+}
+
+func (s *azureSink) Stat(name string) (sinkStat, error) {
+	resp, err := s.do("HEAD", name, nil, nil, nil)
+	if err != nil {
+		return sinkStat{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return sinkStat{}, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return sinkStat{}, fmt.Errorf("azure HEAD %s: %s", name, resp.Status)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return sinkStat{Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *azureSink) Remove(name string) error {
+	resp, err := s.do("DELETE", name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("azure DELETE %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+// WriteFile Put Blob for small files; Put Block for every azureBlock and a
+// Put Block List committing them for the rest.
+func (s *azureSink) WriteFile(name string, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	kind := contentType(f, name)
+
+	if size <= azureBlock {
+		body := func() (io.Reader, int64) { return throttle(io.NewSectionReader(f, 0, size)), size }
+		resp, err := s.do("PUT", name, nil, body, http.Header{"X-Ms-Blob-Type": {"BlockBlob"}, "Content-Type": {kind}})
+		if err != nil {
+			return err
+		}
+		return azureDone(resp, "put", name)
+	}
+
+	var list bytes.Buffer
+	list.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for off, n := int64(0), 0; off < size; off, n = off+azureBlock, n+1 {
+		length := size - off
+		if length > azureBlock {
+			length = azureBlock
+		}
+		// block ids must all have the same length
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", n)))
+		start := off
+		body := func() (io.Reader, int64) { return throttle(io.NewSectionReader(f, start, length)), length }
+		resp, err := s.do("PUT", name, url.Values{"comp": {"block"}, "blockid": {id}}, body, nil)
+		if err != nil {
+			return err
+		}
+		if err = azureDone(resp, "put block", name); err != nil {
+			return err
+		}
+		list.WriteString("<Latest>" + id + "</Latest>")
+	}
+	list.WriteString("</BlockList>")
+
+	body := func() (io.Reader, int64) { return bytes.NewReader(list.Bytes()), int64(list.Len()) }
+	resp, err := s.do("PUT", name, url.Values{"comp": {"blocklist"}}, body, http.Header{"X-Ms-Blob-Content-Type": {kind}})
+	if err != nil {
+		return err
+	}
+	return azureDone(resp, "put block list", name)
+}
+
+func azureDone(resp *http.Response, op string, name string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("azure %s %s: %s %s", op, name, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
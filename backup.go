@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// backupFile With --backup-dir, move a destination file that is about to be
+// overwritten or deleted into the backup dir, at the same path relative to
+// the job's destination. An older backup of the same path is replaced.
+// Returns the backup's path, "" when there was nothing to back up.
+func (j *job) backupFile(dstFileName string) (string, error) {
+	if opts.BackupDir == "" || !IsFile(dstFileName) {
+		return "", nil
+	}
+
+	rel, err := filepath.Rel(j.Dest, dstFileName)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(dstFileName)
+	}
+	backup := filepath.Join(opts.BackupDir, j.Name, rel)
+	if err := mkdirAll(filepath.Dir(backup)); err != nil {
+		return "", err
+	}
+
+	os.Remove(backup)
+	if err := moveFile(backup, dstFileName); err != nil {
+		return "", err
+	}
+	debugf("backed up %s to %s", dstFileName, backup)
+	return backup, nil
+}
+
+// setAside Keep the destination file about to be replaced or removed by op:
+// as a version, in the backup dir or in the undo journal, whichever is
+// enabled first in that order. The journal also records a version or a
+// backup. Returns where the file went, "" when it stayed or did not exist.
+func (j *job) setAside(op string, dstFileName string) (string, error) {
+	if op == "overwrite" && opts.Versions > 0 {
+		version, err := j.keepVersion(dstFileName)
+		if err != nil || version == "" {
+			return "", err
+		}
+		return version, journalKept(op, dstFileName, version)
+	}
+	if opts.BackupDir != "" {
+		backup, err := j.backupFile(dstFileName)
+		if err != nil || backup == "" {
+			return "", err
+		}
+		return backup, journalKept(op, dstFileName, backup)
+	}
+	return journalRecord(op, dstFileName)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// versionedSink A bucket destination that keeps the old versions of its
+// objects, so deletes only add a delete marker and restore can bring a prefix
+// back the way it was at a point in time.
+type versionedSink interface {
+	Sink
+	// VersionsAt Every object under prefix that exists now or existed at t.
+	VersionsAt(prefix string, at time.Time) ([]objectVersions, error)
+	// RestoreVersion Make version id of name its current content again.
+	RestoreVersion(name string, id string) error
+}
+
+// objectVersions The version of an object that is current now and the one
+// that was current at the restore time; "" when there was none.
+type objectVersions struct {
+	Name    string
+	Current string
+	At      string
+}
+
+// restoreBucket watch restore --at TIME [--prefix PATH] s3://bucket/prefix
+// Objects created since are deleted, which on a versioned bucket only adds a
+// delete marker, so a restore can itself be undone by another restore.
+func restoreBucket(dest string, prefix string, at time.Time) int {
+	sink, err := openSink(dest)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	bucket, ok := sink.(versionedSink)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "restore: only versioned s3:// and gs:// buckets keep old versions, not", dest)
+		return 2
+	}
+
+	objects, err := bucket.VersionsAt(prefix, at)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	sort.Slice(objects, func(a, b int) bool { return objects[a].Name < objects[b].Name })
+
+	failed := 0
+	for _, o := range objects {
+		switch {
+		case o.At == o.Current:
+			continue
+		case o.At == "":
+			if err := bucket.Remove(o.Name); err != nil {
+				fmt.Fprintln(os.Stderr, "restore", o.Name, err)
+				failed++
+				continue
+			}
+			fmt.Fprintln(os.Stdout, "removed", o.Name)
+		default:
+			if err := bucket.RestoreVersion(o.Name, o.At); err != nil {
+				fmt.Fprintln(os.Stderr, "restore", o.Name, err)
+				failed++
+				continue
+			}
+			fmt.Fprintln(os.Stdout, "restored", o.Name, "version", o.At)
+		}
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// tokenBucket Shared byte budget refilled at rate bytes per second, so all
+// workers together stay under --bwlimit.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+var bandwidth *tokenBucket
+
+func newTokenBucket(rate int64) *tokenBucket {
+	burst := float64(rate) / 4
+	if burst < 32*1024 {
+		burst = 32 * 1024
+	}
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take Spend n bytes, sleeping until the bucket has refilled enough. Inside a
+// --full-speed-window nothing is spent.
+func (b *tokenBucket) take(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	if inWindows(fullSpeed, now) {
+		b.tokens, b.last = b.burst, now
+		b.mu.Unlock()
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	wait := time.Duration(0)
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	time.Sleep(wait)
+}
+
+// limitedReader Reads no faster than the bucket allows.
+type limitedReader struct {
+	r io.Reader
+	b *tokenBucket
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > int(l.b.burst) {
+		p = p[:int(l.b.burst)]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		l.b.take(n)
+	}
+	return n, err
+}
+
+// throttle Wrap r with the --bwlimit bucket, if one is set.
+func throttle(r io.Reader) io.Reader {
+	if bandwidth == nil {
+		return r
+	}
+	return &limitedReader{r: r, b: bandwidth}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// catalog --catalog: every event and copy outcome as a row of the files
+// table, turning the watcher into an inventory of what it has seen. SQLite
+// files are written through the sqlite3 command, postgres:// URLs through
+// psql; both stay running and get batches of INSERTs on stdin.
+type catalog struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	rows    chan eventMessage
+	done    chan struct{}
+	dropped int64 // rows that found the queue full since the last flush
+}
+
+var catalogDB *catalog
+
+const catalogSchema = `CREATE TABLE IF NOT EXISTS files (
+  time %s NOT NULL,
+  event TEXT,
+  outcome TEXT,
+  path TEXT NOT NULL,
+  job TEXT,
+  dest TEXT,
+  size BIGINT,
+  mtime %s,
+  sha256 TEXT,
+  error TEXT
+);
+CREATE INDEX IF NOT EXISTS files_path ON files (path);
+`
+
+func openCatalog(dsn string) (*catalog, error) {
+	var cmd *exec.Cmd
+	timeType := "TEXT"
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		if _, err := exec.LookPath("psql"); err != nil {
+			return nil, fmt.Errorf("--catalog %s needs the psql command: %v", u.Redacted(), err)
+		}
+		cmd = exec.Command("psql", "-X", "-q", "-v", "ON_ERROR_STOP=0", dsn)
+		timeType = "TIMESTAMPTZ"
+	} else {
+		if _, err := exec.LookPath("sqlite3"); err != nil {
+			return nil, fmt.Errorf("--catalog %s needs the sqlite3 command: %v", dsn, err)
+		}
+		if err := guardSource(strings.TrimPrefix(dsn, "sqlite://")); err != nil {
+			return nil, err
+		}
+		cmd = exec.Command("sqlite3", "-batch", strings.TrimPrefix(dsn, "sqlite://"))
+	}
+
+	detach(cmd)
+	// errors of single statements are reported but don't stop the catalog
+	cmd.Stdout = io.Discard
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	c := &catalog{cmd: cmd, stdin: stdin, rows: make(chan eventMessage, 4096), done: make(chan struct{})}
+	if _, err = fmt.Fprintf(stdin, catalogSchema, timeType, timeType); err != nil {
+		return nil, err
+	}
+	go c.run()
+	return c, nil
+}
+
+// record Queue a row. Rows are written in one transaction per second; while
+// the database can't keep up, rows are dropped rather than holding up copies.
+func (c *catalog) record(msg eventMessage) {
+	select {
+	case c.rows <- msg:
+	default:
+		if atomic.AddInt64(&c.dropped, 1) == 1 {
+			warnf("catalog: the database can't keep up, dropping rows")
+		}
+	}
+}
+
+func (c *catalog) run() {
+	defer close(c.done)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	var batch strings.Builder
+	flush := func() {
+		if n := atomic.SwapInt64(&c.dropped, 0); n > 0 {
+			warnf("catalog: dropped %d rows", n)
+		}
+		if batch.Len() == 0 {
+			return
+		}
+		if _, err := io.WriteString(c.stdin, "BEGIN;\n"+batch.String()+"COMMIT;\n"); err != nil {
+			errorf("catalog: %v", err)
+		}
+		batch.Reset()
+	}
+
+	for {
+		select {
+		case msg, ok := <-c.rows:
+			if !ok {
+				flush()
+				return
+			}
+			batch.WriteString(catalogInsert(msg))
+			if batch.Len() > 1<<20 {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+// close Write what is pending and wait for the database to finish, on
+// shutdown.
+func (c *catalog) close() {
+	close(c.rows)
+	<-c.done
+	c.stdin.Close()
+	c.cmd.Wait()
+}
+
+// catalogInsert The INSERT for one message. Size and modification time are
+// taken from the file as it is now; copied files have the checksum of what
+// was copied.
+func catalogInsert(msg eventMessage) string {
+	var event, outcome string
+	if msg.outcome() {
+		outcome = msg.Op
+	} else {
+		event = msg.Op
+	}
+
+	size, mtime, sum := "NULL", "NULL", "NULL"
+	if stat, err := os.Stat(msg.Path); err == nil && stat.Mode().IsRegular() {
+		size = strconv.FormatInt(stat.Size(), 10)
+		mtime = sqlQuote(stat.ModTime().UTC().Format(time.RFC3339Nano))
+		if msg.Op == "copied" {
+			sum = sqlNullable(msg.Sha256)
+		}
+	}
+
+	return fmt.Sprintf("INSERT INTO files (time, event, outcome, path, job, dest, size, mtime, sha256, error) VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s);\n",
+		sqlQuote(msg.Time.UTC().Format(time.RFC3339Nano)), sqlNullable(event), sqlNullable(outcome), sqlQuote(msg.Path),
+		sqlNullable(msg.Job), sqlNullable(msg.Dest), size, mtime, sum, sqlNullable(msg.Error))
+}
+
+// sqlQuote A SQL string literal.
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func sqlNullable(s string) string {
+	if s == "" {
+		return "NULL"
+	}
+	return sqlQuote(s)
+}
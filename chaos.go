@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chaos --chaos, parsed in setup; nil without it.
+var chaos *chaosConfig
+
+// chaosConfig Percentages of events to drop, delay or duplicate (--chaos).
+type chaosConfig struct {
+	Drop     float64
+	Delay    float64
+	Dup      float64
+	MaxDelay time.Duration
+}
+
+// parseChaos Parse "drop=5,delay=10,dup=5,max-delay=2s". Each share is a
+// percentage from 0 to 100, so a probability from 0 to 1.
+func parseChaos(s string) (chaosConfig, error) {
+	c := chaosConfig{MaxDelay: time.Second}
+
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return c, fmt.Errorf("--chaos: expected key=value, got %q", part)
+		}
+
+		var err error
+		switch kv[0] {
+		case "drop":
+			c.Drop, err = strconv.ParseFloat(kv[1], 64)
+		case "delay":
+			c.Delay, err = strconv.ParseFloat(kv[1], 64)
+		case "dup":
+			c.Dup, err = strconv.ParseFloat(kv[1], 64)
+		case "max-delay":
+			c.MaxDelay, err = time.ParseDuration(kv[1])
+			if err == nil && c.MaxDelay < 0 {
+				err = fmt.Errorf("max-delay %s is negative", kv[1])
+			}
+		default:
+			err = fmt.Errorf("unknown key %s", kv[0])
+		}
+		if err != nil {
+			return c, fmt.Errorf("--chaos: %v", err)
+		}
+	}
+
+	for _, share := range []struct {
+		name    string
+		percent float64
+	}{{"drop", c.Drop}, {"delay", c.Delay}, {"dup", c.Dup}} {
+		// written this way round so NaN fails too
+		if !(share.percent >= 0 && share.percent <= 100) {
+			return c, fmt.Errorf("--chaos: %s=%v is not a percentage from 0 to 100", share.name, share.percent)
+		}
+	}
+	return c, nil
+}
+
+// chaosEvents Pass events from in to out, dropping, delaying and duplicating
+// the configured share of them.
+func chaosEvents(c chaosConfig, in <-chan fileEvent, out chan<- fileEvent) {
+	for ev := range in {
+		if rand.Float64()*100 < c.Drop {
+			continue
+		}
+
+		copies := 1
+		if rand.Float64()*100 < c.Dup {
+			copies = 2
+		}
+
+		if rand.Float64()*100 < c.Delay && c.MaxDelay > 0 {
+			delay := time.Duration(rand.Int63n(int64(c.MaxDelay)))
+			go func(ev fileEvent, copies int) {
+				time.Sleep(delay)
+				for i := 0; i < copies; i++ {
+					out <- ev
+				}
+			}(ev, copies)
+			continue
+		}
+
+		for i := 0; i < copies; i++ {
+			out <- ev
+		}
+	}
+}
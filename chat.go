@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// chatBatch How long failures are gathered into one chat message.
+const chatBatch = 30 * time.Second
+
+// chatNotifier --chat: notices posted to a chat through its incoming
+// webhook: Slack, Discord and Telegram each get the payload they expect,
+// any other URL {"text": ...}, which Mattermost, Rocket.Chat and the like
+// take. --chat-on picks the kinds of notice, --chat-template words them.
+type chatNotifier struct {
+	target  string // the URL without its secrets, for messages
+	webhook string
+	body    func(text string) interface{}
+	kinds   map[string]bool
+	text    *template.Template
+	client  *http.Client
+	failed  failureBatch
+}
+
+func openChat(webhook string, kinds []string, text *template.Template) (*chatNotifier, error) {
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid --chat %q, expected the webhook URL", webhook)
+	}
+	c := &chatNotifier{target: u.Scheme + "://" + u.Host, webhook: webhook, kinds: make(map[string]bool),
+		text: text, client: &http.Client{Timeout: 10 * time.Second}}
+	for _, kind := range kinds {
+		c.kinds[kind] = true
+	}
+	c.failed = failureBatch{window: chatBatch, send: c.post}
+
+	switch host := strings.ToLower(u.Hostname()); {
+	case host == "api.telegram.org":
+		// https://api.telegram.org/bot<token>/sendMessage?chat_id=<chat>
+		chat := u.Query().Get("chat_id")
+		if chat == "" {
+			return nil, fmt.Errorf("--chat %s: Telegram needs ?chat_id=", c.target)
+		}
+		u.RawQuery = ""
+		c.webhook = u.String()
+		c.body = func(text string) interface{} { return map[string]string{"chat_id": chat, "text": text} }
+	case host == "discord.com" || host == "discordapp.com":
+		c.body = func(text string) interface{} { return map[string]string{"content": text} }
+	default:
+		c.body = func(text string) interface{} { return map[string]string{"text": text} }
+	}
+	return c, nil
+}
+
+func (c *chatNotifier) notify(n notice) {
+	if !c.kinds[n.Kind] {
+		return
+	}
+	if n.Kind == "failed" {
+		c.failed.add(n)
+		return
+	}
+	go c.post(n)
+}
+
+// post Send the notice in the chat's words; failures are only logged.
+func (c *chatNotifier) post(n notice) {
+	var text bytes.Buffer
+	if err := c.text.Execute(&text, n); err != nil {
+		warnf("chat %s: --chat-template: %v", c.target, err)
+		return
+	}
+	data, err := json.Marshal(c.body(text.String()))
+	if err != nil {
+		return
+	}
+	resp, err := c.client.Post(c.webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		// the URL holds the webhook's secret
+		warnf("chat %s: %v", c.target, strings.ReplaceAll(err.Error(), c.webhook, c.target))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		warnf("chat %s: %s", c.target, resp.Status)
+	}
+}
+
+// parseChatOn --chat-on, a comma separated list of notice kinds.
+func parseChatOn(list string) ([]string, error) {
+	var kinds []string
+	for _, kind := range strings.Split(list, ",") {
+		kind = strings.TrimSpace(kind)
+		if !contains(noticeKinds, kind) {
+			return nil, fmt.Errorf("invalid --chat-on %q, use some of %s", kind, strings.Join(noticeKinds, ", "))
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
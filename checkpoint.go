@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// checkpointEvery How often a running initial sync records its progress.
+const checkpointEvery = 30 * time.Second
+
+// checkpoint How far an initial sync got: every file up to Path, in walk
+// order, was brought over.
+type checkpoint struct {
+	Source string    `json:"source"`
+	Dest   string    `json:"dest"`
+	Path   string    `json:"path"`
+	Time   time.Time `json:"time"`
+}
+
+// checkpointFile --checkpoint, one file per job when there are several, or
+// .watch-checkpoint in a local destination. Remote destinations have none
+// without --checkpoint, and archives none at all.
+func (j *job) checkpointFile() string {
+	if opts.Archive != "" {
+		return ""
+	}
+	if opts.Checkpoint != "" {
+		if len(runningJobs()) > 1 {
+			return opts.Checkpoint + "." + j.Name
+		}
+		return opts.Checkpoint
+	}
+	if j.sink != nil {
+		return ""
+	}
+	return filepath.Join(j.Dest, ".watch-checkpoint")
+}
+
+// loadCheckpoint The path an interrupted initial sync of this job got to,
+// relative to the source, or "".
+func (j *job) loadCheckpoint() string {
+	file := j.checkpointFile()
+	if file == "" {
+		return ""
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	var c checkpoint
+	if json.Unmarshal(data, &c) != nil || c.Source != j.Source || c.Dest != j.Dest {
+		return ""
+	}
+	return filepath.FromSlash(c.Path)
+}
+
+func (j *job) saveCheckpoint(rel string) {
+	file := j.checkpointFile()
+	if on, _ := inMaintenance(); file == "" || on {
+		return
+	}
+	data, _ := json.Marshal(checkpoint{Source: j.Source, Dest: j.Dest, Path: filepath.ToSlash(rel), Time: time.Now()})
+	tmp := file + ".tmp"
+	err := guardSource(tmp)
+	if err == nil {
+		err = os.WriteFile(tmp, data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		warnf("job %s: checkpoint: %v", j.Name, err)
+	}
+}
+
+// clearCheckpoint The initial sync finished; the next starts from the top.
+func (j *job) clearCheckpoint() {
+	if file := j.checkpointFile(); file != "" {
+		os.Remove(file)
+	}
+}
+
+// walkBefore filepath.Walk visits a before b: it compares the paths name by
+// name, each folder's entries in lexical order.
+func walkBefore(a string, b string) bool {
+	as := strings.Split(a, string(filepath.Separator))
+	bs := strings.Split(b, string(filepath.Separator))
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	// a folder comes before what is in it
+	return len(as) < len(bs)
+}
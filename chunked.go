@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chunkProgress What a resumable copy has written so far: one checksum per
+// completed chunk, kept next to the partial file.
+type chunkProgress struct {
+	Source    string    `json:"source"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mtime"`
+	ChunkSize int64     `json:"chunk_size"`
+	Sums      []string  `json:"sums"`
+}
+
+var (
+	chunkSize      int64
+	chunkThreshold int64
+)
+
+// partLocks One copy at a time into a partial file, each lock kept only
+// while a copy holds or waits for it.
+var partLocks = struct {
+	sync.Mutex
+	held map[string]*partLock
+}{held: make(map[string]*partLock)}
+
+type partLock struct {
+	sync.Mutex
+	users int
+}
+
+// chunkBufs Buffers chunks are copied through, shared by the workers
+// rather than one of --chunk-size per copy.
+var chunkBufs = sync.Pool{New: func() interface{} {
+	buf := make([]byte, 1<<20)
+	return &buf
+}}
+
+// partMaxAge A partial file untouched this long belongs to a copy that was
+// given up on, and is removed on startup.
+const partMaxAge = 7 * 24 * time.Hour
+
+// chunked Files this big are copied in resumable chunks.
+func chunked(srcFileName string) bool {
+	stat, err := os.Stat(srcFileName)
+	return err == nil && chunkThreshold > 0 && stat.Size() >= chunkThreshold
+}
+
+// partName The stable staging name of a resumable copy, so a later run finds it.
+func (j *job) partName(dstFileName string) string {
+	sum := sha256.Sum256([]byte(dstFileName))
+	return filepath.Join(j.stagingDir(), fmt.Sprintf("%s-%s-%s.part", j.Name, hex.EncodeToString(sum[:8]), filepath.Base(dstFileName)))
+}
+
+// copyChunked Copy srcFileName into the partial file chunk by chunk,
+// recording a checksum after each chunk is synced to disk. A copy that was
+// interrupted resumes after its last chunk that still verifies.
+func copyChunked(partName string, srcFileName string) (int64, error) {
+	defer lockPart(partName)()
+
+	stat, err := os.Stat(srcFileName)
+	if err != nil {
+		return 0, err
+	}
+
+	progress := loadProgress(partName)
+	if progress.Source != srcFileName || progress.Size != stat.Size() || !progress.ModTime.Equal(stat.ModTime()) || progress.ChunkSize != chunkSize {
+		progress = chunkProgress{Source: srcFileName, Size: stat.Size(), ModTime: stat.ModTime(), ChunkSize: chunkSize}
+	}
+
+	src, err := os.Open(srcFileName)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	part, err := os.OpenFile(partName, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer part.Close()
+
+	// the last recorded chunk may not have survived a crash
+	for len(progress.Sums) > 0 {
+		last := len(progress.Sums) - 1
+		sum, err := chunkSum(part, int64(last)*chunkSize)
+		if err == nil && sum == progress.Sums[last] {
+			break
+		}
+		progress.Sums = progress.Sums[:last]
+	}
+
+	offset := int64(len(progress.Sums)) * chunkSize
+	if offset > 0 {
+		infof("resuming %s at %d of %d bytes", srcFileName, offset, progress.Size)
+	}
+	if err = part.Truncate(offset); err != nil {
+		return 0, err
+	}
+
+	buf := chunkBufs.Get().(*[]byte)
+	defer chunkBufs.Put(buf)
+	for offset < progress.Size {
+		h := sha256.New()
+		w := io.MultiWriter(io.NewOffsetWriter(part, offset), h)
+		n, err := io.CopyBuffer(w, throttle(io.NewSectionReader(src, offset, chunkSize)), *buf)
+		if err != nil {
+			return offset, err
+		}
+		if n == 0 {
+			return offset, io.ErrUnexpectedEOF // the source shrank
+		}
+		if err = part.Sync(); err != nil {
+			return offset, err
+		}
+
+		progress.Sums = append(progress.Sums, hex.EncodeToString(h.Sum(nil)))
+		if err = saveProgress(partName, progress); err != nil {
+			return offset, err
+		}
+		offset += int64(n)
+	}
+
+	return offset, nil
+}
+
+func chunkSum(f *os.File, offset int64) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, offset, chunkSize)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func loadProgress(partName string) chunkProgress {
+	var p chunkProgress
+	if data, err := os.ReadFile(partName + ".json"); err == nil {
+		json.Unmarshal(data, &p)
+	}
+	return p
+}
+
+func saveProgress(partName string, p chunkProgress) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp := partName + ".json.tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, partName+".json")
+}
+
+// lockPart Take the lock of a partial file, returning its release.
+func lockPart(partName string) func() {
+	partLocks.Lock()
+	l := partLocks.held[partName]
+	if l == nil {
+		l = &partLock{}
+		partLocks.held[partName] = l
+	}
+	l.users++
+	partLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		partLocks.Lock()
+		if l.users--; l.users == 0 {
+			delete(partLocks.held, partName)
+		}
+		partLocks.Unlock()
+	}
+}
+
+// finishChunked Drop the progress record once the copy is in place.
+func finishChunked(partName string) {
+	os.Remove(partName + ".json")
+}
+
+// cleanParts Remove the partial files of this job's copies that were given
+// up on, with their progress records, untouched for partMaxAge.
+func (j *job) cleanParts() {
+	entries, err := os.ReadDir(j.stagingDir())
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !j.partFile(name) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < partMaxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(j.stagingDir(), name)); err == nil {
+			infof("removed stale partial copy %s", name)
+		}
+	}
+}
+
+// partFile name is a partial file of this job, or its progress record:
+// the job's name, a hash of the destination and the file's name, as
+// partName makes them.
+func (j *job) partFile(name string) bool {
+	rest, ok := strings.CutPrefix(name, j.Name+"-")
+	if !ok || len(rest) < 17 || rest[16] != '-' {
+		return false
+	}
+	if _, err := hex.DecodeString(rest[:16]); err != nil {
+		return false
+	}
+	for _, suffix := range []string{".part", ".part.json", ".part.json.tmp"} {
+		if strings.HasSuffix(rest, suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// errSkipped The destination differs and the collision policy kept it.
+var errSkipped = errors.New("skipped")
+
+var collisionPolicies = []string{"overwrite", "skip", "rename", "fail"}
+
+func validCollision(policy string) error {
+	for _, p := range collisionPolicies {
+		if policy == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid collision policy %s, use %s", policy, strings.Join(collisionPolicies, ", "))
+}
+
+var conflictPolicies = []string{"keep-both", "newer", "source", "dest", "skip"}
+
+func validConflict(policy string) error {
+	for _, p := range conflictPolicies {
+		if policy == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid conflict policy %s, use %s", policy, strings.Join(conflictPolicies, ", "))
+}
+
+// collisionPolicy The job's on_collision, or --on-collision.
+func (j *job) collisionPolicy() string {
+	if j.OnCollision != "" {
+		return j.OnCollision
+	}
+	return opts.OnCollision
+}
+
+// conflictPolicy The job's conflict, or --conflict.
+func (j *job) conflictPolicy() string {
+	if j.Conflict != "" {
+		return j.Conflict
+	}
+	return opts.Conflict
+}
+
+// conflictCopy Matches the names conflictName makes.
+var conflictCopy = regexp.MustCompile(` \(conflict [0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{6}\)(\.[^/\\]*)?$`)
+
+// conflictName name (conflict 2024-06-01 120000).ext, where the version that
+// lost a conflict is kept.
+func conflictName(name string) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s (conflict %s)%s", strings.TrimSuffix(name, ext), time.Now().Format("2006-01-02 150405"), ext)
+}
+
+// resolveCollision Where srcFileName should be copied when dstFileName
+// already exists with different content: dstFileName itself to overwrite it,
+// the next free name-N.ext to rename, or errSkipped / an error. A destination
+// changed there is a conflict, settled by the conflict policy before the
+// collision policy.
+func (j *job) resolveCollision(dstFileName string, srcFileName string) (string, error) {
+	if j.conflicts(dstFileName, srcFileName) {
+		j.auditDecision("conflict", srcFileName, dstFileName, "changed in the destination, settled by "+j.conflictPolicy())
+		switch j.conflictPolicy() {
+		case "source":
+			return dstFileName, nil
+		case "dest":
+			return "", errSkipped
+		case "newer":
+			if newer(dstFileName, srcFileName) {
+				return "", errSkipped
+			}
+			return dstFileName, nil
+		case "skip":
+			warnf("conflict: %s was changed in the destination, left as it is", dstFileName)
+			return "", errSkipped
+		}
+		saved := conflictName(dstFileName)
+		if err := os.Rename(dstFileName, saved); err != nil {
+			return "", err
+		}
+		warnf("conflict: %s was changed in the destination, kept it as %s", dstFileName, saved)
+		return dstFileName, nil
+	}
+
+	policy := j.collisionPolicy()
+	if policy == "overwrite" || !differs(dstFileName, srcFileName) || j.ownCopy(dstFileName) {
+		return dstFileName, nil
+	}
+
+	j.auditDecision("collision", srcFileName, dstFileName, "destination differs, settled by "+policy)
+	switch policy {
+	case "skip":
+		return "", errSkipped
+	case "fail":
+		return "", fmt.Errorf("destination %s exists and differs from %s", dstFileName, srcFileName)
+	}
+
+	ext := filepath.Ext(dstFileName)
+	stem := strings.TrimSuffix(dstFileName, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s-%d%s", stem, n, ext)
+		// an earlier rename of the same content is reused
+		if !differs(candidate, srcFileName) {
+			return candidate, nil
+		}
+	}
+}
+
+// conflicts dstFileName was changed in the destination and holds something
+// other than srcFileName. With a sync state that is a change since the last
+// sync; without one, a modification after srcFileName's beyond
+// --mtime-tolerance: unless --no-preserve-times, copies carry the source's
+// time, so a later one means the destination was changed there.
+func (j *job) conflicts(dstFileName string, srcFileName string) bool {
+	if changed, known := j.destChanged(dstFileName); known {
+		return changed && !identical(dstFileName, srcFileName)
+	}
+	if opts.NoPreserveTimes {
+		return false
+	}
+	src, err := os.Stat(srcFileName)
+	if err != nil {
+		return false
+	}
+	dst, err := os.Stat(dstFileName)
+	if err != nil || !dst.Mode().IsRegular() {
+		return false
+	}
+	tolerance, _ := time.ParseDuration(opts.MtimeTolerance)
+	if dst.ModTime().Sub(src.ModTime()) <= tolerance {
+		return false
+	}
+
+	// a compressed or encrypted copy can't be compared
+	if transformed() || dst.Size() != src.Size() {
+		return true
+	}
+	if same, _ := sameContent(dstFileName, srcFileName); same {
+		return false
+	}
+	return !identical(dstFileName, srcFileName)
+}
+
+// ownCopy dstFileName is still what the watcher copied there, as the sync
+// state or the hash index tells, so it is updated rather than a collision.
+func (j *job) ownCopy(dstFileName string) bool {
+	if changed, known := j.destChanged(dstFileName); known {
+		return !changed
+	}
+	if hashIndex == nil {
+		return false
+	}
+	var rec hashRecord
+	if !hashIndex.Get(dstFileName, &rec) {
+		return false
+	}
+	stat, err := os.Stat(dstFileName)
+	if err != nil || stat.Size() != rec.Size {
+		return false
+	}
+	sum, err := fileSha256(dstFileName)
+	return err == nil && sum == rec.Sha256
+}
+
+// newer a was modified after b.
+func newer(a string, b string) bool {
+	aStat, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bStat, err := os.Stat(b)
+	return err == nil && aStat.ModTime().After(bStat.ModTime())
+}
+
+// differs dstFileName exists and is not known to match srcFileName.
+func differs(dstFileName string, srcFileName string) bool {
+	if _, err := os.Stat(dstFileName); err != nil {
+		return false
+	}
+	if unchanged(dstFileName, srcFileName) {
+		return false
+	}
+	same, _ := sameContent(dstFileName, srcFileName)
+	return !same
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The --on-change command runs for a change once it is dealt with: after the
+// copy for a job that copies it, else when the event is handled, e.g. for a
+// deletion or in a job without a destination. --on-create, --on-write,
+// --on-delete and --on-rename run when an event of their kind is handled.
+// --pre-copy and --post-copy run around every copy, in the copy worker.
+// Every command of a job runs at most once within --interval; changes
+// within the interval get one more run at its end, for the latest of them.
+// With --debounce a command runs once changes have been quiet that long
+// instead, given every file changed meanwhile. --command-policy decides how
+// runs overlap: one at a time, a few at once, or a run stopping the one of
+// the same command under way.
+
+// change A change a command runs for.
+type change struct {
+	job  *job
+	path string
+	op   string
+	dest string // where the file was copied, or would go
+}
+
+// hook A command of a job, with its throttle.
+type hook struct {
+	name    string // the option, e.g. on-create
+	command string
+
+	mu       sync.Mutex
+	last     time.Time
+	trailing *change     // the latest change within the interval
+	trailer  *time.Timer // runs it when the interval is over
+	busy     bool        // serial: a run is under way or waiting its turn
+
+	batch []change       // with --debounce, the changes since the last run
+	index map[string]int // of their paths in batch
+	quiet *time.Timer    // runs them once changes are quiet
+
+	restartMu sync.Mutex
+	stop      chan struct{} // with --command-policy restart, closed to stop the run under way
+	done      chan struct{} // closed once it is over
+}
+
+// outputWaitDelay How long a command's output is still read after it exited,
+// as processes it left in the background may hold the pipes open for good.
+const outputWaitDelay = 5 * time.Second
+
+// maxArgsSize How long the changed files may be together to be passed as
+// arguments, below what Windows and the exec limits of Unix take.
+const maxArgsSize = 32 << 10
+
+// eventHooks The options of the commands run for one kind of event.
+var eventHooks = map[string]string{
+	"create": "on-create",
+	"write":  "on-write",
+	"delete": "on-delete",
+	"rename": "on-rename",
+}
+
+var (
+	// commandPolicy --command-policy without its number: serial,
+	// concurrent or restart.
+	commandPolicy = "serial"
+	execMu        sync.Mutex    // serial: one run at a time
+	execSlots     chan struct{} // concurrent: a slot per run
+
+	errRestarted = errors.New("stopped for a newer change")
+
+	// errRefused --pre-copy failed, so the file is not copied.
+	errRefused = errors.New("refused by --pre-copy")
+
+	// commandTimeout With --command-timeout, how long a run may take.
+	commandTimeout time.Duration
+
+	// debounce With --debounce, how long changes must be quiet for a run.
+	debounce time.Duration
+)
+
+// parseCommandPolicy --command-policy serial, concurrent[=N] (4 by
+// default) or restart.
+func parseCommandPolicy(s string) error {
+	policy, n, hasN := strings.Cut(s, "=")
+	slots := 4
+	if hasN {
+		var err error
+		if slots, err = strconv.Atoi(n); err != nil || slots < 1 || policy != "concurrent" {
+			return fmt.Errorf("invalid --command-policy %s", s)
+		}
+	}
+	switch policy {
+	case "serial", "restart":
+	case "concurrent":
+		execSlots = make(chan struct{}, slots)
+	default:
+		return fmt.Errorf("invalid --command-policy %s, use serial, concurrent[=N] or restart", s)
+	}
+	commandPolicy = policy
+	return nil
+}
+
+// setHooks Take the job's commands from its config, or else the options.
+// Without --shell they must split into words.
+func (j *job) setHooks() error {
+	if j.OnCreate == "" {
+		j.OnCreate = opts.OnCreate
+	}
+	if j.OnWrite == "" {
+		j.OnWrite = opts.OnWrite
+	}
+	if j.OnDelete == "" {
+		j.OnDelete = opts.OnDelete
+	}
+	if j.OnRename == "" {
+		j.OnRename = opts.OnRename
+	}
+	if j.PreCopy == "" {
+		j.PreCopy = opts.PreCopy
+	}
+	if j.PostCopy == "" {
+		j.PostCopy = opts.PostCopy
+	}
+	if !opts.Shell {
+		for name, command := range map[string]string{"pre-copy": j.PreCopy, "post-copy": j.PostCopy} {
+			if _, err := splitWords(command); command != "" && err != nil {
+				return fmt.Errorf("--%s: %v", name, err)
+			}
+		}
+	}
+	commands := map[string]string{
+		"change": opts.OnChange, "create": j.OnCreate, "write": j.OnWrite, "delete": j.OnDelete, "rename": j.OnRename,
+	}
+	j.hooks = make(map[string]*hook)
+	for op, command := range commands {
+		if command == "" {
+			continue
+		}
+		name := eventHooks[op]
+		if op == "change" {
+			name = "on-change"
+		}
+		if !opts.Shell {
+			if _, err := splitWords(command); err != nil {
+				return fmt.Errorf("--%s: %v", name, err)
+			}
+		}
+		j.hooks[op] = &hook{name: name, command: command}
+	}
+	return nil
+}
+
+// run Run the command for c, now or at the end of the interval, or with
+// the batch once changes are quiet.
+func (h *hook) run(c change) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if debounce > 0 {
+		h.collect(c)
+		return
+	}
+	h.trailing = &c
+	h.schedule()
+}
+
+// schedule Start the run for the latest change if the interval is over, or
+// else a timer for when it is. With the serial policy nothing starts while a
+// run of the command is under way or waiting its turn: the change waits for
+// it, so a command slower than its interval has one run pending at most
+// instead of one per tick. The caller holds h.mu.
+func (h *hook) schedule() {
+	if h.busy || h.trailer != nil || h.trailing == nil {
+		return
+	}
+	if wait := interval - time.Since(h.last); wait > 0 {
+		h.trailer = time.AfterFunc(wait, func() {
+			h.mu.Lock()
+			h.trailer = nil
+			h.schedule()
+			h.mu.Unlock()
+		})
+		return
+	}
+	c := *h.trailing
+	h.trailing, h.last = nil, time.Now()
+	h.busy = commandPolicy == "serial"
+	go func() {
+		h.exec(c, nil)
+		h.mu.Lock()
+		h.busy = false
+		h.schedule()
+		h.mu.Unlock()
+	}()
+}
+
+// collect Add c to the batch, a file once with its latest change, and put
+// the run off until changes have been quiet for --debounce. The caller
+// holds h.mu.
+func (h *hook) collect(c change) {
+	if i, ok := h.index[c.path]; ok {
+		h.batch[i] = c
+	} else {
+		if h.index == nil {
+			h.index = make(map[string]int)
+		}
+		h.index[c.path] = len(h.batch)
+		h.batch = append(h.batch, c)
+	}
+	if h.quiet != nil {
+		h.quiet.Stop()
+	}
+	h.quiet = time.AfterFunc(debounce, h.runBatch)
+}
+
+// runBatch Run the command once for the changes collected, with the latest
+// for the placeholders and every changed file.
+func (h *hook) runBatch() {
+	h.mu.Lock()
+	batch := h.batch
+	h.batch, h.index = nil, nil
+	h.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	files := make([]string, len(batch))
+	for i, c := range batch {
+		files[i] = c.path
+	}
+	h.exec(batch[len(batch)-1], files)
+}
+
+func (h *hook) exec(c change, files []string) {
+	var stop chan struct{}
+	switch commandPolicy {
+	case "concurrent":
+		execSlots <- struct{}{}
+		defer func() { <-execSlots }()
+	case "restart":
+		h.restartMu.Lock()
+		if h.stop != nil {
+			close(h.stop)
+			<-h.done
+		}
+		stop = make(chan struct{})
+		done := make(chan struct{})
+		h.stop, h.done = stop, done
+		h.restartMu.Unlock()
+		defer close(done)
+	default:
+		execMu.Lock()
+		defer execMu.Unlock()
+	}
+	if files != nil {
+		debugf("%s: %d changed files", h.name, len(files))
+	} else {
+		debugf("%s: %s %s", h.name, c.op, c.path)
+	}
+	err := ExecCommand(h.name, h.command, c, files, stop)
+	switch {
+	case err == errRestarted:
+		debugf("%s for %s: %v", h.name, c.path, err)
+	case err != nil:
+		reportError(&commandError{h.name, c.path, err})
+	}
+}
+
+// commandError A command run for a change failed, or was killed after
+// --command-timeout.
+type commandError struct {
+	hook string
+	path string
+	err  error
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("%s for %s: %v", e.hook, e.path, e.err)
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// preCopy Run the --pre-copy command for the copy of src to dst. It
+// reports whether the copy may go ahead: not when the command exits with an
+// error, or can't be run at all.
+func (j *job) preCopy(src string, dst string) bool {
+	if j.PreCopy == "" {
+		return true
+	}
+	err := ExecCommand("pre-copy", j.PreCopy, change{j, src, "copy", dst}, nil, nil)
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &exit):
+		infof("--pre-copy refused %s: %v", src, err)
+	default:
+		reportError(&commandError{"pre-copy", src, err})
+	}
+	j.auditDecision("skipped", src, dst, "refused by --pre-copy")
+	return false
+}
+
+// prepareCopy Everything every copy does before copyInto: --pre-copy first,
+// while the destination is as it was, then for a local destination the
+// collision and conflict handling, which may rename what is there. Returns
+// where to copy to, errRefused or errSkipped.
+func (j *job) prepareCopy(dst string, src string) (string, error) {
+	if !j.preCopy(src, dst) {
+		return "", errRefused
+	}
+	if j.sink != nil || j.twoWay != nil || opts.Archive != "" {
+		return dst, nil
+	}
+	return j.resolveCollision(dst, src)
+}
+
+// postCopy Run the --post-copy command for the copy of src made at dst.
+func (j *job) postCopy(src string, dst string) {
+	if j.PostCopy == "" {
+		return
+	}
+	if err := ExecCommand("post-copy", j.PostCopy, change{j, src, "copied", dst}, nil, nil); err != nil {
+		reportError(&commandError{"post-copy", src, err})
+	}
+}
+
+// onChange Run the --on-change command for the change op of path, copied
+// to dest.
+func (j *job) onChange(path string, op string, dest string) {
+	restartRun()
+	if h := j.hooks["change"]; h != nil {
+		h.run(change{j, path, op, dest})
+	}
+}
+
+// copies Whether the job copies the file changed by ev, so its --on-change
+// run waits for the copy.
+func (j *job) copies(ev fileEvent) bool {
+	if j.twoWay != nil || (ev.Op != "create" && ev.Op != "attrib") {
+		return false
+	}
+	if j.sink == nil && len(j.Dest) == 0 {
+		return false
+	}
+	return IsFile(ev.Path) && j.wants(ev.Path)
+}
+
+// changeHandled Run the command for the kind of ev, and the --on-change
+// command in the jobs that don't copy the file.
+func changeHandled(ev fileEvent) {
+	for _, j := range jobsFor(ev.Path) {
+		dest := ""
+		if on, _ := inMaintenance(); on && (j.sink != nil || len(j.Dest) > 0) {
+			dest = j.rawDest(ev.Path)
+		} else if j.sink != nil || len(j.Dest) > 0 {
+			dest = j.fileDest(ev.Path)
+		}
+		if h := j.hooks[ev.Op]; h != nil {
+			h.run(change{j, ev.Path, ev.Op, dest})
+		}
+		if !j.copies(ev) {
+			j.onChange(ev.Path, ev.Op, dest)
+		}
+	}
+}
+
+// placeholders The values of {file}, {dir}, {event}, {dest} and {relpath}
+// for the change, put through quote if there is one.
+func (c change) placeholders(quote func(string) string) *strings.Replacer {
+	rel, err := filepath.Rel(c.job.root(), c.path)
+	if err != nil {
+		rel = filepath.Base(c.path)
+	}
+	values := []string{
+		"{file}", c.path,
+		"{dir}", filepath.Dir(c.path),
+		"{event}", c.op,
+		"{dest}", c.dest,
+		"{relpath}", rel,
+	}
+	if quote != nil {
+		for i := 1; i < len(values); i += 2 {
+			values[i] = quote(values[i])
+		}
+	}
+	return strings.NewReplacer(values...)
+}
+
+// env The change as environment variables, for commands that would rather
+// not parse arguments.
+func (c change) env() []string {
+	return []string{
+		"WATCH_FILE=" + c.path,
+		"WATCH_EVENT=" + c.op,
+		"WATCH_DEST=" + c.dest,
+		"WATCH_ROOT=" + c.job.root(),
+	}
+}
+
+func argsSize(files []string) int {
+	size := 0
+	for _, f := range files {
+		size += len(f) + 1
+	}
+	return size
+}
+
+// ExecCommand Run command for the change c, and for the files of a
+// --debounce batch, passed as --pass-files says. Closing stop kills it. Its
+// output is logged, each line after the name of its option and the file.
+func ExecCommand(name string, command string, c change, files []string, stop <-chan struct{}) error {
+	if command == "" {
+		return nil
+	} else {
+		var input io.Reader = os.Stdin
+		var extra []string
+		pass := opts.PassFiles
+		if size := argsSize(files); pass == "args" && size > maxArgsSize {
+			warnf("[%s] %d files take %s as arguments, passing them in a file instead", name, len(files), formatBytes(int64(size)))
+			pass = "file"
+		}
+		switch {
+		case files == nil:
+		case pass == "stdin":
+			input = strings.NewReader(strings.Join(files, "\n") + "\n")
+		case pass == "file":
+			list, err := os.CreateTemp("", "watch-files-*.txt")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(list.Name())
+			_, err = list.WriteString(strings.Join(files, "\n") + "\n")
+			if cerr := list.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			extra = []string{list.Name()}
+		default:
+			extra = files
+		}
+
+		var cmd *exec.Cmd
+		if opts.Shell {
+			// placeholders are quoted for the shell, the files are its arguments
+			cmd = shellCommand(c.placeholders(quoteArg).Replace(command), extra)
+		} else {
+			// placeholders are filled in per word, so paths with spaces stay one
+			args, err := splitWords(command)
+			if err != nil {
+				return err
+			}
+			fill := c.placeholders(nil)
+			for i := range args {
+				args[i] = fill.Replace(args[i])
+			}
+			args = append(args, extra...)
+			cmd = exec.Command(args[0], args[1:]...)
+		}
+		cmd.Env = append(append(os.Environ(), c.job.meta().env()...), c.env()...)
+
+		label := c.path
+		if files != nil {
+			label = fmt.Sprintf("%d files", len(files))
+		}
+		stdout := newLineLogger(levelInfo, "["+name+"] "+label+": ")
+		stderr := newLineLogger(levelWarn, "["+name+"] "+label+": ")
+		defer stdout.flush()
+		defer stderr.flush()
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		cmd.Stdin = input
+		cmd.WaitDelay = outputWaitDelay
+		detach(cmd)
+
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		if commandTimeout == 0 && stop == nil {
+			return cmd.Wait()
+		}
+		var timeout <-chan time.Time
+		if commandTimeout > 0 {
+			timeout = time.After(commandTimeout)
+		}
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err := <-done:
+			return err
+		case <-stop:
+			killGroup(cmd)
+			<-done
+			return errRestarted
+		case <-timeout:
+			// whatever it started goes too, or it could hold the output open
+			killGroup(cmd)
+			<-done
+			return fmt.Errorf("killed after --command-timeout %s", commandTimeout)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+// commands Subcommands run instead of watching, keyed by os.Args[1].
+var commands = map[string]func(args []string) int{
+	"undo":            undoCommand,
+	"restore":         restoreCommand,
+	"decrypt":         decryptCommand,
+	"serve":           serveCommand,
+	"sync":            syncCommand,
+	"diff":            diffCommand,
+	"status":          statusCommand,
+	"history":         historyCommand,
+	"report":          reportCommand,
+	"ctl":             ctlCommand,
+	"fleet":           fleetCommand,
+	"install-systemd": installSystemdCommand,
+	"install-launchd": installLaunchdCommand,
+}
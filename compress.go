@@ -0,0 +1,160 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// compressSuffix The extension compressed copies get at the destination.
+func compressSuffix() string {
+	switch opts.Compress {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	}
+	return ""
+}
+
+func validCompress(name string) error {
+	switch name {
+	case "", "gzip":
+		return nil
+	case "zstd":
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return fmt.Errorf("--compress zstd needs the zstd command: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown --compress %s (gzip, zstd)", name)
+}
+
+// transformed Copies are compressed and/or encrypted rather than plain.
+func transformed() bool {
+	return opts.Compress != "" || encryptKey != nil
+}
+
+// copyTransformed Write a compressed and/or encrypted copy of srcFileName
+// to dstFileName. Compression comes first; encrypted data doesn't compress.
+func copyTransformed(dstFileName string, srcFileName string) (int64, error) {
+	src, err := os.Open(srcFileName)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	var w io.Writer = dst
+	var enc *encryptWriter
+	if encryptKey != nil {
+		if enc, err = newEncryptWriter(dst, encryptKey); err != nil {
+			return 0, err
+		}
+		w = enc
+	}
+
+	var n int64
+	switch opts.Compress {
+	case "zstd":
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdin = throttle(src)
+		cmd.Stdout = w
+		err = cmd.Run()
+	case "gzip":
+		zw := gzip.NewWriter(w)
+		if n, err = io.Copy(zw, throttle(src)); err == nil {
+			err = zw.Close()
+		}
+	default:
+		n, err = io.Copy(w, throttle(src))
+	}
+	if err != nil {
+		return n, err
+	}
+
+	if enc != nil {
+		return n, enc.Close()
+	}
+	return n, nil
+}
+
+// openCopy Open a copy at the destination for reading its original content.
+func openCopy(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil || !transformed() {
+		return f, err
+	}
+
+	var r io.Reader = f
+	if encryptKey != nil {
+		if r, err = newDecryptReader(f, encryptKey); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	switch opts.Compress {
+	case "":
+		return &plainReader{Reader: r, file: f}, nil
+	case "zstd":
+		cmd := exec.Command("zstd", "-q", "-d", "-c")
+		cmd.Stdin = r
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &cmdReader{ReadCloser: out, cmd: cmd, file: f}, nil
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipReader{Reader: zr, file: f}, nil
+}
+
+type plainReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (r *plainReader) Close() error {
+	return r.file.Close()
+}
+
+type gzipReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *gzipReader) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+type cmdReader struct {
+	io.ReadCloser
+	cmd  *exec.Cmd
+	file *os.File
+}
+
+func (r *cmdReader) Close() error {
+	io.Copy(io.Discard, r.ReadCloser)
+	err := r.cmd.Wait()
+	r.file.Close()
+	return err
+}
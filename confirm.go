@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// stdin The one reader of the console, so what was typed ahead for one
+// prompt isn't lost to the next.
+var stdin = bufio.NewReader(os.Stdin)
+
+// confirmMu One prompt at a time.
+var confirmMu sync.Mutex
+
+// confirmDestructive Ask before --mirror or --two-way (op) removes count of
+// the total files in dir. Removals below --confirm-files and --confirm-percent
+// pass silently; larger ones need an interactive "y" or --yes, and without a
+// terminal to ask on they are refused rather than left waiting. The decision
+// is always logged.
+func confirmDestructive(op string, dir string, count, total int) bool {
+	if count <= 0 || !overConfirmThreshold(count, total) {
+		return true
+	}
+
+	if opts.Yes {
+		infof("%s: removing %d of %d files (confirmed by --yes)", op, count, total)
+		return true
+	}
+
+	if !isInteractive() {
+		warnf("%s: refusing to remove %d of %d files without --yes", op, count, total)
+		return false
+	}
+
+	confirmMu.Lock()
+	fmt.Fprintf(logOut, "%s will remove %d of %d files in %s. Continue? [y/N] ", op, count, total, dir)
+	line, _ := stdin.ReadString('\n')
+	confirmMu.Unlock()
+	ok := parseBool(line)
+
+	if ok {
+		infof("%s: removing %d of %d files (confirmed)", op, count, total)
+	} else {
+		warnf("%s: removal of %d of %d files declined", op, count, total)
+	}
+
+	return ok
+}
+
+func overConfirmThreshold(count, total int) bool {
+	if opts.ConfirmFiles > 0 && count > opts.ConfirmFiles {
+		return true
+	}
+	if opts.ConfirmPercent > 0 && total > 0 && float64(count)*100/float64(total) > opts.ConfirmPercent {
+		return true
+	}
+	return false
+}
+
+// isInteractive Stdin is a terminal, so a prompt can be answered. The null
+// device a service gets is a character device too, but not one.
+func isInteractive() bool {
+	stat, err := os.Stdin.Stat()
+	if err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(stat, null)
+}
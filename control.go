@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// startControl Listen on a Unix socket (also available on Windows 10+) for
+// one-line commands, answering each with one line:
+//
+//	log-level [error|warn|info|debug|trace]
+//	trace add|remove PATH
+//	trace list
+//	status
+//	pause|resume [JOB]
+//	resync [JOB]
+//	flush [JOB]
+//	queue [JOB]
+//	reload
+//	maintenance [on|off]
+//	path add|remove DIR
+//	path list (as JSON)
+func startControl(path string) error {
+	if err := guardSource(path); err != nil {
+		return err
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveControl(conn)
+		}
+	}()
+	return nil
+}
+
+func serveControl(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fmt.Fprintln(conn, controlCommand(line))
+	}
+}
+
+// controlCommand Run one control command and return the reply.
+func controlCommand(line string) string {
+	fields := strings.Fields(line)
+
+	switch fields[0] {
+	case "log-level":
+		if len(fields) == 1 {
+			return "ok " + levelNames[currentLevel()]
+		}
+		level, err := parseLevel(fields[1])
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		setLogLevel(level)
+		infof("log level set to %s", levelNames[level])
+		return "ok " + levelNames[level]
+
+	case "trace":
+		if len(fields) == 2 && fields[1] == "list" {
+			return "ok " + strings.Join(tracedPrefixes(), " ")
+		}
+		if len(fields) != 3 {
+			return "error: usage: trace add|remove PATH | trace list"
+		}
+		switch fields[1] {
+		case "add":
+			addTrace(fields[2])
+		case "remove":
+			removeTrace(fields[2])
+		default:
+			return "error: usage: trace add|remove PATH | trace list"
+		}
+		return "ok"
+
+	case "status":
+		data, err := json.Marshal(status())
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return "ok " + string(data)
+
+	case "pause", "resume", "resync", "flush":
+		if len(fields) > 2 {
+			return "error: usage: " + fields[0] + " [JOB]"
+		}
+		name := ""
+		if len(fields) == 2 {
+			name = fields[1]
+		}
+		var reply string
+		var err error
+		switch fields[0] {
+		case "pause", "resume":
+			reply, err = pauseJobs(name, fields[0] == "pause")
+		case "resync":
+			reply, err = resyncJobs(name)
+		default:
+			reply, err = flushJobs(name)
+		}
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return "ok " + reply
+
+	case "maintenance":
+		switch {
+		case len(fields) == 1:
+			return "ok " + maintenanceState()
+		case len(fields) == 2 && fields[1] == "on":
+			return "ok " + startMaintenance()
+		case len(fields) == 2 && fields[1] == "off":
+			return "ok " + endMaintenance()
+		}
+		return "error: usage: maintenance [on|off]"
+
+	case "reload":
+		reply, err := reloadWatches()
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return "ok " + reply
+
+	case "queue":
+		if len(fields) > 2 {
+			return "error: usage: queue [JOB]"
+		}
+		name := ""
+		if len(fields) == 2 {
+			name = fields[1]
+		}
+		found, err := jobsNamed(name)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		waiting := make([]queuedCopy, 0)
+		for _, j := range found {
+			waiting = append(waiting, j.queue.list()...)
+		}
+		data, err := json.Marshal(waiting)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return "ok " + string(data)
+
+	case "path":
+		if len(fields) == 2 && fields[1] == "list" {
+			data, _ := json.Marshal(watchedPaths())
+			return "ok " + string(data)
+		}
+		if len(fields) < 3 || (fields[1] != "add" && fields[1] != "remove") {
+			return "error: usage: path add|remove DIR | path list"
+		}
+		// the folder may have spaces in its name
+		dir := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line[len("path"):]), fields[1]))
+		var reply string
+		var err error
+		if fields[1] == "add" {
+			reply, err = addWatchPath(dir)
+		} else {
+			reply, err = removeWatchPath(dir)
+		}
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return "ok " + reply
+	}
+
+	return "error: unknown command " + fields[0]
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errUnchanged The destination already matches the source; nothing was copied.
+var errUnchanged = errors.New("unchanged")
+
+// copyInto Copy srcFileName to dstFileName through the staging directory,
+// so the destination only ever holds complete files. It returns the state of
+// the content copied, which the source may no longer have, when the job
+// keeps sync state or the copy's checksum is recorded; for archives and
+// remote destinations that of the source after the copy. attempt counts the
+// retries of a failed copy.
+func copyInto(j *job, dstFileName string, srcFileName string, attempt int) (syncState, error) {
+	if opts.Archive != "" || j.sink != nil {
+		var err error
+		if opts.Archive != "" {
+			err = j.archiveFile(srcFileName)
+		} else {
+			err = j.upload(dstFileName, srcFileName)
+		}
+		if err != nil || !checksumsRecorded() {
+			return syncState{}, err
+		}
+		copied, _ := stateOf(srcFileName)
+		return copied, nil
+	}
+
+	if unchanged(dstFileName, srcFileName) {
+		return syncState{}, errUnchanged
+	}
+
+	same, sum := sameContent(dstFileName, srcFileName)
+	if same {
+		return syncState{}, errUnchanged
+	}
+	if opts.Dedup && sum == "" {
+		sum, _ = fileSha256(srcFileName)
+	}
+
+	if err := mkdirAll(j.stagingDir()); err != nil {
+		return syncState{}, err
+	}
+	// a copy queued during maintenance has no folder yet
+	if err := mkdirAll(filepath.Dir(dstFileName)); err != nil {
+		return syncState{}, err
+	}
+
+	if err := guardSource(dstFileName); err != nil {
+		return syncState{}, err
+	}
+	srcStat, err := os.Stat(srcFileName)
+	if err != nil {
+		return syncState{}, err
+	}
+
+	compressed := transformed()
+	delta := !compressed && useDelta(dstFileName)
+	resumable := !compressed && !delta && chunked(srcFileName)
+	tmp := j.stagingName(dstFileName)
+	if resumable {
+		tmp = j.partName(dstFileName)
+	}
+	discard := func() {
+		os.Remove(tmp)
+		finishChunked(tmp)
+	}
+
+	t := startTransfer(j, srcFileName, dstFileName, tmp)
+	defer t.finish()
+
+	// the .part of a resumable copy holds what earlier attempts wrote, which
+	// a link or reflink would replace or truncate; a delta is decided on
+	// first, as it only goes to network filesystems, where a reflink can't
+	if !dedupLink(tmp, sum) && (compressed || resumable || !linkFile(tmp, srcFileName)) {
+		if compressed || resumable || delta || opts.NoReflink || !reflinkFile(tmp, srcFileName) {
+			var err error
+			if compressed {
+				_, err = copyTransformed(tmp, srcFileName)
+			} else if delta {
+				_, err = copyDelta(tmp, dstFileName, srcFileName)
+			} else if resumable {
+				_, err = copyChunked(tmp, srcFileName)
+			} else {
+				_, err = copyFile(tmp, srcFileName)
+			}
+			if err != nil {
+				// a partial chunked copy stays for the next attempt to resume
+				if !resumable {
+					discard()
+				}
+				return syncState{}, err
+			}
+		}
+
+		if err := copyMetadata(tmp, srcFileName); err != nil {
+			discard()
+			return syncState{}, err
+		}
+
+		// checked in staging, so a bad copy never replaces a good one
+		if err := verifyCopy(j, tmp, srcFileName, sum, attempt); err != nil {
+			discard()
+			return syncState{}, err
+		}
+	}
+
+	// taken from the staged copy, as the source may have changed since
+	var copied syncState
+	if compressed && checksumsRecorded() {
+		// of the original content, not of the compressed or encrypted copy
+		copied = syncState{Size: srcStat.Size(), ModTime: srcStat.ModTime(), Sha256: sum}
+		if sum == "" {
+			copied.Sha256, _ = fileSha256(srcFileName)
+		}
+	} else if j.state != nil || j.twoWay != nil || checksumsRecorded() {
+		if copied, err = stagedState(tmp, srcStat); err != nil {
+			discard()
+			return syncState{}, err
+		}
+	}
+
+	created := !IsFile(dstFileName)
+	kept, err := j.setAside("overwrite", dstFileName)
+	if err != nil {
+		discard()
+		return syncState{}, err
+	}
+
+	if err := os.Rename(tmp, dstFileName); err != nil {
+		// the old copy goes back rather than leaving nothing at the path
+		if kept != "" {
+			moveFile(dstFileName, kept)
+		}
+		discard()
+		return syncState{}, err
+	}
+	finishChunked(tmp)
+	if created {
+		if err := journalCreated(dstFileName); err != nil {
+			return syncState{}, err
+		}
+	}
+	atomic.AddInt64(&stats.Copied, 1)
+	atomic.AddInt64(&j.copied, 1)
+	noteCopy(j, dstFileName)
+	if stat, err := os.Stat(dstFileName); err == nil {
+		atomic.AddInt64(&stats.Bytes, stat.Size())
+	}
+
+	if err := rememberContent(dstFileName, sum); err != nil {
+		return copied, err
+	}
+	return copied, indexCopy(dstFileName, sum)
+}
+
+// checksumsRecorded The history, audit log or catalog records the checksum
+// of every copy, which copyInto takes once for them all.
+func checksumsRecorded() bool {
+	return history != nil || audit != nil || catalogDB != nil
+}
+
+// unchanged The destination has the source's size and, within
+// --mtime-tolerance, its modification time.
+func unchanged(dstFileName string, srcFileName string) bool {
+	if opts.AlwaysCopy {
+		return false
+	}
+
+	src, err := os.Stat(srcFileName)
+	if err != nil {
+		return false
+	}
+	dst, err := os.Stat(dstFileName)
+	if err != nil {
+		return false
+	}
+	// a compressed or encrypted copy has its own size, so only the mtime can tell
+	if !transformed() && dst.Size() != src.Size() {
+		return false
+	}
+	if os.SameFile(src, dst) {
+		return true
+	}
+
+	tolerance, _ := time.ParseDuration(opts.MtimeTolerance)
+	diff := dst.ModTime().Sub(src.ModTime())
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= tolerance
+}
+
+var linkWarned sync.Once
+
+// linkFile With --link, hardlink instead of copying. A link shares the source
+// inode and its metadata, so there is nothing left to copy afterwards. Across
+// filesystems linking fails and the caller falls back to a byte copy.
+func linkFile(dstFileName string, srcFileName string) bool {
+	if !opts.Link {
+		return false
+	}
+
+	err := os.Link(srcFileName, dstFileName)
+	if err != nil {
+		linkWarned.Do(func() { warnf("--link: %v - copying instead", err) })
+	}
+	return err == nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// cronSchedule A parsed five-field cron expression (minute, hour, day of
+// month, month, day of week), in local time.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// with both day fields restricted a day matches either, as in cron
+	anyDom, anyDow bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q, use minute hour day month weekday", expr)
+	}
+
+	c := &cronSchedule{anyDom: fields[2] == "*", anyDow: fields[4] == "*"}
+	var err error
+	if c.minute, err = cronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("schedule %q: minute: %v", expr, err)
+	}
+	if c.hour, err = cronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("schedule %q: hour: %v", expr, err)
+	}
+	if c.dom, err = cronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("schedule %q: day: %v", expr, err)
+	}
+	if c.month, err = cronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("schedule %q: month: %v", expr, err)
+	}
+	if c.dow, err = cronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, fmt.Errorf("schedule %q: weekday: %v", expr, err)
+	}
+	// 7 is Sunday too
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// cronField The bit set of one field: lists of *, n, a-b, each with an
+// optional /step. names, if any, stand for min, min+1, ...
+func cronField(field string, min int, max int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return min + i, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q out of %d-%d", s, min, max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step %q", stepPart)
+			}
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			a, b, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = value(a); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(b); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("bad range %q", rangePart)
+			}
+		}
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	}
+	return dom || dow
+}
+
+// next The first matching minute after t.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	// time.Date rather than Truncate, which works in UTC and would land off
+	// the hour in zones like +05:30
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+	// a schedule like Feb 30 never matches; give up after five years
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// runSchedule Run a full sync of the job at every time its schedule names,
+// catching anything the events missed. A sync still running when the next
+// is due makes that one skip.
+func (j *job) runSchedule() {
+	for {
+		next := j.schedule.next(time.Now())
+		if next.IsZero() {
+			warnf("job %s: schedule %q never matches", j.Name, j.Schedule)
+			return
+		}
+		debugf("job %s: next scheduled sync at %s", j.Name, next.Format(time.RFC3339))
+		time.Sleep(time.Until(next))
+		if j.queue.isRetired() {
+			return
+		}
+
+		if !atomic.CompareAndSwapInt32(&j.syncing, 0, 1) {
+			warnf("job %s: previous sync still running, skipped the one due at %s", j.Name, next.Format("15:04"))
+			continue
+		}
+		j.syncNow("scheduled")
+		atomic.StoreInt32(&j.syncing, 0)
+	}
+}
+
+// syncNow Run a full sync of the job, which the caller marked as syncing,
+// log how it went and tell the notifiers. kind says what started it, e.g.
+// scheduled.
+func (j *job) syncNow(kind string) {
+	infof("job %s: %s sync", j.Name, kind)
+	copied := atomic.LoadInt64(&j.copied)
+	if err := j.fullSync(); err != nil {
+		errorf("job %s: %s sync: %v", j.Name, kind, err)
+		j.notifySyncFailed(kind, err)
+	} else {
+		infof("job %s: %s sync complete, %d copied", j.Name, kind, atomic.LoadInt64(&j.copied)-copied)
+		j.notifySynced(kind, atomic.LoadInt64(&j.copied)-copied)
+	}
+}
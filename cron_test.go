@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNextInHalfHourZone(t *testing.T) {
+	c, err := parseCron("0 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	india := time.FixedZone("IST", 5*3600+30*60)
+
+	got := c.next(time.Date(2024, 6, 1, 0, 45, 0, 0, india))
+	want := time.Date(2024, 6, 1, 2, 0, 0, 0, india)
+	if !got.Equal(want) {
+		t.Errorf("next = %s, want %s", got, want)
+	}
+}
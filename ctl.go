@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const ctlUsage = `usage: watch ctl [--control-socket path] [--json] COMMAND
+  status              how the watcher is doing
+  pause [JOB]         stop taking copies off the queue of a job, or of all
+  resume [JOB]        start again
+  resync [JOB]        run a full sync now
+  flush [JOB]         copy what is queued now
+  queue [JOB]         the copies waiting
+  reload              reread the config and update the watched folders
+  maintenance [on|off] stop writing to the destinations, or write again
+  path add|remove DIR watch a folder of a source, or stop
+  path list           the watched folders
+The socket is the watcher's --control-socket, or WATCH_CONTROL_SOCKET.`
+
+// controlSocket The --control-socket, or WATCH_CONTROL_SOCKET without one.
+func controlSocket() string {
+	if opts.ControlSocket != "" {
+		return opts.ControlSocket
+	}
+	return os.Getenv("WATCH_CONTROL_SOCKET")
+}
+
+// ctlCommand watch ctl [--control-socket path] [--json] COMMAND [ARGS]
+// Manage a running watcher over its control socket, a Unix socket, which
+// Windows 10 and later have as well.
+func ctlCommand(args []string) int {
+	positional, err := parseOptions(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	socket := controlSocket()
+	if len(positional) == 0 || socket == "" {
+		fmt.Fprintln(os.Stderr, ctlUsage)
+		return 2
+	}
+
+	command := positional[0]
+	switch command {
+	case "status", "pause", "resume", "resync", "flush", "queue", "reload":
+		if len(positional) > 2 || ((command == "status" || command == "reload") && len(positional) > 1) {
+			fmt.Fprintln(os.Stderr, ctlUsage)
+			return 2
+		}
+	case "maintenance":
+		if len(positional) > 2 || (len(positional) == 2 && positional[1] != "on" && positional[1] != "off") {
+			fmt.Fprintln(os.Stderr, ctlUsage)
+			return 2
+		}
+	case "path":
+		if len(positional) < 2 {
+			fmt.Fprintln(os.Stderr, ctlUsage)
+			return 2
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n%s\n", command, ctlUsage)
+		return 2
+	}
+
+	reply, err := askControl(socket, strings.Join(positional, " "))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch {
+	case command == "status" && !opts.JSON:
+		var r statusReport
+		if err = json.Unmarshal(reply, &r); err != nil {
+			fmt.Fprintln(os.Stderr, "unexpected status reply:", string(reply))
+			return 1
+		}
+		printStatus(os.Stdout, r)
+	case command == "queue" && !opts.JSON:
+		var waiting []queuedCopy
+		if err = json.Unmarshal(reply, &waiting); err != nil {
+			fmt.Fprintln(os.Stderr, "unexpected queue reply:", string(reply))
+			return 1
+		}
+		printQueue(waiting)
+	case command == "path" && positional[1] == "list" && !opts.JSON:
+		var dirs []string
+		if err = json.Unmarshal(reply, &dirs); err != nil {
+			fmt.Fprintln(os.Stderr, "unexpected path reply:", string(reply))
+			return 1
+		}
+		for _, dir := range dirs {
+			fmt.Println(dir)
+		}
+	case len(reply) > 0:
+		fmt.Println(string(reply))
+	}
+	return 0
+}
+
+// printQueue e.g. "photos  /data/a.jpg -> /mnt/a.jpg  due in 4s, retry 1"
+func printQueue(waiting []queuedCopy) {
+	if len(waiting) == 0 {
+		fmt.Println("nothing queued")
+		return
+	}
+	sort.SliceStable(waiting, func(a, b int) bool { return waiting[a].Due.Before(waiting[b].Due) })
+	for _, c := range waiting {
+		due := "due now"
+		if wait := time.Until(c.Due).Round(time.Second); wait > 0 {
+			due = "due in " + wait.String()
+		}
+		if c.Attempt > 0 {
+			due += fmt.Sprintf(", retry %d", c.Attempt)
+		}
+		fmt.Printf("%s  %s -> %s  %s\n", c.Job, c.Path, c.Dest, due)
+	}
+}
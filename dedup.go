@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// dedupRecord A destination file holding some content, as it was when
+// recorded. A file that changed since is not linked to.
+type dedupRecord struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+var (
+	dedupMu   sync.Mutex
+	dedupSeen = make(map[string]dedupRecord)
+)
+
+// dedupLink With --dedup, hardlink tmp to a destination file that already
+// holds the content with hash sum instead of storing it again.
+func dedupLink(tmp string, sum string) bool {
+	if !opts.Dedup || sum == "" {
+		return false
+	}
+
+	rec, ok := lookupContent(sum)
+	if !ok {
+		return false
+	}
+	stat, err := os.Stat(rec.Path)
+	if err != nil || stat.Size() != rec.Size || !stat.ModTime().Equal(rec.ModTime) {
+		return false
+	}
+
+	if err := os.Link(rec.Path, tmp); err != nil {
+		debugf("--dedup: %v", err)
+		return false
+	}
+	debugf("linked %s to identical %s", tmp, rec.Path)
+	return true
+}
+
+// rememberContent Record dstFileName as holding the content with hash sum.
+func rememberContent(dstFileName string, sum string) error {
+	if !opts.Dedup || sum == "" {
+		return nil
+	}
+
+	stat, err := os.Stat(dstFileName)
+	if err != nil {
+		return err
+	}
+	rec := dedupRecord{Path: dstFileName, Size: stat.Size(), ModTime: stat.ModTime()}
+
+	// the hash index keeps the records across runs
+	if hashIndex != nil {
+		return hashIndex.Put("content:"+sum, rec)
+	}
+	dedupMu.Lock()
+	dedupSeen[sum] = rec
+	dedupMu.Unlock()
+	return nil
+}
+
+func lookupContent(sum string) (dedupRecord, bool) {
+	var rec dedupRecord
+	if hashIndex != nil {
+		return rec, hashIndex.Get("content:"+sum, &rec)
+	}
+	dedupMu.Lock()
+	defer dedupMu.Unlock()
+	rec, ok := dedupSeen[sum]
+	return rec, ok
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	deltaMod   = 1 << 16
+	deltaBlock = 64 * 1024
+)
+
+// blockSig The weak rolling and strong checksums of one block of the old file.
+type blockSig struct {
+	index  int64
+	strong [sha256.Size]byte
+}
+
+var deltaThreshold int64
+
+// deltaOut Where deltaCopy sends its result: literal source bytes, and
+// references to blocks of the old file.
+type deltaOut interface {
+	Literal(p []byte) error
+	Block(index int64) error
+}
+
+// localDelta Rebuild the new file locally, reading matched blocks from base.
+type localDelta struct {
+	w         io.Writer
+	base      io.ReaderAt
+	blockSize int
+	block     []byte
+}
+
+func (d *localDelta) Literal(p []byte) error {
+	_, err := d.w.Write(p)
+	return err
+}
+
+func (d *localDelta) Block(index int64) error {
+	if d.block == nil {
+		d.block = make([]byte, d.blockSize)
+	}
+	if _, err := d.base.ReadAt(d.block, index*int64(d.blockSize)); err != nil {
+		return err
+	}
+	_, err := d.w.Write(d.block)
+	return err
+}
+
+// useDelta A large destination already exists to take unchanged blocks from,
+// on a network filesystem. On a local disk a delta reads the old copy on top
+// of writing the whole new one, so a plain copy is cheaper.
+func useDelta(dstFileName string) bool {
+	if !opts.Delta || !networkFS(filepath.Dir(dstFileName)) {
+		return false
+	}
+	stat, err := os.Stat(dstFileName)
+	return err == nil && stat.Mode().IsRegular() && stat.Size() >= deltaThreshold
+}
+
+// copyDelta Build tmp from srcFileName the rsync way: blocks that are
+// unchanged in the old destination are taken from it, and only the rest is
+// read as literal data from the source.
+func copyDelta(tmp string, dstFileName string, srcFileName string) (int64, error) {
+	base, err := os.Open(dstFileName)
+	if err != nil {
+		return 0, err
+	}
+	defer base.Close()
+
+	blockSize := deltaBlock
+	sigs, err := blockSignatures(base, blockSize)
+	if err != nil {
+		return 0, err
+	}
+
+	src, err := os.Open(srcFileName)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	w := bufio.NewWriterSize(out, 1<<20)
+	delta := &localDelta{w: w, base: base, blockSize: blockSize}
+	matched, literal, err := deltaCopy(delta, bufio.NewReaderSize(throttle(src), 1<<20), sigs, blockSize)
+	if err != nil {
+		return 0, err
+	}
+	if err = w.Flush(); err != nil {
+		return 0, err
+	}
+
+	debugf("delta %s: %d bytes reused, %d bytes copied", dstFileName, matched, literal)
+	return matched + literal, nil
+}
+
+func blockSignatures(f *os.File, blockSize int) (map[uint32][]blockSig, error) {
+	sigs := make(map[uint32][]blockSig)
+	buf := make([]byte, blockSize)
+	r := bufio.NewReaderSize(f, 1<<20)
+
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(r, buf)
+		if n < blockSize {
+			// a short last block is sent as literal data
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return sigs, nil
+			}
+			return nil, err
+		}
+		a, b := weakSum(buf)
+		weak := a | b<<16
+		sigs[weak] = append(sigs[weak], blockSig{index: index, strong: sha256.Sum256(buf)})
+	}
+}
+
+func weakSum(block []byte) (uint32, uint32) {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a % deltaMod, b % deltaMod
+}
+
+// deltaCopy Slide a block-sized window over src, rolling the weak checksum
+// one byte at a time, and emit either a matching old block or literal bytes.
+func deltaCopy(out deltaOut, src *bufio.Reader, sigs map[uint32][]blockSig, blockSize int) (int64, int64, error) {
+	var matched, literal int64
+	lit := make([]byte, 0, 1<<20)
+
+	flush := func() error {
+		if len(lit) == 0 {
+			return nil
+		}
+		err := out.Literal(lit)
+		literal += int64(len(lit))
+		lit = lit[:0]
+		return err
+	}
+
+	fill := func() ([]byte, error) {
+		win := make([]byte, blockSize, blockSize*2)
+		n, err := io.ReadFull(src, win)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		return win[:n], err
+	}
+
+	win, err := fill()
+	if err != nil {
+		return 0, 0, err
+	}
+	a, b := weakSum(win)
+
+	for len(win) > 0 {
+		if len(win) == blockSize {
+			if found, ok := findBlock(sigs, a|b<<16, win); ok {
+				if err = flush(); err != nil {
+					return matched, literal, err
+				}
+				if err = out.Block(found.index); err != nil {
+					return matched, literal, err
+				}
+				matched += int64(blockSize)
+
+				if win, err = fill(); err != nil {
+					return matched, literal, err
+				}
+				a, b = weakSum(win)
+				continue
+			}
+		}
+
+		first := win[0]
+		lit = append(lit, first)
+		in, err := src.ReadByte()
+		if err == io.EOF {
+			lit = append(lit, win[1:]...)
+			break
+		}
+		if err != nil {
+			return matched, literal, err
+		}
+
+		win = append(win[1:], in)
+		a = (a - uint32(first) + uint32(in)) % deltaMod
+		b = (b - uint32(blockSize)*uint32(first) + a) % deltaMod
+
+		if len(lit) == cap(lit) {
+			if err = flush(); err != nil {
+				return matched, literal, err
+			}
+		}
+	}
+
+	return matched, literal, flush()
+}
+
+func findBlock(sigs map[uint32][]blockSig, weak uint32, win []byte) (blockSig, bool) {
+	candidates, ok := sigs[weak]
+	if !ok {
+		return blockSig{}, false
+	}
+	strong := sha256.Sum256(win)
+	for _, c := range candidates {
+		if c.strong == strong {
+			return c, true
+		}
+	}
+	return blockSig{}, false
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// desktopBatch How long failures are gathered into one desktop notification.
+const desktopBatch = 10 * time.Second
+
+// desktopNotifier --desktop-notify: failed copies and finished syncs as
+// notifications of the desktop: a toast on Windows, Notification Center on
+// macOS, libnotify's notify-send elsewhere.
+type desktopNotifier struct {
+	mu     sync.Mutex
+	failed failureBatch
+	broken bool
+}
+
+func newDesktopNotifier() *desktopNotifier {
+	d := &desktopNotifier{}
+	d.failed = failureBatch{window: desktopBatch, send: func(n notice) { d.show(n.Title, n.Message) }}
+	return d
+}
+
+func (d *desktopNotifier) notify(n notice) {
+	switch n.Kind {
+	case "synced":
+		go d.show(n.Title, n.Message)
+	case "failed":
+		d.failed.add(n)
+	}
+}
+
+// show Warn once when notifications can't be shown, then stay quiet.
+func (d *desktopNotifier) show(title string, message string) {
+	err := showDesktop(title, message)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil && !d.broken {
+		warnf("desktop notification: %v", err)
+	}
+	d.broken = err != nil
+}
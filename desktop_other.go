@@ -0,0 +1,17 @@
+//go:build !windows && !darwin
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// showDesktop Through notify-send, which comes with libnotify.
+func showDesktop(title string, message string) error {
+	out, err := exec.Command("notify-send", "--app-name=watch", title, message).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("notify-send: %v %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !unix && !windows
+
+package main
+
+import "os/exec"
+
+func detach(cmd *exec.Cmd) {}
+
+func signalGroup(cmd *exec.Cmd, name string) error {
+	return killGroup(cmd)
+}
+
+func killGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func processAlive(pid int) bool {
+	return true
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// divergence One path where the source and destination trees disagree.
+type divergence struct {
+	Status   string     `json:"status"` // missing, extra or differs
+	Path     string     `json:"path"`
+	Reason   string     `json:"reason,omitempty"` // size, mtime or content
+	SrcSize  int64      `json:"src_size,omitempty"`
+	DstSize  int64      `json:"dst_size,omitempty"`
+	SrcMtime *time.Time `json:"src_mtime,omitempty"`
+	DstMtime *time.Time `json:"dst_mtime,omitempty"`
+}
+
+// diffCommand watch diff path copyDir [--json] [--verify]
+// Report files missing from the destination, extra in it, or differing in
+// size, mtime or, with --verify, content, without copying anything. Exits
+// like diff(1): 0 when the trees match, 1 when they don't, 2 for trouble.
+func diffCommand(args []string) int {
+	paths, err := parseOptions(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(paths) != 2 || !IsDir(paths[0]) || !IsDir(paths[1]) {
+		fmt.Fprintln(os.Stderr, "usage: watch diff path copyDir [--json] [--verify], both existing folders")
+		return 2
+	}
+	if err = validPatterns(append(opts.Include, opts.Exclude...)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	j := newJob("diff", paths[0], paths[1])
+	j.Include, j.Exclude = opts.Include, opts.Exclude
+	found, err := j.diff()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	counts := make(map[string]int)
+	for _, d := range found {
+		counts[d.Status]++
+		if opts.JSON {
+			line, _ := json.Marshal(d)
+			fmt.Println(string(line))
+			continue
+		}
+		if d.Reason != "" {
+			fmt.Printf("%-8s %s (%s)\n", d.Status, d.Path, d.Reason)
+		} else {
+			fmt.Printf("%-8s %s\n", d.Status, d.Path)
+		}
+	}
+	if !opts.JSON {
+		fmt.Printf("%d missing, %d extra, %d differ\n", counts["missing"], counts["extra"], counts["differs"])
+	}
+
+	if len(found) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// diff Compare the job's source and destination trees, by path.
+func (j *job) diff() ([]divergence, error) {
+	src, err := treeFiles(j, j.Source)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := treeFiles(j, j.Dest)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []divergence
+	for rel, s := range src {
+		d, ok := dst[rel]
+		if !ok {
+			found = append(found, divergence{Status: "missing", Path: filepath.ToSlash(rel), SrcSize: s.Size()})
+			continue
+		}
+		if reason := j.differsBy(rel, s, d); reason != "" {
+			sm, dm := s.ModTime(), d.ModTime()
+			found = append(found, divergence{Status: "differs", Path: filepath.ToSlash(rel), Reason: reason,
+				SrcSize: s.Size(), DstSize: d.Size(), SrcMtime: &sm, DstMtime: &dm})
+		}
+	}
+	for rel, d := range dst {
+		if _, ok := src[rel]; !ok {
+			found = append(found, divergence{Status: "extra", Path: filepath.ToSlash(rel), DstSize: d.Size()})
+		}
+	}
+
+	sort.Slice(found, func(a, b int) bool { return found[a].Path < found[b].Path })
+	return found, nil
+}
+
+// differsBy Why the copy at rel doesn't match its source, or "".
+func (j *job) differsBy(rel string, src os.FileInfo, dst os.FileInfo) string {
+	if src.Size() != dst.Size() {
+		return "size"
+	}
+	tolerance, _ := time.ParseDuration(opts.MtimeTolerance)
+	diff := dst.ModTime().Sub(src.ModTime())
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > tolerance && !opts.NoPreserveTimes {
+		return "mtime"
+	}
+	if !opts.Verify {
+		return ""
+	}
+	srcSum, err := fileSha256(filepath.Join(j.Source, rel))
+	if err != nil {
+		return "content"
+	}
+	dstSum, err := fileSha256(filepath.Join(j.Dest, rel))
+	if err != nil || srcSum != dstSum {
+		return "content"
+	}
+	return ""
+}
+
+// treeFiles The regular files under root the job would copy, by relative
+// path, leaving out the watcher's own files and versions.
+func treeFiles(j *job, root string) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if rel == "." {
+			return nil
+		}
+		if j.mirrorKeeps(path, rel) || (info.IsDir() && opts.NoRecurse) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() && j.wants(filepath.Join(j.Source, rel)) {
+			files[rel] = info
+		}
+		return nil
+	})
+	return files, err
+}
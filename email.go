@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emailBatch How long the first notice waits for others to go with it.
+const emailBatch = time.Minute
+
+// emailNotifier --email-to: failed copies and syncs and destinations going
+// offline or coming back, mailed through --smtp. Notices are batched: a mail
+// goes out emailBatch after the first, then no more often than
+// --email-interval, with everything that happened in between.
+type emailNotifier struct {
+	server   *url.URL
+	from     string
+	to       []string
+	interval time.Duration
+
+	mu       sync.Mutex
+	pending  []notice
+	timer    *time.Timer
+	lastSent time.Time
+}
+
+var mailer *emailNotifier
+
+// openEmail Check --smtp, e.g. smtp://user@mail.example.com:587 or
+// smtps://mail.example.com. The password comes from the URL or
+// SMTP_PASSWORD.
+func openEmail(server string, from string, to []string, interval time.Duration) (*emailNotifier, error) {
+	u, err := url.Parse(server)
+	if err != nil || (u.Scheme != "smtp" && u.Scheme != "smtps") || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid --smtp %q, expected smtp://[user@]host[:port] or smtps://", server)
+	}
+	if from == "" {
+		host, _ := os.Hostname()
+		from = "watch@" + host
+	}
+	return &emailNotifier{server: u, from: from, to: to, interval: interval}, nil
+}
+
+func (e *emailNotifier) notify(n notice) {
+	if n.Kind == "synced" {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending = append(e.pending, n)
+	if e.timer != nil {
+		return
+	}
+	delay := emailBatch
+	if wait := time.Until(e.lastSent.Add(e.interval)); wait > delay {
+		delay = wait
+	}
+	e.timer = time.AfterFunc(delay, e.flush)
+}
+
+// flush Mail what is pending.
+func (e *emailNotifier) flush() {
+	e.mu.Lock()
+	pending := e.pending
+	e.pending, e.timer, e.lastSent = nil, nil, time.Now()
+	e.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	if err := e.send(emailSubject(pending), emailBody(pending)); err != nil {
+		errorf("email to %s: %v", strings.Join(e.to, ", "), err)
+	}
+}
+
+// close Mail what is pending right away, on shutdown.
+func (e *emailNotifier) close() {
+	e.mu.Lock()
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.mu.Unlock()
+	e.flush()
+}
+
+// emailSubject e.g. "[watch] 3 failures, 1 destination offline on host".
+func emailSubject(list []notice) string {
+	counts := make(map[string]int)
+	for _, n := range list {
+		counts[n.Kind]++
+	}
+	var parts []string
+	for _, c := range []struct {
+		kind, one, many string
+	}{
+		{"failed", "1 failure", "%d failures"},
+		{"offline", "1 destination offline", "%d destinations offline"},
+		{"online", "1 destination back online", "%d destinations back online"},
+	} {
+		switch counts[c.kind] {
+		case 0:
+		case 1:
+			parts = append(parts, c.one)
+		default:
+			parts = append(parts, fmt.Sprintf(c.many, counts[c.kind]))
+		}
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("[watch] %s on %s", strings.Join(parts, ", "), host)
+}
+
+func emailBody(list []notice) string {
+	var b strings.Builder
+	for _, n := range list {
+		fmt.Fprintf(&b, "%s  %s: %s\r\n", n.Time.Local().Format("2006-01-02 15:04:05"), n.Title, n.Message)
+	}
+	return b.String()
+}
+
+func (e *emailNotifier) send(subject string, body string) error {
+	host := e.server.Hostname()
+	port := e.server.Port()
+	if port == "" {
+		port = "25"
+		if e.server.Scheme == "smtps" {
+			port = "465"
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+
+	var conn net.Conn
+	var err error
+	if e.server.Scheme == "smtps" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: busTimeout}, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, busTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && e.server.Scheme == "smtp" {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if user := e.server.User.Username(); user != "" {
+		pass, ok := e.server.User.Password()
+		if !ok {
+			pass = os.Getenv("SMTP_PASSWORD")
+		}
+		if err = c.Auth(smtp.PlainAuth("", user, pass, host)); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(e.from); err != nil {
+		return err
+	}
+	for _, to := range e.to {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		e.from, strings.Join(e.to, ", "), subject, time.Now().Format(time.RFC1123Z), body)
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
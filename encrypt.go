@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted copies are a header (magic and an 8 byte random nonce prefix)
+// followed by AES-256-GCM sealed chunks of encChunk bytes. Each chunk's
+// nonce is the prefix plus its index, and the final chunk is marked in the
+// additional data, so reordered or truncated files fail to decrypt.
+const (
+	encMagic  = "WATCHENC1"
+	encChunk  = 64 * 1024
+	encSuffix = ".enc"
+)
+
+var encryptKey []byte
+
+// loadKey A keyfile holds 32 raw bytes or 64 hex characters; anything else is
+// hashed into a key.
+func loadKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+func encryptSuffix() string {
+	if encryptKey != nil {
+		return encSuffix
+	}
+	return ""
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], index)
+	return nonce
+}
+
+func chunkAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptWriter Seals everything written to it in chunks; Close seals the last one.
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	buf    []byte
+}
+
+func newEncryptWriter(w io.Writer, key []byte) (*encryptWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, 8)
+	if _, err = rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(append([]byte(encMagic), prefix...)); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, encChunk)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full buffer is only sealed once more data shows it isn't the last
+		if len(e.buf) == encChunk {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encChunk], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	out := e.aead.Seal(nil, chunkNonce(e.prefix, e.index), e.buf, chunkAAD(last))
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(out)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// decryptReader Opens the chunks written by encryptWriter.
+type decryptReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	next   []byte
+	plain  bytes.Buffer
+	done   bool
+}
+
+func newDecryptReader(r io.Reader, key []byte) (*decryptReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(encMagic)+8)
+	if _, err = io.ReadFull(r, header); err != nil || string(header[:len(encMagic)]) != encMagic {
+		return nil, errors.New("not an encrypted copy")
+	}
+
+	d := &decryptReader{r: r, aead: aead, prefix: header[len(encMagic):]}
+	d.next, err = d.readChunk()
+	return d, err
+}
+
+func (d *decryptReader) readChunk() ([]byte, error) {
+	chunk := make([]byte, encChunk+d.aead.Overhead())
+	n, err := io.ReadFull(d.r, chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return chunk[:n], err
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for d.plain.Len() == 0 && !d.done {
+		if len(d.next) == 0 {
+			return 0, errors.New("encrypted copy is truncated")
+		}
+		following, err := d.readChunk()
+		if err != nil {
+			return 0, err
+		}
+		last := len(following) == 0
+
+		plain, err := d.aead.Open(nil, chunkNonce(d.prefix, d.index), d.next, chunkAAD(last))
+		if err != nil {
+			return 0, fmt.Errorf("decrypt: %v", err)
+		}
+		d.index++
+		d.plain.Write(plain)
+		d.next = following
+		d.done = last
+	}
+
+	if d.plain.Len() == 0 {
+		return 0, io.EOF
+	}
+	return d.plain.Read(p)
+}
+
+// decryptCommand watch decrypt --key FILE in.enc [out]
+// Writes the plain content to out, or to stdout.
+func decryptCommand(args []string) int {
+	files, err := parseOptions(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if opts.Key == "" || len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: watch decrypt --key keyfile file.enc [out]")
+		return 2
+	}
+
+	key, err := loadKey(opts.Key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	in, err := os.Open(files[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer in.Close()
+
+	r, err := newDecryptReader(in, key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, files[0], err)
+		return 1
+	}
+
+	out := os.Stdout
+	if len(files) > 1 {
+		if out, err = os.Create(files[1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer out.Close()
+	}
+
+	if _, err = io.Copy(out, r); err != nil {
+		fmt.Fprintln(os.Stderr, files[0], err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// errorClasses What reported errors are sorted into, for the counters in
+// the statistics and for --error-policy.
+var errorClasses = []string{"permission", "disk-full", "unreachable", "vanished", "checksum", "command", "other"}
+
+// errorActions What --error-policy can do about a class: log it as usual,
+// only log it at debug level, or stop the watcher.
+var errorActions = []string{"log", "ignore", "halt"}
+
+// errChecksum A copy didn't read back with the source's checksum.
+var errChecksum = errors.New("checksum mismatch")
+
+var (
+	errorPolicies = make(map[string]string)
+
+	errorCountsMu sync.Mutex
+	errorCounts   = make(map[string]int64)
+)
+
+// classifyError The class of err: by its type where it has one, by its
+// message for errors that come as text, e.g. from remote destinations.
+func classifyError(err error) string {
+	var network *net.OpError
+	var dns *net.DNSError
+	var command *commandError
+	switch {
+	case errors.As(err, &command):
+		return "command"
+	case errors.Is(err, errChecksum):
+		return "checksum"
+	case errors.Is(err, syscall.ENOSPC):
+		return "disk-full"
+	case errors.Is(err, os.ErrPermission):
+		return "permission"
+	case errors.Is(err, os.ErrNotExist):
+		return "vanished"
+	case errors.As(err, &network), errors.As(err, &dns), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET):
+		return "unreachable"
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, c := range []struct{ class, text string }{
+		{"disk-full", "no space left"}, {"disk-full", "not enough space"}, {"disk-full", "disk full"},
+		{"disk-full", "quota exceeded"}, {"disk-full", "insufficient storage"},
+		{"permission", "permission denied"}, {"permission", "access is denied"}, {"permission", "403 forbidden"},
+		{"permission", "401 unauthorized"},
+		{"unreachable", "connection refused"}, {"unreachable", "no such host"}, {"unreachable", "timeout"},
+		{"unreachable", "unreachable"}, {"unreachable", "connection reset"}, {"unreachable", "broken pipe"},
+		{"unreachable", "503 service unavailable"},
+		{"vanished", "no such file"}, {"vanished", "cannot find the file"},
+	} {
+		if strings.Contains(message, c.text) {
+			return c.class
+		}
+	}
+	return "other"
+}
+
+// parseErrorPolicies --error-policy class=action, e.g. disk-full=halt.
+func parseErrorPolicies(list []string) (map[string]string, error) {
+	policies := make(map[string]string)
+	for _, p := range list {
+		class, action, ok := strings.Cut(p, "=")
+		if !ok || !contains(errorClasses, class) || !contains(errorActions, action) {
+			return nil, fmt.Errorf("invalid --error-policy %q, use class=action with a class of %s and an action of %s",
+				p, strings.Join(errorClasses, ", "), strings.Join(errorActions, ", "))
+		}
+		policies[class] = action
+	}
+	return policies, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// countError Count an error of class.
+func countError(class string) {
+	errorCountsMu.Lock()
+	errorCounts[class]++
+	errorCountsMu.Unlock()
+}
+
+// errorsByClass The count of every class that occurred.
+func errorsByClass() map[string]int64 {
+	errorCountsMu.Lock()
+	defer errorCountsMu.Unlock()
+	counts := make(map[string]int64, len(errorCounts))
+	for class, n := range errorCounts {
+		counts[class] = n
+	}
+	return counts
+}
+
+// formatErrorCounts e.g. "3 permission, 1 vanished", most frequent first.
+func formatErrorCounts(counts map[string]int64) string {
+	classes := make([]string, 0, len(counts))
+	for class := range counts {
+		classes = append(classes, class)
+	}
+	sort.Slice(classes, func(a, b int) bool {
+		if counts[classes[a]] != counts[classes[b]] {
+			return counts[classes[a]] > counts[classes[b]]
+		}
+		return classes[a] < classes[b]
+	})
+	parts := make([]string, 0, len(classes))
+	for _, class := range classes {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[class], class))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errorGroup Repeats of one kind of error, e.g. "open: permission denied".
+type errorGroup struct {
+	key        string
+	count      int
+	suppressed int
+	first      time.Time
+	last       time.Time
+	prefix     string
+}
+
+var errorSummaryEvery time.Duration
+
+// maxErrorGroups How many kinds of error are kept, and errorGroupTTL how long
+// one is kept after its last repeat.
+const (
+	maxErrorGroups = 1000
+	errorGroupTTL  = 24 * time.Hour
+)
+
+var errGroups = struct {
+	sync.Mutex
+	m map[string]*errorGroup
+}{m: make(map[string]*errorGroup)}
+
+// reportError Log err, collapsing repeats: the first error of a kind is
+// logged right away, later ones only at debug level, and a summary with
+// counts, first/last occurrence and the common path prefix is printed every
+// --error-summary. Errors are counted by class, and handled as
+// --error-policy says for theirs.
+func reportError(err error) {
+	class := classifyError(err)
+	countError(class)
+	switch errorPolicies[class] {
+	case "ignore":
+		debugf("%v", err)
+		return
+	case "halt":
+		errorf("%v", err)
+		errorf("halting, as --error-policy %s=halt says", class)
+		closeOutputs()
+		os.Exit(1)
+	}
+
+	key, path := errorKey(err)
+
+	errGroups.Lock()
+	g, ok := errGroups.m[key]
+	if !ok {
+		if len(errGroups.m) >= maxErrorGroups {
+			forgetOldestError()
+		}
+		g = &errorGroup{key: key, first: time.Now(), prefix: path}
+		errGroups.m[key] = g
+	}
+	g.count++
+	g.last = time.Now()
+	g.prefix = commonPrefix(g.prefix, path)
+	repeat := g.count > 1
+	if repeat {
+		g.suppressed++
+	}
+	errGroups.Unlock()
+
+	if repeat && errorSummaryEvery > 0 {
+		debugf("%v", err)
+		return
+	}
+	errorf("%v", err)
+}
+
+// forgetOldestError Make room for another kind of error. The lock must be
+// held.
+func forgetOldestError() {
+	var oldest *errorGroup
+	for _, g := range errGroups.m {
+		if oldest == nil || g.last.Before(oldest.last) {
+			oldest = g
+		}
+	}
+	if oldest != nil {
+		delete(errGroups.m, oldest.key)
+	}
+}
+
+// errorKey Group by what went wrong, not where: paths in the message, as
+// "copy /srv/a.txt: ..." has, are left out of the key.
+func errorKey(err error) (string, string) {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return pe.Op + ": " + pe.Err.Error(), pe.Path
+	}
+	var le *os.LinkError
+	if errors.As(err, &le) {
+		return le.Op + ": " + le.Err.Error(), le.New
+	}
+	return stripPaths(err.Error())
+}
+
+// stripPaths Replace every word of message that looks like a path with
+// "...", returning the first such path too.
+func stripPaths(message string) (string, string) {
+	words := strings.Split(message, " ")
+	first := ""
+	for i, word := range words {
+		p := strings.Trim(word, `"'(),:;`)
+		if !looksLikePath(p) {
+			continue
+		}
+		if first == "" {
+			first = p
+		}
+		words[i] = strings.Replace(word, p, "...", 1)
+	}
+	return strings.Join(words, " "), first
+}
+
+// looksLikePath A word with a slash or backslash in it: a path, a UNC path
+// or a URL.
+func looksLikePath(word string) bool {
+	return len(word) > 1 && strings.ContainsAny(word, `/\`)
+}
+
+func commonPrefix(a, b string) string {
+	if a == "" || b == "" {
+		return ""
+	}
+	as := strings.Split(filepath.ToSlash(a), "/")
+	bs := strings.Split(filepath.ToSlash(b), "/")
+	n := 0
+	for n < len(as) && n < len(bs) && as[n] == bs[n] {
+		n++
+	}
+	return filepath.FromSlash(strings.Join(as[:n], "/"))
+}
+
+// summarizeErrors Print one line per error kind that was repeated since the
+// last summary.
+func summarizeErrors() {
+	errGroups.Lock()
+	groups := make([]*errorGroup, 0)
+	for _, g := range errGroups.m {
+		if g.suppressed > 0 {
+			c := *g
+			groups = append(groups, &c)
+		}
+		g.suppressed = 0
+	}
+	errGroups.Unlock()
+
+	sort.Slice(groups, func(i, k int) bool { return groups[i].count > groups[k].count })
+	for _, g := range groups {
+		where := ""
+		if g.prefix != "" {
+			where = " under " + g.prefix
+		}
+		errorf("%d x %s%s (%d total, first %s, last %s)", g.suppressed+1, g.key, where, g.count,
+			g.first.Format(time.RFC3339), g.last.Format(time.RFC3339))
+	}
+}
+
+// startErrorSummaries Summarize every --error-summary interval.
+func startErrorSummaries(every time.Duration) {
+	errorSummaryEvery = every
+	if every <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(every) {
+			summarizeErrors()
+		}
+	}()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// eventMeta Says which job, watch root and destination an event belongs to,
+// so one receiver of hooks and notifications can tell many jobs and
+// instances apart.
+type eventMeta struct {
+	Job      string `json:"job"`
+	Root     string `json:"root"`
+	Backend  string `json:"backend"`
+	Instance string `json:"instance"`
+}
+
+// rootAlias The configured alias of the job's watch root, or its base name.
+func (j *job) rootAlias() string {
+	if j.Alias != "" {
+		return j.Alias
+	}
+	return filepath.Base(j.Source)
+}
+
+// backend The kind of destination the job writes to.
+func (j *job) backend() string {
+	if opts.Output != "" {
+		return opts.Output
+	}
+	if isRemote(j.Dest) {
+		u, _ := url.Parse(j.Dest)
+		return u.Scheme
+	}
+	return "local"
+}
+
+func (j *job) meta() eventMeta {
+	host, _ := os.Hostname()
+	return eventMeta{Job: j.Name, Root: j.rootAlias(), Backend: j.backend(), Instance: host}
+}
+
+// metaOf The metadata of the job called name, or only the instance when
+// there is no such job.
+func metaOf(name string) eventMeta {
+	if name != "" {
+		if found, err := jobsNamed(name); err == nil {
+			return found[0].meta()
+		}
+	}
+	host, _ := os.Hostname()
+	return eventMeta{Job: name, Instance: host}
+}
+
+// env The metadata as environment variables for hook commands.
+func (m eventMeta) env() []string {
+	return []string{
+		"WATCH_JOB=" + m.Job,
+		"WATCH_ROOT_ALIAS=" + m.Root,
+		"WATCH_BACKEND=" + m.Backend,
+		"WATCH_INSTANCE=" + m.Instance,
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/botsphp/fsnotify"
+)
+
+// fileEvent A change to a watched path, independent of where it came from:
+// the filesystem watcher or a --replay file.
+type fileEvent struct {
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"`
+	Path string    `json:"path"`
+}
+
+func newFileEvent(ev *fsnotify.FileEvent) fileEvent {
+	op := "write"
+	switch {
+	case ev.IsCreate():
+		op = "create"
+	case ev.IsDelete():
+		op = "delete"
+	case ev.IsRename():
+		op = "rename"
+	case ev.IsAttrib():
+		op = "attrib"
+	}
+	return fileEvent{Time: time.Now(), Op: op, Path: ev.GetFile()}
+}
+
+func (e fileEvent) String() string {
+	return fmt.Sprintf("%q: %s", e.Path, e.Op)
+}
+
+// eventMessage What the watcher tells consumers of its change stream: a
+// watched path changed (the event ops), or how a job's copy of it ended
+// (copied, unchanged, skipped, failed).
+type eventMessage struct {
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`
+	Path   string    `json:"path"`
+	Job    string    `json:"job,omitempty"`
+	Dest   string    `json:"dest,omitempty"`
+	Size   int64     `json:"size,omitempty"`
+	Sha256 string    `json:"sha256,omitempty"` // of what was copied
+	Error  string    `json:"error,omitempty"`
+	Data   []byte    `json:"data,omitempty"`
+}
+
+// outcome The message ends a copy rather than reporting a change.
+func (m eventMessage) outcome() bool {
+	switch m.Op {
+	case "copied", "unchanged", "skipped", "failed":
+		return true
+	}
+	return false
+}
+
+// emit Send msg to every configured event consumer.
+func emit(msg eventMessage) {
+	noteActivity(msg)
+	if opts.EventSocket != "" {
+		sendEventSocket(msg)
+	}
+	if catalogDB != nil {
+		catalogDB.record(msg)
+	}
+	if audit != nil {
+		auditMessage(msg)
+	}
+	if bus != nil {
+		bus.send(msg)
+	}
+	if syslogOut != nil {
+		syslogOut.sendEvent(msg)
+	}
+	if len(webhooks) > 0 {
+		sendWebhooks(msg)
+	}
+	if n, ok := noticeOf(msg); ok {
+		notify(n)
+	}
+}
+
+// emitOutcome Emit how a job's copy of src to dst ended, other than copied.
+func (j *job) emitOutcome(op string, dst string, src string, err error) {
+	msg := eventMessage{Time: time.Now(), Op: op, Path: src, Job: j.Name, Dest: dst}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+	emit(msg)
+	if op == "failed" {
+		j.recordFailure()
+	}
+}
+
+// emitCopied Emit the "copied" message for a finished copy, with the content
+// when it is within --event-content. copied is what copyInto returned.
+func (j *job) emitCopied(dst string, src string, copied syncState) {
+	msg := eventMessage{Time: time.Now(), Op: "copied", Path: src, Job: j.Name, Dest: dst, Sha256: copied.Sha256}
+	if stat, err := os.Stat(src); err == nil {
+		msg.Size = stat.Size()
+		if msg.Size > 0 && msg.Size <= eventContent {
+			msg.Data, _ = os.ReadFile(src)
+		}
+	}
+	emit(msg)
+	j.recordHistory(dst, src, copied)
+}
+
+// syncedCopy Record a copy made by a full sync, which isn't emitted as an
+// event like the copies of changes are, in the audit log and the history.
+func (j *job) syncedCopy(dst string, src string, copied syncState) {
+	if audit != nil {
+		auditMessage(eventMessage{Time: time.Now(), Op: "copied", Path: src, Job: j.Name, Dest: dst, Size: copied.Size, Sha256: copied.Sha256})
+	}
+	j.recordHistory(dst, src, copied)
+}
+
+// printEvent Show an event on stdout, as a JSON line with --json.
+func printEvent(ev fileEvent) {
+	tracef(ev.Path, "event %s %s", ev.Op, ev.Path)
+	if currentLevel() < levelInfo {
+		return
+	}
+	if opts.JSON {
+		json.NewEncoder(logOut).Encode(ev)
+		return
+	}
+	fmt.Fprintln(logOut, ev)
+}
+
+// replayEvents Feed events recorded with --json (from a file or "-" for
+// stdin) into out instead of watching, keeping their original spacing.
+func replayEvents(path string, out chan<- fileEvent) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var prev time.Time
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var ev fileEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil || ev.Path == "" {
+			continue
+		}
+		if !prev.IsZero() && ev.Time.After(prev) {
+			time.Sleep(ev.Time.Sub(prev))
+		}
+		prev = ev.Time
+		ev.Time = time.Now()
+		out <- ev
+	}
+	return scanner.Err()
+}
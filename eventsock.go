@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// eventClient One reader of the --event-socket, fed through its own buffer
+// so a slow reader never holds up copying.
+type eventClient struct {
+	conn  net.Conn
+	lines chan []byte
+}
+
+var eventClients struct {
+	sync.Mutex
+	list map[*eventClient]bool
+}
+
+// removeStaleSocket Remove a socket left behind by an unclean exit. Anything
+// else at path, or a socket still being served, is left alone.
+func removeStaleSocket(path string) error {
+	stat, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Windows reports some sockets as irregular files
+	if stat.Mode()&(os.ModeSocket|os.ModeIrregular) == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// startEventSocket Listen on a Unix socket (also available on Windows 10+)
+// and send every client a JSON line per event and finished copy.
+func startEventSocket(path string) error {
+	if err := guardSource(path); err != nil {
+		return err
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	eventClients.list = make(map[*eventClient]bool)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c := &eventClient{conn: conn, lines: make(chan []byte, 1024)}
+			eventClients.Lock()
+			eventClients.list[c] = true
+			eventClients.Unlock()
+			go c.run()
+		}
+	}()
+	return nil
+}
+
+func (c *eventClient) run() {
+	defer c.drop()
+	for line := range c.lines {
+		c.conn.SetWriteDeadline(time.Now().Add(time.Minute))
+		if _, err := c.conn.Write(line); err != nil {
+			return
+		}
+	}
+}
+
+func (c *eventClient) drop() {
+	eventClients.Lock()
+	delete(eventClients.list, c)
+	eventClients.Unlock()
+	c.conn.Close()
+}
+
+// sendEventSocket Queue msg for every connected client. A client that has
+// fallen 1024 lines behind is disconnected.
+func sendEventSocket(msg eventMessage) {
+	eventClients.Lock()
+	defer eventClients.Unlock()
+	if len(eventClients.list) == 0 {
+		return
+	}
+
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	for c := range eventClients.list {
+		select {
+		case c.lines <- line:
+		default:
+			warnf("event socket: dropping a reader that fell behind")
+			delete(eventClients.list, c)
+			close(c.lines)
+		}
+	}
+}
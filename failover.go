@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// failoverProbe How often a primary that failed over is checked for its return.
+const failoverProbe = 30 * time.Second
+
+// failoverSink Writes to the primary destination until a request to it has
+// failed --failover-after times in a row, then to the first fallback that
+// works.
+// Files that went to a fallback are queued again from their source once the
+// primary answers, and files removed meanwhile are removed from it. That list
+// is kept in .watch-failover in the first local fallback, so it survives a
+// restart.
+type failoverSink struct {
+	job       *job
+	primary   Sink
+	fallbacks []Sink
+	dests     []string
+
+	mu      sync.Mutex
+	down    bool
+	pending map[string]pendingChange // by name
+	store   *kvStore
+}
+
+// pendingChange What the primary missed of a file while failed over: a copy
+// from Source, or its removal.
+type pendingChange struct {
+	Source string `json:"source,omitempty"`
+	Remove bool   `json:"remove,omitempty"`
+}
+
+func (j *job) openFailover() (Sink, error) {
+	f := &failoverSink{job: j, dests: append([]string{j.Dest}, j.Fallback...), pending: make(map[string]pendingChange)}
+	for i, dest := range f.dests {
+		s, err := openDest(dest)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			f.primary = s
+		} else {
+			f.fallbacks = append(f.fallbacks, s)
+		}
+	}
+	if err := f.openPending(); err != nil {
+		return nil, err
+	}
+	go f.watchPrimary()
+	return f, nil
+}
+
+// openPending Load what an earlier run failed over and did not reconcile.
+func (f *failoverSink) openPending() error {
+	for _, s := range f.fallbacks {
+		local, ok := s.(*localSink)
+		if !ok || !IsDir(local.root) {
+			continue
+		}
+		store, err := openStore(filepath.Join(local.root, ".watch-failover"))
+		if err != nil {
+			return err
+		}
+		for _, name := range store.Keys() {
+			var c pendingChange
+			if store.Get(name, &c) {
+				f.pending[name] = c
+			}
+		}
+		f.store = store
+		return nil
+	}
+	return nil
+}
+
+// note Remember a change the primary missed. The lock must be held.
+func (f *failoverSink) note(name string, c pendingChange) {
+	f.pending[name] = c
+	if f.store == nil {
+		return
+	}
+	if err := f.store.Put(name, c); err != nil {
+		warnf("job %s: failover: %v", f.job.Name, err)
+	}
+}
+
+// forget Drop a change that reached the primary. The lock must be held.
+func (f *failoverSink) forget(name string) {
+	delete(f.pending, name)
+	if f.store != nil {
+		f.store.Delete(name)
+	}
+}
+
+// openDest A sink for a URL or, for fallbacks, a local directory.
+func openDest(dest string) (Sink, error) {
+	if isRemote(dest) {
+		return openSink(dest)
+	}
+	return &localSink{root: dest}, nil
+}
+
+// reachable err says nothing against the destination being there.
+func reachable(err error) bool {
+	return err == nil || os.IsNotExist(err) || errors.Is(err, errNoStat)
+}
+
+// run Do op on the primary while it is up, otherwise on the fallbacks in
+// order. It reports whether the primary served.
+func (f *failoverSink) run(op func(s Sink, primary bool) error) (bool, error) {
+	f.mu.Lock()
+	down := f.down
+	f.mu.Unlock()
+
+	var err error
+	if !down {
+		for attempt := 1; attempt <= opts.FailoverAfter; attempt++ {
+			if err = op(f.primary, true); reachable(err) {
+				return true, err
+			}
+			if attempt < opts.FailoverAfter {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+		f.mu.Lock()
+		if !f.down {
+			f.down = true
+			warnf("job %s: %s failed %d times (%v), failing over to %s", f.job.Name, f.dests[0], opts.FailoverAfter, err, f.dests[1])
+		}
+		f.mu.Unlock()
+	}
+
+	for _, s := range f.fallbacks {
+		if err = op(s, false); reachable(err) {
+			return false, err
+		}
+	}
+	return false, err
+}
+
+func (f *failoverSink) EnsureDir(dir string) error {
+	_, err := f.run(func(s Sink, _ bool) error { return s.EnsureDir(dir) })
+	return err
+}
+
+func (f *failoverSink) WriteFile(name string, src string) error {
+	return f.writeFrom(name, src, src)
+}
+
+// writeFrom Upload the local file upload, built from the source file src
+// (the same file unless the copy is transformed).
+func (f *failoverSink) writeFrom(name string, upload string, src string) error {
+	primary, err := f.run(func(s Sink, primary bool) error {
+		if !primary {
+			// the directory may only have been made on the primary
+			if dir := path.Dir(name); dir != "." {
+				if err := s.EnsureDir(dir); err != nil {
+					return err
+				}
+			}
+		}
+		return s.WriteFile(name, upload)
+	})
+	if err == nil && !primary {
+		f.mu.Lock()
+		f.note(name, pendingChange{Source: src})
+		f.mu.Unlock()
+	}
+	return err
+}
+
+func (f *failoverSink) Remove(name string) error {
+	primary, err := f.run(func(s Sink, _ bool) error { return s.Remove(name) })
+	if err == nil && !primary {
+		f.mu.Lock()
+		f.note(name, pendingChange{Remove: true})
+		f.mu.Unlock()
+	}
+	return err
+}
+
+func (f *failoverSink) Stat(name string) (sinkStat, error) {
+	var st sinkStat
+	_, err := f.run(func(s Sink, _ bool) (err error) {
+		st, err = s.Stat(name)
+		return err
+	})
+	return st, err
+}
+
+// watchPrimary While failed over, check the primary every failoverProbe and
+// reconcile once it answers again.
+func (f *failoverSink) watchPrimary() {
+	for range time.Tick(failoverProbe) {
+		f.mu.Lock()
+		// what an earlier run left is brought over once the primary answers
+		idle := !f.down && len(f.pending) == 0
+		f.mu.Unlock()
+		if idle {
+			continue
+		}
+		if err := probeSink(f.primary); err != nil {
+			debugf("job %s: %s still unreachable: %v", f.job.Name, f.dests[0], err)
+			continue
+		}
+
+		f.mu.Lock()
+		f.down = false
+		pending := make(map[string]pendingChange, len(f.pending))
+		for name, c := range f.pending {
+			pending[name] = c
+		}
+		f.mu.Unlock()
+
+		names := make([]string, 0, len(pending))
+		for name := range pending {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		// the copies go through the job's queue, retries included
+		infof("job %s: %s is back, bringing over %d changes made on the fallback", f.job.Name, f.dests[0], len(names))
+		for _, name := range names {
+			c := pending[name]
+			switch {
+			case c.Remove:
+				if err := f.primary.Remove(name); err != nil {
+					warnf("job %s: remove %s from %s: %v", f.job.Name, name, f.dests[0], err)
+					continue
+				}
+			case IsFile(c.Source):
+				f.job.queue.push(&copyTask{job: f.job, src: c.Source, dst: name, due: time.Now()})
+			}
+			f.mu.Lock()
+			// unless it changed again meanwhile
+			if f.pending[name] == c {
+				f.forget(name)
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+// probeSink Whether s answers: a stat, or for a destination that can't stat,
+// a request it has to serve.
+func probeSink(s Sink) error {
+	_, err := s.Stat(".watch-probe")
+	if !errors.Is(err, errNoStat) {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if p, ok := s.(interface{ Ping() error }); ok {
+		return p.Ping()
+	}
+	return s.EnsureDir(".")
+}
+
+// localSink A local directory used as a sink, for failover between local and
+// remote destinations. Copies are written to a temp name and renamed.
+type localSink struct {
+	root string
+}
+
+func (s *localSink) local(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *localSink) EnsureDir(dir string) error {
+	// a missing root is an unplugged or unmounted disk, not a folder to make
+	if !IsDir(s.root) {
+		return fmt.Errorf("copy target dir is not exists %s", s.root)
+	}
+	return mkdirAll(s.local(dir))
+}
+
+func (s *localSink) WriteFile(name string, src string) error {
+	if !IsDir(s.root) {
+		return fmt.Errorf("copy target dir is not exists %s", s.root)
+	}
+	dst := s.local(name)
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".watch-tmp")
+	if _, err := copyFile(tmp, src); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func (s *localSink) Remove(name string) error {
+	err := os.Remove(s.local(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localSink) Stat(name string) (sinkStat, error) {
+	if !IsDir(s.root) {
+		return sinkStat{}, fmt.Errorf("copy target dir is not exists %s", s.root)
+	}
+	stat, err := os.Stat(s.local(name))
+	if err != nil {
+		return sinkStat{}, err
+	}
+	return sinkStat{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
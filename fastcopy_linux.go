@@ -0,0 +1,13 @@
+package main
+
+import "os"
+
+// copyData The kernel moves the bytes with copy_file_range, or sendfile
+// across filesystems, without passing them through user space.
+func copyData(dst *os.File, src *os.File) (int64, error) {
+	return dst.ReadFrom(src)
+}
+
+func systemCopy(dstFileName string, srcFileName string) (int64, bool) {
+	return 0, false
+}
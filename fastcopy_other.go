@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+
+package main
+
+import "os"
+
+func copyData(dst *os.File, src *os.File) (int64, error) {
+	return bufferedCopy(dst, src)
+}
+
+func systemCopy(dstFileName string, srcFileName string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// parseOptions Bind the tagged fields of opts to a flag set and parse args.
+// Flags and positional arguments may be mixed; positionals are returned in order.
+func parseOptions(args []string) ([]string, error) {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	registerOptions(fs, &opts)
+
+	positional := make([]string, 0)
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	return positional, nil
+}
+
+// givenOptions The options set in args, as --name=value with their long
+// names, leaving out the ones named in skip.
+func givenOptions(args []string, skip ...string) ([]string, error) {
+	var given options
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	registerOptions(fs, &given)
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if len(fs.Args()) == 0 {
+			break
+		}
+		args = fs.Args()[1:]
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	skipped := make(map[string]bool)
+	for _, name := range skip {
+		skipped[name] = true
+	}
+
+	rv := reflect.ValueOf(&given).Elem()
+	rt := rv.Type()
+	flags := make([]string, 0)
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		long := field.Tag.Get("long")
+		if long == "" || skipped[long] {
+			continue
+		}
+		if !set[long] && (field.Tag.Get("short") == "" || !set[field.Tag.Get("short")]) {
+			continue
+		}
+		if list, ok := rv.Field(i).Interface().([]string); ok {
+			for _, v := range list {
+				flags = append(flags, "--"+long+"="+v)
+			}
+			continue
+		}
+		flags = append(flags, fmt.Sprintf("--%s=%v", long, rv.Field(i).Interface()))
+	}
+
+	return flags, nil
+}
+
+// registerOptions Register every field carrying a long tag (and its short alias).
+func registerOptions(fs *flag.FlagSet, v interface{}) {
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		long := field.Tag.Get("long")
+		if long == "" {
+			continue
+		}
+
+		names := []string{long}
+		if short := field.Tag.Get("short"); short != "" {
+			names = append(names, short)
+		}
+
+		desc := field.Tag.Get("description")
+		ptr := rv.Field(i).Addr().Interface()
+		for _, name := range names {
+			switch p := ptr.(type) {
+			case *bool:
+				fs.BoolVar(p, name, *p, desc)
+			case *string:
+				fs.StringVar(p, name, *p, desc)
+			case *int:
+				fs.IntVar(p, name, *p, desc)
+			case *int64:
+				fs.Int64Var(p, name, *p, desc)
+			case *float64:
+				fs.Float64Var(p, name, *p, desc)
+			case *[]string:
+				fs.Var((*stringList)(p), name, desc)
+			}
+		}
+	}
+}
+
+// stringList An option that may be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// optionsUsage Render the option list from the struct tags.
+func optionsUsage(v interface{}) string {
+	rt := reflect.TypeOf(v).Elem()
+	var b strings.Builder
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		long := field.Tag.Get("long")
+		if long == "" {
+			continue
+		}
+
+		name := "    --" + long
+		if short := field.Tag.Get("short"); short != "" {
+			name = "-" + short + ", --" + long
+		}
+		if field.Type.Kind() != reflect.Bool {
+			name += " <arg>"
+		}
+
+		fmt.Fprintf(&b, "  %-28s %s\n", name, field.Tag.Get("description"))
+	}
+
+	return b.String()
+}
+
+// parseBool Lenient yes/no parsing used by the interactive prompts.
+func parseBool(s string) bool {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "y" || s == "yes" {
+		return true
+	}
+	b, _ := strconv.ParseBool(s)
+	return b
+}
+
+// parseSize Parse sizes like 512, 64K, 10M or 2G (powers of 1024).
+func parseSize(arg string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(arg))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", arg)
+	}
+	return int64(n * float64(mult)), nil
+}
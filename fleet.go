@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// instance A running watcher as it lists itself in the --registry folder,
+// for watch fleet.
+type instance struct {
+	Name    string          `json:"name"`
+	Host    string          `json:"host,omitempty"`
+	PID     int             `json:"pid"`
+	Socket  string          `json:"control_socket,omitempty"`
+	HTTP    string          `json:"http,omitempty"`
+	Started time.Time       `json:"started"`
+	Jobs    []registeredJob `json:"jobs,omitempty"`
+}
+
+type registeredJob struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
+}
+
+// registered The file this watcher listed itself in, removed on exit, and
+// the name it is listed by.
+var registered, registeredName string
+
+// register List this watcher in the registry folder dir, by its control
+// socket and --http address, which it needs at least one of. Without
+// --service-name it is named after its first source, and a name another
+// running instance has is made unique with the PID.
+func register(dir string) error {
+	socket := controlSocket()
+	if socket == "" && opts.HTTP == "" {
+		return fmt.Errorf("--registry needs a --control-socket or --http to be reached by")
+	}
+	if socket != "" {
+		abs, err := filepath.Abs(socket)
+		if err != nil {
+			return err
+		}
+		socket = abs
+	}
+	host, _ := os.Hostname()
+	in := instance{Name: registeredName, Host: host, PID: os.Getpid(), Socket: socket, HTTP: opts.HTTP, Started: started}
+	for _, j := range runningJobs() {
+		in.Jobs = append(in.Jobs, registeredJob{Name: j.Name, Source: j.Source, Dest: j.Dest})
+	}
+	if in.Name == "" {
+		in.Name = instanceName(dir, in)
+	}
+	data, err := json.MarshalIndent(in, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the start time tells apart instances with the same PID, on other
+	// hosts or in other containers
+	path := registered
+	if path == "" {
+		path = filepath.Join(dir, fmt.Sprintf("%s-%d-%d.json", in.Name, in.PID, in.Started.UnixNano()))
+	}
+	if err = guardSource(path); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err = os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	registered, registeredName = path, in.Name
+	return nil
+}
+
+// instanceName --service-name, or watch-<first source folder>, with the PID
+// added when a running instance in dir has that name already.
+func instanceName(dir string, in instance) string {
+	name := opts.ServiceName
+	if name == "watch" && len(in.Jobs) > 0 {
+		name = "watch-" + filepath.Base(in.Jobs[0].Source)
+	}
+	for _, other := range readRegistry(dir) {
+		if other.Name == name {
+			return fmt.Sprintf("%s-%d", name, in.PID)
+		}
+	}
+	return name
+}
+
+// readRegistry The instances listed in dir. Entries of instances on this
+// host that are no longer running are removed.
+func readRegistry(dir string) []instance {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		warnf("registry %s: %v", dir, err)
+		return nil
+	}
+	host, _ := os.Hostname()
+	var list []instance
+	for _, f := range files {
+		var in instance
+		data, err := os.ReadFile(f)
+		if err == nil {
+			err = json.Unmarshal(data, &in)
+		}
+		if err != nil {
+			warnf("registry %s: %v", f, err)
+			continue
+		}
+		if in.Host == host && in.PID > 0 && !processAlive(in.PID) {
+			os.Remove(f)
+			continue
+		}
+		list = append(list, in)
+	}
+	return list
+}
+
+func unregister() {
+	if registered != "" {
+		os.Remove(registered)
+	}
+}
+
+// fleetRow How one instance is doing, for the fleet table.
+type fleetRow struct {
+	Instance instance      `json:"instance"`
+	Status   *statusReport `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// fleetCommand watch fleet [--registry dir] [--json] [socket...]
+// Ask every watcher listed in the registry, and those on the given control
+// sockets, how it is doing, and show them in one table.
+func fleetCommand(args []string) int {
+	sockets, err := parseOptions(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	dir := registryDir()
+	if dir == "" && len(sockets) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: watch fleet [--registry dir] [--json] [socket...]")
+		return 2
+	}
+
+	var list []instance
+	if dir != "" {
+		list = readRegistry(dir)
+	}
+	for _, s := range sockets {
+		list = append(list, instance{Name: filepath.Base(s), Socket: s})
+	}
+
+	rows := make([]fleetRow, len(list))
+	done := make(chan struct{})
+	for i := range list {
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+			rows[i].Instance = list[i]
+			data, err := askInstance(list[i])
+			var r statusReport
+			if err == nil {
+				err = json.Unmarshal(data, &r)
+			}
+			if err != nil {
+				rows[i].Error = err.Error()
+				return
+			}
+			rows[i].Status = &r
+		}(i)
+	}
+	for range list {
+		<-done
+	}
+	sort.SliceStable(rows, func(a, b int) bool { return rows[a].Instance.Name < rows[b].Instance.Name })
+
+	if opts.JSON {
+		json.NewEncoder(os.Stdout).Encode(rows)
+		return 0
+	}
+	printFleet(rows)
+	for _, r := range rows {
+		if r.Error != "" {
+			return 1
+		}
+	}
+	return 0
+}
+
+// registryDir The --registry folder, or WATCH_REGISTRY without one.
+func registryDir() string {
+	if opts.Registry != "" {
+		return opts.Registry
+	}
+	return os.Getenv("WATCH_REGISTRY")
+}
+
+// askInstance The status of a watcher, over its control socket or else its
+// --http address.
+func askInstance(in instance) ([]byte, error) {
+	if in.Socket != "" {
+		return askControl(in.Socket, "status")
+	}
+	return fetchStatus(in.HTTP)
+}
+
+// printFleet One line per job of every instance, e.g.
+//
+//	INSTANCE  PID   UP      JOB      SOURCE      DEST         QUEUED  COPIED  FAILED  STATE
+//	photos    4121  26h4m   default  /srv/photo  sftp://nas/  2       1841    1       ok
+func printFleet(rows []fleetRow) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tPID\tUP\tJOB\tSOURCE\tDEST\tQUEUED\tCOPIED\tFAILED\tSTATE")
+	var queued int
+	var copied, failed int64
+	for _, r := range rows {
+		pid := "-"
+		if r.Instance.PID > 0 {
+			pid = strconv.Itoa(r.Instance.PID)
+		}
+		if r.Status == nil {
+			// what it was running, as it registered
+			registeredJobs := r.Instance.Jobs
+			if len(registeredJobs) == 0 {
+				registeredJobs = []registeredJob{{Name: "-", Source: "-", Dest: "-"}}
+			}
+			for _, j := range registeredJobs {
+				fmt.Fprintf(w, "%s\t%s\t-\t%s\t%s\t%s\t-\t-\t-\tdown: %s\n", r.Instance.Name, pid, j.Name, j.Source, j.Dest, r.Error)
+			}
+			continue
+		}
+		up := (time.Duration(r.Status.Uptime) * time.Second).String()
+		for _, j := range r.Status.Jobs {
+			state := "ok"
+			switch {
+			case r.Status.Maintenance != nil:
+				state = "maintenance"
+			case !j.Reachable:
+				state = "unreachable"
+			case j.Paused:
+				state = "paused"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n",
+				r.Instance.Name, pid, up, j.Name, j.Source, j.Dest, j.Queued, j.Copied, j.Failed, state)
+			queued, copied, failed = queued+j.Queued, copied+j.Copied, failed+j.Failed
+		}
+	}
+	fmt.Fprintf(w, "total\t\t\t\t\t\t%d\t%d\t%d\t%s\n", queued, copied, failed, fleetHealth(rows))
+	w.Flush()
+}
+
+// fleetHealth e.g. "3 instances, 1 down".
+func fleetHealth(rows []fleetRow) string {
+	down := 0
+	for _, r := range rows {
+		if r.Status == nil {
+			down++
+		}
+	}
+	text := fmt.Sprintf("%d instances", len(rows))
+	if len(rows) == 1 {
+		text = "1 instance"
+	}
+	if down > 0 {
+		text += fmt.Sprintf(", %d down", down)
+	}
+	return text
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gcsChunk Resumable uploads send this much per request (a multiple of 256K).
+const gcsChunk = 16 << 20
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsSink gs://bucket/prefix through the JSON API. Credentials are looked up
+// the way Google's SDKs do: GOOGLE_APPLICATION_CREDENTIALS, then the gcloud
+// application default credentials, then the metadata server on GCE, GKE
+// and Cloud Run. STORAGE_EMULATOR_HOST points at an emulator instead.
+type gcsSink struct {
+	client *http.Client
+	base   string
+	bucket string
+	prefix string
+	token  *bearerToken
+}
+
+func newGCSSink(u *url.URL) (Sink, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: missing bucket", u.Redacted())
+	}
+
+	s := &gcsSink{
+		// a 308 asks for the next chunk of a resumable upload, it is no redirect
+		client: &http.Client{Timeout: 10 * time.Minute, CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}},
+		base:   "https://storage.googleapis.com",
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+	}
+	if emulator := os.Getenv("STORAGE_EMULATOR_HOST"); emulator != "" {
+		if !strings.Contains(emulator, "://") {
+			emulator = "http://" + emulator
+		}
+		s.base = strings.TrimSuffix(emulator, "/")
+		return s, nil
+	}
+
+	token, err := googleCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", u.Redacted(), err)
+	}
+	s.token = token
+	return s, nil
+}
+
+// googleCredentials Application default credentials.
+func googleCredentials() (*bearerToken, error) {
+	file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if file == "" && IsFile(gcloudADC()) {
+		file = gcloudADC()
+	}
+
+	if file == "" {
+		// the metadata server of the VM or container
+		return &bearerToken{fetch: func() (*http.Request, error) {
+			req, err := http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token?scopes="+gcsScope, nil)
+			if err == nil {
+				req.Header.Set("Metadata-Flavor", "Google")
+			}
+			return req, err
+		}}, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var creds struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err = json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	switch creds.Type {
+	case "authorized_user":
+		return &bearerToken{fetch: func() (*http.Request, error) {
+			return formRequest(creds.TokenURI, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {creds.ClientID},
+				"client_secret": {creds.ClientSecret},
+				"refresh_token": {creds.RefreshToken},
+			})
+		}}, nil
+	case "service_account":
+		key, err := parseRSAKey(creds.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		return &bearerToken{fetch: func() (*http.Request, error) {
+			assertion, err := signJWT(key, map[string]interface{}{
+				"iss":   creds.ClientEmail,
+				"scope": gcsScope,
+				"aud":   creds.TokenURI,
+				"iat":   time.Now().Unix(),
+				"exp":   time.Now().Add(time.Hour).Unix(),
+			})
+			if err != nil {
+				return nil, err
+			}
+			return formRequest(creds.TokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}}, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported credentials type %q", file, creds.Type)
+}
+
+// gcloudADC Where gcloud auth application-default login saves credentials.
+func gcloudADC() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud", "application_default_credentials.json")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+}
+
+func parseRSAKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("no PEM private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not RSA")
+	}
+	return key, nil
+}
+
+// signJWT An RS256 JSON web token with the given claims.
+func signJWT(key *rsa.PrivateKey, claims map[string]interface{}) (string, error) {
+	enc := base64.RawURLEncoding
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString(payload)
+
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+func (s *gcsSink) object(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *gcsSink) do(method string, target string, body func() (io.Reader, int64), header http.Header) (*http.Response, error) {
+	return sinkRequest(s.client, func() (*http.Request, error) {
+		req, err := newBodyRequest(method, target, body)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if s.token != nil {
+			token, err := s.token.get()
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return req, nil
+	})
+}
+
+func (s *gcsSink) objectURL(name string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", s.base, url.PathEscape(s.bucket), url.PathEscape(s.object(name)))
+}
+
+// EnsureDir Object stores have no folders.
+func (s *gcsSink) EnsureDir(dir string) error {
+	return nil
+}
+
+func (s *gcsSink) Stat(name string) (sinkStat, error) {
+	resp, err := s.do("GET", s.objectURL(name), nil, nil)
+	if err != nil {
+		return sinkStat{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return sinkStat{}, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return sinkStat{}, fmt.Errorf("gcs stat %s: %s", name, resp.Status)
+	}
+
+	var obj struct {
+		Size    string    `json:"size"`
+		Updated time.Time `json:"updated"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return sinkStat{}, err
+	}
+	size, _ := strconv.ParseInt(obj.Size, 10, 64)
+	return sinkStat{Size: size, ModTime: obj.Updated}, nil
+}
+
+func (s *gcsSink) Remove(name string) error {
+	resp, err := s.do("DELETE", s.objectURL(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("gcs delete %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+// WriteFile A single request for small files, a resumable upload in
+// gcsChunk pieces for the rest.
+func (s *gcsSink) WriteFile(name string, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	header := http.Header{"Content-Type": {contentType(f, name)}}
+	upload := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?name=%s", s.base, url.PathEscape(s.bucket), url.QueryEscape(s.object(name)))
+
+	if size <= gcsChunk {
+		body := func() (io.Reader, int64) { return throttle(io.NewSectionReader(f, 0, size)), size }
+		resp, err := s.do("POST", upload+"&uploadType=media", body, header)
+		if err != nil {
+			return err
+		}
+		return gcsDone(resp, name)
+	}
+
+	resp, err := s.do("POST", upload+"&uploadType=resumable", nil, http.Header{"X-Upload-Content-Type": header["Content-Type"]})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusOK || session == "" {
+		return fmt.Errorf("gcs upload %s: %s", name, resp.Status)
+	}
+
+	for off := int64(0); off < size; off += gcsChunk {
+		n := size - off
+		if n > gcsChunk {
+			n = gcsChunk
+		}
+		start := off
+		body := func() (io.Reader, int64) { return throttle(io.NewSectionReader(f, start, n)), n }
+		resp, err := s.do("PUT", session, body, http.Header{"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", off, off+n-1, size)}})
+		if err != nil {
+			return err
+		}
+		// 308 asks for the next chunk
+		if resp.StatusCode == http.StatusPermanentRedirect {
+			resp.Body.Close()
+			continue
+		}
+		return gcsDone(resp, name)
+	}
+	return fmt.Errorf("gcs upload %s: incomplete", name)
+}
+
+func gcsDone(resp *http.Response, name string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("gcs upload %s: %s %s", name, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// VersionsAt From the object generations, listed with versions=true. A
+// generation was current from its timeCreated until its timeDeleted.
+func (s *gcsSink) VersionsAt(prefix string, at time.Time) ([]objectVersions, error) {
+	list := s.object(prefix)
+	if prefix == "" && s.prefix != "" {
+		list = s.prefix + "/"
+	}
+
+	byName := make(map[string]*objectVersions)
+	token := ""
+	for {
+		target := fmt.Sprintf("%s/storage/v1/b/%s/o?versions=true&prefix=%s", s.base, url.PathEscape(s.bucket), url.QueryEscape(list))
+		if token != "" {
+			target += "&pageToken=" + url.QueryEscape(token)
+		}
+		resp, err := s.do("GET", target, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("gcs list %s: %s", list, resp.Status)
+		}
+		var page struct {
+			Items []struct {
+				Name        string    `json:"name"`
+				Generation  string    `json:"generation"`
+				TimeCreated time.Time `json:"timeCreated"`
+				TimeDeleted time.Time `json:"timeDeleted"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range page.Items {
+			o := byName[item.Name]
+			if o == nil {
+				o = &objectVersions{Name: strings.TrimPrefix(strings.TrimPrefix(item.Name, s.prefix), "/")}
+				byName[item.Name] = o
+			}
+			if item.TimeDeleted.IsZero() {
+				o.Current = item.Generation
+			}
+			if !item.TimeCreated.After(at) && (item.TimeDeleted.IsZero() || item.TimeDeleted.After(at)) {
+				o.At = item.Generation
+			}
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		token = page.NextPageToken
+	}
+
+	objects := make([]objectVersions, 0, len(byName))
+	for _, o := range byName {
+		objects = append(objects, *o)
+	}
+	return objects, nil
+}
+
+// RestoreVersion Rewrite the old generation over the object, which makes it
+// the live generation and keeps the history in between. Large objects take
+// several rewrite calls.
+func (s *gcsSink) RestoreVersion(name string, generation string) error {
+	target := fmt.Sprintf("%s/rewriteTo/b/%s/o/%s?sourceGeneration=%s", s.objectURL(name), url.PathEscape(s.bucket), url.PathEscape(s.object(name)), url.QueryEscape(generation))
+	token := ""
+	for {
+		call := target
+		if token != "" {
+			call += "&rewriteToken=" + url.QueryEscape(token)
+		}
+		resp, err := s.do("POST", call, nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			return fmt.Errorf("gcs rewrite %s generation %s: %s %s", name, generation, resp.Status, strings.TrimSpace(string(msg)))
+		}
+		var rewrite struct {
+			Done         bool   `json:"done"`
+			RewriteToken string `json:"rewriteToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&rewrite)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if rewrite.Done {
+			return nil
+		}
+		token = rewrite.RewriteToken
+	}
+}
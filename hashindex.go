@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+)
+
+// hashRecord What the hash index remembers about the last copy to a path.
+type hashRecord struct {
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+var hashIndex *kvStore
+
+// sameContent The last copy to dstFileName had the content srcFileName has
+// now and is still in place. The hash is returned for indexing the copy.
+func sameContent(dstFileName string, srcFileName string) (bool, string) {
+	if hashIndex == nil {
+		return false, ""
+	}
+
+	sum, err := fileSha256(srcFileName)
+	if err != nil {
+		return false, ""
+	}
+
+	var rec hashRecord
+	if !hashIndex.Get(dstFileName, &rec) || rec.Sha256 != sum {
+		return false, sum
+	}
+
+	stat, err := os.Stat(dstFileName)
+	return err == nil && stat.Size() == rec.Size, sum
+}
+
+// indexCopy Remember the content now at dstFileName.
+func indexCopy(dstFileName string, sum string) error {
+	if hashIndex == nil || sum == "" {
+		return nil
+	}
+
+	stat, err := os.Stat(dstFileName)
+	if err != nil {
+		return err
+	}
+	return hashIndex.Put(dstFileName, hashRecord{Sha256: sum, Size: stat.Size()})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/botsphp/fsnotify"
+)
+
+// healthCache How long a destination check is reused, so frequent probes
+// don't turn into a stream of requests to remote destinations.
+const healthCache = 10 * time.Second
+
+var (
+	started = time.Now()
+
+	rootsMu sync.Mutex
+	roots   = make(map[string]os.FileInfo) // watched path, as it was when added
+)
+
+// watchRoot Watch p and remember what it was, so a root deleted or replaced
+// since, which the watch doesn't survive, can be told.
+func watchRoot(watcher *fsnotify.Watcher, p string) error {
+	if err := watcher.Watch(p); err != nil {
+		return err
+	}
+	stat, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	rootsMu.Lock()
+	roots[p] = stat
+	rootsMu.Unlock()
+	return nil
+}
+
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status       string        `json:"status"` // ok, maintenance or failing
+	Uptime       int64         `json:"uptime_seconds"`
+	Roots        []healthCheck `json:"roots,omitempty"`
+	Destinations []healthCheck `json:"destinations,omitempty"`
+}
+
+// destHealth The last destination check of a job.
+type destHealth struct {
+	at  time.Time
+	err error
+}
+
+var (
+	destHealthMu sync.Mutex
+	destChecks   = make(map[*job]destHealth)
+)
+
+// reachableDest Whether the job's destination answers. Remote ones are
+// checked at most once per healthCache.
+func (j *job) reachableDest() error {
+	if j.sink == nil {
+		if opts.Archive == "" && !IsDir(j.Dest) {
+			return fmt.Errorf("%s is not there", j.Dest)
+		}
+		return nil
+	}
+
+	destHealthMu.Lock()
+	last, ok := destChecks[j]
+	destHealthMu.Unlock()
+	if ok && time.Since(last.at) < healthCache {
+		return last.err
+	}
+
+	err := probeSink(j.sink)
+	destHealthMu.Lock()
+	destChecks[j] = destHealth{at: time.Now(), err: err}
+	destHealthMu.Unlock()
+	return err
+}
+
+// health Check that every job's source is still the one watched and every
+// destination is reachable.
+func health() healthReport {
+	r := healthReport{Status: "ok", Uptime: int64(time.Since(started).Seconds())}
+
+	// only the sources: a subfolder deleted since it was watched is a change,
+	// not a failure
+	sources := make(map[string]bool)
+	for _, j := range runningJobs() {
+		sources[j.Source] = true
+	}
+	rootsMu.Lock()
+	for p, stat := range roots {
+		if !sources[p] {
+			continue
+		}
+		c := healthCheck{Name: p, OK: true}
+		now, err := os.Stat(p)
+		if err != nil {
+			c.Error = err.Error()
+		} else if !os.SameFile(stat, now) {
+			c.Error = "replaced since it was watched"
+		}
+		c.OK = c.Error == ""
+		r.Roots = append(r.Roots, c)
+	}
+	rootsMu.Unlock()
+	sort.Slice(r.Roots, func(a, b int) bool { return r.Roots[a].Name < r.Roots[b].Name })
+
+	on, _ := inMaintenance()
+	for _, j := range runningJobs() {
+		c := healthCheck{Name: j.Name, OK: true}
+		if on {
+			// left alone, and perhaps unmounted, on purpose
+			c.Error = "maintenance"
+		} else if err := j.reachableDest(); err != nil {
+			c.OK, c.Error = false, err.Error()
+		}
+		r.Destinations = append(r.Destinations, c)
+	}
+
+	if on {
+		r.Status = "maintenance"
+	}
+	for _, c := range append(r.Roots, r.Destinations...) {
+		if !c.OK {
+			r.Status = "failing"
+		}
+	}
+	return r
+}
+
+// serveHealth GET /healthz: 200 with status ok while the watcher is sound,
+// or maintenance while it leaves the destinations alone on purpose, 503
+// otherwise. It is open to probes, so which sources and jobs it checked, and
+// what is wrong with them, only go to requests with the --api-token.
+func serveHealth(w http.ResponseWriter, req *http.Request) {
+	r := health()
+	if !hasToken(req) {
+		r.Roots, r.Destinations = nil, nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Status == "failing" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(r)
+}
+
+// startHTTP Serve the health and status endpoints and the API on addr.
+func startHTTP(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", serveHealth)
+	mux.HandleFunc("/status", serveStatus)
+	mux.HandleFunc("/api/", serveAPI)
+
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go server.Serve(l)
+	return nil
+}
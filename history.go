@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyKeep How many of the latest copies of each source file the history
+// remembers.
+const historyKeep = 20
+
+// historyEntry One finished copy of a source file.
+type historyEntry struct {
+	Time   time.Time `json:"time"`
+	Job    string    `json:"job"`
+	Source string    `json:"source"`
+	Dest   string    `json:"dest"`
+	Size   int64     `json:"size"`
+	Sha256 string    `json:"sha256,omitempty"`
+}
+
+// history --history: the latest copies of every source file, keyed by its
+// absolute path.
+var (
+	history   *kvStore
+	historyMu sync.Mutex // between reading a file's copies and adding one
+)
+
+// historyDest The absolute destination of a copy, or its URL for remote
+// destinations, where dst is the name below the sink root.
+func (j *job) historyDest(dst string) string {
+	if j.sink != nil {
+		return strings.TrimSuffix(j.Dest, "/") + "/" + dst
+	}
+	if abs, err := filepath.Abs(dst); err == nil {
+		return abs
+	}
+	return dst
+}
+
+// recordHistory Add the copy of src to dst to the history, with the size and
+// checksum of what was copied.
+func (j *job) recordHistory(dst string, src string, copied syncState) {
+	if history == nil {
+		return
+	}
+	source, err := filepath.Abs(src)
+	if err != nil {
+		return
+	}
+	e := historyEntry{Time: time.Now(), Job: j.Name, Source: source, Dest: j.historyDest(dst),
+		Size: copied.Size, Sha256: copied.Sha256}
+
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	j.countReport(e.Time, e.Size, false)
+	var copies []historyEntry
+	history.Get(source, &copies)
+	copies = append(copies, e)
+	if len(copies) > historyKeep {
+		copies = copies[len(copies)-historyKeep:]
+	}
+	if err = history.Put(source, copies); err != nil {
+		warnf("history: %v", err)
+	}
+}
+
+// recordFailure Count a copy of src that failed for good in the report
+// totals of the history.
+func (j *job) recordFailure() {
+	if history == nil {
+		return
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	j.countReport(time.Now(), 0, true)
+}
+
+// under path is p or inside the folder p, a local path or a URL.
+func under(path string, p string) bool {
+	if path == p {
+		return true
+	}
+	for _, sep := range []string{string(filepath.Separator), "/"} {
+		if strings.HasPrefix(path, strings.TrimSuffix(p, sep)+sep) {
+			return true
+		}
+	}
+	return false
+}
+
+// historyCommand watch history --history file [--path p] [--since 24h] [--json]
+// List the recorded copies of p, a source or destination file or a folder
+// of either, newest first.
+func historyCommand(args []string) int {
+	if _, err := parseOptions(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if opts.History == "" {
+		fmt.Fprintln(os.Stderr, "usage: watch history --history file [--path p] [--since 24h] [--json]")
+		return 2
+	}
+
+	var since time.Time
+	if opts.Since != "" {
+		ago, err := parseAge(opts.Since)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		since = time.Now().Add(-ago)
+	}
+	p := opts.Path
+	if p != "" && !isRemote(p) {
+		var err error
+		if p, err = filepath.Abs(p); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	store, err := readStore(opts.History)
+	if store == nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err != nil {
+		warnf("history: %v", err)
+	}
+
+	var found []historyEntry
+	for _, key := range store.Keys() {
+		if strings.HasPrefix(key, reportKey) {
+			continue
+		}
+		var copies []historyEntry
+		if !store.Get(key, &copies) {
+			continue
+		}
+		for _, e := range copies {
+			if e.Time.Before(since) {
+				continue
+			}
+			if p == "" || under(e.Source, p) || under(e.Dest, p) {
+				found = append(found, e)
+			}
+		}
+	}
+	sort.SliceStable(found, func(a, b int) bool { return found[a].Time.After(found[b].Time) })
+
+	for _, e := range found {
+		if opts.JSON {
+			line, _ := json.Marshal(e)
+			fmt.Println(string(line))
+			continue
+		}
+		fmt.Printf("%s  %s -> %s  %d bytes  sha256 %s\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Source, e.Dest, e.Size, e.Sha256)
+	}
+	if len(found) == 0 && !opts.JSON {
+		fmt.Println("no copies recorded")
+	}
+	return 0
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// errNoStat The destination cannot tell whether or how a file is stored.
+var errNoStat = errors.New("destination cannot stat files")
+
+// httpSink http(s)://host/ingest/{path}: every file is sent to the URL with
+// its placeholders filled in, or to the URL plus its path when there are
+// none. --http-method picks PUT or POST, --http-form sends a multipart form
+// instead of the raw file, --http-header adds headers and HTTP_UPLOAD_TOKEN
+// is sent as a bearer token.
+type httpSink struct {
+	client *http.Client
+	target string
+	method string
+	form   string
+	header http.Header
+}
+
+func newHTTPSink(u *url.URL) (Sink, error) {
+	s := &httpSink{
+		client: &http.Client{Timeout: 10 * time.Minute},
+		target: u.String(),
+		method: strings.ToUpper(opts.HTTPMethod),
+		form:   opts.HTTPForm,
+		header: make(http.Header),
+	}
+	if s.method != "PUT" && s.method != "POST" {
+		return nil, fmt.Errorf("invalid --http-method %s, use PUT or POST", opts.HTTPMethod)
+	}
+
+	// the URL was parsed with its placeholders escaped
+	if unescaped, err := url.PathUnescape(s.target); err == nil {
+		s.target = unescaped
+	}
+	if !strings.Contains(s.target, "{") {
+		s.target = strings.TrimSuffix(s.target, "/") + "/{path}"
+	}
+
+	for _, h := range opts.HTTPHeader {
+		k, v, ok := strings.Cut(h, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid --http-header %q, use \"Name: value\"", h)
+		}
+		s.header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	if token := os.Getenv("HTTP_UPLOAD_TOKEN"); token != "" {
+		s.header.Set("Authorization", "Bearer "+token)
+	}
+	return s, nil
+}
+
+// url The target for name: {path} (escaped, slashes kept), {dir}, {name},
+// {ext} and {yyyy}/{mm}/{dd}/{hh} of now.
+func (s *httpSink) url(name string) string {
+	base := path.Base(name)
+	ext := path.Ext(base)
+	dir := path.Dir(name)
+	if dir == "." {
+		dir = ""
+	}
+	now := time.Now()
+
+	return strings.NewReplacer(
+		"{path}", urlEscape(name),
+		"{dir}", urlEscape(dir),
+		"{name}", urlEscape(strings.TrimSuffix(base, ext)),
+		"{ext}", urlEscape(ext),
+		"{yyyy}", now.Format("2006"),
+		"{mm}", now.Format("01"),
+		"{dd}", now.Format("02"),
+		"{hh}", now.Format("15"),
+	).Replace(s.target)
+}
+
+// urlEscape Escape every path element so it is safe in the path and the
+// query alike.
+func urlEscape(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = strings.ReplaceAll(url.QueryEscape(part), "+", "%20")
+	}
+	return strings.Join(parts, "/")
+}
+
+func (s *httpSink) do(method string, name string, body func() (io.Reader, int64), header http.Header) (*http.Response, error) {
+	return sinkRequest(s.client, func() (*http.Request, error) {
+		req, err := newBodyRequest(method, s.url(name), body)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range s.header {
+			req.Header[k] = v
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		return req, nil
+	})
+}
+
+// EnsureDir Endpoints have no folders.
+func (s *httpSink) EnsureDir(dir string) error {
+	return nil
+}
+
+func (s *httpSink) WriteFile(name string, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{"Content-Type": {contentType(f, name)}}
+	body := func() (io.Reader, int64) { return throttle(io.NewSectionReader(f, 0, stat.Size())), stat.Size() }
+
+	if s.form != "" {
+		// the form is built in memory around the file, so its length is known
+		var prefix, suffix strings.Builder
+		w := multipart.NewWriter(&prefix)
+		if _, err = w.CreateFormFile(s.form, path.Base(name)); err != nil {
+			return err
+		}
+		boundary := w.Boundary()
+		header.Set("Content-Type", w.FormDataContentType())
+		suffix.WriteString("\r\n--" + boundary + "--\r\n")
+
+		fileBody := body
+		body = func() (io.Reader, int64) {
+			r, n := fileBody()
+			return io.MultiReader(strings.NewReader(prefix.String()), r, strings.NewReader(suffix.String())), int64(prefix.Len()) + n + int64(suffix.Len())
+		}
+	}
+
+	resp, err := s.do(s.method, name, body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s %s", s.method, name, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Remove DELETE on the file's URL; endpoints without deletes are ignored.
+func (s *httpSink) Remove(name string) error {
+	resp, err := s.do("DELETE", name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusMethodNotAllowed {
+		return fmt.Errorf("DELETE %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+// Ping HEAD on the endpoint: any answer short of a server error will do.
+func (s *httpSink) Ping() error {
+	resp, err := s.do("HEAD", ".watch-probe", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Stat Ingest endpoints can't be asked, so every change is sent.
+func (s *httpSink) Stat(name string) (sinkStat, error) {
+	return sinkStat{}, errNoStat
+}
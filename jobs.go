@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// job One source tree copied into one destination directory.
+type job struct {
+	Name         string   `json:"name"`
+	Alias        string   `json:"alias,omitempty"`
+	Source       string   `json:"source"`
+	Dest         string   `json:"dest"`
+	After        []string `json:"after,omitempty"`
+	InitialSync  bool     `json:"initial_sync,omitempty"`
+	OnCollision  string   `json:"on_collision,omitempty"`
+	Conflict     string   `json:"conflict,omitempty"`
+	DestTemplate string   `json:"dest_template,omitempty"`
+	Rename       []string `json:"rename,omitempty"`
+	Fallback     []string `json:"fallback,omitempty"`
+	Include      []string `json:"include,omitempty"`
+	Exclude      []string `json:"exclude,omitempty"`
+	Schedule     string   `json:"schedule,omitempty"`
+	PauseWindows []string `json:"pause_windows,omitempty"`
+	OnCreate     string   `json:"on_create,omitempty"`
+	OnWrite      string   `json:"on_write,omitempty"`
+	OnDelete     string   `json:"on_delete,omitempty"`
+	OnRename     string   `json:"on_rename,omitempty"`
+	PreCopy      string   `json:"pre_copy,omitempty"`
+	PostCopy     string   `json:"post_copy,omitempty"`
+
+	rootDir  string
+	paths    []string
+	caps     destCaps
+	capsMu   sync.Mutex
+	unprobed int32 // the destination couldn't be probed yet
+	caseMu   sync.Mutex
+	caseSeen map[string]string
+	names    *kvStore
+	renames  []renameRule
+	sink     Sink
+	queue    *copyQueue
+	copied   int64
+	failed   int64
+	twoWay   *twoWay
+	schedule *cronSchedule
+	pauses   []timeWindow
+	state    *kvStore
+	snapMu   sync.Mutex
+	snapshot string
+	syncing  int32
+	offline  int32
+	destLost int32 // changes came while the destination was gone
+	batch    int64
+	hooks    map[string]*hook
+}
+
+// config The --config file: a list of jobs.
+type config struct {
+	Jobs []*job `json:"jobs"`
+}
+
+var jobs []*job
+
+// jobsMu Guards jobs once watching has started, as a reload replaces the
+// list. It is only ever replaced, never changed in place.
+var jobsMu sync.RWMutex
+
+// runningJobs The jobs as of now, for code that runs alongside a reload.
+func runningJobs() []*job {
+	jobsMu.RLock()
+	defer jobsMu.RUnlock()
+	return jobs
+}
+
+func newJob(name, source, dest string) *job {
+	return &job{
+		Name:     name,
+		Source:   source,
+		Dest:     dest,
+		rootDir:  sourceRoot(source),
+		caps:     defaultCaps,
+		caseSeen: make(map[string]string),
+	}
+}
+
+// loadConfig Read the jobs from a JSON config file.
+func loadConfig(path string) ([]*job, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c config
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	loaded := make([]*job, 0, len(c.Jobs))
+	for i, j := range c.Jobs {
+		if j.Name == "" {
+			j.Name = fmt.Sprintf("job%d", i+1)
+		}
+		n := newJob(j.Name, j.Source, j.Dest)
+		n.Alias = j.Alias
+		n.After = j.After
+		n.InitialSync = j.InitialSync
+		n.OnCollision = j.OnCollision
+		n.Conflict = j.Conflict
+		n.DestTemplate = j.DestTemplate
+		n.Rename = j.Rename
+		n.Fallback = j.Fallback
+		n.Include = j.Include
+		n.Exclude = j.Exclude
+		n.Schedule = j.Schedule
+		n.PauseWindows = j.PauseWindows
+		n.OnCreate = j.OnCreate
+		n.OnWrite = j.OnWrite
+		n.OnDelete = j.OnDelete
+		n.OnRename = j.OnRename
+		n.PreCopy = j.PreCopy
+		n.PostCopy = j.PostCopy
+		loaded = append(loaded, n)
+	}
+
+	return loaded, validateJobs(loaded)
+}
+
+// validateJobs Names are unique, and every dependency exists without cycles.
+func validateJobs(list []*job) error {
+	byName := make(map[string]*job)
+	for _, j := range list {
+		if j.Source == "" {
+			return fmt.Errorf("job %s: missing source", j.Name)
+		}
+		if _, ok := byName[j.Name]; ok {
+			return fmt.Errorf("job %s: duplicate name", j.Name)
+		}
+		if j.OnCollision != "" {
+			if err := validCollision(j.OnCollision); err != nil {
+				return fmt.Errorf("job %s: %v", j.Name, err)
+			}
+		}
+		if j.Conflict != "" {
+			if err := validConflict(j.Conflict); err != nil {
+				return fmt.Errorf("job %s: %v", j.Name, err)
+			}
+		}
+		if err := validTemplate(j.DestTemplate); err != nil {
+			return fmt.Errorf("job %s: %v", j.Name, err)
+		}
+		if err := validPatterns(append(j.Include, j.Exclude...)); err != nil {
+			return fmt.Errorf("job %s: %v", j.Name, err)
+		}
+		if j.Schedule != "" {
+			if _, err := parseCron(j.Schedule); err != nil {
+				return fmt.Errorf("job %s: %v", j.Name, err)
+			}
+		}
+		if _, err := parseWindows(j.PauseWindows); err != nil {
+			return fmt.Errorf("job %s: %v", j.Name, err)
+		}
+		byName[j.Name] = j
+	}
+
+	state := make(map[string]int) // 1 visiting, 2 done
+	var visit func(j *job) error
+	visit = func(j *job) error {
+		switch state[j.Name] {
+		case 1:
+			return fmt.Errorf("job %s: dependency cycle", j.Name)
+		case 2:
+			return nil
+		}
+		state[j.Name] = 1
+		for _, dep := range j.After {
+			d, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("job %s: unknown dependency %s", j.Name, dep)
+			}
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[j.Name] = 2
+		return nil
+	}
+
+	for _, j := range list {
+		if err := visit(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// root The watched root, as found when the job was built. It stays put
+// when a single watched file is deleted, which would otherwise make the
+// destination root the file's own destination.
+func (j *job) root() string {
+	if j.rootDir == "" {
+		return j.Source
+	}
+	return j.rootDir
+}
+
+// sourceRoot The watched root of a source: the folder of a single watched
+// file, which lands in the destination under its own name.
+func sourceRoot(source string) string {
+	if IsFile(source) {
+		return filepath.Dir(source)
+	}
+	return source
+}
+
+// jobsFor The jobs whose source tree contains path: those with the deepest
+// such root, several when one source fans out to several destinations.
+func jobsFor(path string) []*job {
+	path = filepath.Clean(path)
+
+	var found []*job
+	depth := -1
+	for _, j := range runningJobs() {
+		root := filepath.Clean(j.Source)
+		if path != root && !strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			continue
+		}
+		if len(root) > depth {
+			found, depth = nil, len(root)
+		}
+		if len(root) == depth {
+			found = append(found, j)
+		}
+	}
+	return found
+}
+
+// runInitialSyncs Run every job's initial sync in parallel, except that a job
+// waits for the jobs listed in its After to finish first. A job whose
+// dependency failed is skipped. It returns how many jobs failed.
+func runInitialSyncs(list []*job) int {
+	done := make(map[string]chan struct{})
+	failed := make(map[string]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, j := range list {
+		done[j.Name] = make(chan struct{})
+	}
+
+	hasFailed := func(name string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return failed[name]
+	}
+	markFailed := func(name string) {
+		mu.Lock()
+		failed[name] = true
+		mu.Unlock()
+	}
+
+	for _, j := range list {
+		wg.Add(1)
+		go func(j *job) {
+			defer wg.Done()
+			defer close(done[j.Name])
+
+			for _, dep := range j.After {
+				// a job added by a reload doesn't wait for the running ones
+				if done[dep] == nil {
+					continue
+				}
+				<-done[dep]
+				if hasFailed(dep) {
+					errorf("job %s: skipping initial sync, %s failed", j.Name, dep)
+					markFailed(j.Name)
+					return
+				}
+			}
+
+			if j.twoWay != nil && j != j.twoWay.fwd {
+				// a pair is reconciled by its forward job
+				return
+			}
+			// mirrors, snapshots and two-way pairs always start from a full comparison
+			if !j.InitialSync && !opts.InitialSync && !opts.Mirror && !opts.Snapshots && j.twoWay == nil {
+				return
+			}
+
+			atomic.StoreInt32(&j.syncing, 1)
+			defer atomic.StoreInt32(&j.syncing, 0)
+			copied := atomic.LoadInt64(&j.copied)
+			if err := j.fullSync(); err != nil {
+				errorf("job %s: initial sync: %v", j.Name, err)
+				j.notifySyncFailed("initial", err)
+				markFailed(j.Name)
+				return
+			}
+			infof("job %s: initial sync complete", j.Name)
+			j.notifySynced("initial", atomic.LoadInt64(&j.copied)-copied)
+		}(j)
+	}
+
+	wg.Wait()
+	return len(failed)
+}
+
+// fullSync Compare the whole source with the destination and bring it up to
+// date: reconcile a two-way pair, or copy what differs and, for a mirror or
+// a new snapshot, remove what the source doesn't have.
+func (j *job) fullSync() error {
+	j.waitWindow()
+	if j.twoWay != nil {
+		if j != j.twoWay.fwd {
+			return nil
+		}
+		return j.twoWay.reconcileAll()
+	}
+	if opts.Snapshots {
+		if err := j.newSnapshot(); err != nil {
+			return err
+		}
+	}
+	if err := j.initialSync(); err != nil {
+		return err
+	}
+	if opts.Mirror || opts.Snapshots {
+		return j.pruneMirror()
+	}
+	return nil
+}
+
+// initialSync Copy the whole source tree once, synchronously. Progress is
+// checkpointed, so an interrupted sync resumes after the last checkpoint
+// instead of walking and comparing everything before it again.
+func (j *job) initialSync() error {
+	if j.sink == nil && !IsDir(j.Dest) && !reconnectShare(j.Dest) {
+		return fmt.Errorf("copy target dir is not exists %s", j.Dest)
+	}
+
+	resume := j.loadCheckpoint()
+	if resume != "" {
+		infof("job %s: resuming the initial sync after %s", j.Name, resume)
+	}
+	saved := time.Now()
+
+	err := filepath.Walk(j.Source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(j.Source, path)
+		if resume != "" && rel != "." {
+			if info.IsDir() && walkBefore(rel, resume) && !strings.HasPrefix(resume, rel+string(filepath.Separator)) {
+				return filepath.SkipDir
+			}
+			if !info.IsDir() && !walkBefore(resume, rel) {
+				return nil
+			}
+		}
+
+		if err := j.syncEntry(path, info); err != nil {
+			return err
+		}
+		if !info.IsDir() && rel != "." && time.Since(saved) >= checkpointEvery {
+			j.saveCheckpoint(rel)
+			saved = time.Now()
+		}
+		return nil
+	})
+	if err == nil {
+		j.clearCheckpoint()
+	}
+	return err
+}
+
+// syncEntry Bring over one file or folder of the source tree.
+func (j *job) syncEntry(path string, info os.FileInfo) error {
+	if opts.NoRecurse && info.IsDir() && path != j.Source {
+		return filepath.SkipDir
+	}
+	if !info.IsDir() && !j.wants(path) {
+		return nil
+	}
+	if !info.IsDir() {
+		j.waitWindow()
+	}
+
+	if opts.Archive != "" {
+		if info.IsDir() {
+			return nil
+		}
+		if _, err := j.prepareCopy(path, path); err == errRefused {
+			return nil
+		}
+		if err := j.archiveFile(path); err != nil {
+			return err
+		}
+		j.postCopy(path, path)
+		return nil
+	}
+
+	if j.sink != nil {
+		if info.IsDir() {
+			return nil
+		}
+		newPath, err := j.prepareCopy(j.fileDest(path), path)
+		if err == errRefused {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if copied, err := copyInto(j, newPath, path, 0); err != nil && err != errUnchanged {
+			return err
+		} else if err == nil {
+			j.syncedCopy(newPath, path, copied)
+		}
+		j.postCopy(path, newPath)
+		return moveSource(j, newPath, path)
+	}
+
+	newPath := j.destPath(path)
+	if info.IsDir() {
+		if j.destTemplate() != "" {
+			return nil
+		}
+		return mkdirAll(newPath)
+	}
+
+	newPath = j.fileDest(path)
+	if err := mkdirAll(filepath.Dir(newPath)); err != nil {
+		return err
+	}
+	newPath, err := j.prepareCopy(newPath, path)
+	if err == errSkipped {
+		infof("destination differs, kept %s", j.fileDest(path))
+		return nil
+	} else if err == errRefused {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	copied, err := copyInto(j, newPath, path, 0)
+	if err != nil && err != errUnchanged {
+		return err
+	} else if err == nil {
+		j.syncedCopy(newPath, path, copied)
+	}
+	j.recordSynced(newPath, copied)
+	j.postCopy(path, newPath)
+	return moveSource(j, newPath, path)
+}
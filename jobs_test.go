@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRootOfFolderSource(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	j := newJob("test", src, dst)
+
+	if got := j.root(); got != src {
+		t.Fatalf("root() = %q, want %q", got, src)
+	}
+	file := filepath.Join(src, "sub", "a.txt")
+	if got, want := j.relDest(file), filepath.Join("sub", "a.txt"); got != want {
+		t.Errorf("relDest(%q) = %q, want %q", file, got, want)
+	}
+	if got, want := j.destPath(file), filepath.Join(dst, "sub", "a.txt"); got != want {
+		t.Errorf("destPath(%q) = %q, want %q", file, got, want)
+	}
+}
+
+func TestRootOfFileSource(t *testing.T) {
+	dir := t.TempDir()
+	dst := t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(file, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j := newJob("test", file, dst)
+
+	if got := j.root(); got != dir {
+		t.Fatalf("root() = %q, want %q", got, dir)
+	}
+	if got, want := j.destPath(file), filepath.Join(dst, "a.txt"); got != want {
+		t.Errorf("destPath(%q) = %q, want %q", file, got, want)
+	}
+}
+
+// A deleted single watched file must keep its own destination, never the
+// destination root, which --mirror would remove.
+func TestRootOfDeletedFileSource(t *testing.T) {
+	dir := t.TempDir()
+	dst := t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(file, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j := newJob("test", file, dst)
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := j.root(); got != dir {
+		t.Errorf("root() after delete = %q, want %q", got, dir)
+	}
+	if got, want := j.relDest(file), "a.txt"; got != want {
+		t.Errorf("relDest(%q) after delete = %q, want %q", file, got, want)
+	}
+	if got := j.destPath(file); got == dst {
+		t.Errorf("destPath(%q) after delete is the destination root %q", file, dst)
+	}
+}
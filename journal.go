@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalEntry One destructive change to the destination, with the moved-aside
+// copy. A "create" entry has no copy: undoing it removes the file.
+type journalEntry struct {
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`
+	Path   string    `json:"path"`
+	Saved  string    `json:"saved"`
+	Sha256 string    `json:"sha256"`
+}
+
+var journalMu sync.Mutex
+
+// journalRecord Move path aside into the undo journal before it gets
+// overwritten or deleted, returning where it went. Without --journal, or when
+// path does not exist, nothing happens.
+func journalRecord(op string, path string) (string, error) {
+	if opts.Journal == "" {
+		return "", nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", nil
+	}
+
+	journalMu.Lock()
+	defer journalMu.Unlock()
+
+	now := time.Now()
+	saved := journalName(now, path)
+	if err := mkdirAll(filepath.Dir(saved)); err != nil {
+		return "", err
+	}
+	if err := moveFile(saved, path); err != nil {
+		return "", err
+	}
+
+	sum, err := fileSha256(saved)
+	if err != nil {
+		return saved, err
+	}
+
+	return saved, appendJournal(journalEntry{Time: now, Op: op, Path: path, Saved: saved, Sha256: sum})
+}
+
+// journalKept Record the copy of path that --versions or --backup-dir has
+// just kept. The journal gets a copy of its own, as those only keep the newest
+// versions or the latest backup.
+func journalKept(op string, path string, kept string) error {
+	if opts.Journal == "" {
+		return nil
+	}
+
+	journalMu.Lock()
+	defer journalMu.Unlock()
+
+	now := time.Now()
+	saved := journalName(now, path)
+	if err := mkdirAll(filepath.Dir(saved)); err != nil {
+		return err
+	}
+	if _, err := copyFile(saved, kept); err != nil {
+		return err
+	}
+
+	sum, err := fileSha256(saved)
+	if err != nil {
+		return err
+	}
+
+	return appendJournal(journalEntry{Time: now, Op: op, Path: path, Saved: saved, Sha256: sum})
+}
+
+func journalName(now time.Time, path string) string {
+	return filepath.Join(opts.Journal, "files", strconv.FormatInt(now.UnixNano(), 10)+"-"+filepath.Base(path))
+}
+
+// journalCreated Record that path did not exist before the watcher copied it,
+// so undo and restore remove it again.
+func journalCreated(path string) error {
+	if opts.Journal == "" {
+		return nil
+	}
+
+	journalMu.Lock()
+	defer journalMu.Unlock()
+
+	return appendJournal(journalEntry{Time: time.Now(), Op: "create", Path: path})
+}
+
+func appendJournal(e journalEntry) error {
+	f, err := os.OpenFile(filepath.Join(opts.Journal, "journal.jsonl"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(e)
+}
+
+// readJournal Load the journal entries recorded at or after since.
+func readJournal(since time.Time) ([]journalEntry, error) {
+	f, err := os.Open(filepath.Join(opts.Journal, "journal.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]journalEntry, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if !e.Time.Before(since) {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// undoCommand watch undo --journal DIR --since 1h
+// Restores every overwritten or deleted file and removes every created one,
+// newest change first.
+func undoCommand(args []string) int {
+	opts.Since = "1h"
+	if _, err := parseOptions(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if opts.Journal == "" {
+		fmt.Fprintln(os.Stderr, "undo needs --journal")
+		return 2
+	}
+
+	since, err := time.ParseDuration(opts.Since)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	entries, err := readJournal(time.Now().Add(-since))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return rollBack(entries, "")
+}
+
+// rollBack Restore the entries under prefix, newest change first.
+func rollBack(entries []journalEntry, prefix string) int {
+	failed := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if prefix != "" && !strings.HasPrefix(e.Path, prefix) {
+			continue
+		}
+		if err := restoreJournalEntry(e); err != nil {
+			fmt.Fprintln(os.Stderr, "restore", e.Path, err)
+			failed++
+			continue
+		}
+		if e.Op == "create" {
+			fmt.Fprintln(os.Stdout, "removed", e.Path, "created", e.Time.Format(time.RFC3339))
+			continue
+		}
+		fmt.Fprintln(os.Stdout, "restored", e.Path, "from", e.Op, e.Time.Format(time.RFC3339))
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func restoreJournalEntry(e journalEntry) error {
+	if e.Op == "create" {
+		if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if _, err := os.Stat(e.Saved); err != nil {
+		// already restored by an earlier undo or restore
+		return nil
+	}
+
+	if e.Sha256 != "" {
+		sum, err := fileSha256(e.Saved)
+		if err != nil {
+			return err
+		}
+		if sum != e.Sha256 {
+			return fmt.Errorf("saved copy %s is corrupt", e.Saved)
+		}
+	}
+
+	if err := mkdirAll(filepath.Dir(e.Path)); err != nil {
+		return err
+	}
+	return moveFile(e.Path, e.Saved)
+}
+
+// moveFile Rename, falling back to copy and remove across volumes.
+func moveFile(dstFileName string, srcFileName string) error {
+	if err := os.Rename(srcFileName, dstFileName); err == nil {
+		return nil
+	}
+
+	if _, err := copyFile(dstFileName, srcFileName); err != nil {
+		return err
+	}
+	return os.Remove(srcFileName)
+}
+
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return readerSha256(f)
+}
+
+// copySha256 The checksum of a destination copy's original content.
+func copySha256(path string) (string, error) {
+	r, err := openCopy(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	return readerSha256(r)
+}
+
+func readerSha256(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// restoreCommand watch restore --journal DIR --prefix PATH --at TIME
+// Puts every file under the prefix back the way it was at TIME (RFC 3339, or
+// a duration meaning that long ago), resurrecting deleted files too. Given a
+// versioned s3:// or gs:// bucket instead of --journal, the bucket's own old
+// versions are restored.
+func restoreCommand(args []string) int {
+	args, err := parseOptions(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if (opts.Journal == "") == (len(args) == 0) || len(args) > 1 || opts.At == "" {
+		fmt.Fprintln(os.Stderr, "restore needs --at and either --journal or a bucket URL")
+		return 2
+	}
+
+	at, err := time.Parse(time.RFC3339, opts.At)
+	if err != nil {
+		ago, derr := time.ParseDuration(opts.At)
+		if derr != nil {
+			fmt.Fprintln(os.Stderr, "invalid --at", opts.At)
+			return 2
+		}
+		at = time.Now().Add(-ago)
+	}
+
+	if len(args) == 1 {
+		return restoreBucket(args[0], opts.Prefix, at)
+	}
+
+	entries, err := readJournal(at)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return rollBack(entries, opts.Prefix)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUndoRemovesCreatedFiles(t *testing.T) {
+	opts.Journal = t.TempDir()
+	defer func() { opts.Journal = "" }()
+	dst := t.TempDir()
+
+	kept := filepath.Join(dst, "kept.txt")
+	if err := os.WriteFile(kept, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := journalRecord("overwrite", kept); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(kept, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	created := filepath.Join(dst, "created.txt")
+	if err := os.WriteFile(created, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := journalCreated(created); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readJournal(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := rollBack(entries, ""); code != 0 {
+		t.Fatalf("rollBack = %d", code)
+	}
+
+	if IsFile(created) {
+		t.Errorf("%s still exists after undo", created)
+	}
+	if data, _ := os.ReadFile(kept); string(data) != "old" {
+		t.Errorf("%s = %q after undo, want %q", kept, data, "old")
+	}
+}
+
+func TestVersionsAreJournaled(t *testing.T) {
+	opts.Journal = t.TempDir()
+	opts.Versions = 1
+	defer func() { opts.Journal, opts.Versions = "", 0 }()
+	dst := t.TempDir()
+	j := newJob("test", t.TempDir(), dst)
+
+	file := filepath.Join(dst, "a.txt")
+	if err := os.WriteFile(file, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	version, err := j.setAside("overwrite", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsFile(version) {
+		t.Fatalf("no version kept at %q", version)
+	}
+
+	entries, err := readJournal(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Path != file {
+		t.Fatalf("journal = %+v, want one entry for %s", entries, file)
+	}
+	if data, _ := os.ReadFile(entries[0].Saved); string(data) != "old" {
+		t.Errorf("journaled copy = %q, want %q", data, "old")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const launchdPlist = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+{{args}}	</array>
+	<key>WorkingDirectory</key>
+	<string>{{dir}}</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ThrottleInterval</key>
+	<integer>10</integer>
+	<key>ExitTimeOut</key>
+	<integer>{{stop}}</integer>
+	<key>StandardOutPath</key>
+	<string>{{log}}</string>
+	<key>StandardErrorPath</key>
+	<string>{{log}}</string>
+</dict>
+</plist>
+`
+
+func xmlText(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// installLaunchdCommand watch install-launchd [--user] [--service-name watch] (--config file | path copyDir...)
+// Write a launchd plist starting the watcher at boot, or at login with
+// --user, and restarting it when it crashes, and load it.
+func installLaunchdCommand(args []string) int {
+	positional, err := parseOptions(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	service, err := serviceArgs(args, positional)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "usage: watch install-launchd [--user] [--service-name watch] (--config file | path copyDir...)")
+		return 2
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	drain, err := time.ParseDuration(opts.DrainTimeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid --drain-timeout", opts.DrainTimeout)
+		return 2
+	}
+
+	dir, logDir, domain := "/Library/LaunchDaemons", "/var/log", "system"
+	if opts.User {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		dir, logDir, domain = filepath.Join(home, "Library", "LaunchAgents"), filepath.Join(home, "Library", "Logs"), "gui/"+strconv.Itoa(os.Getuid())
+	}
+
+	var list strings.Builder
+	for _, a := range append([]string{exe}, service...) {
+		fmt.Fprintf(&list, "\t\t<string>%s</string>\n", xmlText(a))
+	}
+	plist := strings.NewReplacer(
+		"{{label}}", xmlText(opts.ServiceName),
+		"{{args}}", list.String(),
+		"{{dir}}", xmlText(cwd),
+		// room for the drain on SIGTERM, then launchd kills
+		"{{stop}}", strconv.Itoa(int((drain + 30*time.Second).Seconds())),
+		"{{log}}", xmlText(filepath.Join(logDir, opts.ServiceName+".log")),
+	).Replace(launchdPlist)
+
+	path := filepath.Join(dir, opts.ServiceName+".plist")
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err = os.WriteFile(path, []byte(plist), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("wrote", path)
+
+	if runtime.GOOS != "darwin" {
+		fmt.Println("not loaded, launchctl is on macOS only")
+		return 0
+	}
+	// a previous version of the job is replaced
+	exec.Command("launchctl", "bootout", domain+"/"+opts.ServiceName).Run()
+	if out, err := exec.Command("launchctl", "bootstrap", domain, path).CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "launchctl bootstrap %s %s: %v: %s\n", domain, path, err, bytes.TrimSpace(out))
+		return 1
+	}
+	fmt.Printf("loaded %s into %s\n", opts.ServiceName, domain)
+	return 0
+}
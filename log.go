@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	levelError = iota
+	levelWarn
+	levelInfo
+	levelDebug
+	levelTrace
+)
+
+var levelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+// logOut Where events and info messages go: stdout, unless that carries
+// the --output stream.
+var logOut io.Writer = os.Stdout
+
+// logLevel Current verbosity; changed at runtime over the control socket.
+var logLevel int32 = levelInfo
+
+// traced Path prefixes logged at trace level whatever the current level.
+var traced struct {
+	sync.Mutex
+	prefixes []string
+}
+
+func parseLevel(name string) (int, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (%s)", name, strings.Join(levelNames, ", "))
+}
+
+func setLogLevel(level int) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+func currentLevel() int {
+	return int(atomic.LoadInt32(&logLevel))
+}
+
+func logAt(level int, format string, args ...interface{}) {
+	if level == levelError {
+		noteError(fmt.Sprintf(format, args...))
+	}
+	if level > currentLevel() {
+		return
+	}
+
+	out := logOut
+	if level <= levelWarn {
+		out = os.Stderr
+	}
+	fmt.Fprintf(out, format+"\n", args...)
+
+	if syslogOut != nil && level <= levelWarn {
+		severity := syslogErr
+		if level == levelWarn {
+			severity = syslogWarning
+		}
+		syslogOut.send(severity, levelNames[level], nil, fmt.Sprintf(format, args...))
+	}
+}
+
+func errorf(format string, args ...interface{}) { logAt(levelError, format, args...) }
+func warnf(format string, args ...interface{})  { logAt(levelWarn, format, args...) }
+func infof(format string, args ...interface{})  { logAt(levelInfo, format, args...) }
+func debugf(format string, args ...interface{}) { logAt(levelDebug, format, args...) }
+
+// lineLogger Log what a command writes line by line at level, each line
+// after prefix, e.g. "[on-change] src/a.txt: ", so its output can be told
+// from the watcher's and goes wherever the log goes.
+type lineLogger struct {
+	level  int
+	prefix string
+	mu     sync.Mutex
+	buf    []byte
+}
+
+func newLineLogger(level int, prefix string) *lineLogger {
+	return &lineLogger{level: level, prefix: prefix}
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		logAt(l.level, "%s%s", l.prefix, strings.TrimSuffix(string(l.buf[:i]), "\r"))
+		l.buf = l.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush Log what is left after the last line break.
+func (l *lineLogger) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) > 0 {
+		logAt(l.level, "%s%s", l.prefix, l.buf)
+		l.buf = nil
+	}
+}
+
+// tracef Log about path at trace level, or whenever path is being traced.
+func tracef(path string, format string, args ...interface{}) {
+	if currentLevel() < levelTrace && !isTraced(path) {
+		return
+	}
+	fmt.Fprintf(logOut, "[trace] "+format+"\n", args...)
+}
+
+func isTraced(path string) bool {
+	traced.Lock()
+	defer traced.Unlock()
+
+	for _, p := range traced.prefixes {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func addTrace(prefix string) {
+	traced.Lock()
+	defer traced.Unlock()
+	traced.prefixes = append(traced.prefixes, filepath.Clean(prefix))
+}
+
+func removeTrace(prefix string) {
+	traced.Lock()
+	defer traced.Unlock()
+
+	prefix = filepath.Clean(prefix)
+	kept := traced.prefixes[:0]
+	for _, p := range traced.prefixes {
+		if p != prefix {
+			kept = append(kept, p)
+		}
+	}
+	traced.prefixes = kept
+}
+
+func tracedPrefixes() []string {
+	traced.Lock()
+	defer traced.Unlock()
+	return append([]string(nil), traced.prefixes...)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maintenanceDrain How long turning maintenance on waits for the copies
+// under way to finish.
+const maintenanceDrain = 30 * time.Second
+
+// maintenance While on, nothing is written to any destination: copies stay
+// queued, full syncs wait before their next file and mirror removals are
+// put off, so a destination volume can be checked or remounted while
+// changes keep being collected.
+var maintenance struct {
+	sync.Mutex
+	on       bool
+	since    time.Time
+	ended    chan struct{} // closed when it ends
+	removals []deferredPath
+	folders  []deferredPath
+}
+
+// deferredPath A deletion to be mirrored, or a new source folder to be
+// created in the destination, once maintenance ends.
+type deferredPath struct {
+	job  *job
+	path string
+}
+
+// inMaintenance Whether maintenance is on, and since when.
+func inMaintenance() (bool, time.Time) {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	return maintenance.on, maintenance.since
+}
+
+// waitMaintenance Block while maintenance is on.
+func waitMaintenance() {
+	maintenance.Lock()
+	on, ended := maintenance.on, maintenance.ended
+	maintenance.Unlock()
+	if on {
+		<-ended
+	}
+}
+
+// deferRemoval Put off mirroring the deletion of path during maintenance.
+// It reports whether it did, false when maintenance is off.
+func deferRemoval(j *job, path string) bool {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	if !maintenance.on {
+		return false
+	}
+	maintenance.removals = append(maintenance.removals, deferredPath{j, path})
+	return true
+}
+
+// deferFolder Put off creating the destination folder of a new source folder
+// during maintenance, as the destination may not even be mounted. It reports
+// whether it did, false when maintenance is off.
+func deferFolder(j *job, path string) bool {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	if !maintenance.on {
+		return false
+	}
+	maintenance.folders = append(maintenance.folders, deferredPath{j, path})
+	return true
+}
+
+// startMaintenance Stop writing to the destinations, and wait a while for
+// the copies under way to finish.
+func startMaintenance() string {
+	maintenance.Lock()
+	if maintenance.on {
+		since := maintenance.since
+		maintenance.Unlock()
+		return fmt.Sprintf("maintenance on since %s", since.Local().Format("15:04:05"))
+	}
+	maintenance.on, maintenance.since, maintenance.ended = true, time.Now(), make(chan struct{})
+	maintenance.Unlock()
+	warnf("maintenance on: nothing is written to the destinations until it is turned off")
+
+	deadline := time.Now().Add(maintenanceDrain)
+	reply := "maintenance on, no copies under way"
+	for {
+		busy := 0
+		for _, j := range runningJobs() {
+			j.queue.mu.Lock()
+			busy += j.queue.busy
+			j.queue.mu.Unlock()
+		}
+		if busy == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			reply = fmt.Sprintf("maintenance on, %d copies still finishing", busy)
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	for _, j := range runningJobs() {
+		j.suspendStores()
+	}
+	return reply
+}
+
+// destStores The stores a job keeps open in its destination.
+func (j *job) destStores() []*kvStore {
+	var stores []*kvStore
+	for _, s := range []*kvStore{j.names, j.state} {
+		if s != nil {
+			stores = append(stores, s)
+		}
+	}
+	if j.twoWay != nil {
+		stores = append(stores, j.twoWay.state)
+	}
+	return stores
+}
+
+// suspendStores Close the files of the job's stores, so nothing of the
+// watcher's is left open in the destination during maintenance.
+func (j *job) suspendStores() {
+	for _, s := range j.destStores() {
+		if err := s.Suspend(); err != nil {
+			warnf("job %s: %s: %v", j.Name, s.path, err)
+		}
+	}
+}
+
+// resumeStores Open the job's stores again after maintenance.
+func (j *job) resumeStores() {
+	for _, s := range j.destStores() {
+		if err := s.Resume(); err != nil {
+			warnf("job %s: %s: %v", j.Name, s.path, err)
+		}
+	}
+}
+
+// endMaintenance Write to the destinations again: copy what was queued,
+// create the folders and mirror the deletions put off.
+func endMaintenance() string {
+	maintenance.Lock()
+	if !maintenance.on {
+		maintenance.Unlock()
+		return "maintenance off"
+	}
+	since, removals, folders := maintenance.since, maintenance.removals, maintenance.folders
+	maintenance.on, maintenance.removals, maintenance.folders = false, nil, nil
+	close(maintenance.ended)
+	maintenance.Unlock()
+
+	waiting := 0
+	for _, j := range runningJobs() {
+		j.resumeStores()
+		j.queue.wake()
+		waiting += j.queue.len()
+	}
+	infof("maintenance off after %s, %d copies waiting, %d removals put off", time.Since(since).Round(time.Second), waiting, len(removals))
+	go func() {
+		for _, f := range folders {
+			if err := syncFile(f.job, f.path); err != nil {
+				reportError(err)
+			}
+		}
+		for _, r := range removals {
+			if err := r.job.mirrorRemove(r.path); err != nil {
+				reportError(err)
+			}
+		}
+	}()
+	return fmt.Sprintf("maintenance off after %s, %d copies waiting", time.Since(since).Round(time.Second), waiting)
+}
+
+// maintenanceState The reply to a question about maintenance.
+func maintenanceState() string {
+	on, since := inMaintenance()
+	if !on {
+		return "maintenance off"
+	}
+	return fmt.Sprintf("maintenance on since %s", since.Local().Format("15:04:05"))
+}
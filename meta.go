@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+// copyMetadata Carry the source file's metadata over to a finished copy.
+func copyMetadata(dstFileName string, srcFileName string) error {
+	stat, err := os.Stat(srcFileName)
+	if err != nil {
+		return err
+	}
+
+	// chown clears setuid/setgid, so ownership goes first
+	if opts.PreserveOwner {
+		if err = preserveOwner(dstFileName, stat); err != nil {
+			return err
+		}
+	}
+
+	if err = preserveMode(dstFileName, stat); err != nil {
+		return err
+	}
+
+	// after the mode, since an ACL also carries the mode bits
+	if opts.Xattrs {
+		if err = copyXattrs(dstFileName, srcFileName); err != nil {
+			return err
+		}
+	}
+
+	if !opts.NoPreserveTimes {
+		return os.Chtimes(dstFileName, fileAtime(stat), stat.ModTime())
+	}
+
+	return nil
+}
+
+// preserveMode Match the destination mode to the source, or to --chmod when set.
+func preserveMode(dstFileName string, src os.FileInfo) error {
+	mode := src.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+
+	if opts.Chmod != "" {
+		fixed, err := strconv.ParseUint(opts.Chmod, 8, 32)
+		if err != nil {
+			return err
+		}
+		mode = os.FileMode(fixed) & os.ModePerm
+	}
+
+	return os.Chmod(dstFileName, mode)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// numberedVersion file.txt.~3~, a numbered version kept by --versions.
+var numberedVersion = regexp.MustCompile(`\.~[0-9]+~$`)
+
+// mirrorKeeps A destination path that belongs to the watcher rather than to
+// the replica: staging, probes, versions, kept conflict copies, and a backup
+// dir or journal kept inside the destination.
+func (j *job) mirrorKeeps(dstFileName string, rel string) bool {
+	if internal(rel) || conflictCopy.MatchString(rel) {
+		return true
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if parts[0] == versionsDir || (opts.Versions > 0 && numberedVersion.MatchString(rel)) {
+		return true
+	}
+	for _, dir := range []string{opts.BackupDir, opts.Journal} {
+		if dir == "" {
+			continue
+		}
+		if within(dstFileName, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// mirrorRemove With --mirror, remove the copy of a source path that was
+// deleted or renamed away, setting it aside first. A removed folder takes
+// its copy along file by file, asking first when that is a mass deletion;
+// files changed in the destination and the watcher's own are kept.
+func (j *job) mirrorRemove(filePath string) error {
+	if _, err := os.Lstat(filePath); err == nil {
+		// renamed onto, or back already
+		return nil
+	}
+
+	if j.sink != nil {
+		name := j.remotePath(filePath)
+		if err := j.sink.Remove(name); err != nil {
+			return err
+		}
+		j.auditDecision("remove", filePath, name, "deleted from the source")
+		infof("removed %s, deleted from the source", name)
+		return nil
+	}
+
+	suffix := compressSuffix() + encryptSuffix()
+	dst := j.destPath(filePath)
+	if !IsDir(dst) {
+		if name, ok := j.handedName(filePath); ok {
+			dst = name
+		}
+		if !IsFile(dst+suffix) || j.keepChanged(dst+suffix) {
+			return nil
+		}
+		if err := j.removeCopy(dst, suffix); err != nil {
+			return err
+		}
+		j.auditDecision("remove", filePath, dst+suffix, "deleted from the source")
+		infof("removed %s, deleted from the source", dst+suffix)
+		return nil
+	}
+
+	root := j.target()
+	var files, dirs []string
+	filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		if j.mirrorKeeps(path, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+		} else if !j.handedOut(strings.TrimSuffix(path, suffix)) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if !confirmDestructive("mirror", dst, len(files), countFiles(root)) {
+		return nil
+	}
+	for _, f := range files {
+		if j.keepChanged(f) {
+			continue
+		}
+		if err := j.removeCopy(strings.TrimSuffix(f, suffix), suffix); err != nil {
+			return err
+		}
+	}
+	// deepest first, so parents are empty by the time they come up
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+	j.auditDecision("remove", filePath, dst, "folder deleted from the source")
+	infof("removed %s, deleted from the source", dst)
+	return nil
+}
+
+// removeCopy Set aside and remove the copy name+suffix, forgetting its sync
+// state and the name caseGuard handed out for it.
+func (j *job) removeCopy(name string, suffix string) error {
+	path := name + suffix
+	if _, err := j.setAside("delete", path); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	j.forgetSynced(path)
+	j.forgetName(name)
+	return nil
+}
+
+// pruneMirror Remove what the destination holds beyond the source, after
+// the initial sync. Remote destinations can't be listed and are only kept
+// in step by deletions as they happen. A new snapshot is pruned the same way,
+// without asking or setting anything aside: the previous snapshot still has it.
+func (j *job) pruneMirror() error {
+	if j.sink != nil || opts.Archive != "" || !IsDir(j.Source) {
+		return nil
+	}
+	suffix := compressSuffix() + encryptSuffix()
+	dest := j.target()
+
+	var extra, extraDirs []string
+	total := 0
+	err := filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dest, path)
+		if rel == "." {
+			return nil
+		}
+		if j.mirrorKeeps(path, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			if !IsDir(filepath.Join(j.Source, rel)) {
+				extraDirs = append(extraDirs, path)
+			}
+			return nil
+		}
+		total++
+		if !strings.HasSuffix(rel, suffix) {
+			extra = append(extra, path)
+			return nil
+		}
+		// a name caseGuard handed out doesn't match its source's
+		if _, err := os.Lstat(filepath.Join(j.Source, strings.TrimSuffix(rel, suffix))); os.IsNotExist(err) && !j.handedOut(strings.TrimSuffix(path, suffix)) {
+			extra = append(extra, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(extra) == 0 && len(extraDirs) == 0 {
+		return nil
+	}
+	if !opts.Snapshots && !confirmDestructive("mirror", dest, len(extra), total) {
+		warnf("job %s: %d files not in %s were kept in %s", j.Name, len(extra), j.Source, dest)
+		return nil
+	}
+
+	for _, path := range extra {
+		waitMaintenance()
+		if j.keepChanged(path) {
+			continue
+		}
+		if !opts.Snapshots {
+			if _, err := j.setAside("delete", path); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		j.forgetSynced(path)
+		j.forgetName(strings.TrimSuffix(path, suffix))
+		j.auditDecision("remove", "", path, "not in the source")
+		infof("removed %s, not in the source", path)
+	}
+	// deepest first, so parents are empty by the time they come up
+	sort.Sort(sort.Reverse(sort.StringSlice(extraDirs)))
+	for _, dir := range extraDirs {
+		os.Remove(dir)
+	}
+	return nil
+}
+
+// sharedDest Two jobs whose destinations are the same folder or one inside
+// the other, where pruning either would remove the other's files.
+func sharedDest(list []*job) (*job, *job, bool) {
+	for a := range list {
+		for b := a + 1; b < len(list); b++ {
+			if within(list[a].Dest, list[b].Dest) || within(list[b].Dest, list[a].Dest) {
+				return list[a], list[b], true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// within path is dir or below it.
+func within(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// keepChanged A file deleted from the source but changed in the destination
+// since its last sync is kept, unless --conflict source says the source wins.
+func (j *job) keepChanged(dstFileName string) bool {
+	if changed, _ := j.destChanged(dstFileName); !changed || j.conflictPolicy() == "source" {
+		return false
+	}
+	warnf("conflict: %s was deleted from the source but changed in the destination, kept it", dstFileName)
+	j.auditDecision("keep", "", dstFileName, "deleted from the source but changed in the destination")
+	j.emitOutcome("skipped", dstFileName, "", fmt.Errorf("changed in the destination"))
+	return true
+}
+
+// countFiles The regular files under dir.
+func countFiles(dir string) int {
+	n := 0
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// moveSource With --move, delete srcFileName once its copy at dstFileName is
+// in place and its checksum matches, whatever the --verify setting.
+func moveSource(j *job, dstFileName string, srcFileName string) error {
+	if !opts.Move {
+		return nil
+	}
+
+	check := verifiedCopy
+	if j.sink != nil {
+		check = j.uploaded
+	}
+	if err := check(dstFileName, srcFileName); err != nil {
+		return err
+	}
+
+	if err := os.Remove(srcFileName); err != nil {
+		return err
+	}
+	infof("moved %s to %s", srcFileName, dstFileName)
+	return nil
+}
+
+// verifiedCopy The local copy at dstFileName has the content of srcFileName.
+func verifiedCopy(dstFileName string, srcFileName string) error {
+	src, err := os.Stat(srcFileName)
+	if err != nil {
+		return err
+	}
+	dst, err := os.Stat(dstFileName)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(src, dst) {
+		return nil
+	}
+
+	srcSum, err := fileSha256(srcFileName)
+	if err != nil {
+		return err
+	}
+	dstSum, err := copySha256(dstFileName)
+	if err != nil {
+		return err
+	}
+	if srcSum != dstSum {
+		return fmt.Errorf("--move: copy %s does not match %s, keeping the source", dstFileName, srcFileName)
+	}
+	return nil
+}
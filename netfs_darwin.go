@@ -0,0 +1,23 @@
+package main
+
+import "syscall"
+
+// networkFS path is on a filesystem served over the network.
+func networkFS(path string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false
+	}
+	name := make([]byte, 0, len(st.Fstypename))
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	switch string(name) {
+	case "nfs", "smbfs", "afpfs", "webdav", "macfuse", "osxfuse":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,19 @@
+package main
+
+import "syscall"
+
+// networkMagic Filesystem types whose files live on another machine: NFS,
+// SMB and CIFS, FUSE (sshfs, rclone), AFS, Ceph and 9P.
+var networkMagic = map[uint32]bool{
+	0x6969: true, 0x517b: true, 0xff534d42: true, 0xfe534d42: true,
+	0x65735546: true, 0x5346414f: true, 0x00c36400: true, 0x01021997: true,
+}
+
+// networkFS path is on a filesystem served over the network.
+func networkFS(path string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false
+	}
+	return networkMagic[uint32(st.Type)]
+}
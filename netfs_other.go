@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+// networkFS path is on a share, by UNC path; other network filesystems
+// are not told apart here.
+func networkFS(path string) bool {
+	return uncShare(path) != ""
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDriveType = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDriveTypeW")
+
+// driveRemote What GetDriveType answers for a mapped network drive.
+const driveRemote = 4
+
+// networkFS path is on a share, by UNC path or mapped drive.
+func networkFS(path string) bool {
+	if uncShare(path) != "" {
+		return true
+	}
+	root, err := syscall.UTF16PtrFromString(filepath.VolumeName(path) + `\`)
+	if err != nil {
+		return false
+	}
+	kind, _, _ := procGetDriveType.Call(uintptr(unsafe.Pointer(root)))
+	return kind == driveRemote
+}
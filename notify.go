@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// notice Something to tell people who aren't watching the log: a copy or a
+// full sync that failed, a full sync or a large batch of copies that
+// finished, a destination that went offline or came back.
+type notice struct {
+	eventMeta
+
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"` // failed, synced, batch, offline or online
+	Path    string    `json:"path,omitempty"`
+	Title   string    `json:"title"`
+	Message string    `json:"message"`
+	Count   int       `json:"count,omitempty"` // of files copied, or of failures taken together
+}
+
+// noticeKinds Every kind of notice, for picking some.
+var noticeKinds = []string{"failed", "synced", "batch", "offline", "online"}
+
+// batchNotice --notify-batch: how many copies make a batch worth a notice.
+var batchNotice int64
+
+// notifier Passes notices on, picking the kinds it cares about.
+type notifier interface {
+	notify(n notice)
+}
+
+var notifiers []notifier
+
+func notify(n notice) {
+	for _, nt := range notifiers {
+		nt.notify(n)
+	}
+}
+
+// noticeOf The notice for a failed copy, if msg reports one.
+func noticeOf(msg eventMessage) (notice, bool) {
+	if msg.Op != "failed" {
+		return notice{}, false
+	}
+	return notice{Time: msg.Time, Kind: "failed", eventMeta: metaOf(msg.Job), Path: msg.Path,
+		Title: "Copy failed", Message: fmt.Sprintf("%s: %s", msg.Path, msg.Error)}, true
+}
+
+// failureBatch Failures within window taken together, so a failing
+// destination doesn't make a notice per file.
+type failureBatch struct {
+	mu      sync.Mutex
+	window  time.Duration
+	list    []notice
+	pending bool
+	send    func(n notice)
+}
+
+func (b *failureBatch) add(n notice) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.list = append(b.list, n)
+	if !b.pending {
+		b.pending = true
+		time.AfterFunc(b.window, b.flush)
+	}
+}
+
+// flush Send the failure, or one notice for them all with the last one's
+// message.
+func (b *failureBatch) flush() {
+	b.mu.Lock()
+	list := b.list
+	b.list, b.pending = nil, false
+	b.mu.Unlock()
+
+	n := list[len(list)-1]
+	if len(list) > 1 {
+		n.Title = fmt.Sprintf("%d failures", len(list))
+		n.Message = "last: " + n.Message
+		n.Count = len(list)
+	}
+	b.send(n)
+}
+
+// endBatch Once the job's queue has run dry after at least --notify-batch
+// copies, tell of the batch.
+func (j *job) endBatch() {
+	if j.queue.len() > 0 {
+		return
+	}
+	n := atomic.SwapInt64(&j.batch, 0)
+	if batchNotice > 0 && n >= batchNotice {
+		notify(notice{Time: time.Now(), Kind: "batch", eventMeta: j.meta(), Title: "Batch copied", Count: int(n),
+			Message: fmt.Sprintf("job %s: %d files copied to %s", j.Name, n, j.Dest)})
+	}
+}
+
+// notifySynced Tell that a full sync of the job, the initial, a scheduled or
+// a requested one, finished, with the number of files it copied.
+func (j *job) notifySynced(what string, copied int64) {
+	notify(notice{Time: time.Now(), Kind: "synced", eventMeta: j.meta(), Title: "Sync complete", Count: int(copied),
+		Message: fmt.Sprintf("job %s: %s sync of %s complete, %d copied", j.Name, what, j.Source, copied)})
+}
+
+// notifySyncFailed Tell that a full sync of the job, the initial, a
+// scheduled or a requested one, failed.
+func (j *job) notifySyncFailed(what string, err error) {
+	notify(notice{Time: time.Now(), Kind: "failed", eventMeta: j.meta(), Title: "Sync failed",
+		Message: fmt.Sprintf("job %s: %s sync of %s: %v", j.Name, what, j.Source, err)})
+}
+
+// noteReachable Tell when the job's destination stops answering and when it
+// answers again, judged by how its copies end.
+func (j *job) noteReachable(err error) {
+	if err != nil && err != errUnchanged && err != errSkipped {
+		if classifyError(err) == "unreachable" && atomic.CompareAndSwapInt32(&j.offline, 0, 1) {
+			notify(notice{Time: time.Now(), Kind: "offline", eventMeta: j.meta(), Title: "Destination offline",
+				Message: fmt.Sprintf("job %s: %s is unreachable: %v", j.Name, j.Dest, err)})
+		}
+		return
+	}
+	if atomic.CompareAndSwapInt32(&j.offline, 1, 0) {
+		notify(notice{Time: time.Now(), Kind: "online", eventMeta: j.meta(), Title: "Destination back online",
+			Message: fmt.Sprintf("job %s: %s answers again", j.Name, j.Dest)})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bearerToken An OAuth access token fetched on first use and again shortly
+// before it expires.
+type bearerToken struct {
+	mu     sync.Mutex
+	fetch  func() (*http.Request, error)
+	token  string
+	expiry time.Time
+}
+
+func (t *bearerToken) get() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && time.Now().Before(t.expiry.Add(-time.Minute)) {
+		return t.token, nil
+	}
+
+	req, err := t.fetch()
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("token from %s: %s %s", req.URL.Host, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var body struct {
+		AccessToken string          `json:"access_token"`
+		ExpiresIn   json.RawMessage `json:"expires_in"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	// some token services send the lifetime as a string
+	seconds, _ := strconv.Atoi(strings.Trim(string(body.ExpiresIn), `"`))
+	if seconds <= 0 {
+		seconds = 300
+	}
+
+	t.token = body.AccessToken
+	t.expiry = time.Now().Add(time.Duration(seconds) * time.Second)
+	return t.token, nil
+}
+
+func formRequest(target string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+func preserveOwner(dstFileName string, src os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+)
+
+var ownerWarned sync.Once
+
+// preserveOwner Chown the copy to the source uid/gid. Without the privilege
+// to do so the copy keeps the current user and a warning is printed once.
+func preserveOwner(dstFileName string, src os.FileInfo) error {
+	st, ok := src.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	err := os.Lchown(dstFileName, int(st.Uid), int(st.Gid))
+	if errors.Is(err, os.ErrPermission) {
+		ownerWarned.Do(func() {
+			warnf("--preserve-owner: no privilege to change ownership, keeping current user")
+		})
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pluginTimeout How long a plugin may take to answer, and pluginRate the
+// slowest upload it may make on top of that, in bytes per second.
+const (
+	pluginTimeout = 2 * time.Minute
+	pluginRate    = 64 * 1024
+)
+
+// pluginPrefix Destinations with a scheme of their own, say dam://, are
+// handled by the program watch-sink-dam found in PATH.
+const pluginPrefix = "watch-sink-"
+
+// pluginSink A destination implemented by an external program that speaks
+// JSON lines over stdio. The program gets the destination URL as its only
+// argument and answers one request at a time:
+//
+//	{"id":1,"op":"ensure_dir","path":"a/b"}
+//	{"id":2,"op":"write_file","path":"a/b/c.txt","src":"/local/c.txt","size":42}
+//	{"id":3,"op":"remove","path":"a/b/c.txt"}
+//	{"id":4,"op":"stat","path":"a/b/c.txt"}
+//
+// with {"id":N} on success, {"id":N,"size":42,"mtime":"2024-06-01T12:00:00Z"}
+// for stat, and {"id":N,"error":"..."} on failure, adding "not_exist":true
+// when the file is missing. A plugin that cannot stat answers
+// "unsupported":true, and uploads are then never skipped as unchanged.
+// Whatever it writes to stderr is passed through.
+type pluginSink struct {
+	program string
+	dest    string
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Scanner
+	output io.ReadCloser
+	id     int64
+}
+
+type pluginRequest struct {
+	ID   int64  `json:"id"`
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	Src  string `json:"src,omitempty"`
+	Size int64  `json:"size,omitempty"`
+}
+
+type pluginResponse struct {
+	ID          int64     `json:"id"`
+	Error       string    `json:"error,omitempty"`
+	NotExist    bool      `json:"not_exist,omitempty"`
+	Unsupported bool      `json:"unsupported,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	ModTime     time.Time `json:"mtime,omitempty"`
+}
+
+// pluginProgram The plugin serving scheme, if one is installed.
+func pluginProgram(scheme string) (string, bool) {
+	if scheme == "" {
+		return "", false
+	}
+	program, err := exec.LookPath(pluginPrefix + scheme)
+	return program, err == nil
+}
+
+func newPluginSink(u *url.URL) (Sink, error) {
+	program, ok := pluginProgram(u.Scheme)
+	if !ok {
+		return nil, fmt.Errorf("unsupported destination %s (no %s%s in PATH)", u.Redacted(), pluginPrefix, u.Scheme)
+	}
+	p := &pluginSink{program: program, dest: u.String()}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// a plugin that cannot start is a configuration error, found at startup
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *pluginSink) start() error {
+	cmd := exec.Command(p.program, p.dest)
+	cmd.Stderr = os.Stderr
+	// killed with whatever it started when it stops answering
+	detach(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("%s: %v", p.program, err)
+	}
+
+	p.cmd, p.stdin, p.output = cmd, stdin, stdout
+	p.stdout = bufio.NewScanner(stdout)
+	p.stdout.Buffer(make([]byte, 64*1024), 1<<20)
+	return nil
+}
+
+// stop Drop a plugin that broke the protocol or died; the next request
+// starts it again.
+func (p *pluginSink) stop() {
+	if p.cmd == nil {
+		return
+	}
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+	p.cmd = nil
+}
+
+// call Send one request and wait for its answer. A plugin that takes longer
+// than pluginTimeout, plus a second per pluginRate bytes of an upload, is
+// killed and started again for the next request.
+func (p *pluginSink) call(req pluginRequest) (pluginResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var resp pluginResponse
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return resp, err
+		}
+	}
+
+	timeout := pluginTimeout + time.Duration(req.Size/pluginRate)*time.Second
+	var expired int32
+	cmd, stdin, output := p.cmd, p.stdin, p.output
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&expired, 1)
+		killGroup(cmd)
+		// a process it started may still hold the pipes open
+		stdin.Close()
+		output.Close()
+	})
+	defer timer.Stop()
+
+	p.id++
+	req.ID = p.id
+	line, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	if _, err = p.stdin.Write(append(line, '\n')); err != nil {
+		p.stop()
+		if atomic.LoadInt32(&expired) == 1 {
+			err = fmt.Errorf("no answer to %s %s in %s", req.Op, req.Path, timeout)
+		}
+		return resp, fmt.Errorf("%s: %v", p.program, err)
+	}
+
+	if !p.stdout.Scan() {
+		err = p.stdout.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		p.stop()
+		if atomic.LoadInt32(&expired) == 1 {
+			err = fmt.Errorf("no answer to %s %s in %s", req.Op, req.Path, timeout)
+		}
+		return resp, fmt.Errorf("%s: %v", p.program, err)
+	}
+	if err = json.Unmarshal(p.stdout.Bytes(), &resp); err != nil || resp.ID != req.ID {
+		p.stop()
+		return resp, fmt.Errorf("%s: bad answer to %s %s: %q", p.program, req.Op, req.Path, p.stdout.Text())
+	}
+
+	if resp.NotExist {
+		return resp, os.ErrNotExist
+	}
+	if resp.Unsupported {
+		return resp, errNoStat
+	}
+	if resp.Error != "" {
+		return resp, fmt.Errorf("%s %s: %s", req.Op, req.Path, resp.Error)
+	}
+	return resp, nil
+}
+
+func (p *pluginSink) EnsureDir(dir string) error {
+	_, err := p.call(pluginRequest{Op: "ensure_dir", Path: dir})
+	return err
+}
+
+// WriteFile The plugin reads src itself, so --bwlimit does not apply.
+func (p *pluginSink) WriteFile(name string, src string) error {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	// the plugin may run elsewhere than our working directory
+	if abs, aerr := filepath.Abs(src); aerr == nil {
+		src = abs
+	}
+	_, err = p.call(pluginRequest{Op: "write_file", Path: name, Src: src, Size: stat.Size()})
+	return err
+}
+
+func (p *pluginSink) Remove(name string) error {
+	_, err := p.call(pluginRequest{Op: "remove", Path: name})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (p *pluginSink) Stat(name string) (sinkStat, error) {
+	resp, err := p.call(pluginRequest{Op: "stat", Path: name})
+	if err != nil {
+		return sinkStat{}, err
+	}
+	return sinkStat{Size: resp.Size, ModTime: resp.ModTime}, nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// destCaps What the destination filesystem accepts, as found by probeDest.
+type destCaps struct {
+	CaseInsensitive bool
+	Unicode         bool
+	RejectedChars   string
+	MaxName         int
+}
+
+const probePrefix = ".watch-probe-"
+
+// defaultCaps What a destination is taken to accept until it is probed:
+// any name, as on most filesystems.
+var defaultCaps = destCaps{Unicode: true, MaxName: 255}
+
+// probeDest Create test names in dir to learn its case sensitivity, unicode
+// handling and name length limit. When not even a plain name can be created
+// nothing is learnt, and the defaults come back with the error.
+func probeDest(dir string) (destCaps, error) {
+	base := filepath.Join(dir, probePrefix+"base")
+	if err := touch(base); err != nil {
+		return defaultCaps, err
+	}
+	os.Remove(base)
+	caps := destCaps{}
+
+	upper := filepath.Join(dir, probePrefix+"Case")
+	if touch(upper) == nil {
+		_, err := os.Stat(filepath.Join(dir, probePrefix+"cASE"))
+		caps.CaseInsensitive = err == nil
+		os.Remove(upper)
+	}
+
+	accent := filepath.Join(dir, probePrefix+"\u00e9")
+	if touch(accent) == nil {
+		caps.Unicode = true
+		os.Remove(accent)
+	}
+
+	for _, c := range `:*?"<>|\` {
+		name := filepath.Join(dir, probePrefix+"c"+string(c))
+		if touch(name) != nil {
+			caps.RejectedChars += string(c)
+			continue
+		}
+		os.Remove(name)
+	}
+
+	caps.MaxName = 255
+	for caps.MaxName > len(probePrefix) {
+		name := filepath.Join(dir, probePrefix+strings.Repeat("n", caps.MaxName-len(probePrefix)))
+		if touch(name) == nil {
+			os.Remove(name)
+			break
+		}
+		caps.MaxName -= 8
+	}
+
+	return caps, nil
+}
+
+// probe Learn what the destination accepts. One that can't be written to
+// yet keeps the defaults, rather than having every name mangled for the rest
+// of the run, and watchShares probes it again until it can.
+func (j *job) probe() {
+	caps, err := probeDest(j.Dest)
+	if err != nil {
+		if atomic.SwapInt32(&j.unprobed, 1) == 0 {
+			warnf("job %s: can't probe %s (%v), assuming it takes any name until it can be", j.Name, j.Dest, err)
+		}
+		return
+	}
+	j.capsMu.Lock()
+	j.caps = caps
+	j.capsMu.Unlock()
+	j.logDestCaps()
+
+	if atomic.SwapInt32(&j.unprobed, 0) == 1 && j.names == nil {
+		j.caseMu.Lock()
+		err = j.openNames()
+		j.caseMu.Unlock()
+		if err != nil {
+			warnf("job %s: names: %v", j.Name, err)
+		}
+	}
+}
+
+// fsCaps What the destination accepts, as far as is known.
+func (j *job) fsCaps() destCaps {
+	j.capsMu.Lock()
+	defer j.capsMu.Unlock()
+	return j.caps
+}
+
+func touch(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// logDestCaps Report what the probe found and which workarounds are enabled.
+func (j *job) logDestCaps() {
+	caps := j.fsCaps()
+	infof("destination %s: case-insensitive=%v unicode=%v max-name=%d rejects=%q",
+		j.Dest, caps.CaseInsensitive, caps.Unicode, caps.MaxName, caps.RejectedChars)
+	if caps.RejectedChars != "" || !caps.Unicode {
+		infof("enabled name sanitization for the destination")
+	}
+	if caps.CaseInsensitive {
+		infof("enabled case collision suffixes for the destination")
+	}
+}
+
+// destRel Rewrite a path relative to the destination into names it accepts.
+func (j *job) destRel(rel string) string {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i, part := range parts {
+		parts[i] = destName(j.fsCaps(), j.renameName(part))
+	}
+	return filepath.FromSlash(strings.Join(parts, "/"))
+}
+
+func destName(caps destCaps, name string) string {
+	if name == "" {
+		return name
+	}
+
+	if caps.RejectedChars != "" || !caps.Unicode {
+		name = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(caps.RejectedChars, r) || (!caps.Unicode && r > 127) {
+				return '_'
+			}
+			return r
+		}, name)
+	}
+
+	if caps.MaxName > 0 && len(name) > caps.MaxName {
+		ext := filepath.Ext(name)
+		if len(ext) >= caps.MaxName {
+			ext = ""
+		}
+		name = truncateUTF8(name[:len(name)-len(ext)], caps.MaxName-len(ext)) + ext
+	}
+
+	return name
+}
+
+func truncateUTF8(s string, n int) string {
+	for n > 0 && n < len(s) && s[n]&0xC0 == 0x80 {
+		n--
+	}
+	return s[:n]
+}
+
+// caseGuard On a case-insensitive destination, give the second of two source
+// files differing only in case its own name instead of overwriting the first,
+// and the same for a file already there under another case. With --flatten
+// or rename rules the same goes for any two files that end up sharing a name.
+// The names handed out are kept in .watch-names, so a restart gives every
+// file the name it had before.
+func (j *job) caseGuard(dstFileName string, srcFileName string) string {
+	if !j.guardsNames() {
+		return dstFileName
+	}
+
+	j.caseMu.Lock()
+	defer j.caseMu.Unlock()
+
+	name := dstFileName
+	ext := filepath.Ext(dstFileName)
+	for n := 2; ; n++ {
+		key := j.caseKey(name)
+		owner, ok := j.caseSeen[key]
+		if ok && owner == srcFileName {
+			return name
+		}
+		if !ok && !j.otherCase(name) {
+			j.noteName(key, srcFileName)
+			return name
+		}
+		name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(dstFileName, ext), n, ext)
+	}
+}
+
+// maxNames How many names caseGuard keeps before it forgets those whose
+// copy is gone from the destination.
+const maxNames = 100000
+
+// noteName Hand out key to srcFileName. The lock must be held.
+func (j *job) noteName(key string, srcFileName string) {
+	if len(j.caseSeen) >= maxNames && len(j.caseSeen)%maxNames == 0 {
+		j.pruneNames()
+	}
+	j.caseSeen[key] = srcFileName
+	if j.names != nil {
+		if err := j.names.Put(key, srcFileName); err != nil {
+			warnf("job %s: names: %v", j.Name, err)
+		}
+	}
+}
+
+// pruneNames Forget the names whose copy is gone from the destination. The
+// lock must be held.
+func (j *job) pruneNames() {
+	for key := range j.caseSeen {
+		if _, err := os.Lstat(filepath.Join(j.Dest, filepath.FromSlash(key))); os.IsNotExist(err) {
+			delete(j.caseSeen, key)
+			if j.names != nil {
+				j.names.Delete(key)
+			}
+		}
+	}
+}
+
+// handedOut dstFileName is a name caseGuard gave a source file that is
+// still there, such as "a (2).txt" for A.txt next to a.txt.
+func (j *job) handedOut(dstFileName string) bool {
+	if !j.guardsNames() {
+		return false
+	}
+	j.caseMu.Lock()
+	src, ok := j.caseSeen[j.caseKey(dstFileName)]
+	j.caseMu.Unlock()
+	if !ok {
+		return false
+	}
+	_, err := os.Lstat(src)
+	return err == nil
+}
+
+// handedName The destination name caseGuard gave srcFileName, if any.
+func (j *job) handedName(srcFileName string) (string, bool) {
+	if !j.guardsNames() {
+		return "", false
+	}
+	j.caseMu.Lock()
+	defer j.caseMu.Unlock()
+	for key, src := range j.caseSeen {
+		if src != srcFileName {
+			continue
+		}
+		if filepath.IsAbs(key) {
+			return key, true
+		}
+		// lower-cased where case does not count, so it still finds the file
+		return filepath.Join(j.Dest, filepath.FromSlash(key)), true
+	}
+	return "", false
+}
+
+// forgetName Free a name caseGuard handed out, once its copy is removed.
+func (j *job) forgetName(dstFileName string) {
+	if !j.guardsNames() {
+		return
+	}
+	j.caseMu.Lock()
+	defer j.caseMu.Unlock()
+	key := j.caseKey(dstFileName)
+	if _, ok := j.caseSeen[key]; !ok {
+		return
+	}
+	delete(j.caseSeen, key)
+	if j.names != nil {
+		j.names.Delete(key)
+	}
+}
+
+// otherCase On a case-insensitive destination, a file is there already
+// under the same name in another case, which copying would overwrite.
+func (j *job) otherCase(dstFileName string) bool {
+	if !j.fsCaps().CaseInsensitive {
+		return false
+	}
+	// only listed when something answers to the name at all
+	if _, err := os.Lstat(dstFileName); err != nil {
+		return false
+	}
+	base := filepath.Base(dstFileName)
+	entries, err := os.ReadDir(filepath.Dir(dstFileName))
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if e.Name() != base && strings.EqualFold(e.Name(), base) {
+			return true
+		}
+	}
+	return false
+}
+
+// guardsNames Two source files can end up with the same destination name.
+func (j *job) guardsNames() bool {
+	return j.fsCaps().CaseInsensitive || opts.Flatten || len(j.renames) > 0
+}
+
+// caseKey The key caseGuard files a destination name under: its path below
+// the destination, lower-cased where case does not count.
+func (j *job) caseKey(dstFileName string) string {
+	key := dstFileName
+	if rel, err := filepath.Rel(j.Dest, dstFileName); err == nil {
+		key = filepath.ToSlash(rel)
+	}
+	if j.fsCaps().CaseInsensitive {
+		key = strings.ToLower(key)
+	}
+	return key
+}
+
+// openNames Load the names caseGuard handed out before, for a local
+// destination that needs them.
+func (j *job) openNames() error {
+	if !j.guardsNames() || j.sink != nil || opts.Archive != "" {
+		return nil
+	}
+	names, err := openStore(filepath.Join(j.Dest, ".watch-names"))
+	if err != nil {
+		return err
+	}
+	for _, key := range names.Keys() {
+		var src string
+		if names.Get(key, &src) {
+			j.caseSeen[key] = src
+		}
+	}
+	j.names = names
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressEvery How often the progress bars of large copies are redrawn;
+// without a terminal a progress line is logged every progressLogEvery.
+const (
+	progressEvery    = 2 * time.Second
+	progressLogEvery = 30 * time.Second
+)
+
+// transfer A copy of a file above --progress-min under way.
+type transfer struct {
+	job     *job
+	src     string
+	dst     string
+	partial string // the file being written, "" when its size can't be seen
+	size    int64
+	started time.Time
+}
+
+// transferStatus How far a transfer got, for the status report. Done and
+// Percent are -1 for uploads, whose progress isn't known.
+type transferStatus struct {
+	Path    string  `json:"path"`
+	Dest    string  `json:"dest"`
+	Size    int64   `json:"size"`
+	Done    int64   `json:"done"`
+	Percent float64 `json:"percent"`
+	Rate    int64   `json:"bytes_per_second,omitempty"`
+	ETA     int64   `json:"eta_seconds,omitempty"`
+	Elapsed int64   `json:"elapsed_seconds"`
+}
+
+var (
+	progressMin int64
+
+	transfersMu sync.Mutex
+	transfers   = make(map[*transfer]bool)
+)
+
+// startTransfer Follow the copy of src to dst, written to partial, when src
+// is large enough. The result, possibly nil, must be finished.
+func startTransfer(j *job, src string, dst string, partial string) *transfer {
+	if progressMin <= 0 {
+		return nil
+	}
+	stat, err := os.Stat(src)
+	if err != nil || stat.Size() < progressMin {
+		return nil
+	}
+	t := &transfer{job: j, src: src, dst: dst, partial: partial, size: stat.Size(), started: time.Now()}
+	transfersMu.Lock()
+	transfers[t] = true
+	transfersMu.Unlock()
+	return t
+}
+
+func (t *transfer) finish() {
+	if t == nil {
+		return
+	}
+	transfersMu.Lock()
+	delete(transfers, t)
+	transfersMu.Unlock()
+}
+
+func (t *transfer) status() transferStatus {
+	elapsed := time.Since(t.started)
+	s := transferStatus{Path: t.src, Dest: t.dst, Size: t.size, Done: -1, Percent: -1, Elapsed: int64(elapsed.Seconds())}
+	if t.partial == "" {
+		return s
+	}
+	s.Done = 0
+	if stat, err := os.Stat(t.partial); err == nil {
+		s.Done = stat.Size()
+	}
+	if s.Done > t.size {
+		s.Done = t.size
+	}
+	s.Percent = float64(int(float64(s.Done)*1000/float64(t.size))) / 10
+	if elapsed >= time.Second && s.Done > 0 {
+		s.Rate = int64(float64(s.Done) / elapsed.Seconds())
+		s.ETA = (t.size - s.Done) / s.Rate
+	}
+	return s
+}
+
+// runningTransfers The status of the job's transfers, or of all of them for
+// a nil job, oldest first.
+func runningTransfers(j *job) []transferStatus {
+	transfersMu.Lock()
+	var list []*transfer
+	for t := range transfers {
+		if j == nil || t.job == j {
+			list = append(list, t)
+		}
+	}
+	transfersMu.Unlock()
+
+	sort.Slice(list, func(a, b int) bool { return list[a].started.Before(list[b].started) })
+	found := make([]transferStatus, 0, len(list))
+	for _, t := range list {
+		found = append(found, t.status())
+	}
+	return found
+}
+
+// showProgress Redraw a progress bar per large copy on stderr when it is a
+// terminal, or log a progress line now and then when it isn't.
+func showProgress() {
+	stat, err := os.Stderr.Stat()
+	terminal := err == nil && stat.Mode()&os.ModeCharDevice != 0
+
+	drawn := false
+	lastLog := time.Now()
+	for range time.Tick(progressEvery) {
+		running := runningTransfers(nil)
+		if terminal {
+			if len(running) == 0 && !drawn {
+				continue
+			}
+			bars := make([]string, 0, len(running))
+			for _, s := range running {
+				bars = append(bars, progressBar(s))
+			}
+			fmt.Fprint(os.Stderr, "\r\033[K"+strings.Join(bars, " | "))
+			drawn = len(running) > 0
+			continue
+		}
+		if time.Since(lastLog) < progressLogEvery {
+			continue
+		}
+		lastLog = time.Now()
+		for _, s := range running {
+			infof("copying %s: %s", s.Path, progressText(s))
+		}
+	}
+}
+
+// progressBar e.g. report.iso [=======>      ] 52.0% 20.8G/40.0G 85.2M/s ETA 3m50s
+func progressBar(s transferStatus) string {
+	const width = 20
+	name := s.Path[strings.LastIndexAny(s.Path, `/\`)+1:]
+	if s.Done < 0 {
+		return name + " " + progressText(s)
+	}
+	filled := int(s.Percent / 100 * width)
+	bar := strings.Repeat("=", filled)
+	if filled < width {
+		bar += ">" + strings.Repeat(" ", width-filled-1)
+	}
+	return fmt.Sprintf("%s [%s] %s", name, bar, progressText(s))
+}
+
+func progressText(s transferStatus) string {
+	if s.Done < 0 {
+		return fmt.Sprintf("uploading %s for %s", formatBytes(s.Size), time.Duration(s.Elapsed)*time.Second)
+	}
+	text := fmt.Sprintf("%.1f%% %s/%s", s.Percent, formatBytes(s.Done), formatBytes(s.Size))
+	if s.Rate > 0 {
+		text += fmt.Sprintf(" %s/s ETA %s", formatBytes(s.Rate), time.Duration(s.ETA)*time.Second)
+	}
+	return text
+}
+
+// formatBytes A size the way parseSize reads it, e.g. 1.5G.
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	size, unit := float64(n)/1024, 0
+	for size >= 1024 && unit < 3 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%c", size, "KMGT"[unit])
+}
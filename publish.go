@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// publisher A message bus connection sending one message per event.
+type publisher interface {
+	publish(msg []byte) error
+	close()
+}
+
+// busPublisher --publish: events and copy outcomes as JSON messages on a
+// NATS subject, an MQTT topic or a Kafka topic. Messages are sent from a
+// buffer in the background; while the bus is unreachable they are dropped
+// rather than held up, and the connection is retried.
+type busPublisher struct {
+	dest     string
+	open     func() (publisher, error)
+	messages chan []byte
+	done     chan struct{}
+}
+
+var bus *busPublisher
+
+// busSchemes Constructors for the --publish URL schemes.
+var busSchemes = map[string]func(u *url.URL) (publisher, error){
+	"nats":  newNATS,
+	"tls":   newNATS,
+	"mqtt":  newMQTT,
+	"mqtts": newMQTT,
+	"kafka": newKafka,
+}
+
+const busTimeout = 10 * time.Second
+
+func openBus(dest string) (*busPublisher, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	open, ok := busSchemes[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported --publish %s (nats, tls, mqtt, mqtts, kafka)", u.Redacted())
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("--publish %s: missing subject or topic", u.Redacted())
+	}
+
+	b := &busPublisher{
+		dest:     u.Redacted(),
+		open:     func() (publisher, error) { return open(u) },
+		messages: make(chan []byte, 4096),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b, nil
+}
+
+// send Queue msg, dropping it when the buffer is full.
+func (b *busPublisher) send(msg eventMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	select {
+	case b.messages <- data:
+	default:
+		debugf("publish %s: buffer full, dropped %s %s", b.dest, msg.Op, msg.Path)
+	}
+}
+
+func (b *busPublisher) run() {
+	defer close(b.done)
+	var p publisher
+	var retryAt time.Time
+	dropped := 0
+
+	for data := range b.messages {
+		if p == nil && time.Now().After(retryAt) {
+			var err error
+			if p, err = b.open(); err != nil {
+				warnf("publish %s: %v", b.dest, err)
+				retryAt = time.Now().Add(10 * time.Second)
+			} else if dropped > 0 {
+				warnf("publish %s: reconnected, %d messages were dropped", b.dest, dropped)
+				dropped = 0
+			}
+		}
+		if p == nil {
+			dropped++
+			continue
+		}
+		if err := p.publish(data); err != nil {
+			warnf("publish %s: %v", b.dest, err)
+			p.close()
+			p = nil
+			dropped++
+		}
+	}
+	if p != nil {
+		p.close()
+	}
+}
+
+// close Send what is buffered and disconnect, on shutdown.
+func (b *busPublisher) close() {
+	close(b.messages)
+	select {
+	case <-b.done:
+	case <-time.After(busTimeout):
+	}
+}
+
+func dialBus(u *url.URL, defaultPort string, secure bool) (net.Conn, error) {
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	addr := net.JoinHostPort(host, port)
+	if secure {
+		return tls.DialWithDialer(&net.Dialer{Timeout: busTimeout}, "tcp", addr, &tls.Config{ServerName: host})
+	}
+	return net.DialTimeout("tcp", addr, busTimeout)
+}
+
+// natsConn nats://[user:pass@|token@]host[:4222]/subject, tls:// for TLS.
+// NATS_TOKEN is used when the URL carries no credentials.
+type natsConn struct {
+	conn    net.Conn
+	subject string
+
+	mu  sync.Mutex
+	err error
+}
+
+func newNATS(u *url.URL) (publisher, error) {
+	conn, err := dialBus(u, "4222", u.Scheme == "tls")
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(busTimeout))
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("no NATS server at %s", u.Host)
+	}
+
+	connect := map[string]interface{}{"verbose": false, "pedantic": false, "name": "watch", "lang": "go"}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			connect["user"], connect["pass"] = u.User.Username(), pass
+		} else {
+			connect["auth_token"] = u.User.Username()
+		}
+	} else if token := os.Getenv("NATS_TOKEN"); token != "" {
+		connect["auth_token"] = token
+	}
+	line, _ := json.Marshal(connect)
+	// a PING right away surfaces a refused login as -ERR instead of PONG
+	if _, err = fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", line); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(reply, "PONG") {
+		conn.Close()
+		return nil, fmt.Errorf("NATS %s: %s", u.Host, strings.TrimSpace(reply))
+	}
+	conn.SetDeadline(time.Time{})
+
+	n := &natsConn{conn: conn, subject: strings.ReplaceAll(strings.Trim(u.Path, "/"), "/", ".")}
+	go n.read(r)
+	return n, nil
+}
+
+// read Answer the server's PINGs and note errors until the connection ends.
+func (n *natsConn) read(r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			n.fail(err)
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			n.mu.Lock()
+			io.WriteString(n.conn, "PONG\r\n")
+			n.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			n.fail(errors.New(strings.TrimSpace(line)))
+		}
+	}
+}
+
+func (n *natsConn) fail(err error) {
+	n.mu.Lock()
+	if n.err == nil {
+		n.err = err
+	}
+	n.mu.Unlock()
+}
+
+func (n *natsConn) publish(msg []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return n.err
+	}
+	n.conn.SetWriteDeadline(time.Now().Add(busTimeout))
+	_, err := fmt.Fprintf(n.conn, "PUB %s %d\r\n%s\r\n", n.subject, len(msg), msg)
+	return err
+}
+
+func (n *natsConn) close() {
+	n.conn.Close()
+}
+
+// mqttConn mqtt://[user:pass@]host[:1883]/topic, or mqtts:// on port 8883,
+// publishing with QoS 0 over MQTT 3.1.1. MQTT_PASSWORD is used when the URL
+// names a user without one.
+type mqttConn struct {
+	conn  net.Conn
+	topic string
+
+	mu   sync.Mutex
+	err  error
+	stop chan struct{}
+}
+
+const mqttKeepAlive = 60
+
+func newMQTT(u *url.URL) (publisher, error) {
+	port := "1883"
+	if u.Scheme == "mqtts" {
+		port = "8883"
+	}
+	conn, err := dialBus(u, port, u.Scheme == "mqtts")
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	var payload []byte
+	payload = mqttString(payload, "watch-"+host+"-"+strconv.Itoa(os.Getpid()))
+	flags := byte(0x02) // clean session
+	if u.User != nil {
+		flags |= 0x80
+		payload = mqttString(payload, u.User.Username())
+		pass, ok := u.User.Password()
+		if !ok {
+			pass = os.Getenv("MQTT_PASSWORD")
+		}
+		if pass != "" {
+			flags |= 0x40
+			payload = mqttString(payload, pass)
+		}
+	}
+	variable := append(mqttString(nil, "MQTT"), 4, flags, 0, mqttKeepAlive)
+
+	conn.SetDeadline(time.Now().Add(busTimeout))
+	if _, err = conn.Write(mqttPacket(0x10, append(variable, payload...))); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ack := make([]byte, 4)
+	if _, err = io.ReadFull(conn, ack); err != nil || ack[0] != 0x20 {
+		conn.Close()
+		return nil, fmt.Errorf("no MQTT broker at %s", u.Host)
+	}
+	if ack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("MQTT %s refused the connection (code %d)", u.Host, ack[3])
+	}
+	conn.SetDeadline(time.Time{})
+
+	m := &mqttConn{conn: conn, topic: strings.Trim(u.Path, "/"), stop: make(chan struct{})}
+	go m.keepAlive()
+	go m.read()
+	return m, nil
+}
+
+// keepAlive Ping often enough that the broker keeps an idle connection.
+func (m *mqttConn) keepAlive() {
+	tick := time.NewTicker(mqttKeepAlive / 2 * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			m.mu.Lock()
+			m.conn.SetWriteDeadline(time.Now().Add(busTimeout))
+			m.conn.Write([]byte{0xc0, 0})
+			m.mu.Unlock()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// read Discard ping responses until the broker hangs up.
+func (m *mqttConn) read() {
+	_, err := io.Copy(io.Discard, m.conn)
+	if err == nil {
+		err = io.EOF
+	}
+	m.mu.Lock()
+	if m.err == nil {
+		m.err = err
+	}
+	m.mu.Unlock()
+}
+
+func (m *mqttConn) publish(msg []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.conn.SetWriteDeadline(time.Now().Add(busTimeout))
+	_, err := m.conn.Write(mqttPacket(0x30, append(mqttString(nil, m.topic), msg...)))
+	return err
+}
+
+func (m *mqttConn) close() {
+	close(m.stop)
+	m.mu.Lock()
+	m.conn.Write([]byte{0xe0, 0}) // DISCONNECT
+	m.mu.Unlock()
+	m.conn.Close()
+}
+
+// mqttPacket A control packet: type byte, variable length, body.
+func mqttPacket(kind byte, body []byte) []byte {
+	packet := []byte{kind}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func mqttString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// kafkaConn kafka://broker1[:9092],broker2/topic through kcat, which stays
+// running and produces one message per line. Query parameters are passed as
+// librdkafka settings, e.g. ?security.protocol=SASL_SSL.
+type kafkaConn struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func newKafka(u *url.URL) (publisher, error) {
+	kcat, err := exec.LookPath("kcat")
+	if err != nil {
+		if kcat, err = exec.LookPath("kafkacat"); err != nil {
+			return nil, fmt.Errorf("kafka needs the kcat command: %v", err)
+		}
+	}
+
+	args := []string{"-P", "-b", u.Host, "-t", strings.Trim(u.Path, "/")}
+	for key, values := range u.Query() {
+		for _, v := range values {
+			args = append(args, "-X", key+"="+v)
+		}
+	}
+	cmd := exec.Command(kcat, args...)
+	detach(cmd)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &kafkaConn{cmd: cmd, stdin: stdin}, nil
+}
+
+func (k *kafkaConn) publish(msg []byte) error {
+	_, err := k.stdin.Write(append(msg, '\n'))
+	return err
+}
+
+func (k *kafkaConn) close() {
+	k.stdin.Close()
+	k.cmd.Wait()
+}
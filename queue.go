@@ -0,0 +1,423 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// copyTask One pending copy, not started before due so the file can settle.
+type copyTask struct {
+	job     *job
+	src     string
+	dst     string
+	due     time.Time
+	attempt int
+	seen    time.Time // the first event, zero for copies without one
+	// queued during maintenance: dst has yet to go through caseGuard
+	unguarded bool
+}
+
+// key What the queue files the task under: its destination, or its source
+// while the destination is not settled yet.
+func (t *copyTask) key() string {
+	if t.unguarded {
+		return "\x00" + t.src
+	}
+	return t.dst
+}
+
+// retryDelay The wait before the first retry of a failed copy, doubled for
+// every further attempt.
+const retryDelay = 5 * time.Second
+
+// copyQueue Pending copies, bounded to --queue-size. A new event for a file
+// already queued only pushes its due time back. When the queue is full,
+// --queue-policy block makes the event loop wait (backpressure) and
+// drop-oldest discards the oldest pending copy; a queue that is paused drops
+// the oldest even with block, as waiting for it would stall every job's
+// events. Every job has its own queue, so a slow or failing destination
+// doesn't hold up the others. Inside one of the job's pause windows, while it is held by a
+// pause command, or during maintenance, nothing is taken off the queue.
+type copyQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	tasks   []*copyTask
+	pending map[string]*copyTask
+	size    int
+	policy  string
+	dropped int64
+	name    string
+	pauses  []timeWindow
+	paused  bool
+	until   time.Time // when the pause window the queue is in ends
+	held    bool
+	retired bool // the job was removed by a reload
+	busy    int  // copies taken off the queue and not done yet
+}
+
+func newCopyQueue(size int, policy string) *copyQueue {
+	q := &copyQueue{pending: make(map[string]*copyTask), size: size, policy: policy}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *copyQueue) push(t *copyTask) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.retired {
+		return
+	}
+	if old, ok := q.pending[t.key()]; ok {
+		old.src = t.src
+		old.due = t.due
+		if t.attempt == 0 {
+			// a fresh event starts over, without the backoff of a failed copy
+			old.attempt, old.seen = 0, t.seen
+		}
+		return
+	}
+
+	// retries come from the workers, which must never wait on themselves
+	for q.size > 0 && len(q.tasks) >= q.size && t.attempt == 0 && !q.retired {
+		stalled := q.stalled(time.Now())
+		if q.policy == "drop-oldest" || stalled {
+			oldest := q.tasks[0]
+			q.tasks = q.tasks[1:]
+			delete(q.pending, oldest.key())
+			q.dropped++
+			if stalled && q.policy != "drop-oldest" {
+				warnf("queue full while paused, dropped copy of %s", oldest.src)
+			} else {
+				warnf("queue full, dropped copy of %s", oldest.src)
+			}
+			continue
+		}
+		q.cond.Wait()
+	}
+
+	q.tasks = append(q.tasks, t)
+	q.pending[t.key()] = t
+	q.cond.Broadcast()
+}
+
+// pop Wait for the first task that is due and take it off the queue. It
+// returns nil once the queue is retired.
+func (q *copyQueue) pop() *copyTask {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.retired {
+			return nil
+		}
+		now := time.Now()
+		var next time.Time
+		if on, _ := inMaintenance(); q.held || on {
+			q.cond.Wait()
+			continue
+		}
+		if until, in := q.pauseEnd(now); in {
+			next = until
+			if !q.paused {
+				infof("job %s: copies paused until %s", q.name, next.Format("Mon 15:04"))
+				q.paused = true
+				// a push waiting for a slot takes the copy instead
+				q.cond.Broadcast()
+			}
+			q.wait(now, next)
+			continue
+		}
+		if q.paused {
+			infof("job %s: copies resumed, %d waiting", q.name, len(q.tasks))
+			q.paused = false
+		}
+
+		for i, t := range q.tasks {
+			if !t.due.After(now) {
+				q.tasks = append(q.tasks[:i], q.tasks[i+1:]...)
+				delete(q.pending, t.key())
+				q.busy++
+				q.cond.Broadcast()
+				return t
+			}
+			if next.IsZero() || t.due.Before(next) {
+				next = t.due
+			}
+		}
+
+		q.wait(now, next)
+	}
+}
+
+// pauseEnd Whether now is inside one of the queue's pause windows, and when
+// that pause ends, worked out once per pause. The lock must be held.
+func (q *copyQueue) pauseEnd(now time.Time) (time.Time, bool) {
+	if now.Before(q.until) {
+		return q.until, true
+	}
+	if !inWindows(q.pauses, now) {
+		q.until = time.Time{}
+		return q.until, false
+	}
+	q.until = windowsEnd(q.pauses, now)
+	if q.until.IsZero() {
+		q.until = now.Add(time.Hour)
+	}
+	return q.until, true
+}
+
+// stalled Nothing is taken off the queue for now: it is held, in a pause
+// window, or waiting out maintenance. The lock must be held.
+func (q *copyQueue) stalled(now time.Time) bool {
+	if on, _ := inMaintenance(); q.held || on {
+		return true
+	}
+	_, in := q.pauseEnd(now)
+	return in
+}
+
+// wait Wait for the queue to change, or until next if it isn't zero. The
+// lock must be held.
+func (q *copyQueue) wait(now time.Time, next time.Time) {
+	if next.IsZero() {
+		q.cond.Wait()
+		return
+	}
+	timer := time.AfterFunc(next.Sub(now), func() {
+		q.mu.Lock()
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	})
+	q.cond.Wait()
+	timer.Stop()
+}
+
+// hold Stop taking copies off the queue, or start again; copies under way
+// finish. It reports whether that changed anything.
+func (q *copyQueue) hold(held bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.held == held {
+		return false
+	}
+	q.held = held
+	q.cond.Broadcast()
+	return true
+}
+
+// retire Stop the workers of a job removed by a reload, dropping what is
+// still queued; copies under way finish. It returns how many were dropped.
+func (q *copyQueue) retire() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	dropped := len(q.tasks)
+	q.retired, q.tasks, q.pending = true, nil, make(map[string]*copyTask)
+	q.cond.Broadcast()
+	return dropped
+}
+
+func (q *copyQueue) isRetired() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.retired
+}
+
+// wake Have pop look at the queue again, e.g. after maintenance.
+func (q *copyQueue) wake() {
+	q.mu.Lock()
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+func (q *copyQueue) isHeld() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.held
+}
+
+// flush Make every waiting copy due now, skipping what is left of the
+// settling delays and retry waits. It returns how many there are.
+func (q *copyQueue) flush() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for _, t := range q.tasks {
+		if t.due.After(now) {
+			t.due = now
+		}
+	}
+	q.cond.Broadcast()
+	return len(q.tasks)
+}
+
+// queuedCopy A copy waiting in a queue, for watch ctl queue.
+type queuedCopy struct {
+	Job     string    `json:"job"`
+	Path    string    `json:"path"`
+	Dest    string    `json:"dest"`
+	Due     time.Time `json:"due"`
+	Attempt int       `json:"attempt,omitempty"`
+}
+
+// list The copies waiting in the queue, soonest due first.
+func (q *copyQueue) list() []queuedCopy {
+	q.mu.Lock()
+	found := make([]queuedCopy, 0, len(q.tasks))
+	for _, t := range q.tasks {
+		found = append(found, queuedCopy{Job: t.job.Name, Path: t.src, Dest: t.dst, Due: t.due, Attempt: t.attempt})
+	}
+	q.mu.Unlock()
+	sort.SliceStable(found, func(a, b int) bool { return found[a].Due.Before(found[b].Due) })
+	return found
+}
+
+// idle Nothing waiting and nothing being copied.
+func (q *copyQueue) idle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks) == 0 && q.busy == 0
+}
+
+// drainQueues Copy what every job has queued without waiting for it to
+// settle, and wait up to timeout for the copies to finish, on shutdown. It
+// reports whether they did.
+func drainQueues(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		idle := true
+		for _, j := range runningJobs() {
+			if j.queue.isHeld() {
+				continue // paused on purpose, left for the next start
+			}
+			j.queue.flush()
+			if !j.queue.idle() {
+				idle = false
+			}
+		}
+		if idle {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// len Copies waiting in the queue.
+func (q *copyQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks)
+}
+
+// startWorkers Run n goroutines copying tasks off the queue.
+func (q *copyQueue) startWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				t := q.pop()
+				if t == nil {
+					return
+				}
+				runTask(t)
+				t.job.endBatch()
+				q.mu.Lock()
+				q.busy--
+				q.mu.Unlock()
+			}
+		}()
+	}
+}
+
+func runTask(t *copyTask) {
+	if t.unguarded {
+		t.dst, t.unguarded = t.job.fileDest(t.src), false
+	}
+	if t.job.twoWay != nil {
+		t.job.twoWay.run(t)
+		return
+	}
+
+	// 文件被删除则不处理
+	if !IsFile(t.src) {
+		return
+	}
+
+	tr := startTrace(t)
+	dst, err := t.job.prepareCopy(t.dst, t.src)
+	if err == errRefused || err == errSkipped {
+		if err == errSkipped {
+			infof("destination differs, kept %s", t.dst)
+		}
+		t.job.emitOutcome("skipped", t.dst, t.src, nil)
+		tr.end("skipped", nil)
+		return
+	} else if err != nil {
+		reportError(err)
+		t.job.emitOutcome("failed", t.dst, t.src, err)
+		tr.end("failed", err)
+		return
+	}
+
+	tracef(t.src, "copying %s to %s", t.src, dst)
+	start := time.Now()
+	copied, err := copyInto(t.job, dst, t.src, t.attempt)
+	tr.span("copy", start, time.Now(), err)
+	t.job.noteReachable(err)
+	if err == errUnchanged {
+		infof("file unchanged, skipped %s", dst)
+		t.job.emitOutcome("unchanged", dst, t.src, nil)
+		tr.end("unchanged", nil)
+	} else if err != nil {
+		t.job.retry(t, err)
+		tr.end("failed", err)
+		return
+	} else {
+		infof("file copy success %s", dst)
+		t.job.emitCopied(dst, t.src, copied)
+		noteLatency(t.seen)
+		atomic.AddInt64(&t.job.batch, 1)
+		tr.end("copied", nil)
+	}
+	t.job.recordSynced(dst, copied)
+
+	if err = moveSource(t.job, dst, t.src); err != nil {
+		reportError(err)
+	}
+	t.job.postCopy(t.src, dst)
+	t.job.onChange(t.src, "copied", dst)
+}
+
+// retry Queue a failed copy again after a growing delay, up to --retries
+// times, then count it as failed for its job.
+func (j *job) retry(t *copyTask, err error) {
+	if t.attempt >= opts.Retries {
+		atomic.AddInt64(&j.failed, 1)
+		atomic.AddInt64(&stats.Failed, 1)
+		if t.attempt > 0 {
+			err = fmt.Errorf("%v (gave up after %d retries)", err, t.attempt)
+		}
+		reportError(err)
+		j.emitOutcome("failed", t.dst, t.src, err)
+		return
+	}
+
+	delay := retryDelay << t.attempt
+	warnf("job %s: %v, retrying in %s", j.Name, err, delay)
+	j.queue.push(&copyTask{job: j, src: t.src, dst: t.dst, due: time.Now().Add(delay), attempt: t.attempt + 1, seen: t.seen})
+}
+
+// reportJobs Log how every job's destination fared.
+func reportJobs() {
+	for _, j := range runningJobs() {
+		infof("job %s to %s: %d copied, %d failed, %d waiting", j.Name, j.Dest, atomic.LoadInt64(&j.copied), atomic.LoadInt64(&j.failed), j.queue.len())
+	}
+}
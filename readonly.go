@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// validateReadOnlySource With --read-only-source, refuse to start when any
+// enabled feature could write into a source tree.
+func validateReadOnlySource(list []*job) error {
+	if !opts.ReadOnlySource {
+		return nil
+	}
+
+	problems := make([]string, 0)
+	if opts.OnChange != "" {
+		problems = append(problems, "--on-change runs arbitrary commands")
+	}
+	if opts.Move {
+		problems = append(problems, "--move deletes source files")
+	}
+	if opts.Link {
+		problems = append(problems, "--link shares source inodes with the destination")
+	}
+
+	for _, o := range []struct{ name, command string }{
+		{"--on-create", opts.OnCreate}, {"--on-write", opts.OnWrite}, {"--on-delete", opts.OnDelete}, {"--on-rename", opts.OnRename},
+		{"--pre-copy", opts.PreCopy}, {"--post-copy", opts.PostCopy}, {"--run", opts.Run},
+	} {
+		if o.command != "" {
+			problems = append(problems, o.name+" runs arbitrary commands")
+		}
+	}
+
+	for _, j := range list {
+		if j.OnCreate != "" || j.OnWrite != "" || j.OnDelete != "" || j.OnRename != "" || j.PreCopy != "" || j.PostCopy != "" {
+			problems = append(problems, fmt.Sprintf("job %s: its event and copy commands run arbitrary commands", j.Name))
+		}
+		if j.Dest != "" && inSource(j.Dest) {
+			problems = append(problems, fmt.Sprintf("job %s: destination %s is inside a source tree", j.Name, j.Dest))
+		}
+		if j.Dest != "" && inSource(j.stagingDir()) {
+			problems = append(problems, fmt.Sprintf("job %s: staging dir %s is inside a source tree", j.Name, j.stagingDir()))
+		}
+	}
+	if opts.Journal != "" && inSource(opts.Journal) {
+		problems = append(problems, fmt.Sprintf("journal %s is inside a source tree", opts.Journal))
+	}
+	if opts.BackupDir != "" && inSource(opts.BackupDir) {
+		problems = append(problems, fmt.Sprintf("backup dir %s is inside a source tree", opts.BackupDir))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("--read-only-source: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// inSource path lies inside one of the jobs' source trees.
+func inSource(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	for _, j := range runningJobs() {
+		root, err := filepath.Abs(j.Source)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, abs)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// guardSource The last line of defence: with --read-only-source every write
+// path is checked before touching the disk.
+func guardSource(path string) error {
+	if opts.ReadOnlySource && inSource(path) {
+		return fmt.Errorf("--read-only-source: refusing to write %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// reflinkFile Clone on APFS; cp -c uses clonefile(2) and fails elsewhere.
+func reflinkFile(dstFileName string, srcFileName string) bool {
+	if err := exec.Command("/bin/cp", "-c", srcFileName, dstFileName).Run(); err != nil {
+		os.Remove(dstFileName)
+		return false
+	}
+	return true
+}
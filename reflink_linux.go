@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// FICLONE from linux/fs.h
+const ficlone = 0x40049409
+
+// reflinkFile Clone srcFileName into a new dstFileName so both share blocks
+// (btrfs, XFS). False when the filesystem can't, leaving no file behind.
+func reflinkFile(dstFileName string, srcFileName string) bool {
+	src, err := os.Open(srcFileName)
+	if err != nil {
+		return false
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return false
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	dst.Close()
+	if errno != 0 {
+		os.Remove(dstFileName)
+		return false
+	}
+	return true
+}
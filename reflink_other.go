@@ -0,0 +1,7 @@
+//go:build !linux && !darwin
+
+package main
+
+func reflinkFile(dstFileName string, srcFileName string) bool {
+	return false
+}
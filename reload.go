@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The watch set: the folders of every job's source, with the folders added
+// and removed at runtime by path add and path remove. A reload, or one of
+// those commands, works out the folders wanted and watches or unwatches only
+// the difference, so queues, counters and watches that stay are untouched.
+
+var (
+	overridesMu  sync.Mutex
+	addedPaths   = make(map[string]bool) // watched with their folders
+	removedPaths = make(map[string]bool) // left out with their folders
+
+	watchSetMu sync.Mutex // one change of the watch set at a time
+)
+
+// wantedWatches The folders that should be watched now. The watches under a
+// source that can't be read at the moment, e.g. an unmounted volume, are
+// kept as they are.
+func wantedWatches() map[string]bool {
+	want := make(map[string]bool)
+	keepUnder := func(p string) {
+		rootsMu.Lock()
+		for dir := range roots {
+			if under(dir, p) {
+				want[dir] = true
+			}
+		}
+		rootsMu.Unlock()
+	}
+	resolve := func(p string) {
+		paths, err := ResolvePaths([]string{p})
+		if err != nil {
+			debugf("watch set: %v, keeping the watches under %s", err, p)
+			keepUnder(p)
+			return
+		}
+		for _, dir := range paths {
+			want[dir] = true
+		}
+	}
+
+	for _, j := range runningJobs() {
+		resolve(j.Source)
+	}
+	overridesMu.Lock()
+	defer overridesMu.Unlock()
+	for p := range addedPaths {
+		resolve(p)
+	}
+	for dir := range want {
+		for p := range removedPaths {
+			if under(dir, p) && !readded(dir, p) {
+				delete(want, dir)
+			}
+		}
+	}
+	return want
+}
+
+// readded Whether dir, in the removed folder p, is in a folder added again
+// inside p since; the narrower command wins. The caller holds overridesMu.
+func readded(dir string, p string) bool {
+	for a := range addedPaths {
+		if a != p && under(a, p) && under(dir, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateWatches Watch the wanted folders not watched yet and stop watching
+// those no longer wanted. It returns how many it added and removed.
+func updateWatches() (int, int, error) {
+	watchSetMu.Lock()
+	defer watchSetMu.Unlock()
+
+	want := wantedWatches()
+	var gone []string
+	rootsMu.Lock()
+	for dir := range roots {
+		if want[dir] {
+			delete(want, dir)
+		} else {
+			gone = append(gone, dir)
+		}
+	}
+	rootsMu.Unlock()
+
+	added := 0
+	for dir := range want {
+		if err := watchRoot(activeWatcher, dir); err != nil {
+			return added, 0, err
+		}
+		added++
+	}
+	for _, dir := range gone {
+		if err := activeWatcher.RemoveWatch(dir); err != nil {
+			debugf("unwatch %s: %v", dir, err)
+		}
+		rootsMu.Lock()
+		delete(roots, dir)
+		rootsMu.Unlock()
+	}
+	if added > 0 || len(gone) > 0 {
+		infof("watch set: %d folders added, %d removed", added, len(gone))
+	}
+	return added, len(gone), nil
+}
+
+// reloadWatches Read the --config file again, bring the jobs in line with
+// it and the watch set up to date with the folders of the sources as they
+// are now.
+func reloadWatches() (string, error) {
+	var changes []string
+	if opts.Config != "" {
+		loaded, err := loadConfig(opts.Config)
+		if err != nil {
+			return "", fmt.Errorf("%v, keeping the running config", err)
+		}
+		if changes, err = reloadJobs(loaded); err != nil {
+			return "", fmt.Errorf("%v, keeping the running config", err)
+		}
+	}
+
+	added, removed, err := updateWatches()
+	if err != nil {
+		return "", err
+	}
+	reply := fmt.Sprintf("watching %d more folders, %d fewer", added, removed)
+	if len(changes) > 0 {
+		infof("reload: %s", strings.Join(changes, ", "))
+		reply += "; " + strings.Join(changes, ", ")
+	}
+	return reply, nil
+}
+
+// reloadJobs Start the jobs new in loaded, retire those no longer in it and
+// replace those given another source or destination. Jobs that stay keep
+// their queues and counters. The "-back" job of a two-way pair comes and goes
+// with its pair, so it is never compared by itself.
+func reloadJobs(loaded []*job) ([]string, error) {
+	running := make(map[string]*job)
+	for _, j := range runningJobs() {
+		if j.twoWay != nil && j == j.twoWay.back {
+			continue
+		}
+		running[j.Name] = j
+	}
+
+	var kept, added, retired []*job
+	var changes []string
+	for _, l := range loaded {
+		j, ok := running[l.Name]
+		delete(running, l.Name)
+		switch {
+		case ok && j.Source == l.Source && j.Dest == l.Dest:
+			kept = append(kept, j)
+			continue
+		case ok:
+			retired = append(retired, j)
+			changes = append(changes, "job "+l.Name+" replaced")
+		default:
+			changes = append(changes, "job "+l.Name+" added")
+		}
+		added = append(added, l)
+	}
+	for name, j := range running {
+		retired = append(retired, j)
+		changes = append(changes, "job "+name+" removed")
+	}
+	if len(added) == 0 && len(retired) == 0 {
+		return nil, nil
+	}
+
+	// checked the same way as at the start, before anything changes
+	for _, j := range added {
+		for _, route := range opts.Route {
+			pattern, dest, _ := strings.Cut(route, "=")
+			if sameDest(j.Dest, dest) {
+				j.Include = append(j.Include, pattern)
+			}
+		}
+	}
+	if err := validateReadOnlySource(added); err != nil {
+		return nil, err
+	}
+	var err error
+	if opts.TwoWay {
+		if added, err = addTwoWayJobs(added); err != nil {
+			return nil, err
+		}
+	}
+	for _, j := range added {
+		if err = j.prepare(len(loaded)); err != nil {
+			return nil, err
+		}
+	}
+
+	list := make([]*job, 0, len(kept)+len(added))
+	for _, j := range kept {
+		list = append(list, j)
+		if j.twoWay != nil {
+			list = append(list, j.twoWay.back)
+		}
+	}
+	list = append(list, added...)
+	jobsMu.Lock()
+	jobs = list
+	jobsMu.Unlock()
+
+	for _, j := range retired {
+		dropped := j.queue.retire()
+		if j.twoWay != nil {
+			dropped += j.twoWay.back.queue.retire()
+		}
+		if dropped > 0 {
+			warnf("job %s: removed by reload, dropped %d queued copies", j.Name, dropped)
+		}
+	}
+	for _, j := range added {
+		j.queue.startWorkers(opts.Workers)
+		if j.schedule != nil {
+			go j.runSchedule()
+		}
+	}
+	go runInitialSyncs(added)
+
+	if registered != "" {
+		if err = register(filepath.Dir(registered)); err != nil {
+			warnf("reload: %v", err)
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// renameRule Turns one source name (a single path element) into its
+// destination name.
+type renameRule func(name string) string
+
+// unsafeChars Rejected by FAT, NTFS or awkward in S3 keys and URLs.
+const unsafeChars = `<>:"/\|?*#%{}^~[]` + "`"
+
+// asciiFrom/asciiTo One-letter transliterations; asciiMulti the rest.
+const (
+	asciiFrom = "ÀÁÂÃÄÅàáâãäåĀāĂăĄąÇçĆćĈĉĊċČčĎďĐđÈÉÊËèéêëĒēĔĕĖėĘęĚěĜĝĞğĠġĢģĤĥĦħÌÍÎÏìíîïĨĩĪīĬĭĮįİıĴĵĶķĹĺĻļĽľĿŀŁłÑñŃńŅņŇňÒÓÔÕÖØòóôõöøŌōŎŏŐőŔŕŖŗŘřŚśŜŝŞşŠšŢţŤťŦŧÙÚÛÜùúûüŨũŪūŬŭŮůŰűŲųŴŵÝýÿŶŷŸŹźŻżŽž"
+	asciiTo   = "AAAAAAaaaaaaAaAaAaCcCcCcCcCcDdDdEEEEeeeeEeEeEeEeEeGgGgGgGgHhHhIIIIiiiiIiIiIiIiIiJjKkLlLlLlLlLlNnNnNnNnOOOOOOooooooOoOoOoRrRrRrSsSsSsSsTtTtTtUUUUuuuuUuUuUuUuUuUuWwYyyYyYZzZzZz"
+)
+
+var asciiMulti = map[rune]string{
+	'Æ': "AE", 'æ': "ae", 'Œ': "OE", 'œ': "oe", 'ß': "ss",
+	'Þ': "TH", 'þ': "th", 'Ð': "D", 'ð': "d",
+}
+
+var asciiTable = func() map[rune]rune {
+	from, to := []rune(asciiFrom), []rune(asciiTo)
+	table := make(map[rune]rune, len(from))
+	for i, r := range from {
+		table[r] = to[i]
+	}
+	return table
+}()
+
+// parseRenameRules Build the rules from names: lower, safe, ascii, or a
+// s/regexp/replacement/ substitution.
+func parseRenameRules(names []string) ([]renameRule, error) {
+	rules := make([]renameRule, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+		case name == "lower":
+			rules = append(rules, strings.ToLower)
+		case name == "safe":
+			rules = append(rules, safeName)
+		case name == "ascii":
+			rules = append(rules, asciiName)
+		case strings.HasPrefix(name, "s") && len(name) > 1:
+			rule, err := substitution(name)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		default:
+			return nil, fmt.Errorf("unknown rename rule %q, use lower, safe, ascii or s/regexp/replacement/", name)
+		}
+	}
+	return rules, nil
+}
+
+// substitution s/regexp/replacement/, any character after the s may delimit.
+func substitution(expr string) (renameRule, error) {
+	sep := expr[1:2]
+	parts := strings.Split(expr[2:], sep)
+	if len(parts) != 3 || parts[2] != "" {
+		return nil, fmt.Errorf("invalid rename rule %q, use s/regexp/replacement/", expr)
+	}
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("rename rule %q: %v", expr, err)
+	}
+	replacement := parts[1]
+	return func(name string) string {
+		return re.ReplaceAllString(name, replacement)
+	}, nil
+}
+
+// safeName Replace unsafe and control characters with _, and drop the
+// trailing dots and spaces Windows strips silently.
+func safeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(unsafeChars, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if trimmed := strings.TrimRight(name, ". "); trimmed != "" {
+		name = trimmed
+	}
+	return name
+}
+
+// asciiName Transliterate accented Latin letters; other non-ASCII becomes _.
+func asciiName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r < 128:
+			b.WriteRune(r)
+		case asciiTable[r] != 0:
+			b.WriteRune(asciiTable[r])
+		case asciiMulti[r] != "":
+			b.WriteString(asciiMulti[r])
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// renameName Apply the job's rename rules to one path element. Separators the
+// rules put in become _, and a name they empty or turn into . or .. is kept
+// as it was, so a rule can never move a file out of its folder.
+func (j *job) renameName(name string) string {
+	if name == "" || name == "." || name == ".." {
+		return name
+	}
+	renamed := name
+	for _, rule := range j.renames {
+		renamed = rule(renamed)
+	}
+	renamed = strings.NewReplacer("/", "_", `\`, "_").Replace(renamed)
+	if renamed == "" || renamed == "." || renamed == ".." {
+		return name
+	}
+	return renamed
+}
+
+// compileRename The job's rename list, or --rename and --rename-regex.
+func (j *job) compileRename() (err error) {
+	names := j.Rename
+	if len(names) == 0 {
+		names = strings.Split(opts.Rename, ",")
+		if opts.RenameRegex != "" {
+			names = append(names, opts.RenameRegex)
+		}
+	}
+	j.renames, err = parseRenameRules(names)
+	return err
+}
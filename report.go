@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportKey The history keys of the daily totals, followed by the date,
+// e.g. "report 2024-06-01"; the other keys are absolute source paths.
+const reportKey = "report "
+
+// reportRow What a job copied from a root on a day.
+type reportRow struct {
+	Date     string `json:"date"`
+	Job      string `json:"job"`
+	Root     string `json:"root"`
+	Copies   int64  `json:"copies"`
+	Bytes    int64  `json:"bytes"`
+	Failures int64  `json:"failures"`
+}
+
+// countReport Add a copy of size bytes at t, or a failed one, to the day's
+// totals of the job. The caller holds historyMu.
+func (j *job) countReport(t time.Time, size int64, failed bool) {
+	key := reportKey + t.Local().Format("2006-01-02")
+	root, err := filepath.Abs(j.Source)
+	if err != nil {
+		root = j.Source
+	}
+
+	var rows []reportRow
+	history.Get(key, &rows)
+	n := -1
+	for i, r := range rows {
+		if r.Job == j.Name && r.Root == root {
+			n = i
+			break
+		}
+	}
+	if n < 0 {
+		rows = append(rows, reportRow{Date: key[len(reportKey):], Job: j.Name, Root: root})
+		n = len(rows) - 1
+	}
+	if failed {
+		rows[n].Failures++
+	} else {
+		rows[n].Copies++
+		rows[n].Bytes += size
+	}
+	if err = history.Put(key, rows); err != nil {
+		warnf("history: %v", err)
+	}
+}
+
+// parseAge A duration like time.ParseDuration reads, or a number of days
+// such as 7d.
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && n >= 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// reportCommand watch report --history file [--since 7d] [--format csv|json|html]
+// Print the copies, bytes and failures of every day, job and root in the
+// history's totals, oldest day first, with a total.
+func reportCommand(args []string) int {
+	if _, err := parseOptions(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if opts.History == "" {
+		fmt.Fprintln(os.Stderr, "usage: watch report --history file [--since 7d] [--format csv|json|html]")
+		return 2
+	}
+	format := opts.Format
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" && format != "html" {
+		fmt.Fprintf(os.Stderr, "invalid --format %q, use csv, json or html\n", format)
+		return 2
+	}
+
+	since := ""
+	if opts.Since != "" {
+		ago, err := parseAge(opts.Since)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		since = time.Now().Add(-ago).Local().Format("2006-01-02")
+	}
+
+	store, err := readStore(opts.History)
+	if store == nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err != nil {
+		warnf("history: %v", err)
+	}
+
+	var rows []reportRow
+	total := reportRow{Date: "total"}
+	for _, key := range store.Keys() {
+		if !strings.HasPrefix(key, reportKey) || key[len(reportKey):] < since {
+			continue
+		}
+		var day []reportRow
+		if !store.Get(key, &day) {
+			continue
+		}
+		for _, r := range day {
+			rows = append(rows, r)
+			total.Copies += r.Copies
+			total.Bytes += r.Bytes
+			total.Failures += r.Failures
+		}
+	}
+	sort.Slice(rows, func(a, b int) bool {
+		if rows[a].Date != rows[b].Date {
+			return rows[a].Date < rows[b].Date
+		}
+		if rows[a].Job != rows[b].Job {
+			return rows[a].Job < rows[b].Job
+		}
+		return rows[a].Root < rows[b].Root
+	})
+
+	switch format {
+	case "json":
+		err = json.NewEncoder(os.Stdout).Encode(struct {
+			Generated time.Time   `json:"generated"`
+			Since     string      `json:"since,omitempty"`
+			Rows      []reportRow `json:"rows"`
+			Total     reportRow   `json:"total"`
+		}{time.Now(), since, append([]reportRow{}, rows...), total})
+	case "html":
+		err = reportPage.Execute(os.Stdout, map[string]interface{}{
+			"Generated": time.Now().Local().Format("2006-01-02 15:04:05"), "Since": since, "Rows": rows, "Total": total,
+		})
+	default:
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"date", "job", "root", "copies", "bytes", "failures"})
+		for _, r := range append(rows, total) {
+			w.Write([]string{r.Date, r.Job, r.Root, strconv.FormatInt(r.Copies, 10),
+				strconv.FormatInt(r.Bytes, 10), strconv.FormatInt(r.Failures, 10)})
+		}
+		w.Flush()
+		err = w.Error()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+var reportPage = template.Must(template.New("report").Funcs(template.FuncMap{"bytes": formatBytes}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>watch transfer report</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; }
+td.n { text-align: right; }
+tfoot td { font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Transfer report</h1>
+<p>Generated {{.Generated}}{{if .Since}}, copies since {{.Since}}{{end}}.</p>
+<table>
+<thead><tr><th>Date</th><th>Job</th><th>Root</th><th>Copies</th><th>Bytes</th><th>Failures</th></tr></thead>
+<tbody>
+{{- range .Rows}}
+<tr><td>{{.Date}}</td><td>{{.Job}}</td><td>{{.Root}}</td><td class="n">{{.Copies}}</td><td class="n" title="{{.Bytes}}">{{bytes .Bytes}}</td><td class="n">{{.Failures}}</td></tr>
+{{- end}}
+</tbody>
+<tfoot><tr><td colspan="3">Total</td><td class="n">{{.Total.Copies}}</td><td class="n" title="{{.Total.Bytes}}">{{bytes .Total.Bytes}}</td><td class="n">{{.Total.Failures}}</td></tr></tfoot>
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// validPatterns Every pattern is a valid glob.
+func validPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad pattern %q", p)
+		}
+	}
+	return nil
+}
+
+// matchAny path matches one of the patterns: those with a slash are matched
+// against the path relative to the watched root, the others against the name.
+func matchAny(patterns []string, rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, p := range patterns {
+		target := path.Base(rel)
+		if strings.Contains(p, "/") {
+			target = rel
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// wants The job copies the file at filePath: it matches one of the job's
+// include patterns, if it has any, and none of its exclude patterns.
+func (j *job) wants(filePath string) bool {
+	if len(j.Include) == 0 && len(j.Exclude) == 0 {
+		return true
+	}
+	rel, err := filepath.Rel(j.root(), filePath)
+	if err != nil {
+		rel = filepath.Base(filePath)
+	}
+	if len(j.Include) > 0 && !matchAny(j.Include, rel) {
+		return false
+	}
+	return !matchAny(j.Exclude, rel)
+}
+
+// applyRoutes --route glob=dest: the jobs copying into dest only take files
+// matching the globs routed to it, instead of the global --include.
+func applyRoutes(list []*job, routes []string) error {
+	for _, route := range routes {
+		pattern, dest, ok := strings.Cut(route, "=")
+		if !ok || pattern == "" || dest == "" {
+			return fmt.Errorf("invalid --route %q, use glob=destination", route)
+		}
+		if err := validPatterns([]string{pattern}); err != nil {
+			return fmt.Errorf("--route: %v", err)
+		}
+
+		found := false
+		for _, j := range list {
+			if sameDest(j.Dest, dest) {
+				j.Include = append(j.Include, pattern)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("--route %s: no job copies to %s", route, dest)
+		}
+	}
+	return nil
+}
+
+func sameDest(a string, b string) bool {
+	if isRemote(a) || isRemote(b) {
+		return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+	}
+	return filepath.Clean(a) == filepath.Clean(b)
+}
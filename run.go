@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The --run command is kept running, like a dev server, and restarted when
+// files change: once changes have been quiet for --debounce, or --interval
+// without it, for the changes --on-change would run for. It is stopped with
+// --kill-signal and killed after --kill-timeout. When it exits on its own it
+// waits for the next change.
+
+// stopSignals What --kill-signal can be.
+var stopSignals = []string{"TERM", "INT", "HUP", "QUIT", "KILL", "USR1", "USR2"}
+
+var (
+	// runCycle Held while the --run command is being stopped or started, so
+	// restarts that overlap can't leave one running unseen.
+	runCycle sync.Mutex
+
+	runMu      sync.Mutex
+	running    *exec.Cmd
+	runExited  chan struct{} // closed when it exits
+	runRestart *time.Timer
+	runStopped bool // the watcher is exiting
+
+	// killTimeout How long the --run command gets to stop.
+	killTimeout time.Duration
+)
+
+// parseRunOptions Check --kill-signal and --kill-timeout, and the --run
+// command's words.
+func parseRunOptions() error {
+	if !contains(stopSignals, opts.KillSignal) {
+		return fmt.Errorf("invalid --kill-signal %s, use %s", opts.KillSignal, strings.Join(stopSignals, ", "))
+	}
+	var err error
+	if killTimeout, err = time.ParseDuration(opts.KillTimeout); err != nil || killTimeout < 0 {
+		return fmt.Errorf("invalid --kill-timeout %s", opts.KillTimeout)
+	}
+	if opts.Run != "" && !opts.Shell {
+		if _, err = splitWords(opts.Run); err != nil {
+			return fmt.Errorf("--run: %v", err)
+		}
+	}
+	return nil
+}
+
+// startRun Start the --run command, stopping the one running first.
+func startRun() {
+	runCycle.Lock()
+	defer runCycle.Unlock()
+	stopRunning(false)
+
+	runMu.Lock()
+	defer runMu.Unlock()
+	if runStopped {
+		return
+	}
+	var cmd *exec.Cmd
+	if opts.Shell {
+		cmd = shellCommand(opts.Run, nil)
+	} else {
+		args, _ := splitWords(opts.Run)
+		cmd = exec.Command(args[0], args[1:]...)
+	}
+	stdout, stderr := newLineLogger(levelInfo, "[run] "), newLineLogger(levelWarn, "[run] ")
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	cmd.WaitDelay = outputWaitDelay
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		reportError(&commandError{"run", opts.Run, err})
+		return
+	}
+	infof("run: started %s (pid %d)", opts.Run, cmd.Process.Pid)
+	exited := make(chan struct{})
+	running, runExited = cmd, exited
+	go func() {
+		err := cmd.Wait()
+		stdout.flush()
+		stderr.flush()
+		close(exited)
+		runMu.Lock()
+		stopping := running != cmd
+		if !stopping {
+			running = nil
+		}
+		runMu.Unlock()
+		switch {
+		case stopping:
+		case err != nil:
+			warnf("run: %s exited: %v, waiting for changes to start it again", opts.Run, err)
+		default:
+			infof("run: %s exited, waiting for changes to start it again", opts.Run)
+		}
+	}()
+}
+
+// restartRun Restart the --run command once changes have been quiet.
+func restartRun() {
+	if opts.Run == "" {
+		return
+	}
+	quiet := debounce
+	if quiet == 0 {
+		quiet = interval
+	}
+	runMu.Lock()
+	defer runMu.Unlock()
+	if runRestart != nil {
+		runRestart.Stop()
+	}
+	runRestart = time.AfterFunc(quiet, func() {
+		infof("run: files changed, restarting %s", opts.Run)
+		startRun()
+	})
+}
+
+// stopRun Stop the --run command with --kill-signal, and kill it with the
+// processes it started when it takes longer than --kill-timeout. exiting
+// keeps it from being started again.
+func stopRun(exiting bool) {
+	runCycle.Lock()
+	defer runCycle.Unlock()
+	stopRunning(exiting)
+}
+
+func stopRunning(exiting bool) {
+	runMu.Lock()
+	cmd, exited := running, runExited
+	running = nil
+	runStopped = runStopped || exiting
+	runMu.Unlock()
+	if cmd == nil {
+		return
+	}
+	if err := signalGroup(cmd, opts.KillSignal); err != nil {
+		debugf("run: %v", err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(killTimeout):
+		warnf("run: %s still running after --kill-timeout %s, killing it", opts.Run, killTimeout)
+		killGroup(cmd)
+		<-exited
+	}
+}
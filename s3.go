@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize Files bigger than one part go up as multipart uploads.
+const s3PartSize = 16 << 20
+
+// s3Sink s3://bucket/prefix. Credentials come from the chain in
+// awsCredentials, the region from ?region=, AWS_REGION or the profile.
+// ?endpoint=http://minio:9000 targets an S3-compatible server, addressing
+// buckets by path.
+type s3Sink struct {
+	client   *http.Client
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	region   string
+	service  string
+	creds    *awsProvider
+}
+
+type awsCreds struct {
+	AccessKey string
+	SecretKey string
+	Token     string
+}
+
+func newS3Sink(u *url.URL) (Sink, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: missing bucket", u.Redacted())
+	}
+
+	s := &s3Sink{
+		client:  &http.Client{Timeout: 10 * time.Minute},
+		bucket:  u.Host,
+		prefix:  strings.Trim(u.Path, "/"),
+		region:  u.Query().Get("region"),
+		service: "s3",
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_REGION")
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		profile := opts.Profile
+		if profile == "" {
+			profile = os.Getenv("AWS_PROFILE")
+		}
+		if profile == "" {
+			profile = "default"
+		}
+		shared, _ := awsSharedConfig(profile)
+		s.region = shared["region"]
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	var err error
+	if s.creds, err = awsCredentials(opts.Profile, s.region); err != nil {
+		return nil, fmt.Errorf("%s: %v", u.Redacted(), err)
+	}
+
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", s.bucket, s.region)
+	} else {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/" + s.bucket
+	}
+	if s.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *s3Sink) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+// EnsureDir Object stores have no folders.
+func (s *s3Sink) EnsureDir(dir string) error {
+	return nil
+}
+
+func (s *s3Sink) Stat(name string) (sinkStat, error) {
+	resp, err := s.do("HEAD", s.key(name), nil, nil, nil)
+	if err != nil {
+		return sinkStat{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return sinkStat{}, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return sinkStat{}, fmt.Errorf("s3 HEAD %s: %s", name, resp.Status)
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return sinkStat{Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *s3Sink) Remove(name string) error {
+	resp, err := s.do("DELETE", s.key(name), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("s3 DELETE %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+func (s *s3Sink) WriteFile(name string, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{"Content-Type": {contentType(f, name)}}
+	if stat.Size() <= s3PartSize {
+		_, err = s.put(s.key(name), nil, f, 0, stat.Size(), header)
+		return err
+	}
+	return s.multipart(s.key(name), f, stat.Size(), header)
+}
+
+// put Upload size bytes of f from off, returning the ETag.
+func (s *s3Sink) put(key string, query url.Values, f *os.File, off int64, size int64, header http.Header) (string, error) {
+	body := func() (io.Reader, int64) { return throttle(io.NewSectionReader(f, off, size)), size }
+	resp, err := s.do("PUT", key, query, body, header)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", s3Error("PUT", key, resp)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+// multipart Upload f in s3PartSize parts; a failed upload is aborted so its
+// parts are not billed.
+func (s *s3Sink) multipart(key string, f *os.File, size int64, header http.Header) error {
+	resp, err := s.do("POST", key, url.Values{"uploads": {""}}, nil, header)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || err != nil {
+		return fmt.Errorf("s3 multipart %s: %s %v", key, resp.Status, err)
+	}
+	upload := url.Values{"uploadId": {initiated.UploadID}}
+
+	parts := make([]s3Part, 0)
+	for off, n := int64(0), 1; off < size; off, n = off+s3PartSize, n+1 {
+		length := size - off
+		if length > s3PartSize {
+			length = s3PartSize
+		}
+		query := url.Values{"uploadId": {initiated.UploadID}, "partNumber": {strconv.Itoa(n)}}
+		etag, err := s.put(key, query, f, off, length, nil)
+		if err != nil {
+			s.abort(key, upload)
+			return err
+		}
+		parts = append(parts, s3Part{Number: n, ETag: etag})
+	}
+
+	var complete bytes.Buffer
+	xml.NewEncoder(&complete).Encode(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	body := func() (io.Reader, int64) { return bytes.NewReader(complete.Bytes()), int64(complete.Len()) }
+	resp, err = s.do("POST", key, upload, body, nil)
+	if err != nil {
+		s.abort(key, upload)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.abort(key, upload)
+		return s3Error("complete multipart", key, resp)
+	}
+	return nil
+}
+
+func (s *s3Sink) abort(key string, upload url.Values) {
+	if resp, err := s.do("DELETE", key, upload, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// do Send a signed request, retrying network errors and 5xx answers.
+func (s *s3Sink) do(method string, key string, query url.Values, body func() (io.Reader, int64), header http.Header) (*http.Response, error) {
+	u := *s.endpoint
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/" + awsEscape(key, true)
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	u.RawQuery = awsQuery(query)
+
+	return sinkRequest(s.client, func() (*http.Request, error) {
+		req, err := newBodyRequest(method, u.String(), body)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		creds, err := s.creds.get()
+		if err != nil {
+			return nil, err
+		}
+		signAWS(req, creds, s.region, s.service, "UNSIGNED-PAYLOAD")
+		return req, nil
+	})
+}
+
+func s3Error(op string, key string, resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 %s %s: %s %s", op, key, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// contentType From the extension, or sniffed from the first bytes.
+func contentType(f *os.File, name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	head := make([]byte, 512)
+	n, _ := f.ReadAt(head, 0)
+	return http.DetectContentType(head[:n])
+}
+
+// signAWS Sign req with AWS Signature Version 4.
+func signAWS(req *http.Request, creds awsCreds, region string, service string, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	names := []string{"host"}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" || lk == "content-md5" {
+			names = append(names, lk)
+		}
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := req.Host
+		if name != "host" {
+			value = strings.Join(req.Header.Values(name), ",")
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.AccessKey, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// awsEscape URI-encode s the way SigV4 expects: only unreserved characters
+// stay, and slashes too when keepSlash.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// awsQuery The canonical query string: sorted and strictly encoded.
+func awsQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Version One version or delete marker from ListObjectVersions.
+type s3Version struct {
+	Key          string    `xml:"Key"`
+	VersionID    string    `xml:"VersionId"`
+	IsLatest     bool      `xml:"IsLatest"`
+	LastModified time.Time `xml:"LastModified"`
+	deleted      bool
+}
+
+// listPrefix The key prefix for the objects under name.
+func (s *s3Sink) listPrefix(name string) string {
+	if name == "" && s.prefix != "" {
+		return s.prefix + "/"
+	}
+	return s.key(name)
+}
+
+// VersionsAt From ListObjectVersions; a delete marker counts as no version.
+func (s *s3Sink) VersionsAt(prefix string, at time.Time) ([]objectVersions, error) {
+	byKey := make(map[string][]s3Version)
+	query := url.Values{"versions": {""}, "prefix": {s.listPrefix(prefix)}}
+	for {
+		resp, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			IsTruncated         bool        `xml:"IsTruncated"`
+			NextKeyMarker       string      `xml:"NextKeyMarker"`
+			NextVersionIDMarker string      `xml:"NextVersionIdMarker"`
+			Versions            []s3Version `xml:"Version"`
+			DeleteMarkers       []s3Version `xml:"DeleteMarker"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error("list versions", query.Get("prefix"), resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range page.Versions {
+			byKey[v.Key] = append(byKey[v.Key], v)
+		}
+		for _, v := range page.DeleteMarkers {
+			v.deleted = true
+			byKey[v.Key] = append(byKey[v.Key], v)
+		}
+		if !page.IsTruncated {
+			break
+		}
+		query.Set("key-marker", page.NextKeyMarker)
+		query.Set("version-id-marker", page.NextVersionIDMarker)
+	}
+
+	objects := make([]objectVersions, 0, len(byKey))
+	for key, versions := range byKey {
+		o := objectVersions{Name: strings.TrimPrefix(strings.TrimPrefix(key, s.prefix), "/")}
+		var then *s3Version
+		for i, v := range versions {
+			if v.IsLatest && !v.deleted {
+				o.Current = v.VersionID
+			}
+			if !v.LastModified.After(at) && (then == nil || v.LastModified.After(then.LastModified)) {
+				then = &versions[i]
+			}
+		}
+		if then != nil && !then.deleted {
+			o.At = then.VersionID
+		}
+		objects = append(objects, o)
+	}
+	return objects, nil
+}
+
+// RestoreVersion Copy the old version over the object, which makes it the
+// newest version and keeps the history in between.
+func (s *s3Sink) RestoreVersion(name string, id string) error {
+	key := s.key(name)
+	source := "/" + s.bucket + "/" + awsEscape(key, true) + "?versionId=" + url.QueryEscape(id)
+	resp, err := s.do("PUT", key, nil, nil, http.Header{"X-Amz-Copy-Source": {source}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// a copy can fail after the 200 has been sent, with the error in the body
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK || bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("s3 copy %s version %s: %s %s", key, id, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// agentIdle How long the receiver keeps a quiet connection open.
+const agentIdle = 10 * time.Minute
+
+// serveCommand watch serve [--listen :7433] [--tls-cert c --tls-key k] dir
+// Receives files from agent:// senders into dir, so the destination host
+// needs no network filesystem mount.
+func serveCommand(args []string) int {
+	opts.Listen = ":" + agentPort
+	dirs, err := parseOptions(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(dirs) != 1 || (opts.TLSCert == "") != (opts.TLSKey == "") {
+		fmt.Fprintln(os.Stderr, "usage: watch serve [--listen :7433] [--tls-cert cert.pem --tls-key key.pem] dir")
+		return 2
+	}
+	if !IsDir(dirs[0]) {
+		fmt.Fprintln(os.Stderr, "copy target dir is not exists", dirs[0])
+		return 2
+	}
+	token := os.Getenv("WATCH_AGENT_TOKEN")
+	if token == "" {
+		fmt.Fprintln(os.Stderr, "serve needs WATCH_AGENT_TOKEN")
+		return 2
+	}
+
+	ln, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if opts.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	} else {
+		warnf("no --tls-cert, accepting unencrypted agent+tcp:// senders only")
+	}
+
+	infof("receiving into %s on %s", dirs[0], ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			errorf("%v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go serveAgent(conn, dirs[0], token)
+	}
+}
+
+// serveAgent Answer one sender's requests until it hangs up. Protocol
+// errors end the connection; failed requests only get an error response.
+func serveAgent(conn net.Conn, root string, token string) {
+	defer conn.Close()
+	c := &idleConn{Conn: conn, timeout: agentIdle}
+	r := bufio.NewReaderSize(c, 1<<20)
+	w := bufio.NewWriter(c)
+	peer := conn.RemoteAddr()
+
+	reply := func(resp agentResponse) error {
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	var hello agentRequest
+	if json.Unmarshal(line, &hello) != nil || hello.Op != "hello" || subtle.ConstantTimeCompare([]byte(hello.Token), []byte(token)) != 1 {
+		warnf("agent %s: refused, wrong token", peer)
+		reply(agentResponse{Error: "unauthorized"})
+		return
+	}
+	if reply(agentResponse{}) != nil {
+		return
+	}
+	debugf("agent %s: connected", peer)
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var req agentRequest
+		if err = json.Unmarshal(line, &req); err != nil {
+			warnf("agent %s: bad request %q", peer, line)
+			return
+		}
+
+		clean := path.Clean("/" + req.Path)
+		if clean == "/" && (req.Op == "remove" || req.Op == "put") {
+			// an empty path is the root, which is never removed or replaced
+			warnf("agent %s: refused %s without a path", peer, req.Op)
+			if req.Op == "put" {
+				return // the data follows, and can't be skipped safely
+			}
+			if reply(agentResponse{Error: "a path is required"}) != nil {
+				return
+			}
+			continue
+		}
+		local := filepath.Join(root, filepath.FromSlash(clean))
+		var resp agentResponse
+		var sigs map[uint32][]blockSig
+		switch req.Op {
+		case "mkdir":
+			err = mkdirAll(local)
+		case "remove":
+			if err = os.Remove(local); os.IsNotExist(err) {
+				err = nil
+			}
+		case "stat":
+			var stat os.FileInfo
+			if stat, err = os.Stat(local); err == nil {
+				resp.Size, resp.ModTime = stat.Size(), stat.ModTime()
+			}
+		case "sum":
+			resp.Sha256, err = fileSha256(local)
+		case "sigs":
+			sigs, err = fileSignatures(local)
+			for _, list := range sigs {
+				resp.Blocks += len(list)
+			}
+		case "put":
+			var intact bool
+			if intact, err = receiveFile(r, local, req); !intact {
+				warnf("agent %s: %s: %v", peer, req.Path, err)
+				return
+			}
+			if err == nil {
+				infof("file copy success %s", local)
+			}
+		default:
+			err = fmt.Errorf("unknown op %q", req.Op)
+		}
+
+		if os.IsNotExist(err) {
+			resp.NotExist = true
+		} else if err != nil {
+			errorf("agent %s: %s %s: %v", peer, req.Op, req.Path, err)
+			resp.Error = err.Error()
+		}
+		if err = reply(resp); err != nil {
+			return
+		}
+		if sigs != nil && writeSignatures(w, sigs) != nil {
+			return
+		}
+	}
+}
+
+func fileSignatures(name string) (map[uint32][]blockSig, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return blockSignatures(f, deltaBlock)
+}
+
+func writeSignatures(w *bufio.Writer, sigs map[uint32][]blockSig) error {
+	rec := make([]byte, 4+8+32)
+	for weak, list := range sigs {
+		for _, sig := range list {
+			binary.BigEndian.PutUint32(rec[:4], weak)
+			binary.BigEndian.PutUint64(rec[4:12], uint64(sig.index))
+			copy(rec[12:], sig.strong[:])
+			if _, err := w.Write(rec); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// receiveFile Rebuild a put's record stream into dst through a temp file.
+// The stream is read to its end even when the file cannot be written, so
+// the connection stays usable; intact is false when the stream broke.
+func receiveFile(r *bufio.Reader, dst string, req agentRequest) (intact bool, err error) {
+	in := r
+	var zr *gzip.Reader
+	if req.Gzip {
+		if zr, err = gzip.NewReader(r); err != nil {
+			return false, err
+		}
+		zr.Multistream(false)
+		in = bufio.NewReaderSize(zr, 1<<20)
+	}
+
+	var base *os.File
+	if req.Delta {
+		if base, err = os.Open(dst); err == nil {
+			defer base.Close()
+		}
+	}
+
+	var tmp *os.File
+	if err == nil {
+		if err = mkdirAll(filepath.Dir(dst)); err == nil {
+			tmp, err = os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".watch-agent-*")
+		}
+	}
+	if tmp != nil {
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+	}
+
+	// write errors are kept for the response; reading goes on regardless
+	sink := &stickyWriter{w: io.Discard, err: err}
+	if tmp != nil {
+		sink.w = tmp
+	}
+	out := bufio.NewWriterSize(sink, 1<<20)
+
+	var written int64
+	block := make([]byte, deltaBlock)
+	var hdr [8]byte
+	for done := false; !done; {
+		kind, rerr := in.ReadByte()
+		if rerr != nil {
+			return false, rerr
+		}
+		switch kind {
+		case agentLiteral:
+			if _, rerr = io.ReadFull(in, hdr[:4]); rerr != nil {
+				return false, rerr
+			}
+			n, rerr := io.CopyN(out, in, int64(binary.BigEndian.Uint32(hdr[:4])))
+			if rerr != nil {
+				return false, rerr
+			}
+			written += n
+		case agentBlock:
+			if _, rerr = io.ReadFull(in, hdr[:]); rerr != nil {
+				return false, rerr
+			}
+			if base == nil {
+				sink.fail(errors.New("delta without a base file"))
+				continue
+			}
+			if _, berr := base.ReadAt(block, int64(binary.BigEndian.Uint64(hdr[:]))*deltaBlock); berr != nil {
+				sink.fail(berr)
+			}
+			out.Write(block)
+			written += deltaBlock
+		case agentEnd:
+			done = true
+		default:
+			return false, fmt.Errorf("unknown record %q", kind)
+		}
+	}
+	if zr != nil {
+		// the gzip trailer carries the checksum
+		if _, err = io.Copy(io.Discard, zr); err != nil {
+			return false, err
+		}
+	}
+
+	out.Flush()
+	if sink.err != nil {
+		return true, sink.err
+	}
+	if written != req.Size {
+		return true, fmt.Errorf("got %d bytes, expected %d", written, req.Size)
+	}
+	if err = tmp.Close(); err != nil {
+		return true, err
+	}
+	os.Chmod(tmp.Name(), 0644)
+	if !req.ModTime.IsZero() {
+		os.Chtimes(tmp.Name(), req.ModTime, req.ModTime)
+	}
+	return true, os.Rename(tmp.Name(), dst)
+}
+
+// stickyWriter Remembers the first failure and swallows everything after it.
+type stickyWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (s *stickyWriter) Write(p []byte) (int, error) {
+	if s.err == nil {
+		_, s.err = s.w.Write(p)
+	}
+	return len(p), nil
+}
+
+func (s *stickyWriter) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sftpSink sftp://user@host[:port]/path, speaking the SFTP protocol to the
+// host's sftp subsystem through the OpenSSH client, so keys, the agent and
+// ~/.ssh/config work as they do for ssh. Nothing runs in a shell on the host.
+// One master connection per host is shared (ControlMaster), and the session
+// is reopened whenever it drops. ?key=/path/to/id selects an identity file.
+type sftpSink struct {
+	target string
+	root   string
+	args   []string
+
+	mu   sync.Mutex // one request at a time on conn
+	conn *sftpConn
+	dirs map[string]bool
+}
+
+// sftpAttempts Requests failing with a connection error are tried this often.
+const sftpAttempts = 3
+
+func newSFTPSink(u *url.URL) (Sink, error) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		return nil, fmt.Errorf("%s needs the ssh command: %v", u.Redacted(), err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%s: missing host", u.Redacted())
+	}
+
+	s := &sftpSink{target: u.Hostname(), root: u.Path, dirs: make(map[string]bool)}
+	if u.User != nil {
+		s.target = u.User.Username() + "@" + s.target
+	}
+	if s.root == "" {
+		s.root = "."
+	}
+
+	s.args = []string{"-o", "BatchMode=yes", "-o", "ServerAliveInterval=15"}
+	if runtime.GOOS != "windows" {
+		s.args = append(s.args,
+			"-o", "ControlMaster=auto",
+			"-o", "ControlPath="+filepath.Join(os.TempDir(), "watch-ssh-%C"),
+			"-o", "ControlPersist=60")
+	}
+	if port := u.Port(); port != "" {
+		s.args = append(s.args, "-p", port)
+	}
+	if key := u.Query().Get("key"); key != "" {
+		s.args = append(s.args, "-i", key)
+	}
+	return s, nil
+}
+
+// session Run fn on the SFTP session, opening it first, and again on a new
+// session when the connection fails.
+func (s *sftpSink) session(fn func(c *sftpConn) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if s.conn == nil {
+			s.conn, err = dialSFTP(s.target, s.args)
+		}
+		if err == nil {
+			err = fn(s.conn)
+			var status *sftpStatus
+			if err == nil || errors.As(err, &status) || errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			s.conn.close()
+			s.conn = nil
+		}
+		if attempt == sftpAttempts {
+			return fmt.Errorf("sftp %s: %v", s.target, err)
+		}
+		warnf("sftp %s: %v, reconnecting", s.target, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func (s *sftpSink) remote(name string) string {
+	return path.Join(s.root, name)
+}
+
+func (s *sftpSink) EnsureDir(dir string) error {
+	s.mu.Lock()
+	known := s.dirs[dir]
+	s.mu.Unlock()
+	if known {
+		return nil
+	}
+
+	err := s.session(func(c *sftpConn) error {
+		return c.mkdirAll(s.remote(dir))
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.dirs[dir] = true
+	s.mu.Unlock()
+	return nil
+}
+
+// WriteFile Upload into a hidden temp name and rename it into place, so
+// readers on the host never see a partial file.
+func (s *sftpSink) WriteFile(name string, src string) error {
+	tmp := s.remote(path.Join(path.Dir(name), ".watch-"+strconv.Itoa(os.Getpid())+"-"+path.Base(name)+stagingSuffix))
+	return s.session(func(c *sftpConn) error {
+		r, _, err := openUpload(src)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if err = c.upload(tmp, r); err != nil {
+			c.remove(tmp)
+			return err
+		}
+		return c.rename(tmp, s.remote(name))
+	})
+}
+
+func (s *sftpSink) Remove(name string) error {
+	return s.session(func(c *sftpConn) error {
+		err := c.remove(s.remote(name))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *sftpSink) Stat(name string) (sinkStat, error) {
+	var st sinkStat
+	err := s.session(func(c *sftpConn) error {
+		attrs, err := c.stat(s.remote(name))
+		if errors.Is(err, os.ErrNotExist) {
+			return os.ErrNotExist
+		}
+		if err != nil {
+			return err
+		}
+		if attrs.mode != 0 && attrs.mode&sftpTypeMask != sftpRegular {
+			return os.ErrNotExist
+		}
+		st = sinkStat{Size: attrs.size, ModTime: time.Unix(int64(attrs.mtime), 0)}
+		return nil
+	})
+	return st, err
+}
+
+// Sha256 Read name back from the host and checksum it.
+func (s *sftpSink) Sha256(name string) (string, error) {
+	var sum string
+	err := s.session(func(c *sftpConn) error {
+		h := sha256.New()
+		if err := c.download(s.remote(name), h); err != nil {
+			return err
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	return sum, err
+}
+
+// SFTP version 3 (draft-ietf-secsh-filexfer-02), as OpenSSH speaks it.
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatusP  = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpAttrsP   = 105
+	sftpExtended = 200
+
+	sftpOK         = 0
+	sftpEOF        = 1
+	sftpNoSuchFile = 2
+
+	sftpOpenRead  = 0x01
+	sftpOpenWrite = 0x02
+	sftpOpenCreat = 0x08
+	sftpOpenTrunc = 0x10
+
+	sftpAttrSize     = 0x01
+	sftpAttrUIDGID   = 0x02
+	sftpAttrPerms    = 0x04
+	sftpAttrTimes    = 0x08
+	sftpAttrExtended = 0x80000000
+
+	sftpTypeMask = 0170000
+	sftpRegular  = 0100000
+	sftpDir      = 0040000
+
+	// sftpChunk The data of one read or write; sftpWindow How many of them
+	// are sent before waiting for the answers.
+	sftpChunk  = 32 << 10
+	sftpWindow = 16
+)
+
+// sftpStatus An error answer of the server; the session stays usable.
+type sftpStatus struct {
+	code uint32
+	msg  string
+}
+
+func (e *sftpStatus) Error() string {
+	return fmt.Sprintf("%s (status %d)", e.msg, e.code)
+}
+
+type sftpAttrs struct {
+	size  int64
+	mode  uint32
+	mtime uint32
+}
+
+// sftpConn One session with the sftp subsystem of an ssh process.
+type sftpConn struct {
+	cmd         *exec.Cmd
+	w           io.WriteCloser
+	r           *bufio.Reader
+	id          uint32
+	posixRename bool // posix-rename@openssh.com, which replaces the target
+}
+
+func dialSFTP(target string, args []string) (*sftpConn, error) {
+	cmd := exec.Command("ssh", append(append([]string{}, args...), "-s", target, "sftp")...)
+	cmd.Stderr = newLineLogger(levelWarn, "ssh "+target+": ")
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := &sftpConn{cmd: cmd, w: w, r: bufio.NewReaderSize(r, 64<<10)}
+
+	var p sftpPacket
+	if err = c.send(*p.putByte(sftpInit).putUint32(3)); err != nil {
+		c.close()
+		return nil, err
+	}
+	typ, data, err := c.receive()
+	if err == nil && typ != sftpVersion {
+		err = fmt.Errorf("unexpected answer %d to init", typ)
+	}
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	data.uint32()
+	for len(data) > 0 {
+		name, _ := data.string(), data.string()
+		if name == "posix-rename@openssh.com" {
+			c.posixRename = true
+		}
+	}
+	return c, nil
+}
+
+func (c *sftpConn) close() {
+	c.w.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+}
+
+func (c *sftpConn) send(p sftpPacket) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(p)))
+	if _, err := c.w.Write(append(size[:], p...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *sftpConn) receive() (byte, sftpPacket, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n == 0 || n > 1<<20 {
+		return 0, nil, fmt.Errorf("bad packet length %d", n)
+	}
+	p := make(sftpPacket, n)
+	if _, err := io.ReadFull(c.r, p); err != nil {
+		return 0, nil, err
+	}
+	return p[0], p[1:], nil
+}
+
+// request Send a request of type typ and return the answer with its id.
+func (c *sftpConn) request(typ byte, body func(p *sftpPacket)) (byte, sftpPacket, error) {
+	if err := c.send(*c.next(typ, body)); err != nil {
+		return 0, nil, err
+	}
+	return c.answer()
+}
+
+// next A request of type typ with the next id.
+func (c *sftpConn) next(typ byte, body func(p *sftpPacket)) *sftpPacket {
+	c.id++
+	p := new(sftpPacket)
+	p.putByte(typ).putUint32(c.id)
+	body(p)
+	return p
+}
+
+// answer Read the answer to the oldest request in flight, without its id, as
+// OpenSSH answers in order.
+func (c *sftpConn) answer() (byte, sftpPacket, error) {
+	typ, data, err := c.receive()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) < 4 {
+		return 0, nil, errors.New("short packet")
+	}
+	data.uint32()
+	return typ, data, nil
+}
+
+// sftpResult The error of a status answer, nil for OK.
+func sftpResult(typ byte, data sftpPacket, what string) error {
+	if typ != sftpStatusP {
+		return fmt.Errorf("%s: unexpected answer %d", what, typ)
+	}
+	code, msg := data.uint32(), data.string()
+	switch code {
+	case sftpOK:
+		return nil
+	case sftpNoSuchFile:
+		return fmt.Errorf("%s: %w", what, os.ErrNotExist)
+	}
+	return &sftpStatus{code: code, msg: what + ": " + msg}
+}
+
+func (c *sftpConn) simple(typ byte, what string, body func(p *sftpPacket)) error {
+	t, data, err := c.request(typ, body)
+	if err != nil {
+		return err
+	}
+	return sftpResult(t, data, what)
+}
+
+func (c *sftpConn) open(name string, flags uint32) (string, error) {
+	typ, data, err := c.request(sftpOpen, func(p *sftpPacket) { p.putString(name).putUint32(flags).putUint32(0) })
+	if err != nil {
+		return "", err
+	}
+	if typ != sftpHandle {
+		return "", sftpResult(typ, data, "open "+name)
+	}
+	return data.string(), nil
+}
+
+func (c *sftpConn) closeHandle(h string) error {
+	return c.simple(sftpClose, "close", func(p *sftpPacket) { p.putString(h) })
+}
+
+// upload Write r to name, replacing what is there, sftpWindow chunks at a
+// time.
+func (c *sftpConn) upload(name string, r io.Reader) error {
+	h, err := c.open(name, sftpOpenWrite|sftpOpenCreat|sftpOpenTrunc)
+	if err != nil {
+		return err
+	}
+	var offset uint64
+	buf := make([]byte, sftpChunk)
+	for eof := false; !eof; {
+		inFlight := 0
+		for inFlight < sftpWindow && !eof {
+			n, rerr := io.ReadFull(r, buf)
+			if n > 0 {
+				if err := c.send(*c.next(sftpWrite, func(p *sftpPacket) { p.putString(h).putUint64(offset).putBytes(buf[:n]) })); err != nil {
+					return err
+				}
+				offset += uint64(n)
+				inFlight++
+			}
+			if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+				eof = true
+			} else if rerr != nil {
+				err, eof = rerr, true
+			}
+		}
+		for ; inFlight > 0; inFlight-- {
+			typ, data, aerr := c.answer()
+			if aerr != nil {
+				return aerr
+			}
+			if serr := sftpResult(typ, data, "write "+name); serr != nil && err == nil {
+				err, eof = serr, true
+			}
+		}
+	}
+	if cerr := c.closeHandle(h); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// download Read name into w, sftpWindow chunks at a time.
+func (c *sftpConn) download(name string, w io.Writer) error {
+	h, err := c.open(name, sftpOpenRead)
+	if err != nil {
+		return err
+	}
+	var offset uint64
+	for eof := false; !eof && err == nil; {
+		for i := 0; i < sftpWindow; i++ {
+			at := offset + uint64(i)*sftpChunk
+			if err := c.send(*c.next(sftpRead, func(p *sftpPacket) { p.putString(h).putUint64(at).putUint32(sftpChunk) })); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < sftpWindow; i++ {
+			typ, data, aerr := c.answer()
+			if aerr != nil {
+				return aerr
+			}
+			if eof || err != nil {
+				continue
+			}
+			if typ != sftpData {
+				if serr := sftpResult(typ, data, "read "+name); serr != nil {
+					var st *sftpStatus
+					if errors.As(serr, &st) && st.code == sftpEOF {
+						eof = true
+						continue
+					}
+					err = serr
+				}
+				continue
+			}
+			chunk := data.bytes()
+			if _, werr := w.Write(chunk); werr != nil {
+				err = werr
+			}
+			offset += uint64(len(chunk))
+			if len(chunk) < sftpChunk {
+				// a short read ends the file; the rest of the window is past it
+				eof = true
+			}
+		}
+	}
+	if cerr := c.closeHandle(h); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *sftpConn) stat(name string) (sftpAttrs, error) {
+	typ, data, err := c.request(sftpStat, func(p *sftpPacket) { p.putString(name) })
+	if err != nil {
+		return sftpAttrs{}, err
+	}
+	if typ != sftpAttrsP {
+		return sftpAttrs{}, sftpResult(typ, data, "stat "+name)
+	}
+	return data.attrs(), nil
+}
+
+func (c *sftpConn) remove(name string) error {
+	return c.simple(sftpRemove, "remove "+name, func(p *sftpPacket) { p.putString(name) })
+}
+
+// rename Move from over to, replacing it: atomically where the server has
+// the OpenSSH extension, else by removing to first.
+func (c *sftpConn) rename(from string, to string) error {
+	if c.posixRename {
+		return c.simple(sftpExtended, "rename "+from, func(p *sftpPacket) {
+			p.putString("posix-rename@openssh.com").putString(from).putString(to)
+		})
+	}
+	if err := c.remove(to); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return c.simple(sftpRename, "rename "+from, func(p *sftpPacket) { p.putString(from).putString(to) })
+}
+
+// mkdirAll Create dir and its parents, which may exist already.
+func (c *sftpConn) mkdirAll(dir string) error {
+	if attrs, err := c.stat(dir); err == nil {
+		if attrs.mode != 0 && attrs.mode&sftpTypeMask != sftpDir {
+			return fmt.Errorf("%s is not a folder", dir)
+		}
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if parent := path.Dir(dir); parent != dir && parent != "." && parent != "/" {
+		if err := c.mkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	err := c.simple(sftpMkdir, "mkdir "+dir, func(p *sftpPacket) { p.putString(dir).putUint32(0) })
+	var st *sftpStatus
+	if errors.As(err, &st) {
+		// made meanwhile by another uploader
+		if attrs, serr := c.stat(dir); serr == nil && attrs.mode&sftpTypeMask == sftpDir {
+			return nil
+		}
+	}
+	return err
+}
+
+// sftpPacket The body of a packet, built by appending and parsed by taking
+// from its front.
+type sftpPacket []byte
+
+func (p *sftpPacket) putByte(b byte) *sftpPacket {
+	*p = append(*p, b)
+	return p
+}
+
+func (p *sftpPacket) putUint32(v uint32) *sftpPacket {
+	*p = binary.BigEndian.AppendUint32(*p, v)
+	return p
+}
+
+func (p *sftpPacket) putUint64(v uint64) *sftpPacket {
+	*p = binary.BigEndian.AppendUint64(*p, v)
+	return p
+}
+
+func (p *sftpPacket) putString(s string) *sftpPacket {
+	return p.putBytes([]byte(s))
+}
+
+func (p *sftpPacket) putBytes(b []byte) *sftpPacket {
+	p.putUint32(uint32(len(b)))
+	*p = append(*p, b...)
+	return p
+}
+
+// The readers below return zero values past the end of a short packet.
+
+func (p *sftpPacket) take(n int) []byte {
+	if len(*p) < n {
+		n = len(*p)
+	}
+	b := (*p)[:n]
+	*p = (*p)[n:]
+	return b
+}
+
+func (p *sftpPacket) uint32() uint32 {
+	b := p.take(4)
+	if len(b) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (p *sftpPacket) uint64() uint64 {
+	b := p.take(8)
+	if len(b) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (p *sftpPacket) bytes() []byte {
+	return p.take(int(p.uint32()))
+}
+
+func (p *sftpPacket) string() string {
+	return string(p.bytes())
+}
+
+func (p *sftpPacket) attrs() sftpAttrs {
+	var a sftpAttrs
+	flags := p.uint32()
+	if flags&sftpAttrSize != 0 {
+		a.size = int64(p.uint64())
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		p.uint32()
+		p.uint32()
+	}
+	if flags&sftpAttrPerms != 0 {
+		a.mode = p.uint32()
+	}
+	if flags&sftpAttrTimes != 0 {
+		p.uint32()
+		a.mtime = p.uint32()
+	}
+	return a
+}
+
+// shellQuote Quote s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/botsphp/fsnotify"
+)
+
+// shareProbe How often a disconnected share is logged on to again.
+const shareProbe = 30 * time.Second
+
+var shareRetry = struct {
+	sync.Mutex
+	next map[string]time.Time
+}{next: make(map[string]time.Time)}
+
+// uncShare The \\server\share part of a UNC path, with either kind of
+// slash, or "" for other paths.
+func uncShare(p string) string {
+	if len(p) < 3 || !isSlash(p[0]) || !isSlash(p[1]) || isSlash(p[2]) || strings.Contains(p, "://") {
+		return ""
+	}
+	parts := strings.FieldsFunc(p[2:], func(r rune) bool { return r < 0x80 && isSlash(byte(r)) })
+	if len(parts) < 2 || parts[0] == "." || parts[0] == "?" {
+		// \\.\ and \\?\ are device paths, not shares
+		return ""
+	}
+	return `\\` + parts[0] + `\` + parts[1]
+}
+
+func isSlash(c byte) bool {
+	return c == '\\' || c == '/'
+}
+
+// connectShares Log on to the shares of a job's UNC source, destination and
+// fallbacks. Where there is no Windows networking, a UNC destination is
+// sent through smbclient instead, and a UNC source has to be mounted.
+func (j *job) connectShares() error {
+	if !shareLogon {
+		if uncShare(j.Source) != "" {
+			return fmt.Errorf("%s: mount the share and watch the mount point", j.Source)
+		}
+		if uncShare(j.Dest) != "" {
+			j.Dest = smbURL(j.Dest)
+		}
+		for i, dest := range j.Fallback {
+			if uncShare(dest) != "" {
+				j.Fallback[i] = smbURL(dest)
+			}
+		}
+		return nil
+	}
+
+	for _, p := range append([]string{j.Source, j.Dest}, j.Fallback...) {
+		share := uncShare(p)
+		if share == "" || (opts.ShareUser == "" && IsDir(share)) {
+			continue
+		}
+		if err := connectShare(share, opts.ShareUser, os.Getenv("SMB_PASSWORD")); err != nil {
+			return fmt.Errorf("%s: %v", share, err)
+		}
+		debugf("connected to %s", share)
+	}
+	return nil
+}
+
+// smbURL The smb:// destination for a UNC path, logging on as --share-user.
+func smbURL(p string) string {
+	host, rest, _ := strings.Cut(strings.ReplaceAll(strings.TrimLeft(p, `\/`), `\`, "/"), "/")
+	u := url.URL{Scheme: "smb", Host: host, Path: "/" + rest}
+	if opts.ShareUser != "" {
+		// DOMAIN\user is written domain;user in smb:// URLs
+		u.User = url.User(strings.Replace(opts.ShareUser, `\`, ";", 1))
+	}
+	return u.String()
+}
+
+// reconnectShare Log on to the share of a UNC path again, at most once per
+// shareProbe. It reports whether the path is reachable afterwards.
+func reconnectShare(p string) bool {
+	share := uncShare(p)
+	if share == "" || !shareLogon {
+		return false
+	}
+
+	shareRetry.Lock()
+	if time.Now().Before(shareRetry.next[share]) {
+		shareRetry.Unlock()
+		return false
+	}
+	shareRetry.next[share] = time.Now().Add(shareProbe)
+	shareRetry.Unlock()
+
+	if err := connectShare(share, opts.ShareUser, os.Getenv("SMB_PASSWORD")); err != nil {
+		warnf("share %s: %v", share, err)
+		return false
+	}
+	if !IsDir(p) {
+		return false
+	}
+	infof("share %s: reconnected", share)
+	return true
+}
+
+// watchShares Check the jobs' UNC sources and lost destinations every
+// shareProbe. A source whose share went away is reconnected, watched again,
+// and synced for the changes made while it was gone; a destination that
+// changes came for while it was gone is synced once it is back.
+func watchShares(watcher *fsnotify.Watcher) {
+	down := make(map[*job]bool)
+	for range time.Tick(shareProbe) {
+		for _, j := range runningJobs() {
+			if atomic.LoadInt32(&j.destLost) == 1 && (IsDir(j.Dest) || reconnectShare(j.Dest)) {
+				atomic.StoreInt32(&j.destLost, 0)
+				infof("job %s: destination %s is back, resyncing", j.Name, j.Dest)
+				go j.resyncAfterReconnect()
+			}
+			if on, _ := inMaintenance(); atomic.LoadInt32(&j.unprobed) == 1 && !on {
+				j.probe()
+			}
+		}
+
+		if !shareLogon {
+			continue
+		}
+		for _, j := range runningJobs() {
+			if uncShare(j.Source) == "" || IsDir(j.root()) {
+				continue
+			}
+			if !down[j] {
+				warnf("job %s: share of %s disconnected", j.Name, j.Source)
+				down[j] = true
+			}
+			if !reconnectShare(j.root()) {
+				continue
+			}
+			down[j] = false
+
+			paths, err := ResolvePaths([]string{j.Source})
+			if err != nil {
+				errorf("job %s: %v", j.Name, err)
+				continue
+			}
+			for _, p := range paths {
+				if err = watchRoot(watcher, p); err != nil {
+					debugf("watch %s: %v", p, err)
+				}
+			}
+			j.paths = paths
+			go j.resyncAfterReconnect()
+		}
+	}
+}
+
+func (j *job) resyncAfterReconnect() {
+	if err := j.initialSync(); err != nil {
+		errorf("job %s: resync after reconnect: %v", j.Name, err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// shareLogon UNC destinations go through smbclient here.
+const shareLogon = false
+
+func connectShare(share string, user string, password string) error {
+	return errors.New("not supported on this platform")
+}
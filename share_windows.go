@@ -0,0 +1,61 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// shareLogon UNC paths are opened directly, after WNetAddConnection2.
+const shareLogon = true
+
+const (
+	resourceTypeDisk        = 1
+	connectTemporary        = 4
+	errorCredentialConflict = 1219
+)
+
+var procWNetAddConnection2 = syscall.NewLazyDLL("mpr.dll").NewProc("WNetAddConnection2W")
+
+// netResource NETRESOURCEW.
+type netResource struct {
+	Scope       uint32
+	Type        uint32
+	DisplayType uint32
+	Usage       uint32
+	LocalName   *uint16
+	RemoteName  *uint16
+	Comment     *uint16
+	Provider    *uint16
+}
+
+// connectShare Log on to \\server\share for this session, as user when set
+// and otherwise with the current user's credentials.
+func connectShare(share string, user string, password string) error {
+	remote, err := syscall.UTF16PtrFromString(share)
+	if err != nil {
+		return err
+	}
+	res := netResource{Type: resourceTypeDisk, RemoteName: remote}
+
+	var userPtr, passPtr *uint16
+	if user != "" {
+		if userPtr, err = syscall.UTF16PtrFromString(user); err != nil {
+			return err
+		}
+		if passPtr, err = syscall.UTF16PtrFromString(password); err != nil {
+			return err
+		}
+	}
+
+	r, _, _ := procWNetAddConnection2.Call(uintptr(unsafe.Pointer(&res)), uintptr(unsafe.Pointer(passPtr)), uintptr(unsafe.Pointer(userPtr)), connectTemporary)
+	switch r {
+	case 0:
+		return nil
+	case errorCredentialConflict:
+		// already connected under other credentials, which Windows keeps using
+		if IsDir(share) {
+			return nil
+		}
+	}
+	return syscall.Errno(r)
+}
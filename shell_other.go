@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "os/exec"
+
+// shellCommand Run script with sh, the args as its "$@".
+func shellCommand(script string, args []string) *exec.Cmd {
+	return exec.Command("/bin/sh", append([]string{"-c", script, "watch"}, args...)...)
+}
+
+// quoteArg v as one word for sh.
+func quoteArg(v string) string {
+	return shellQuote(v)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// shellCommand Run script with cmd, the args after it. The command line is
+// passed as it is, as cmd doesn't follow the quoting rules of other programs.
+func shellCommand(script string, args []string) *exec.Cmd {
+	for _, a := range args {
+		script += " " + quoteArg(a)
+	}
+	comspec := os.Getenv("ComSpec")
+	if comspec == "" {
+		comspec = "cmd.exe"
+	}
+	cmd := exec.Command(comspec)
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: `"` + comspec + `" /S /C "` + script + `"`}
+	return cmd
+}
+
+// quoteArg v as one word for cmd. File names can't hold double quotes.
+func quoteArg(v string) string {
+	return `"` + v + `"`
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Sink A destination that is not a local directory. Paths are slash
+// separated and relative to the destination root.
+type Sink interface {
+	// EnsureDir Create dir and its parents if they are missing.
+	EnsureDir(dir string) error
+	// WriteFile Upload the local file src to name, replacing what is there.
+	// Readers should come from openUpload so --bwlimit applies.
+	WriteFile(name string, src string) error
+	// Remove Delete name; a missing file is not an error.
+	Remove(name string) error
+	// Stat Size and modification time of name, or os.ErrNotExist.
+	Stat(name string) (sinkStat, error)
+}
+
+// hashingSink A destination that can checksum what it holds, which --move
+// needs before it deletes a source file.
+type hashingSink interface {
+	Sink
+	// Sha256 The checksum of name's content as stored.
+	Sha256(name string) (string, error)
+}
+
+type sinkStat struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// sinkSchemes Constructors for the URL schemes a destination may use.
+var sinkSchemes = map[string]func(u *url.URL) (Sink, error){
+	"sftp":        newSFTPSink,
+	"s3":          newS3Sink,
+	"webdav":      newWebDAVSink,
+	"webdav+http": newWebDAVSink,
+	"ftp":         newFTPSink,
+	"ftps":        newFTPSink,
+	"smb":         newSMBSink,
+	"http":        newHTTPSink,
+	"https":       newHTTPSink,
+	"gs":          newGCSSink,
+	"azblob":      newAzureSink,
+	"agent":       newAgentSink,
+	"agent+tcp":   newAgentSink,
+}
+
+// isRemote dest is a URL with a known scheme rather than a local path.
+func isRemote(dest string) bool {
+	u, err := url.Parse(dest)
+	if err != nil || !strings.Contains(dest, "://") {
+		return false
+	}
+	if _, ok := sinkSchemes[u.Scheme]; ok {
+		return true
+	}
+	_, ok := pluginProgram(u.Scheme)
+	return ok
+}
+
+func openSink(dest string) (Sink, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	open, ok := sinkSchemes[u.Scheme]
+	if !ok {
+		return newPluginSink(u)
+	}
+	return open(u)
+}
+
+// remotePath The slash separated name of a source file below the sink root.
+func (j *job) remotePath(filePath string) string {
+	return path.Clean("/" + filepath.ToSlash(j.relDest(filePath)))[1:] + compressSuffix() + encryptSuffix()
+}
+
+// openUpload Open a local file for upload, throttled by --bwlimit.
+func openUpload(src string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{throttle(f), f}, stat.Size(), nil
+}
+
+// upload Copy srcFileName to name on the job's sink. A remote file at least
+// as new as the source with the same size counts as unchanged.
+func (j *job) upload(name string, srcFileName string) error {
+	src, err := os.Stat(srcFileName)
+	if err != nil {
+		return err
+	}
+
+	if !opts.AlwaysCopy {
+		remote, err := j.sink.Stat(name)
+		tolerance, _ := time.ParseDuration(opts.MtimeTolerance)
+		if err == nil && (transformed() || remote.Size == src.Size()) && !remote.ModTime.Before(src.ModTime().Add(-tolerance)) {
+			return errUnchanged
+		}
+	}
+
+	upload := srcFileName
+	if transformed() {
+		// compressed and encrypted copies are built locally first
+		tmp, err := os.CreateTemp("", "watch-upload-*")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		if _, err = copyTransformed(tmp.Name(), srcFileName); err != nil {
+			return err
+		}
+		upload = tmp.Name()
+	}
+
+	t := startTransfer(j, srcFileName, name, "")
+	defer t.finish()
+	if dir := path.Dir(name); dir != "." {
+		if err := j.sink.EnsureDir(dir); err != nil {
+			return err
+		}
+	}
+	if f, ok := j.sink.(*failoverSink); ok {
+		err = f.writeFrom(name, upload, srcFileName)
+	} else {
+		err = j.sink.WriteFile(name, upload)
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&stats.Copied, 1)
+	atomic.AddInt64(&stats.Bytes, src.Size())
+	atomic.AddInt64(&j.copied, 1)
+	noteCopy(j, name)
+	return nil
+}
+
+// uploaded The sink holds name with the content of srcFileName, as its
+// checksum tells.
+func (j *job) uploaded(name string, srcFileName string) error {
+	sink, ok := j.sink.(hashingSink)
+	if !ok || transformed() {
+		return fmt.Errorf("--move: %s can't be checked against %s, keeping the source", name, srcFileName)
+	}
+	srcSum, err := fileSha256(srcFileName)
+	if err != nil {
+		return err
+	}
+	remoteSum, err := sink.Sha256(name)
+	if err != nil {
+		return err
+	}
+	if remoteSum != srcSum {
+		return fmt.Errorf("--move: %s does not match %s, keeping the source", name, srcFileName)
+	}
+	return nil
+}
+
+// checkMove --move deletes a source file only once its copy's checksum
+// matches, which needs plain copies on a destination that can tell it.
+func (j *job) checkMove() error {
+	if !opts.Move || j.sink == nil {
+		return nil
+	}
+	if _, ok := j.sink.(hashingSink); !ok {
+		return fmt.Errorf("job %s --move needs a destination that can checksum its copies: a local folder, sftp:// or agent://", j.Name)
+	}
+	if transformed() {
+		return fmt.Errorf("job %s --move can't check compressed or encrypted uploads", j.Name)
+	}
+	return nil
+}
+
+// sinkRequest Send the request newRequest builds, building and sending it
+// again after a network error or a 5xx answer.
+func sinkRequest(client *http.Client, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	var err error
+	for attempt := 1; attempt <= 3; attempt++ {
+		req, rerr := newRequest()
+		if rerr != nil {
+			return nil, rerr
+		}
+
+		resp, derr := client.Do(req)
+		if derr == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if derr == nil {
+			resp.Body.Close()
+			derr = fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+		}
+		err = derr
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	return nil, err
+}
+
+// newBodyRequest A request whose body, if any, has a known length, as
+// object stores refuse chunked uploads.
+func newBodyRequest(method string, target string, body func() (io.Reader, int64)) (*http.Request, error) {
+	var r io.Reader
+	var size int64
+	if body != nil {
+		r, size = body()
+	}
+	if size == 0 {
+		r = nil
+	}
+	req, err := http.NewRequest(method, target, r)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	return req, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// smbSink smb://[domain;]user@server/share/path through Samba's smbclient,
+// so Windows shares work from Linux without mounting them. The password
+// comes from the URL or SMB_PASSWORD; ?kerberos=1 logs in with the current
+// Kerberos ticket instead.
+type smbSink struct {
+	service string
+	root    string
+	args    []string
+	env     []string
+
+	mu   sync.Mutex
+	dirs map[string]bool
+}
+
+func newSMBSink(u *url.URL) (Sink, error) {
+	if _, err := exec.LookPath("smbclient"); err != nil {
+		return nil, fmt.Errorf("%s needs the smbclient command: %v", u.Redacted(), err)
+	}
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if u.Hostname() == "" || parts[0] == "" {
+		return nil, fmt.Errorf("%s: use smb://server/share/path", u.Redacted())
+	}
+
+	s := &smbSink{service: "//" + u.Hostname() + "/" + parts[0], dirs: make(map[string]bool)}
+	if len(parts) == 2 {
+		s.root = parts[1]
+		if _, err := smbQuote(s.root); err != nil {
+			return nil, err
+		}
+	}
+	if port := u.Port(); port != "" {
+		s.args = append(s.args, "-p", port)
+	}
+
+	if u.Query().Get("kerberos") != "" {
+		s.args = append(s.args, "--use-kerberos=required")
+	} else if u.User != nil {
+		user := u.User.Username()
+		if i := strings.Index(user, ";"); i >= 0 {
+			s.args = append(s.args, "-W", user[:i])
+			user = user[i+1:]
+		}
+		pass, ok := u.User.Password()
+		if !ok {
+			pass = os.Getenv("SMB_PASSWORD")
+		}
+		// smbclient reads the password from PASSWD, keeping it off the command line
+		s.args = append(s.args, "-U", user)
+		s.env = append(os.Environ(), "PASSWD="+pass)
+	} else {
+		s.args = append(s.args, "-N")
+	}
+	return s, nil
+}
+
+// run Run smbclient commands in one session. smbclient exits 0 on some
+// failures, so its output is checked for NT_STATUS errors too.
+func (s *smbSink) run(commands string, stdin io.Reader) (string, error) {
+	args := append(append([]string{s.service}, s.args...), "-c", commands)
+	cmd := exec.Command("smbclient", args...)
+	cmd.Env = s.env
+	cmd.Stdin = stdin
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+
+	text := out.String()
+	if i := strings.Index(text, "NT_STATUS_"); i >= 0 {
+		status := strings.Fields(text[i:])[0]
+		return text, fmt.Errorf("smb %s: %s", s.service, status)
+	}
+	if err != nil {
+		return text, fmt.Errorf("smb %s: %v %s", s.service, err, strings.TrimSpace(text))
+	}
+	return text, nil
+}
+
+func (s *smbSink) remote(name string) (string, error) {
+	return smbQuote(path.Join(s.root, name))
+}
+
+// smbQuote A path on the share as one argument of an smbclient command.
+func smbQuote(name string) (string, error) {
+	return smbArg(strings.ReplaceAll(name, "/", `\`))
+}
+
+// smbArg s as one argument of an smbclient command. smbclient splits
+// commands on ; even inside quotes and has no escape for a quote, so names
+// with either, or with a line break, are refused: they could run commands
+// of their own on the share.
+func smbArg(s string) (string, error) {
+	if strings.ContainsAny(s, ";\"\r\n") {
+		return "", fmt.Errorf("smb: %q can't be passed to smbclient safely, it has a ; quote or line break", s)
+	}
+	return `"` + s + `"`, nil
+}
+
+// EnsureDir mkdir every level, the root path on the share included.
+func (s *smbSink) EnsureDir(dir string) error {
+	parts := strings.Split(path.Join(s.root, dir), "/")
+	for i := range parts {
+		sub := strings.Join(parts[:i+1], "/")
+
+		s.mu.Lock()
+		known := s.dirs[sub]
+		s.mu.Unlock()
+		if known {
+			continue
+		}
+
+		quoted, err := smbQuote(sub)
+		if err != nil {
+			return err
+		}
+		if _, err := s.run("mkdir "+quoted, nil); err != nil && !strings.Contains(err.Error(), "COLLISION") {
+			return err
+		}
+		s.mu.Lock()
+		s.dirs[sub] = true
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// WriteFile put under a temp name and rename over the target in one session.
+func (s *smbSink) WriteFile(name string, src string) error {
+	tmp, err := s.remote(path.Join(path.Dir(name), ".watch-"+strconv.Itoa(os.Getpid())+"-"+path.Base(name)+stagingSuffix))
+	if err != nil {
+		return err
+	}
+	target, err := s.remote(name)
+	if err != nil {
+		return err
+	}
+	if bandwidth == nil {
+		local, err := smbArg(src)
+		if err != nil {
+			return err
+		}
+		_, err = s.run(fmt.Sprintf(`put %s %s; rename %s %s -f`, local, tmp, tmp, target), nil)
+		return err
+	}
+
+	// smbclient reads the file itself, so --bwlimit goes through a pipe
+	r, _, err := openUpload(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = s.run(fmt.Sprintf(`put /dev/stdin %s; rename %s %s -f`, tmp, tmp, target), r)
+	return err
+}
+
+func (s *smbSink) Remove(name string) error {
+	target, err := s.remote(name)
+	if err != nil {
+		return err
+	}
+	_, err = s.run("del "+target, nil)
+	if err != nil && strings.Contains(err.Error(), "NOT_FOUND") {
+		return nil
+	}
+	return err
+}
+
+// Stat Parse an ls line: name, attributes, size and the date, right to left
+// since names may contain spaces.
+func (s *smbSink) Stat(name string) (sinkStat, error) {
+	target, err := s.remote(name)
+	if err != nil {
+		return sinkStat{}, err
+	}
+	out, err := s.run("ls "+target, nil)
+	if err != nil {
+		if strings.Contains(err.Error(), "NOT_FOUND") || strings.Contains(err.Error(), "NO_SUCH_FILE") {
+			return sinkStat{}, os.ErrNotExist
+		}
+		return sinkStat{}, err
+	}
+
+	base := path.Base(name)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 7 || !strings.HasPrefix(strings.TrimSpace(line), base) {
+			continue
+		}
+		n := len(fields)
+		size, err := strconv.ParseInt(fields[n-6], 10, 64)
+		if err != nil {
+			continue
+		}
+		modTime, _ := time.ParseInLocation("Mon Jan 2 15:04:05 2006", strings.Join(fields[n-5:], " "), time.Local)
+		return sinkStat{Size: size, ModTime: modTime}, nil
+	}
+	return sinkStat{}, os.ErrNotExist
+}
@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestSMBQuote(t *testing.T) {
+	got, err := smbQuote("in/a b.txt")
+	if err != nil || got != `"in\a b.txt"` {
+		t.Errorf(`smbQuote("in/a b.txt") = %q, %v`, got, err)
+	}
+	for _, name := range []string{`a";del x;".txt`, "a;b.txt", `a"b.txt`, "a\nb.txt"} {
+		if got, err := smbQuote(name); err == nil {
+			t.Errorf("smbQuote(%q) = %q, want an error", name, got)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// snapshotLayout The name of a snapshot folder, one per hour at most:
+// dest/2024-06-01T12.
+const snapshotLayout = "2006-01-02T15"
+
+// snapshots The snapshot folders in dest, oldest first.
+func snapshots(dest string) []string {
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if _, err := time.Parse(snapshotLayout, e.Name()); err == nil && e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// target The folder copies go to: the destination, or with --snapshots the
+// current snapshot in it.
+func (j *job) target() string {
+	if !opts.Snapshots {
+		return j.Dest
+	}
+	j.snapMu.Lock()
+	defer j.snapMu.Unlock()
+	return filepath.Join(j.Dest, j.snapshot)
+}
+
+// openSnapshots Carry on with the newest snapshot in the destination until
+// the first sync starts the next.
+func (j *job) openSnapshots() error {
+	if names := snapshots(j.Dest); len(names) > 0 {
+		j.snapshot = names[len(names)-1]
+		return nil
+	}
+	j.snapshot = time.Now().Format(snapshotLayout)
+	return mkdirAll(filepath.Join(j.Dest, j.snapshot))
+}
+
+// newSnapshot Start the snapshot a full sync writes into: a copy of the
+// previous one made of hard links, so only what changed takes space. Within
+// the hour of the previous snapshot the sync updates that one instead.
+// Snapshots beyond --snapshot-keep are removed, oldest first.
+func (j *job) newSnapshot() error {
+	name := time.Now().Format(snapshotLayout)
+	j.snapMu.Lock()
+	previous := j.snapshot
+	j.snapMu.Unlock()
+	if name == previous {
+		return nil
+	}
+
+	dir := filepath.Join(j.Dest, name)
+	if err := linkTree(dir, filepath.Join(j.Dest, previous)); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	j.snapMu.Lock()
+	j.snapshot = name
+	j.snapMu.Unlock()
+	infof("job %s: snapshot %s", j.Name, dir)
+
+	if opts.SnapshotKeep <= 0 {
+		return nil
+	}
+	names := snapshots(j.Dest)
+	for len(names) > opts.SnapshotKeep {
+		old := filepath.Join(j.Dest, names[0])
+		if err := os.RemoveAll(old); err != nil {
+			return err
+		}
+		infof("job %s: removed snapshot %s", j.Name, old)
+		names = names[1:]
+	}
+	return nil
+}
+
+// linkTree Recreate the tree at src in dst with hard links to its files.
+func linkTree(dst string, src string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		if internal(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		return os.Link(path, target)
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// sparse The file has fewer blocks allocated than its size needs.
+func sparse(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Blocks*512 < info.Size()
+}
+
+// copySparse Copy only the data regions found with SEEK_DATA/SEEK_HOLE and
+// leave the holes unwritten, so the copy stays sparse.
+func copySparse(dst *os.File, src *os.File, size int64) (int64, error) {
+	var written, offset int64
+	for offset < size {
+		data, err := src.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break // only a hole left
+		}
+		if err != nil {
+			return written, err
+		}
+		hole, err := src.Seek(data, seekHole)
+		if err != nil {
+			return written, err
+		}
+
+		n, err := io.Copy(io.NewOffsetWriter(dst, data), throttle(io.NewSectionReader(src, data, hole-data)))
+		written += n
+		if err != nil {
+			return written, err
+		}
+		offset = hole
+	}
+
+	return written, dst.Truncate(size)
+}
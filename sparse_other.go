@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func sparse(info os.FileInfo) bool {
+	return false
+}
+
+func copySparse(dst *os.File, src *os.File, size int64) (int64, error) {
+	return 0, errors.New("sparse copies are not supported on this platform")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const stagingSuffix = ".tmp"
+
+var stagingSeq uint64
+
+// stagingDir Where partial copies are written before being renamed into
+// place. It defaults to a hidden folder inside the job's destination so the
+// final rename stays on one volume.
+func (j *job) stagingDir() string {
+	if opts.StagingDir != "" {
+		return opts.StagingDir
+	}
+	return filepath.Join(j.Dest, ".watch-staging")
+}
+
+// checkStaging A --staging-dir has to be on the destination's volume, as
+// copies are renamed from it into place; a test file is renamed across to
+// find out.
+func (j *job) checkStaging() error {
+	if opts.StagingDir == "" || j.sink != nil || opts.Archive != "" || !IsDir(j.Dest) {
+		return nil
+	}
+	if err := mkdirAll(opts.StagingDir); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(opts.StagingDir, probePrefix+"staging-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	moved := filepath.Join(j.Dest, filepath.Base(f.Name()))
+	err = os.Rename(f.Name(), moved)
+	os.Remove(f.Name())
+	os.Remove(moved)
+	if err != nil {
+		return fmt.Errorf("--staging-dir %s has to be on the same volume as %s: %v", opts.StagingDir, j.Dest, err)
+	}
+	return nil
+}
+
+// stagingName A temp path unique to this job, process and copy, so concurrent
+// copies of the same file never share a temp file.
+func (j *job) stagingName(dstFileName string) string {
+	seq := atomic.AddUint64(&stagingSeq, 1)
+	name := fmt.Sprintf("%s-%d-%d-%s%s", j.Name, os.Getpid(), seq, filepath.Base(dstFileName), stagingSuffix)
+	return filepath.Join(j.stagingDir(), name)
+}
+
+// cleanStaging Remove temp files earlier runs of this job left behind.
+func (j *job) cleanStaging() {
+	entries, err := os.ReadDir(j.stagingDir())
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !j.staleTemp(name) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(j.stagingDir(), name)); err == nil {
+			infof("removed stale temp file %s", name)
+		}
+	}
+}
+
+// staleTemp name is a temp file of this job whose process is gone, not one
+// another instance sharing the folder is still writing. The job's name is
+// followed by the pid and a sequence number; as the fan-out job default-2
+// starts like default, every number that could be the pid has to be of a
+// process that isn't running.
+func (j *job) staleTemp(name string) bool {
+	if !strings.HasPrefix(name, j.Name+"-") || !strings.HasSuffix(name, stagingSuffix) {
+		return false
+	}
+	fields := strings.Split(strings.TrimPrefix(name, j.Name+"-"), "-")
+	var numbers []int
+	for _, f := range fields[:len(fields)-1] {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			break
+		}
+		numbers = append(numbers, n)
+	}
+	if len(numbers) < 2 {
+		return false
+	}
+	// the last one is the sequence number
+	for _, pid := range numbers[:len(numbers)-1] {
+		if pid == os.Getpid() || processAlive(pid) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// syncState A file as both sides had it after its last sync. Comparing a side
+// with it tells whether that side changed since: the size and mtime decide
+// when they match, the hash when only the mtime moved.
+type syncState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Sha256  string    `json:"sha256,omitempty"`
+}
+
+func (s syncState) matches(stat os.FileInfo) bool {
+	tolerance, _ := time.ParseDuration(opts.MtimeTolerance)
+	diff := stat.ModTime().Sub(s.ModTime)
+	if diff < 0 {
+		diff = -diff
+	}
+	return stat.Size() == s.Size && diff <= tolerance
+}
+
+// same path still holds what was synced: touched, perhaps, but not changed.
+func (s syncState) same(path string, stat os.FileInfo) bool {
+	if s.matches(stat) {
+		return true
+	}
+	if s.Sha256 == "" || stat.Size() != s.Size {
+		return false
+	}
+	sum, err := fileSha256(path)
+	return err == nil && sum == s.Sha256
+}
+
+// identical a and b have the same size and checksum.
+func identical(a string, b string) bool {
+	aStat, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bStat, err := os.Stat(b)
+	if err != nil || aStat.Size() != bStat.Size() {
+		return false
+	}
+	aSum, err := fileSha256(a)
+	if err != nil {
+		return false
+	}
+	bSum, err := fileSha256(b)
+	return err == nil && aSum == bSum
+}
+
+// stateOf The state to record for the file at path.
+func stateOf(path string) (syncState, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return syncState{}, err
+	}
+	sum, err := fileSha256(path)
+	if err != nil {
+		return syncState{}, err
+	}
+	return syncState{Size: stat.Size(), ModTime: stat.ModTime(), Sha256: sum}, nil
+}
+
+// stagedState The state to record for a copy staged at tmp: its own size and
+// checksum, with the modification time srcStat gave the source before the
+// copy, so a source changed meanwhile still looks changed.
+func stagedState(tmp string, srcStat os.FileInfo) (syncState, error) {
+	stat, err := os.Stat(tmp)
+	if err != nil {
+		return syncState{}, err
+	}
+	sum, err := fileSha256(tmp)
+	if err != nil {
+		return syncState{}, err
+	}
+	return syncState{Size: stat.Size(), ModTime: srcStat.ModTime(), Sha256: sum}, nil
+}
+
+// stateFile Where the job keeps its sync state: --sync-state, one file per
+// job when there are several, or .watch-sync-state in the destination.
+func stateFile(j *job, jobCount int) string {
+	if opts.SyncState == "" {
+		return filepath.Join(j.Dest, ".watch-sync-state")
+	}
+	if jobCount > 1 {
+		return opts.SyncState + "." + j.Name
+	}
+	return opts.SyncState
+}
+
+// keepsState One-way jobs remember what they synced with --mirror, an
+// explicit --sync-state, or a collision policy that must tell their own
+// copies from foreign files, for local plain copies only: a compressed or
+// encrypted copy can't be compared with its source.
+func (j *job) keepsState() bool {
+	return (opts.Mirror || opts.SyncState != "" || j.collisionPolicy() != "overwrite") && j.sink == nil && opts.Archive == "" && !transformed()
+}
+
+// stateKey The key of a destination file, its path below the destination.
+func (j *job) stateKey(dstFileName string) (string, bool) {
+	rel, err := filepath.Rel(j.target(), dstFileName)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// recordSynced Remember what dstFileName now holds: copied, the state of the
+// content just copied there, or for a copy found unchanged (copied is empty)
+// the destination file itself. The source is never looked at again, as it
+// may have changed since.
+func (j *job) recordSynced(dstFileName string, copied syncState) {
+	if j.state == nil {
+		return
+	}
+	key, ok := j.stateKey(dstFileName)
+	if !ok {
+		return
+	}
+	var err error
+	if copied.Sha256 == "" {
+		var last syncState
+		if stat, err := os.Stat(dstFileName); err == nil && j.state.Get(key, &last) && last.matches(stat) {
+			return
+		}
+		copied, err = stateOf(dstFileName)
+	}
+	if err == nil {
+		err = j.state.Put(key, copied)
+	}
+	if err != nil {
+		warnf("job %s: sync state of %s: %v", j.Name, dstFileName, err)
+	}
+}
+
+// forgetSynced Drop the state of a destination file that was removed.
+func (j *job) forgetSynced(dstFileName string) {
+	if j.state == nil {
+		return
+	}
+	if key, ok := j.stateKey(dstFileName); ok {
+		j.state.Delete(key)
+	}
+}
+
+// destChanged dstFileName was changed in the destination since its last
+// sync. known is false when there is no record of it.
+func (j *job) destChanged(dstFileName string) (changed bool, known bool) {
+	if j.state == nil {
+		return false, false
+	}
+	key, ok := j.stateKey(dstFileName)
+	if !ok {
+		return false, false
+	}
+	var last syncState
+	if !j.state.Get(key, &last) {
+		return false, false
+	}
+	stat, err := os.Stat(dstFileName)
+	if err != nil {
+		return false, true
+	}
+	return !last.same(dstFileName, stat), true
+}
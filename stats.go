@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// statsSummary The cumulative statistics of the run, shown on SIGQUIT, at
+// exit and by watch status --summary.
+type statsSummary struct {
+	Uptime  int64            `json:"uptime_seconds"`
+	Events  int64            `json:"events"`
+	Copied  int64            `json:"copied"`
+	Bytes   int64            `json:"bytes"`
+	Failed  int64            `json:"failed"`
+	Latency float64          `json:"avg_latency_seconds"` // from event to copy
+	Errors  map[string]int64 `json:"errors_by_class,omitempty"`
+}
+
+func summary() statsSummary {
+	s := statsSummary{
+		Uptime: int64(time.Since(started).Seconds()),
+		Events: atomic.LoadInt64(&stats.Events),
+		Copied: atomic.LoadInt64(&stats.Copied),
+		Bytes:  atomic.LoadInt64(&stats.Bytes),
+		Failed: atomic.LoadInt64(&stats.Failed),
+		Errors: errorsByClass(),
+	}
+	if timed := atomic.LoadInt64(&stats.Timed); timed > 0 {
+		s.Latency = time.Duration(atomic.LoadInt64(&stats.Latency) / timed).Seconds()
+	}
+	return s
+}
+
+func (s statsSummary) String() string {
+	text := fmt.Sprintf("up %s: %d events, %d files copied (%s), %d failed",
+		time.Duration(s.Uptime)*time.Second, s.Events, s.Copied, formatBytes(s.Bytes), s.Failed)
+	if s.Latency > 0 {
+		text += fmt.Sprintf(", %s from event to copy on average", time.Duration(s.Latency*float64(time.Second)).Round(time.Millisecond))
+	}
+	if len(s.Errors) > 0 {
+		text += "; errors: " + formatErrorCounts(s.Errors)
+	}
+	return text
+}
+
+// noteLatency Count the time from the event seen to its copy finishing.
+func noteLatency(seen time.Time) {
+	if seen.IsZero() {
+		return
+	}
+	atomic.AddInt64(&stats.Latency, int64(time.Since(seen)))
+	atomic.AddInt64(&stats.Timed, 1)
+}
+
+// summaryOnQuit Log the summary on every SIGQUIT instead of dying with a
+// goroutine dump.
+func summaryOnQuit() {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGQUIT)
+	for range quit {
+		infof("%s", summary())
+	}
+}
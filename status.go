@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recentErrors How many of the latest errors the status keeps.
+const recentErrors = 20
+
+// statusMark When something last happened, and to which path.
+type statusMark struct {
+	Time time.Time `json:"time"`
+	Path string    `json:"path"`
+}
+
+type statusError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+type jobStatus struct {
+	Name      string           `json:"name"`
+	Source    string           `json:"source"`
+	Dest      string           `json:"dest"`
+	Queued    int              `json:"queued"`
+	Paused    bool             `json:"paused,omitempty"`
+	Copied    int64            `json:"copied"`
+	Failed    int64            `json:"failed"`
+	LastCopy  *statusMark      `json:"last_copy,omitempty"`
+	Transfers []transferStatus `json:"transfers,omitempty"`
+	Reachable bool             `json:"reachable"`
+	Error     string           `json:"error,omitempty"`
+}
+
+type statusReport struct {
+	Uptime      int64         `json:"uptime_seconds"`
+	LastEvent   *statusMark   `json:"last_event,omitempty"`
+	Maintenance *time.Time    `json:"maintenance_since,omitempty"`
+	Jobs        []jobStatus   `json:"jobs"`
+	Errors      []statusError `json:"errors"`
+	Summary     statsSummary  `json:"summary"`
+}
+
+// activity What the status reports beyond the queues and counters, kept up
+// to date from emit, copies and logAt.
+var activity struct {
+	sync.Mutex
+	lastEvent *statusMark
+	lastCopy  map[string]*statusMark
+	errors    []statusError
+}
+
+// noteActivity Remember the time of an event.
+func noteActivity(msg eventMessage) {
+	if msg.outcome() {
+		return
+	}
+	activity.Lock()
+	activity.lastEvent = &statusMark{Time: msg.Time, Path: msg.Path}
+	activity.Unlock()
+}
+
+// noteCopy Remember the job's latest copy.
+func noteCopy(j *job, dst string) {
+	activity.Lock()
+	defer activity.Unlock()
+	if activity.lastCopy == nil {
+		activity.lastCopy = make(map[string]*statusMark)
+	}
+	activity.lastCopy[j.Name] = &statusMark{Time: time.Now(), Path: dst}
+}
+
+// noteError Keep an error message among the recent ones.
+func noteError(message string) {
+	activity.Lock()
+	defer activity.Unlock()
+	activity.errors = append(activity.errors, statusError{Time: time.Now(), Message: message})
+	if len(activity.errors) > recentErrors {
+		activity.errors = activity.errors[len(activity.errors)-recentErrors:]
+	}
+}
+
+func status() statusReport {
+	r := statusReport{Uptime: int64(time.Since(started).Seconds()), Summary: summary()}
+	if on, since := inMaintenance(); on {
+		r.Maintenance = &since
+	}
+
+	activity.Lock()
+	r.LastEvent = activity.lastEvent
+	r.Errors = append([]statusError{}, activity.errors...)
+	lastCopy := make(map[string]*statusMark, len(activity.lastCopy))
+	for name, mark := range activity.lastCopy {
+		lastCopy[name] = mark
+	}
+	activity.Unlock()
+
+	for _, j := range runningJobs() {
+		s := jobStatus{Name: j.Name, Source: j.Source, Dest: j.Dest, Queued: j.queue.len(), Paused: j.queue.isHeld(),
+			Copied: atomic.LoadInt64(&j.copied), Failed: atomic.LoadInt64(&j.failed),
+			LastCopy: lastCopy[j.Name], Transfers: runningTransfers(j), Reachable: true}
+		if err := j.reachableDest(); err != nil {
+			s.Reachable, s.Error = false, err.Error()
+		}
+		r.Jobs = append(r.Jobs, s)
+	}
+	return r
+}
+
+// serveStatus GET /status: the status as JSON, for clients sending the API
+// token, as it names every path and error.
+func serveStatus(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if code, msg := checkToken(w, req); code != 0 {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(apiReply{Error: msg})
+		return
+	}
+	json.NewEncoder(w).Encode(status())
+}
+
+// statusCommand watch status --http addr --api-token TOKEN | --control-socket path [--json] [--summary]
+// Ask a running watcher how it is doing, or only for its statistics.
+func statusCommand(args []string) int {
+	if _, err := parseOptions(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case opts.HTTP != "":
+		data, err = fetchStatus(opts.HTTP)
+	case controlSocket() != "":
+		data, err = askControl(controlSocket(), "status")
+	default:
+		fmt.Fprintln(os.Stderr, "usage: watch status --http addr --api-token token | --control-socket path [--json] [--summary], as the watcher was started with")
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if opts.JSON && !opts.Summary {
+		fmt.Println(strings.TrimSpace(string(data)))
+		return 0
+	}
+	var r statusReport
+	if err = json.Unmarshal(data, &r); err != nil {
+		fmt.Fprintln(os.Stderr, "unexpected status reply:", strings.TrimSpace(string(data)))
+		return 1
+	}
+	switch {
+	case opts.Summary && opts.JSON:
+		line, _ := json.Marshal(r.Summary)
+		fmt.Println(string(line))
+	case opts.Summary:
+		fmt.Println(r.Summary)
+	default:
+		printStatus(os.Stdout, r)
+	}
+	return 0
+}
+
+func fetchStatus(addr string) ([]byte, error) {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	setAPIToken()
+	req.Header.Set("Authorization", "Bearer "+apiToken)
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var r apiReply
+		if json.NewDecoder(resp.Body).Decode(&r) == nil && r.Error != "" {
+			return nil, fmt.Errorf("status: %s", r.Error)
+		}
+		return nil, fmt.Errorf("status: %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// askControl Send one command to a control socket and return what follows
+// "ok" in the reply.
+func askControl(path string, command string) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err = fmt.Fprintln(conn, command); err != nil {
+		return nil, err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && reply == "" {
+		return nil, err
+	}
+	reply = strings.TrimSpace(reply)
+	if reply != "ok" && !strings.HasPrefix(reply, "ok ") {
+		return nil, fmt.Errorf("%s: %s", command, strings.TrimPrefix(reply, "error: "))
+	}
+	return []byte(strings.TrimSpace(strings.TrimPrefix(reply, "ok"))), nil
+}
+
+func printStatus(w io.Writer, r statusReport) {
+	ago := func(t time.Time) string {
+		return time.Since(t).Truncate(time.Second).String() + " ago"
+	}
+
+	line := fmt.Sprintf("up %s", (time.Duration(r.Uptime) * time.Second).String())
+	if r.LastEvent != nil {
+		line += fmt.Sprintf(", last event %s (%s)", ago(r.LastEvent.Time), r.LastEvent.Path)
+	} else {
+		line += ", no events yet"
+	}
+	fmt.Fprintln(w, line)
+	if r.Maintenance != nil {
+		fmt.Fprintf(w, "MAINTENANCE since %s, nothing is written to the destinations\n", ago(*r.Maintenance))
+	}
+
+	for _, j := range r.Jobs {
+		state := "reachable"
+		if !j.Reachable {
+			state = "UNREACHABLE: " + j.Error
+		}
+		fmt.Fprintf(w, "job %s: %s to %s, %s\n", j.Name, j.Source, j.Dest, state)
+		line := fmt.Sprintf("  %d queued, %d copied, %d failed", j.Queued, j.Copied, j.Failed)
+		if j.Paused {
+			line = fmt.Sprintf("  paused, %d queued, %d copied, %d failed", j.Queued, j.Copied, j.Failed)
+		}
+		if j.LastCopy != nil {
+			line += fmt.Sprintf(", last copy %s (%s)", ago(j.LastCopy.Time), j.LastCopy.Path)
+		}
+		fmt.Fprintln(w, line)
+		for _, t := range j.Transfers {
+			fmt.Fprintf(w, "  copying %s: %s\n", t.Path, progressText(t))
+		}
+	}
+
+	if len(r.Errors) > 0 {
+		if len(r.Summary.Errors) > 0 {
+			fmt.Fprintf(w, "recent errors (%s in all):\n", formatErrorCounts(r.Summary.Errors))
+		} else {
+			fmt.Fprintln(w, "recent errors:")
+		}
+		for _, e := range r.Errors {
+			fmt.Fprintf(w, "  %s %s\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Message)
+		}
+	}
+}
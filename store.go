@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// kvStore A small embedded key/value store: an append-only JSON lines file
+// replayed into memory on open and compacted at the same time, and again
+// once it holds mostly replaced lines.
+type kvStore struct {
+	mu      sync.Mutex
+	path    string
+	data    map[string]json.RawMessage
+	file    *os.File
+	written int // lines appended since the last compaction
+}
+
+// compactAfter How many lines a store appends at least before it is
+// compacted again, when they are over three times its live entries.
+const compactAfter = 10000
+
+type storeLine struct {
+	Key     string          `json:"k"`
+	Value   json.RawMessage `json:"v,omitempty"`
+	Deleted bool            `json:"d,omitempty"`
+}
+
+// openStore Open the store at path, creating it when missing. A store that
+// can't be read in full is refused rather than compacted into what was read.
+func openStore(path string) (*kvStore, error) {
+	if err := guardSource(path); err != nil {
+		return nil, err
+	}
+	s, err := readStore(path)
+	if os.IsNotExist(err) {
+		s, err = &kvStore{path: path, data: make(map[string]json.RawMessage)}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readStore Load the store at path for reading only, leaving the file alone
+// for the watcher that may have it open. What could be read is returned
+// along with a read error.
+func readStore(path string) (*kvStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := &kvStore{path: path, data: make(map[string]json.RawMessage)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var l storeLine
+		if json.Unmarshal(scanner.Bytes(), &l) != nil {
+			continue // torn last line after a crash
+		}
+		if l.Deleted {
+			delete(s.data, l.Key)
+		} else {
+			s.data[l.Key] = l.Value
+		}
+	}
+	return s, scanner.Err()
+}
+
+// compact Rewrite the file with only the live entries. The new file is
+// synced before it replaces the old one, so a crash leaves one or the other.
+func (s *kvStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, k := range s.keys() {
+		if err = enc.Encode(storeLine{Key: k, Value: s.data[k]}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.written = 0
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// append Write a line, compacting the file first when it has grown enough.
+// A suspended store only keeps the change in memory until it is resumed.
+func (s *kvStore) append(l storeLine) error {
+	if s.file == nil {
+		return nil
+	}
+	if s.written >= compactAfter && s.written > 3*len(s.data) {
+		if err := s.compact(); err != nil {
+			return err
+		}
+	}
+	s.written++
+	return json.NewEncoder(s.file).Encode(l)
+}
+
+func (s *kvStore) Get(key string, v interface{}) bool {
+	s.mu.Lock()
+	raw, ok := s.data[key]
+	s.mu.Unlock()
+
+	return ok && json.Unmarshal(raw, v) == nil
+}
+
+func (s *kvStore) Put(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = raw
+	return s.append(storeLine{Key: key, Value: raw})
+}
+
+func (s *kvStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[key]; !ok {
+		return nil
+	}
+	delete(s.data, key)
+	return s.append(storeLine{Key: key, Deleted: true})
+}
+
+// Keys Every live key, sorted.
+func (s *kvStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys()
+}
+
+func (s *kvStore) keys() []string {
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *kvStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// Suspend Close the file, e.g. so the volume it is on can be unmounted,
+// keeping the entries in memory.
+func (s *kvStore) Suspend() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Resume Open the file of a suspended store again, writing out what
+// changed in the meantime.
+func (s *kvStore) Resume() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		return nil
+	}
+	return s.compact()
+}
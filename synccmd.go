@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// syncCommand watch sync path copyDir... [options]
+// One comparison-and-copy pass, the watcher's initial sync, then exit: 0 when
+// every destination was brought up to date, 1 when a job failed, 2 for bad
+// usage. Meant for cron and CI, with the same options as watching.
+func syncCommand(args []string) int {
+	paths, err := parseOptions(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if opts.Config == "" && len(paths) < 2 && opts.Output == "" {
+		fmt.Fprintln(os.Stderr, "usage: watch sync path copyDir... [options], or watch sync --config watch.json")
+		return 2
+	}
+
+	setup(paths)
+	opts.InitialSync = true
+	failed := runInitialSyncs(jobs)
+
+	for _, j := range jobs {
+		infof("job %s to %s: %d copied", j.Name, j.Dest, atomic.LoadInt64(&j.copied))
+	}
+	closeOutputs()
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
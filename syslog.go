@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syslogWriter --syslog: warnings, errors, events and copy outcomes as
+// RFC 5424 messages, to the local syslog socket or a remote collector over
+// udp://, tcp:// or tls:// (octet counted). Messages are sent in the
+// background and dropped while the collector is unreachable.
+type syslogWriter struct {
+	network  string
+	addr     string
+	tls      *tls.Config
+	facility int
+	host     string
+	app      string
+	lines    chan []byte
+	done     chan struct{}
+}
+
+var syslogOut *syslogWriter
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Severities of RFC 5424.
+const (
+	syslogErr     = 3
+	syslogWarning = 4
+	syslogNotice  = 5
+	syslogInfo    = 6
+)
+
+func openSyslog(target string) (*syslogWriter, error) {
+	s := &syslogWriter{facility: syslogFacilities["daemon"], app: filepath.Base(os.Args[0]), lines: make(chan []byte, 1024), done: make(chan struct{})}
+	s.host, _ = os.Hostname()
+	if s.host == "" {
+		s.host = "-"
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if f := u.Query().Get("facility"); f != "" {
+		n, ok := syslogFacilities[f]
+		if !ok {
+			return nil, fmt.Errorf("unknown syslog facility %s", f)
+		}
+		s.facility = n
+	}
+
+	switch u.Scheme {
+	case "":
+		if u.Path != "local" {
+			return nil, fmt.Errorf("unsupported --syslog %s (local, udp://, tcp://, tls://)", target)
+		}
+		for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+			if _, err := os.Stat(path); err == nil {
+				s.network, s.addr = "unixgram", path
+				break
+			}
+		}
+		if s.addr == "" {
+			return nil, fmt.Errorf("no local syslog socket, use udp://host:514")
+		}
+	case "udp", "tcp", "tls":
+		port := u.Port()
+		if port == "" {
+			port = "514"
+			if u.Scheme == "tls" {
+				port = "6514"
+			}
+		}
+		s.network, s.addr = u.Scheme, net.JoinHostPort(u.Hostname(), port)
+		if u.Scheme == "tls" {
+			s.network, s.tls = "tcp", &tls.Config{ServerName: u.Hostname()}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported --syslog %s (local, udp://, tcp://, tls://)", target)
+	}
+
+	go s.run()
+	return s, nil
+}
+
+func (s *syslogWriter) dial() (net.Conn, error) {
+	if s.tls != nil {
+		return tls.DialWithDialer(&net.Dialer{Timeout: busTimeout}, "tcp", s.addr, s.tls)
+	}
+	conn, err := net.DialTimeout(s.network, s.addr, busTimeout)
+	if err != nil && s.network == "unixgram" {
+		// some syslog daemons listen on a stream socket
+		conn, err = net.DialTimeout("unix", s.addr, busTimeout)
+	}
+	return conn, err
+}
+
+func (s *syslogWriter) run() {
+	defer close(s.done)
+	var conn net.Conn
+	var retryAt time.Time
+	for line := range s.lines {
+		if conn == nil && time.Now().After(retryAt) {
+			var err error
+			if conn, err = s.dial(); err != nil {
+				// not through the logger, which would come back here
+				fmt.Fprintln(os.Stderr, "syslog:", err)
+				retryAt = time.Now().Add(10 * time.Second)
+			}
+		}
+		if conn == nil {
+			continue
+		}
+
+		framed := line
+		if _, stream := conn.(*net.TCPConn); stream || s.tls != nil {
+			// RFC 6587 octet counting
+			framed = append([]byte(strconv.Itoa(len(line))+" "), line...)
+		}
+		conn.SetWriteDeadline(time.Now().Add(busTimeout))
+		if _, err := conn.Write(framed); err != nil {
+			fmt.Fprintln(os.Stderr, "syslog:", err)
+			conn.Close()
+			conn = nil
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// close Send what is queued, on shutdown.
+func (s *syslogWriter) close() {
+	close(s.lines)
+	select {
+	case <-s.done:
+	case <-time.After(busTimeout):
+	}
+}
+
+// send Queue one message (RFC 5424 allows microseconds at most). msgID
+// names its kind; sd holds the structured data parameters, in order.
+func (s *syslogWriter) send(severity int, msgID string, sd []string, msg string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s ", s.facility*8+severity, time.Now().Format("2006-01-02T15:04:05.000000Z07:00"), s.host, s.app, os.Getpid(), msgID)
+	if len(sd) == 0 {
+		b.WriteString("-")
+	} else {
+		b.WriteString("[watch@32473")
+		for i := 0; i+1 < len(sd); i += 2 {
+			fmt.Fprintf(&b, " %s=\"%s\"", sd[i], sdEscape(sd[i+1]))
+		}
+		b.WriteString("]")
+	}
+	b.WriteString(" ")
+	b.WriteString(msg)
+
+	select {
+	case s.lines <- []byte(b.String()):
+	default:
+	}
+}
+
+// sendEvent An event or copy outcome, with its details as structured data.
+func (s *syslogWriter) sendEvent(msg eventMessage) {
+	severity := syslogInfo
+	text := msg.Op + " " + msg.Path
+	sd := []string{"op", msg.Op, "path", msg.Path}
+	if msg.Job != "" {
+		sd = append(sd, "job", msg.Job, "dest", msg.Dest)
+		text += " -> " + msg.Dest
+	}
+	if msg.Error != "" {
+		severity = syslogErr
+		sd = append(sd, "error", msg.Error)
+		text += ": " + msg.Error
+	} else if msg.outcome() {
+		severity = syslogNotice
+	}
+	s.send(severity, msg.Op, sd, text)
+}
+
+// sdEscape Escape a structured data parameter value.
+func sdEscape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(v)
+}
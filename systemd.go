@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdNotify Tell systemd about the service's state, e.g. READY=1, when it
+// started the watcher as a Type=notify service. It reports whether it did.
+func sdNotify(state string) bool {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		debugf("sd_notify: %v", err)
+		return false
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		debugf("sd_notify: %v", err)
+		return false
+	}
+	return true
+}
+
+// eventLoopAlive Answered by the event loop between events, so the watchdog
+// only pings while events are still being handled.
+var eventLoopAlive = make(chan struct{})
+
+// startWatchdog Ping systemd's watchdog at half its WatchdogSec while the
+// event loop answers, so a watcher that stopped handling events gets
+// restarted.
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	every := time.Duration(usec) * time.Microsecond / 2
+	debugf("systemd watchdog every %s", every)
+	go func() {
+		for range time.Tick(every) {
+			select {
+			case <-eventLoopAlive:
+				sdNotify("WATCHDOG=1")
+			case <-time.After(every):
+				debugf("systemd watchdog: event loop stuck, not pinging")
+			}
+		}
+	}()
+}
+
+// serviceArgs The arguments the service starts the watcher with: every
+// option given but the installer's own, then the config file, or the source
+// and destinations, made absolute. The service runs in the current folder, so
+// relative paths in options still resolve.
+func serviceArgs(args []string, positional []string) ([]string, error) {
+	if opts.Config == "" && len(positional) < 2 {
+		return nil, fmt.Errorf("give a --config file, or a source and destinations")
+	}
+	service, err := givenOptions(args, "user", "service-name", "config")
+	if err != nil {
+		return nil, err
+	}
+	if opts.Config != "" {
+		config, err := filepath.Abs(opts.Config)
+		if err != nil {
+			return nil, err
+		}
+		service = append(service, "--config", config)
+	}
+	for _, p := range positional {
+		if !isRemote(p) {
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				return nil, err
+			}
+			p = abs
+		}
+		service = append(service, p)
+	}
+	return service, nil
+}
+
+// systemdQuote Quote an ExecStart argument the way systemd unquotes it.
+func systemdQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\%$;") {
+		return s
+	}
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(s)
+	return `"` + s + `"`
+}
+
+const systemdUnit = `[Unit]
+Description=watch: copy changed files ({{args}})
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+WorkingDirectory={{dir}}
+ExecStart={{exec}}
+Restart=on-failure
+RestartSec=5
+WatchdogSec=60
+TimeoutStopSec={{stop}}
+
+[Install]
+WantedBy={{target}}
+`
+
+// installSystemdCommand watch install-systemd [--user] [--service-name watch] (--config file | path copyDir...)
+// Write a systemd unit running the watcher as a Type=notify service with a
+// watchdog, system-wide or for the current user.
+func installSystemdCommand(args []string) int {
+	positional, err := parseOptions(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	service, err := serviceArgs(args, positional)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "usage: watch install-systemd [--user] [--service-name watch] (--config file | path copyDir...)")
+		return 2
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	drain, err := time.ParseDuration(opts.DrainTimeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid --drain-timeout", opts.DrainTimeout)
+		return 2
+	}
+
+	dir, target, systemctl := "/etc/systemd/system", "multi-user.target", "systemctl"
+	if opts.User {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		dir, target, systemctl = filepath.Join(home, ".config", "systemd", "user"), "default.target", "systemctl --user"
+	}
+
+	quoted := []string{systemdQuote(exe)}
+	for _, a := range service {
+		quoted = append(quoted, systemdQuote(a))
+	}
+	unit := strings.NewReplacer(
+		"{{args}}", strings.ReplaceAll(strings.Join(service, " "), "%", "%%"),
+		"{{dir}}", systemdQuote(cwd),
+		"{{exec}}", strings.Join(quoted, " "),
+		// room for the drain on SIGTERM, then systemd kills
+		"{{stop}}", strconv.Itoa(int((drain + 30*time.Second).Seconds())),
+		"{{target}}", target,
+	).Replace(systemdUnit)
+
+	path := filepath.Join(dir, opts.ServiceName+".service")
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err = os.WriteFile(path, []byte(unit), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("wrote %s; start it with:\n  %s daemon-reload && %s enable --now %s\n", path, systemctl, systemctl, opts.ServiceName)
+	return 0
+}
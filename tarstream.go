@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// tarSink --output tar: every changed file is appended to one endless tar
+// stream on stdout or --output-file (say a named pipe), for pipelines like
+// `watch src --output tar | ssh host tar x -C /dest`. A stream cannot be
+// asked what it holds or take anything back, so every change is sent and
+// removals are ignored.
+type tarSink struct {
+	mu  sync.Mutex
+	out io.WriteCloser
+	w   *bufio.Writer
+	tw  *tar.Writer
+}
+
+var output *tarSink
+
+func validOutput(kind string) error {
+	switch kind {
+	case "", "tar":
+		return nil
+	}
+	return fmt.Errorf("unknown --output %s (tar)", kind)
+}
+
+// openOutput Start the stream. On stdout, everything that would be printed
+// there goes to stderr instead.
+func openOutput() (*tarSink, error) {
+	out := io.WriteCloser(os.Stdout)
+	if opts.OutputFile != "" {
+		if err := guardSource(opts.OutputFile); err != nil {
+			return nil, err
+		}
+		// opening a named pipe waits for its reader
+		f, err := os.OpenFile(opts.OutputFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	} else {
+		logOut = os.Stderr
+	}
+
+	w := bufio.NewWriterSize(out, copyBufferSize)
+	return &tarSink{out: out, w: w, tw: tar.NewWriter(w)}, nil
+}
+
+func (t *tarSink) EnsureDir(dir string) error {
+	// tar x creates the parents of every entry
+	return nil
+}
+
+// WriteFile Append src as name. The entry is flushed right away, so the
+// reader gets each file as soon as it is complete.
+func (t *tarSink) WriteFile(name string, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err = t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// exactly the size announced in the header, even if the file grows
+	n, err := io.CopyN(t.tw, throttle(f), hdr.Size)
+	if err != nil {
+		// it shrank or couldn't be read: the entry is filled up so the
+		// stream stays readable, and the copy fails, so a retry appends a
+		// good entry after it
+		if perr := padEntry(t.tw, hdr.Size-n); perr != nil {
+			return perr
+		}
+		if err == io.EOF {
+			err = fmt.Errorf("%s shrank while it was streamed, its entry is padded with zeros", src)
+		} else {
+			err = fmt.Errorf("%s: %v, its entry is padded with zeros", src, err)
+		}
+	}
+	if ferr := t.tw.Flush(); ferr != nil {
+		return ferr
+	}
+	if ferr := t.w.Flush(); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// padEntry Write n zero bytes of an entry.
+func padEntry(w io.Writer, n int64) error {
+	zeros := make([]byte, 32<<10)
+	for n > 0 {
+		chunk := zeros
+		if n < int64(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		n -= int64(len(chunk))
+	}
+	return nil
+}
+
+func (t *tarSink) Remove(name string) error {
+	return nil
+}
+
+func (t *tarSink) Stat(name string) (sinkStat, error) {
+	return sinkStat{}, errNoStat
+}
+
+// close End the stream with the tar trailer, on shutdown.
+func (t *tarSink) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.tw.Close(); err == nil {
+		t.w.Flush()
+	}
+	if t.out != os.Stdout {
+		t.out.Close()
+	}
+}
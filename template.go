@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var templateField = regexp.MustCompile(`\{[a-z]+\}`)
+
+// templateFields The placeholders a destination template may use.
+var templateFields = map[string]bool{
+	"{dest}": true, "{job}": true, "{path}": true, "{dir}": true, "{name}": true,
+	"{ext}": true, "{type}": true, "{yyyy}": true, "{mm}": true, "{dd}": true, "{hh}": true,
+}
+
+// validTemplate Only known placeholders, no .. leading out of the
+// destination, and {name} or {path} so files don't all land on one path.
+func validTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+	for _, field := range templateField.FindAllString(template, -1) {
+		if !templateFields[field] {
+			return fmt.Errorf("unknown placeholder %s in destination template %s", field, template)
+		}
+	}
+	for _, part := range strings.FieldsFunc(template, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return fmt.Errorf("destination template %s leads out of the destination", template)
+		}
+	}
+	if !strings.Contains(template, "{name}") && !strings.Contains(template, "{path}") {
+		return fmt.Errorf("destination template %s needs {name} or {path}", template)
+	}
+	return nil
+}
+
+// destTemplate The job's dest_template, or --dest-template. --flatten is
+// the template putting every file straight into the destination.
+func (j *job) destTemplate() string {
+	if opts.Flatten {
+		return "{name}{ext}"
+	}
+	if j.DestTemplate != "" {
+		return j.DestTemplate
+	}
+	return opts.DestTemplate
+}
+
+// expandTemplate The path below the destination for the source file at rel,
+// e.g. {dest}/{yyyy}/{mm}/{name}{ext}. Dates come from the file's mtime.
+func (j *job) expandTemplate(template string, filePath string, rel string) string {
+	mtime := time.Now()
+	if stat, err := os.Stat(filePath); err == nil {
+		mtime = stat.ModTime()
+	}
+
+	base := filepath.Base(rel)
+	ext := filepath.Ext(base)
+	kind := strings.ToLower(strings.TrimPrefix(ext, "."))
+	if kind == "" {
+		kind = "noext"
+	}
+	dir := filepath.Dir(rel)
+	if dir == "." {
+		dir = ""
+	}
+
+	// {dest} is the root everything lands under anyway
+	return strings.NewReplacer(
+		"{dest}", "",
+		"{job}", j.Name,
+		"{path}", rel,
+		"{dir}", dir,
+		"{name}", strings.TrimSuffix(base, ext),
+		"{ext}", ext,
+		"{type}", kind,
+		"{yyyy}", mtime.Format("2006"),
+		"{mm}", mtime.Format("01"),
+		"{dd}", mtime.Format("02"),
+		"{hh}", mtime.Format("15"),
+	).Replace(filepath.FromSlash(template))
+}
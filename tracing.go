@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// otlpExporter --otlp: a trace per copied change, from the event through the
+// settling delay, the wait in the queue and the copy to its verification,
+// sent as OTLP/HTTP JSON to a collector. Spans are batched every
+// otlpInterval in the background and dropped while the collector is down.
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+	spans    chan otlpSpan
+	done     chan struct{}
+	mu       sync.Mutex // guards closed and sending on spans
+	closed   bool
+}
+
+var tracer *otlpExporter
+
+const otlpInterval = 5 * time.Second
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+// otlpSpan A span in the OTLP JSON encoding: ids in hex, times as strings
+// of Unix nanoseconds.
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"` // 1 internal
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+func openTracer(endpoint string) (*otlpExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("--otlp %s: expected an http:// or https:// collector address", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	t := &otlpExporter{
+		endpoint: u.String(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan otlpSpan, 4096),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t, nil
+}
+
+func (t *otlpExporter) send(s otlpSpan) {
+	// copy workers still finishing may end spans after close
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		debugf("otlp: buffer full, dropped span %s", s.Name)
+	}
+}
+
+func (t *otlpExporter) run() {
+	defer close(t.done)
+	tick := time.NewTicker(otlpInterval)
+	defer tick.Stop()
+
+	var batch []otlpSpan
+	failing := false
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := t.export(batch)
+		if err != nil && !failing {
+			warnf("otlp %s: %v, dropping spans until it answers", t.endpoint, err)
+		} else if err == nil && failing {
+			warnf("otlp %s: exporting again", t.endpoint)
+		}
+		failing = err != nil
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= 512 {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+func (t *otlpExporter) export(spans []otlpSpan) error {
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{{Key: "service.name", Value: otlpValue{"watch"}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "watch", "version": version},
+				"spans": spans,
+			}},
+		}},
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// close Export what is pending, on shutdown.
+func (t *otlpExporter) close() {
+	t.mu.Lock()
+	t.closed = true
+	close(t.spans)
+	t.mu.Unlock()
+	select {
+	case <-t.done:
+	case <-time.After(busTimeout):
+	}
+}
+
+// copyTrace The trace of one queued copy, started when a worker takes it.
+type copyTrace struct {
+	id    string
+	root  string
+	task  *copyTask
+	start time.Time
+}
+
+// traceKey A copy under way, for finding its trace from copyInto.
+type traceKey struct {
+	job *job
+	src string
+}
+
+var (
+	tracesMu sync.Mutex
+	traces   = make(map[traceKey]*copyTrace)
+)
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startTrace Begin the trace of t, which a worker just took off the queue:
+// the event, the settling delay and the queue wait are over already. Nil
+// without --otlp; the methods accept that.
+func startTrace(t *copyTask) *copyTrace {
+	if tracer == nil {
+		return nil
+	}
+	tr := &copyTrace{id: randomID(16), root: randomID(8), task: t, start: t.seen}
+	if tr.start.IsZero() || tr.start.After(t.due) {
+		tr.start = t.due
+	}
+	now := time.Now()
+	tr.span("event", tr.start, tr.start, nil)
+	tr.span("debounce", tr.start, t.due, nil)
+	tr.span("queue wait", t.due, now, nil)
+
+	tracesMu.Lock()
+	traces[traceKey{t.job, t.src}] = tr
+	tracesMu.Unlock()
+	return tr
+}
+
+// span Send a child span of the copy's trace.
+func (tr *copyTrace) span(name string, start time.Time, end time.Time, err error) {
+	if tr == nil {
+		return
+	}
+	tracer.send(otlpSpan{TraceID: tr.id, SpanID: randomID(8), ParentSpanID: tr.root, Name: name, Kind: 1,
+		Start: unixNano(start), End: unixNano(end), Status: spanStatus(err)})
+}
+
+// end Send the root span, from the event to the end of the copy, with how
+// it ended.
+func (tr *copyTrace) end(outcome string, err error) {
+	if tr == nil {
+		return
+	}
+	tracesMu.Lock()
+	delete(traces, traceKey{tr.task.job, tr.task.src})
+	tracesMu.Unlock()
+
+	attrs := []otlpAttribute{
+		{Key: "watch.job", Value: otlpValue{tr.task.job.Name}},
+		{Key: "watch.path", Value: otlpValue{tr.task.src}},
+		{Key: "watch.dest", Value: otlpValue{tr.task.dst}},
+		{Key: "watch.outcome", Value: otlpValue{outcome}},
+		{Key: "watch.attempt", Value: otlpValue{strconv.Itoa(tr.task.attempt)}},
+	}
+	tracer.send(otlpSpan{TraceID: tr.id, SpanID: tr.root, Name: "pipeline", Kind: 1,
+		Start: unixNano(tr.start), End: unixNano(time.Now()), Attributes: attrs, Status: spanStatus(err)})
+}
+
+// traceStep Send a span for a step of the copy of src by j since start, if
+// that copy is being traced.
+func traceStep(j *job, src string, name string, start time.Time, err error) {
+	if tracer == nil {
+		return
+	}
+	tracesMu.Lock()
+	tr := traces[traceKey{j, src}]
+	tracesMu.Unlock()
+	tr.span(name, start, time.Now(), err)
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func spanStatus(err error) otlpStatus {
+	if err != nil && err != errUnchanged && err != errSkipped {
+		return otlpStatus{Code: 2, Message: err.Error()}
+	}
+	return otlpStatus{Code: 1}
+}
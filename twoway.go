@@ -0,0 +1,413 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// twoWay --two-way: a job's source (A) and destination (B) are both watched
+// and every change, deletions included, is carried to the other side. The
+// state file remembers each file as it was at its last sync, which tells "new
+// on A" from "deleted on B"; a file changed on both sides since is a conflict,
+// settled by --conflict.
+type twoWay struct {
+	fwd   *job // A to B
+	back  *job // B to A
+	state *kvStore
+
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+type twoWayAction int
+
+const (
+	twoWayNone twoWayAction = iota
+	twoWayRecord
+	twoWayForget
+	twoWayCopyAB
+	twoWayCopyBA
+	twoWayDeleteA
+	twoWayDeleteB
+	twoWayConflict
+)
+
+// addTwoWayJobs Pair every job with a job copying back from its destination,
+// so both sides are watched. The pair shares one queue and state file.
+func addTwoWayJobs(list []*job) ([]*job, error) {
+	paired := list
+	for _, j := range list {
+		if isRemote(j.Dest) || !IsDir(j.Source) || !IsDir(j.Dest) {
+			return nil, fmt.Errorf("job %s: --two-way needs two local folders", j.Name)
+		}
+
+		state, err := openStore(stateFile(j, len(list)))
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %v", j.Name, err)
+		}
+
+		back := newJob(j.Name+"-back", j.Dest, j.Source)
+		back.Include, back.Exclude = j.Include, j.Exclude
+		back.PauseWindows = j.PauseWindows
+		tw := &twoWay{fwd: j, back: back, state: state, busy: make(map[string]bool)}
+		j.twoWay, back.twoWay = tw, tw
+		paired = append(paired, back)
+	}
+	return paired, nil
+}
+
+func (tw *twoWay) sides(rel string) (string, string) {
+	return filepath.Join(tw.fwd.Source, rel), filepath.Join(tw.fwd.Dest, rel)
+}
+
+// internal The watcher's own files (staging, probes, the state file), which
+// are never synced.
+func internal(rel string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.HasPrefix(part, ".watch-") {
+			return true
+		}
+	}
+	return false
+}
+
+// schedule Queue path, which changed on j's side, to be reconciled once it
+// has settled. A folder that went away takes the files under it along.
+func (tw *twoWay) schedule(j *job, path string) {
+	rel, err := filepath.Rel(j.Source, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") || internal(rel) {
+		return
+	}
+
+	if IsDir(path) {
+		// the other side gets the folder now, its files as they settle
+		other := filepath.Join(j.Dest, rel)
+		if !IsDir(other) {
+			if err := mkdirAll(other); err != nil {
+				reportError(err)
+			}
+		}
+		return
+	}
+
+	rels := []string{rel}
+	if _, err := os.Lstat(path); err != nil {
+		prefix := filepath.ToSlash(rel) + "/"
+		for _, key := range tw.state.Keys() {
+			if strings.HasPrefix(key, prefix) {
+				rels = append(rels, filepath.FromSlash(key))
+			}
+		}
+		if len(rels) > 1 {
+			rels = tw.confirmRemoval(j, rel, rels)
+		}
+	}
+
+	due := time.Now().Add(time.Second * time.Duration(sleep))
+	for _, rel := range rels {
+		a, b := tw.sides(rel)
+		tw.fwd.queue.push(&copyTask{job: tw.fwd, src: a, dst: b, due: due, seen: time.Now()})
+	}
+}
+
+// confirmRemoval A folder deleted on j's side takes the files under it along
+// on the other side: ask first when that is a mass deletion, as mirrorRemove
+// does. It returns the files to reconcile, without those it would remove
+// when that was declined.
+func (tw *twoWay) confirmRemoval(j *job, rel string, rels []string) []string {
+	var kept []string
+	deletes := 0
+	for _, r := range rels {
+		if action := tw.plan(r); action == twoWayDeleteA || action == twoWayDeleteB {
+			deletes++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	if confirmDestructive("two-way", filepath.Join(j.Dest, rel), deletes, countFiles(j.Dest)) {
+		return rels
+	}
+	warnf("%s was deleted from %s, kept the %d files it held in %s", rel, j.Source, deletes, j.Dest)
+	return kept
+}
+
+// run Reconcile the file of a queued task; failures are retried like copies.
+func (tw *twoWay) run(t *copyTask) {
+	rel, err := filepath.Rel(tw.fwd.Dest, t.dst)
+	if err != nil {
+		reportError(err)
+		return
+	}
+
+	// the same file changed on both sides at once: one reconcile at a time
+	tw.mu.Lock()
+	if tw.busy[rel] {
+		tw.mu.Unlock()
+		t.due = time.Now().Add(time.Second)
+		tw.fwd.queue.push(t)
+		return
+	}
+	tw.busy[rel] = true
+	tw.mu.Unlock()
+	defer func() {
+		tw.mu.Lock()
+		delete(tw.busy, rel)
+		tw.mu.Unlock()
+	}()
+
+	if err = tw.apply(rel, tw.plan(rel)); err != nil {
+		tw.fwd.retry(t, err)
+	}
+}
+
+// plan What reconciling rel takes, from both sides and its last synced state.
+func (tw *twoWay) plan(rel string) twoWayAction {
+	if !tw.fwd.wants(filepath.Join(tw.fwd.Source, rel)) {
+		return twoWayNone
+	}
+	a, b := tw.sides(rel)
+	aStat, aErr := os.Stat(a)
+	bStat, bErr := os.Stat(b)
+	onA := aErr == nil && aStat.Mode().IsRegular()
+	onB := bErr == nil && bStat.Mode().IsRegular()
+
+	var last syncState
+	known := tw.state.Get(filepath.ToSlash(rel), &last)
+
+	switch {
+	case !onA && !onB:
+		if known {
+			return twoWayForget
+		}
+		return twoWayNone
+	case onA && onB:
+		if unchanged(b, a) {
+			if known && last.matches(aStat) {
+				return twoWayNone
+			}
+			return twoWayRecord
+		}
+		changedA := !known || !last.same(a, aStat)
+		changedB := !known || !last.same(b, bStat)
+		switch {
+		case changedA && !changedB:
+			return twoWayCopyAB
+		case changedB && !changedA:
+			return twoWayCopyBA
+		case identical(a, b):
+			// both sides made the same change
+			return twoWayRecord
+		}
+		return twoWayConflict
+	case onA:
+		// deleted on B, unless A changed since: then the change wins
+		if known && last.same(a, aStat) {
+			return twoWayDeleteA
+		}
+		if known {
+			warnf("%s was deleted on %s but changed on %s, copying it back", rel, tw.fwd.Dest, tw.fwd.Source)
+		}
+		return twoWayCopyAB
+	default:
+		if known && last.same(b, bStat) {
+			return twoWayDeleteB
+		}
+		if known {
+			warnf("%s was deleted on %s but changed on %s, copying it back", rel, tw.fwd.Source, tw.fwd.Dest)
+		}
+		return twoWayCopyBA
+	}
+}
+
+// twoWayActions What the audit log calls each action.
+var twoWayActions = map[twoWayAction]string{
+	twoWayCopyAB: "copy", twoWayCopyBA: "copy back", twoWayDeleteA: "remove from source",
+	twoWayDeleteB: "remove from dest", twoWayConflict: "conflict",
+}
+
+func (tw *twoWay) apply(rel string, action twoWayAction) error {
+	a, b := tw.sides(rel)
+	key := filepath.ToSlash(rel)
+	if op, ok := twoWayActions[action]; ok {
+		tw.fwd.auditDecision(op, a, b, "two-way reconcile")
+	}
+
+	switch action {
+	case twoWayRecord:
+		return tw.record(rel, a)
+	case twoWayForget:
+		return tw.state.Delete(key)
+	case twoWayCopyAB:
+		return tw.copy(tw.fwd, rel, b, a)
+	case twoWayCopyBA:
+		return tw.copy(tw.back, rel, a, b)
+	case twoWayDeleteA:
+		return tw.remove(tw.back, rel, a)
+	case twoWayDeleteB:
+		return tw.remove(tw.fwd, rel, b)
+	case twoWayConflict:
+		return tw.conflict(rel)
+	}
+	return nil
+}
+
+func (tw *twoWay) record(rel string, path string) error {
+	state, err := stateOf(path)
+	if err != nil {
+		return err
+	}
+	return tw.state.Put(filepath.ToSlash(rel), state)
+}
+
+// copy Copy src over dst with j, the job for that direction.
+func (tw *twoWay) copy(j *job, rel string, dst string, src string) error {
+	if err := mkdirAll(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if _, err := j.prepareCopy(dst, src); err == errRefused {
+		return nil
+	}
+	copied, err := copyInto(j, dst, src, 0)
+	if err == errUnchanged {
+		j.postCopy(src, dst)
+		return tw.record(rel, src)
+	}
+	if err != nil {
+		return err
+	}
+	infof("file copy success %s", dst)
+	j.emitCopied(dst, src, copied)
+	j.postCopy(src, dst)
+	// what was copied, not what src holds by now
+	return tw.state.Put(filepath.ToSlash(rel), copied)
+}
+
+// remove Delete path, which is gone on the other side, setting it aside first.
+func (tw *twoWay) remove(j *job, rel string, path string) error {
+	if _, err := j.setAside("delete", path); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	infof("removed %s, deleted on the other side", path)
+	tw.removeEmptyDirs(j, filepath.Dir(rel))
+	return tw.state.Delete(filepath.ToSlash(rel))
+}
+
+// removeEmptyDirs Remove the folders above a file j removed that are left
+// empty on its destination side and gone from its source side, deepest first.
+func (tw *twoWay) removeEmptyDirs(j *job, rel string) {
+	for ; rel != "." && rel != string(filepath.Separator); rel = filepath.Dir(rel) {
+		if _, err := os.Lstat(filepath.Join(j.Source, rel)); err == nil {
+			return
+		}
+		dir := filepath.Join(j.Dest, rel)
+		if os.Remove(dir) != nil {
+			return
+		}
+		infof("removed %s, deleted on the other side", dir)
+	}
+}
+
+// conflict Settle a file changed on both sides according to --conflict.
+func (tw *twoWay) conflict(rel string) error {
+	a, b := tw.sides(rel)
+	switch tw.fwd.conflictPolicy() {
+	case "source":
+		return tw.copy(tw.fwd, rel, b, a)
+	case "dest":
+		return tw.copy(tw.back, rel, a, b)
+	case "newer":
+		aStat, err := os.Stat(a)
+		if err != nil {
+			return err
+		}
+		bStat, err := os.Stat(b)
+		if err != nil {
+			return err
+		}
+		if bStat.ModTime().After(aStat.ModTime()) {
+			return tw.copy(tw.back, rel, a, b)
+		}
+		return tw.copy(tw.fwd, rel, b, a)
+	case "skip":
+		warnf("conflict: %s changed on both sides, left as it is", rel)
+		tw.fwd.emitOutcome("skipped", b, a, fmt.Errorf("changed on both sides"))
+		return nil
+	}
+
+	// keep-both: B's version moves aside under a conflict name on both sides
+	saved := conflictName(rel)
+	savedA, savedB := tw.sides(saved)
+	if err := os.Rename(b, savedB); err != nil {
+		return err
+	}
+	warnf("conflict: %s changed on both sides, kept %s's version as %s", rel, tw.fwd.Dest, saved)
+	if err := tw.copy(tw.back, saved, savedA, savedB); err != nil {
+		return err
+	}
+	return tw.copy(tw.fwd, rel, b, a)
+}
+
+// reconcileAll Bring both sides together at startup, for whatever changed
+// while the watcher wasn't running. Deleting more than --confirm-files or
+// --confirm-percent asks first, like other mass deletions.
+func (tw *twoWay) reconcileAll() error {
+	rels := make(map[string]bool)
+	for _, root := range []string{tw.fwd.Source, tw.fwd.Dest} {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(root, path)
+			if internal(rel) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if opts.NoRecurse && info.IsDir() && path != root {
+				return filepath.SkipDir
+			}
+			if info.Mode().IsRegular() {
+				rels[rel] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range tw.state.Keys() {
+		rels[filepath.FromSlash(key)] = true
+	}
+
+	plans := make(map[string]twoWayAction, len(rels))
+	deletes := 0
+	for rel := range rels {
+		plans[rel] = tw.plan(rel)
+		if plans[rel] == twoWayDeleteA || plans[rel] == twoWayDeleteB {
+			deletes++
+		}
+	}
+	allowDelete := confirmDestructive("two-way", tw.fwd.Source+" and "+tw.fwd.Dest, deletes, len(rels))
+
+	var first error
+	for rel, action := range plans {
+		if (action == twoWayDeleteA || action == twoWayDeleteB) && !allowDelete {
+			continue
+		}
+		if err := tw.apply(rel, action); err != nil {
+			reportError(err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// stats Counters kept for the whole run.
+var stats struct {
+	Copied       int64
+	Verified     int64
+	VerifyFailed int64
+	Events       int64
+	Bytes        int64
+	Failed       int64
+	Latency      int64 // nanoseconds from event to copy, summed over Timed copies
+	Timed        int64
+}
+
+// shouldVerify Full --verify checks every copy. --verify-sample checks that
+// percentage of copies, plus always the large ones (--verify-large). The
+// retries of a failed copy, attempt counting them, are always checked.
+func shouldVerify(size int64, attempt int) bool {
+	if opts.Verify || attempt > 0 {
+		return true
+	}
+	if opts.VerifySample <= 0 {
+		return false
+	}
+	if verifyLarge > 0 && size >= verifyLarge {
+		return true
+	}
+	return rand.Float64()*100 < opts.VerifySample
+}
+
+// verifyCopy Compare the copy's checksum with the source's.
+func verifyCopy(j *job, dstFileName string, srcFileName string, srcSum string, attempt int) (err error) {
+	stat, err := os.Stat(dstFileName)
+	if err != nil || !shouldVerify(stat.Size(), attempt) {
+		return err
+	}
+	start := time.Now()
+	defer func() { traceStep(j, srcFileName, "verify", start, err) }()
+
+	if srcSum == "" {
+		if srcSum, err = fileSha256(srcFileName); err != nil {
+			return err
+		}
+	}
+	dstSum, err := copySha256(dstFileName)
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&stats.Verified, 1)
+	if dstSum != srcSum {
+		atomic.AddInt64(&stats.VerifyFailed, 1)
+		return fmt.Errorf("%w: %s (%s) != %s (%s)", errChecksum, dstFileName, dstSum, srcFileName, srcSum)
+	}
+	return nil
+}
+
+// verifyCoverage One line on how many copies were verified.
+func verifyCoverage() string {
+	copied := atomic.LoadInt64(&stats.Copied)
+	verified := atomic.LoadInt64(&stats.Verified)
+	pct := 0.0
+	if copied > 0 {
+		pct = float64(verified) * 100 / float64(copied)
+	}
+	return fmt.Sprintf("verified %d of %d copies (%.1f%%), %d mismatches",
+		verified, copied, pct, atomic.LoadInt64(&stats.VerifyFailed))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionsDir Root of the dir-style version tree inside a destination.
+const versionsDir = ".versions"
+
+const versionStamp = "20060102T150405.000000000"
+
+// keepVersion With --versions, rename the destination file about to be
+// overwritten into a version, then drop the oldest versions beyond the limit.
+// Returns the version's path, "" when there was nothing to keep.
+func (j *job) keepVersion(dstFileName string) (string, error) {
+	if opts.Versions <= 0 {
+		return "", nil
+	}
+	if !IsFile(dstFileName) {
+		return "", nil
+	}
+
+	if opts.VersionStyle == "dir" {
+		return j.keepDirVersion(dstFileName)
+	}
+	return keepNumberedVersion(dstFileName)
+}
+
+// keepNumberedVersion file.txt becomes file.txt.~N~, the highest N being the newest.
+func keepNumberedVersion(dstFileName string) (string, error) {
+	numbers := numberedVersions(dstFileName)
+	next := 1
+	if len(numbers) > 0 {
+		next = numbers[len(numbers)-1] + 1
+	}
+
+	version := fmt.Sprintf("%s.~%d~", dstFileName, next)
+	if err := os.Rename(dstFileName, version); err != nil {
+		return "", err
+	}
+	numbers = append(numbers, next)
+
+	for len(numbers) > opts.Versions {
+		os.Remove(fmt.Sprintf("%s.~%d~", dstFileName, numbers[0]))
+		numbers = numbers[1:]
+	}
+	return version, nil
+}
+
+// numberedVersions The N of every file.txt.~N~ next to dstFileName, ascending.
+func numberedVersions(dstFileName string) []int {
+	base := filepath.Base(dstFileName) + ".~"
+	entries, err := os.ReadDir(filepath.Dir(dstFileName))
+	if err != nil {
+		return nil
+	}
+
+	numbers := make([]int, 0)
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, base) || !strings.HasSuffix(name, "~") {
+			continue
+		}
+		n, err := strconv.Atoi(name[len(base) : len(name)-1])
+		if err == nil && n > 0 {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// keepDirVersion file.txt becomes .versions/file.txt/<timestamp> under the
+// destination root.
+func (j *job) keepDirVersion(dstFileName string) (string, error) {
+	rel, err := filepath.Rel(j.Dest, dstFileName)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(dstFileName)
+	}
+	dir := filepath.Join(j.Dest, versionsDir, rel)
+	if err := mkdirAll(dir); err != nil {
+		return "", err
+	}
+
+	version := filepath.Join(dir, time.Now().UTC().Format(versionStamp))
+	if err := os.Rename(dstFileName, version); err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return version, nil
+	}
+	// timestamps sort oldest first
+	for i := 0; i < len(entries)-opts.Versions; i++ {
+		os.Remove(filepath.Join(dir, entries[i].Name()))
+	}
+	return version, nil
+}
+
+func validVersionStyle(style string) error {
+	if style != "numbered" && style != "dir" {
+		return fmt.Errorf("invalid --version-style %s, use numbered or dir", style)
+	}
+	return nil
+}
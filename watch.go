@@ -1,70 +1,294 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"github.com/botsphp/fsnotify"
 	"io"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 )
 
 const version = "0.3.0"
 
+// defaultJob Name of the job built from the command line arguments.
+const defaultJob = "default"
+
 const usage = `
 Usage:
-  watch paths... 
+  watch path [copyDir...] [options]
+  watch --config watch.json [options]
+  watch undo --journal dir [--since 1h]
+  watch restore --journal dir --at 2024-06-01T12:00:00Z [--prefix path]
+  watch restore --at 2024-06-01T12:00:00Z [--prefix path] s3://bucket/prefix
+  watch decrypt --key keyfile file.enc [out]
+  watch serve [--listen :7433] [--tls-cert cert.pem --tls-key key.pem] dir
+  watch sync path copyDir... [options]
+  watch diff path copyDir [--json] [--verify]
+  watch status --http addr --api-token token | --control-socket path [--json] [--summary]
+  watch history --history file [--path p] [--since 24h] [--json]
+  watch report --history file [--since 7d] [--format csv|json|html]
+  watch fleet [--registry dir] [--json] [socket...]
+  watch ctl [--control-socket path] [--json] status|pause|resume|resync|flush|queue|reload|path ...
+  watch install-systemd [--user] [--service-name watch] (--config file | path copyDir...)
+  watch install-launchd [--user] [--service-name watch] (--config file | path copyDir...)
 
 Example:
-  watch D:/Windows
+  watch D:/Windows E:/backup --yes
+
+Options:
 `
 
 var (
-	last     time.Time
 	interval time.Duration
-	paths    []string
 	err      error
-	copyDir  = "" //要复制到的目标目录
 	sleep    = 10
+
+	archiveWindow time.Duration
+	drainTimeout  time.Duration
+
+	verifyLarge int64
+
+	eventContent int64
+
+	copyBufferSize = 1 << 20
 )
 
 var opts = options{
-	Interval: "1s",
+	Interval:       "1s",
+	MtimeTolerance: "1s",
+	VerifyLarge:    "100M",
+	LogLevel:       "info",
+	ChunkThreshold: "1G",
+	ChunkSize:      "64M",
+	DeltaThreshold: "64M",
+	ArchiveWindow:  "24h",
+	VersionStyle:   "numbered",
+	BufferSize:     "1M",
+	HTTPMethod:     "PUT",
+	OnCollision:    "overwrite",
+	Retries:        3,
+	FailoverAfter:  3,
+	Conflict:       "keep-both",
+	ErrorSummary:   "1m",
+	QueueSize:      10000,
+	AuditMaxSize:   "100M",
+	AuditKeep:      10,
+	ProgressMin:    "100M",
+	EmailInterval:  "15m",
+	ChatOn:         "failed,batch,offline,online",
+	ChatTemplate:   "{{.Title}}: {{.Message}}",
+	NotifyBatch:    100,
+	WebhookOn:      "copied,batch,failed",
+	DrainTimeout:   "1m",
+	PassFiles:      "args",
+	CommandPolicy:  "serial",
+	KillSignal:     "TERM",
+	KillTimeout:    "5s",
+	ServiceName:    "watch",
+	QueuePolicy:    "block",
+	Workers:        2,
+	ConfirmFiles:   100,
+	ConfirmPercent: 10,
 }
 
 type options struct {
-	Help      bool   `short:"h" long:"help"       description:"Show this help message" default:false`
-	Halt      bool   `short:"h" long:"halt"       description:"Exits on error (Default: false)" default:false`
-	Quiet     bool   `short:"q" long:"quiet"      description:"Suppress standard output (Default: false)" default:false`
-	Interval  string `short:"i" long:"interval"   description:"Run command once within this interval (Default: 1s)" default:"1s"`
-	NoRecurse bool   `short:"n" long:"no-recurse" description:"Skip subfolders (Default: false)" default:false`
-	Version   bool   `short:"V" long:"version"    description:"Output the version number" default:false`
-	OnChange  string `long:"on-change"            description:"Run command on change."`
+	Help            bool     `long:"help"                 description:"Show this help message" default:"false"`
+	Halt            bool     `short:"h" long:"halt"       description:"Exits on error (Default: false)" default:"false"`
+	Quiet           bool     `short:"q" long:"quiet"      description:"Suppress standard output (Default: false)" default:"false"`
+	Interval        string   `short:"i" long:"interval"   description:"Run command once within this interval (Default: 1s)" default:"1s"`
+	NoRecurse       bool     `short:"n" long:"no-recurse" description:"Skip subfolders (Default: false)" default:"false"`
+	Version         bool     `short:"V" long:"version"    description:"Output the version number" default:"false"`
+	OnChange        string   `long:"on-change"            description:"Run command on change."`
+	OnCreate        string   `long:"on-create"            description:"Run command when a file or folder is created"`
+	OnWrite         string   `long:"on-write"             description:"Run command when a file is written"`
+	OnDelete        string   `long:"on-delete"            description:"Run command when a file or folder is deleted"`
+	OnRename        string   `long:"on-rename"            description:"Run command when a file or folder is renamed"`
+	PreCopy         string   `long:"pre-copy"             description:"Run command before every copy, and skip the copy when it fails"`
+	PostCopy        string   `long:"post-copy"            description:"Run command after every copy"`
+	Debounce        string   `long:"debounce"             description:"Run commands once changes have been quiet this long, for all the files changed"`
+	PassFiles       string   `long:"pass-files"           description:"How a --debounce run gets the changed files: args, stdin or file (Default: args)" default:"args"`
+	CommandTimeout  string   `long:"command-timeout"      description:"Kill a command run for changes, with the processes it started, after this long"`
+	Run             string   `long:"run"                  description:"Keep this command running, and restart it when files change"`
+	KillSignal      string   `long:"kill-signal"          description:"Stop the --run command with this signal: TERM, INT, HUP, QUIT, KILL, USR1 or USR2 (Default: TERM)" default:"TERM"`
+	KillTimeout     string   `long:"kill-timeout"         description:"Kill the --run command when it takes longer to stop (Default: 5s)" default:"5s"`
+	Shell           bool     `long:"shell"                description:"Run commands for changes through sh -c, or cmd /C on Windows (Default: false)" default:"false"`
+	CommandPolicy   string   `long:"command-policy"       description:"How runs of commands overlap: serial, concurrent[=N] or restart (Default: serial)" default:"serial"`
+	Yes             bool     `short:"y" long:"yes"        description:"Confirm large deletions without prompting (Default: false)" default:"false"`
+	ConfirmFiles    int      `long:"confirm-files"        description:"Prompt before removing more than this many files (Default: 100)" default:"100"`
+	ConfirmPercent  float64  `long:"confirm-percent"      description:"Prompt before removing more than this percent of the destination (Default: 10)" default:"10"`
+	Chmod           string   `long:"chmod"                description:"Force this octal mode on copies instead of the source mode"`
+	NoPreserveTimes bool     `long:"no-preserve-times"    description:"Leave copy timestamps at the time of copying (Default: false)" default:"false"`
+	Journal         string   `long:"journal"              description:"Keep overwritten and deleted files in this undo journal directory"`
+	Since           string   `long:"since"                description:"undo: restore changes made within this duration (Default: 1h); history, report: copies made within it, e.g. 24h or 7d"`
+	Summary         bool     `long:"summary"              description:"status: print the cumulative statistics only (Default: false)" default:"false"`
+	Path            string   `long:"path"                 description:"history: copies of this source or destination file, or of files in this folder"`
+	User            bool     `long:"user"                 description:"install-systemd, install-launchd: install for the current user instead of system-wide (Default: false)" default:"false"`
+	ServiceName     string   `long:"service-name"         description:"install-systemd, install-launchd: name of the service; also how the watcher is listed in --registry (Default: watch)" default:"watch"`
+	Format          string   `long:"format"               description:"report: csv, json or html (Default: csv)"`
+	At              string   `long:"at"                   description:"restore: point in time, RFC 3339 or a duration ago"`
+	Prefix          string   `long:"prefix"               description:"restore: only paths under this prefix"`
+	Listen          string   `long:"listen"               description:"serve: address to accept senders on (Default: :7433)"`
+	TLSCert         string   `long:"tls-cert"             description:"serve: TLS certificate, PEM"`
+	TLSKey          string   `long:"tls-key"              description:"serve: TLS private key, PEM"`
+	PreserveOwner   bool     `long:"preserve-owner"       description:"Give copies the source owner and group when running with the privilege (Default: false)" default:"false"`
+	Xattrs          bool     `long:"xattrs"               description:"Copy extended attributes and ACLs (Default: false)" default:"false"`
+	NoProbe         bool     `long:"no-probe"             description:"Skip probing the destination filesystem at startup (Default: false)" default:"false"`
+	Config          string   `short:"c" long:"config"     description:"Read the jobs to run from this JSON file"`
+	InitialSync     bool     `long:"initial-sync"         description:"Copy the whole source tree once at startup (Default: false)" default:"false"`
+	ReadOnlySource  bool     `long:"read-only-source"     description:"Guarantee nothing is ever written into the source trees (Default: false)" default:"false"`
+	MtimeTolerance  string   `long:"mtime-tolerance"      description:"Treat copies with the same size and an mtime this close as unchanged (Default: 1s)" default:"1s"`
+	AlwaysCopy      bool     `long:"always-copy"          description:"Copy even when the destination looks unchanged (Default: false)" default:"false"`
+	HashIndex       string   `long:"hash-index"           description:"Remember content hashes of copies in this file and skip identical re-copies"`
+	Link            bool     `long:"link"                 description:"Hardlink instead of copying when source and destination share a filesystem (Default: false)" default:"false"`
+	Verify          bool     `long:"verify"               description:"Compare checksums of every copy with its source (Default: false)" default:"false"`
+	VerifySample    float64  `long:"verify-sample"        description:"Verify this percentage of copies, plus all large ones (Default: 0)" default:"0"`
+	VerifyLarge     string   `long:"verify-large"         description:"With --verify-sample, always verify files at least this big (Default: 100M)" default:"100M"`
+	NoReflink       bool     `long:"no-reflink"           description:"Always copy bytes, even where the filesystem can clone files (Default: false)" default:"false"`
+	JSON            bool     `long:"json"                 description:"Print events as JSON lines (Default: false)" default:"false"`
+	Replay          string   `long:"replay"               description:"Feed events recorded with --json from this file (- for stdin) in addition to watching"`
+	Chaos           string   `long:"chaos"                description:"Test mode: drop/delay/duplicate events, e.g. drop=5,delay=10,dup=5,max-delay=2s"`
+	QueueSize       int      `long:"queue-size"           description:"Most copies waiting at once (Default: 10000)" default:"10000"`
+	QueuePolicy     string   `long:"queue-policy"         description:"When the queue is full: block or drop-oldest (Default: block)" default:"block"`
+	Workers         int      `short:"w" long:"workers"    description:"Copies running in parallel (Default: 2)" default:"2"`
+	LogLevel        string   `long:"log-level"            description:"error, warn, info, debug or trace (Default: info)" default:"info"`
+	DrainTimeout    string   `long:"drain-timeout"        description:"On SIGTERM, copy what is queued for up to this long before exiting (Default: 1m)" default:"1m"`
+	HTTP            string   `long:"http"                 description:"Serve /healthz, and /status and the /api endpoints with --api-token, on this address, e.g. :9090"`
+	APIToken        string   `long:"api-token"            description:"Turn on /status and the /api endpoints of --http for clients sending this bearer token, also read from WATCH_API_TOKEN"`
+	Registry        string   `long:"registry"             description:"List this watcher in this folder, for watch fleet; also read from WATCH_REGISTRY"`
+	ControlSocket   string   `long:"control-socket"       description:"Accept runtime commands (log-level, trace, status, pause, resume, resync, flush, queue, reload, path) on this Unix socket, for watch ctl; also read from WATCH_CONTROL_SOCKET"`
+	ErrorPolicy     []string `long:"error-policy"         description:"Handle errors of a class (permission, disk-full, unreachable, vanished, checksum, other) with log, ignore or halt, e.g. disk-full=halt; may be repeated"`
+	ErrorSummary    string   `long:"error-summary"        description:"Collapse repeated errors into a summary this often, 0 logs every error (Default: 1m)" default:"1m"`
+	BwLimit         string   `long:"bwlimit"              description:"Cap copy throughput across all workers, e.g. 10M per second"`
+	ChunkThreshold  string   `long:"chunk-threshold"      description:"Copy files at least this big in resumable chunks, 0 disables (Default: 1G)" default:"1G"`
+	ChunkSize       string   `long:"chunk-size"           description:"Size of one resumable chunk (Default: 64M)" default:"64M"`
+	NoSparse        bool     `long:"no-sparse"            description:"Write holes of sparse files out as zeros (Default: false)" default:"false"`
+	Delta           bool     `long:"delta"                description:"Reuse unchanged blocks of large existing copies, rsync style (Default: false)" default:"false"`
+	DeltaThreshold  string   `long:"delta-threshold"      description:"Only use --delta for destinations at least this big (Default: 64M)" default:"64M"`
+	Compress        string   `long:"compress"             description:"Store copies compressed: gzip (.gz) or zstd (.zst)"`
+	Archive         string   `long:"archive"              description:"Append changed files to rolling tar or zip archives instead of mirroring"`
+	ArchiveWindow   string   `long:"archive-window"       description:"Start a new archive this often (Default: 24h)" default:"24h"`
+	Encrypt         bool     `long:"encrypt"              description:"Encrypt copies with AES-256-GCM using --key (Default: false)" default:"false"`
+	Key             string   `long:"key"                  description:"Keyfile for --encrypt and decrypt: 32 bytes, 64 hex characters or any secret"`
+	Move            bool     `long:"move"                 description:"Delete each source file once its copy is complete and verified (Default: false)" default:"false"`
+	Versions        int      `long:"versions"             description:"Keep this many previous copies of each overwritten file, 0 keeps none (Default: 0)" default:"0"`
+	VersionStyle    string   `long:"version-style"        description:"numbered (file.txt.~1~) or dir (.versions/file.txt/<timestamp>) (Default: numbered)" default:"numbered"`
+	BackupDir       string   `long:"backup-dir"           description:"Move destination files here before they are overwritten or deleted"`
+	OnCollision     string   `long:"on-collision"         description:"When a destination file exists and differs: overwrite, skip, rename or fail (Default: overwrite)" default:"overwrite"`
+	DestTemplate    string   `long:"dest-template"        description:"Organize copies by a path template, e.g. {dest}/{yyyy}/{mm}/{name}{ext}"`
+	Flatten         bool     `long:"flatten"              description:"Copy every file straight into the destination, suffixing clashing names (Default: false)" default:"false"`
+	Rename          string   `long:"rename"               description:"Rename copies by these comma-separated rules: lower, safe, ascii"`
+	RenameRegex     string   `long:"rename-regex"         description:"Rename copies by a s/regexp/replacement/ substitution"`
+	BufferSize      string   `long:"buffer-size"          description:"Copy buffer size where the system cannot copy files itself (Default: 1M)" default:"1M"`
+	Dedup           bool     `long:"dedup"                description:"Hardlink copies with identical content to one stored file (Default: false)" default:"false"`
+	HTTPMethod      string   `long:"http-method"          description:"http(s) destinations: PUT or POST (Default: PUT)" default:"PUT"`
+	HTTPForm        string   `long:"http-form"            description:"http(s) destinations: send files as this multipart form field instead of the raw body"`
+	HTTPHeader      []string `long:"http-header"          description:"http(s) destinations: add this \"Name: value\" header, may be repeated"`
+	Retries         int      `long:"retries"              description:"Retry a failed copy this many times, waiting 5s, 10s, 20s, ... (Default: 3)" default:"3"`
+	Fallback        []string `long:"fallback"             description:"Copy here when the destination keeps failing; repeat for more fallbacks"`
+	FailoverAfter   int      `long:"failover-after"       description:"Consecutive failures before switching to a fallback (Default: 3)" default:"3"`
+	Output          string   `long:"output"               description:"Stream changed files instead of copying them: tar"`
+	OutputFile      string   `long:"output-file"          description:"Write the --output stream here, e.g. a named pipe, instead of stdout"`
+	EventSocket     string   `long:"event-socket"         description:"Send every event and finished copy as a JSON line to readers of this Unix socket"`
+	EventContent    string   `long:"event-content"        description:"Include the content of copied files up to this size in --event-socket messages, e.g. 64K"`
+	ProgressMin     string   `long:"progress-min"         description:"Show the progress, throughput and ETA of copies of files from this size, 0 for none (Default: 100M)" default:"100M"`
+	DesktopNotify   bool     `long:"desktop-notify"       description:"Show desktop notifications of failed copies and finished syncs (Default: false)" default:"false"`
+	EmailTo         []string `long:"email-to"             description:"Mail failed copies and syncs and destinations going offline to this address; may be repeated"`
+	EmailFrom       string   `long:"email-from"           description:"Sender of --email-to mails (Default: watch@hostname)"`
+	SMTP            string   `long:"smtp"                 description:"Mail server for --email-to: smtp://[user@]host[:port] or smtps://, with the password in SMTP_PASSWORD"`
+	EmailInterval   string   `long:"email-interval"       description:"Send --email-to mails no more often than this (Default: 15m)" default:"15m"`
+	Chat            []string `long:"chat"                 description:"Post notices to this Slack, Discord or Telegram webhook URL, or as {\"text\"} to another; may be repeated"`
+	ChatOn          string   `long:"chat-on"              description:"Notices to post to --chat: failed, synced, batch, offline, online (Default: failed,batch,offline,online)" default:"failed,batch,offline,online"`
+	ChatTemplate    string   `long:"chat-template"        description:"Go template of --chat messages over the notice's .Kind, .Job, .Path, .Title, .Message, .Count, .Time (Default: {{.Title}}: {{.Message}})" default:"{{.Title}}: {{.Message}}"`
+	NotifyBatch     int64    `long:"notify-batch"         description:"Tell notifiers of a batch of this many copies once the queue has run dry, 0 for never (Default: 100)" default:"100"`
+	Webhook         []string `long:"webhook"              description:"POST a JSON payload to this URL for every copy and notice picked by --webhook-on; may be repeated"`
+	WebhookOn       string   `long:"webhook-on"           description:"What to POST to --webhook: copied, failed, synced, batch, offline, online (Default: copied,batch,failed)" default:"copied,batch,failed"`
+	WebhookTemplate string   `long:"webhook-template"     description:"Go template of the --webhook body instead of the payload as JSON; {{json .Path}} quotes a value"`
+	WebhookSecret   string   `long:"webhook-secret"       description:"Sign --webhook bodies with HMAC-SHA256 under this secret, also read from WATCH_WEBHOOK_SECRET"`
+	OTLP            string   `long:"otlp"                 description:"Export a trace of every copy, from event to verify, to this OTLP/HTTP collector, e.g. http://localhost:4318"`
+	History         string   `long:"history"              description:"Remember the latest copies of every file, with their checksums, and daily totals in this file for watch history and watch report"`
+	AuditLog        string   `long:"audit-log"            description:"Append every event, decision and copy result to this file as JSON lines"`
+	AuditMaxSize    string   `long:"audit-max-size"       description:"Rotate the audit log when it reaches this size, 0 for never (Default: 100M)" default:"100M"`
+	AuditKeep       int      `long:"audit-keep"           description:"Rotated audit logs to keep (Default: 10)" default:"10"`
+	Catalog         string   `long:"catalog"              description:"Record every event and copy outcome in this database: a SQLite file or a postgres:// URL"`
+	Publish         string   `long:"publish"              description:"Publish every event and copy outcome as JSON to nats://, mqtt:// or kafka://host/topic"`
+	Syslog          string   `long:"syslog"               description:"Send warnings, errors, events and copy outcomes to syslog: local, or udp://, tcp://, tls://host[:port]"`
+	ShareUser       string   `long:"share-user"           description:"Log on to \\\\server\\share paths as this DOMAIN\\user, with the password in SMB_PASSWORD"`
+	Profile         string   `long:"profile"              description:"s3 destinations: take credentials and region from this profile of ~/.aws/credentials and ~/.aws/config"`
+	Include         []string `long:"include"              description:"Only copy files matching this glob, e.g. *.jpg or raw/*.cr2; may be repeated"`
+	Exclude         []string `long:"exclude"              description:"Don't copy files matching this glob; may be repeated"`
+	Route           []string `long:"route"                description:"Copy files matching a glob only to this destination, e.g. '*.raw=/mnt/nas'; may be repeated"`
+	Schedule        string   `long:"schedule"             description:"Also run a full sync at these times, a cron expression such as \"0 3 * * *\" or @daily"`
+	PauseWindow     []string `long:"pause-window"         description:"Don't copy during this time, e.g. \"mon-fri 08:00-18:00\"; events are queued and copied after; may be repeated"`
+	FullSpeedWindow []string `long:"full-speed-window"    description:"Lift --bwlimit during this time, e.g. 22:00-06:00; may be repeated"`
+	Snapshots       bool     `long:"snapshots"            description:"Write every full sync into a dated snapshot folder, copyDir/2024-06-01T12, hard-linking unchanged files to the previous one"`
+	SnapshotKeep    int      `long:"snapshot-keep"        description:"--snapshots: keep this many snapshots, removing the oldest (Default: all)"`
+	Mirror          bool     `long:"mirror"               description:"Keep the destination an exact replica: remove what was deleted from the source or isn't in it (Default: false)" default:"false"`
+	TwoWay          bool     `long:"two-way"              description:"Sync both ways: watch the destination too and carry changes and deletions back (Default: false)" default:"false"`
+	Conflict        string   `long:"conflict"             description:"When the destination was changed too, or is newer than the source: keep-both, newer, source, dest, skip (Default: keep-both)" default:"keep-both"`
+	SyncState       string   `long:"sync-state"           description:"Keep the last synced state of every file here, always kept for --two-way and --mirror (Default: copyDir/.watch-sync-state)"`
+	Checkpoint      string   `long:"checkpoint"           description:"Record the progress of initial syncs here, so an interrupted one resumes (Default: copyDir/.watch-checkpoint)"`
+	StagingDir      string   `long:"staging-dir"          description:"Write partial copies here, on the destination's volume, before renaming them into place (Default: copyDir/.watch-staging)"`
 }
 
-func init() {
-	if len(os.Args) == 1 {
-		fmt.Fprintln(os.Stderr, usage)
-		os.Exit(0)
+// start Run a subcommand, or parse the options and set the watcher up.
+func start() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
 	}
 
-	paths, err = ResolvePaths([]string{os.Args[1]})
-	if len(paths) <= 0 {
-		fmt.Fprintln(os.Stderr, usage)
+	argv := os.Args[1:]
+	if len(argv) == 0 && wizardOnDoubleClick {
+		if wizardArgs, ok := runWizard(); ok {
+			argv = wizardArgs
+		}
+	}
+
+	args, err := parseOptions(argv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(2)
 	}
 
-	if len(os.Args) >= 3 && IsDir(os.Args[2]) {
-		copyDir = os.Args[2]
+	if opts.Version {
+		fmt.Fprintln(os.Stdout, version)
+		os.Exit(0)
 	}
 
-	if len(copyDir) == 0 || !IsDir(copyDir) {
-		fmt.Fprintln(os.Stderr, "copy target dir is not exists", copyDir)
+	if opts.Help || (len(args) == 0 && opts.Config == "") {
+		fmt.Fprint(os.Stderr, usage, optionsUsage(&opts))
+		os.Exit(0)
+	}
+
+	setup(args)
+}
+
+// setup Build the jobs from the config file or the path arguments, check the
+// options and open destinations, for watching and for the sync command.
+func setup(args []string) {
+	if opts.Config != "" {
+		jobs, err = loadConfig(opts.Config)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	} else {
+		// every further copyDir fans the same source out to one more job
+		jobs = []*job{newJob(defaultJob, args[0], "")}
+		if len(args) >= 2 {
+			jobs[0].Dest = args[1]
+			for i, dest := range args[2:] {
+				jobs = append(jobs, newJob(fmt.Sprintf("%s-%d", defaultJob, i+2), args[0], dest))
+			}
+		}
 	}
 
 	interval, err = time.ParseDuration(opts.Interval)
@@ -72,47 +296,624 @@ func init() {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	if opts.Debounce != "" {
+		if debounce, err = time.ParseDuration(opts.Debounce); err != nil || debounce <= 0 {
+			fmt.Fprintln(os.Stderr, "invalid --debounce", opts.Debounce)
+			os.Exit(1)
+		}
+	}
+	if opts.CommandTimeout != "" {
+		if commandTimeout, err = time.ParseDuration(opts.CommandTimeout); err != nil || commandTimeout <= 0 {
+			fmt.Fprintln(os.Stderr, "invalid --command-timeout", opts.CommandTimeout)
+			os.Exit(1)
+		}
+	}
+	if err = parseRunOptions(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = parseCommandPolicy(opts.CommandPolicy); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if opts.PassFiles != "args" && opts.PassFiles != "stdin" && opts.PassFiles != "file" {
+		fmt.Fprintln(os.Stderr, "invalid --pass-files", opts.PassFiles)
+		os.Exit(1)
+	}
+
+	level, err := parseLevel(opts.LogLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if opts.Quiet && level > levelWarn {
+		level = levelWarn
+	}
+	setLogLevel(level)
+
+	summaryEvery, err := time.ParseDuration(opts.ErrorSummary)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid --error-summary", opts.ErrorSummary)
+		os.Exit(1)
+	}
+	startErrorSummaries(summaryEvery)
+	if errorPolicies, err = parseErrorPolicies(opts.ErrorPolicy); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if opts.Chmod != "" {
+		if _, err = strconv.ParseUint(opts.Chmod, 8, 32); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid --chmod", opts.Chmod)
+			os.Exit(1)
+		}
+	}
+
+	if _, err = time.ParseDuration(opts.MtimeTolerance); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid --mtime-tolerance", opts.MtimeTolerance)
+		os.Exit(1)
+	}
+
+	if verifyLarge, err = parseSize(opts.VerifyLarge); err != nil {
+		fmt.Fprintln(os.Stderr, "--verify-large:", err)
+		os.Exit(1)
+	}
+
+	if chunkThreshold, err = parseSize(opts.ChunkThreshold); err != nil {
+		fmt.Fprintln(os.Stderr, "--chunk-threshold:", err)
+		os.Exit(1)
+	}
+	if chunkSize, err = parseSize(opts.ChunkSize); err != nil || chunkSize <= 0 {
+		fmt.Fprintln(os.Stderr, "invalid --chunk-size", opts.ChunkSize)
+		os.Exit(1)
+	}
+
+	if size, err := parseSize(opts.BufferSize); err != nil || size < 4<<10 || size > 1<<30 {
+		fmt.Fprintln(os.Stderr, "invalid --buffer-size", opts.BufferSize, "(4K to 1G)")
+		os.Exit(1)
+	} else {
+		copyBufferSize = int(size)
+	}
+
+	if deltaThreshold, err = parseSize(opts.DeltaThreshold); err != nil {
+		fmt.Fprintln(os.Stderr, "--delta-threshold:", err)
+		os.Exit(1)
+	}
+
+	if err = validCompress(opts.Compress); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err = validArchive(opts.Archive); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if opts.Archive != "" && (opts.Compress != "" || opts.Encrypt) {
+		// archive entries are written as they are, never compressed or encrypted
+		fmt.Fprintln(os.Stderr, "--archive cannot be used with --compress or --encrypt")
+		os.Exit(1)
+	}
+	if archiveWindow, err = time.ParseDuration(opts.ArchiveWindow); err != nil || archiveWindow <= 0 {
+		fmt.Fprintln(os.Stderr, "invalid --archive-window", opts.ArchiveWindow)
+		os.Exit(1)
+	}
+	if drainTimeout, err = time.ParseDuration(opts.DrainTimeout); err != nil || drainTimeout < 0 {
+		fmt.Fprintln(os.Stderr, "invalid --drain-timeout", opts.DrainTimeout)
+		os.Exit(1)
+	}
+	if opts.Chaos != "" {
+		c, err := parseChaos(opts.Chaos)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		chaos = &c
+	}
+
+	if opts.Encrypt {
+		if opts.Key == "" {
+			fmt.Fprintln(os.Stderr, "--encrypt needs --key")
+			os.Exit(1)
+		}
+		if encryptKey, err = loadKey(opts.Key); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if err = validVersionStyle(opts.VersionStyle); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err = validCollision(opts.OnCollision); err != nil {
+		fmt.Fprintln(os.Stderr, "--on-collision:", err)
+		os.Exit(1)
+	}
+
+	if err = validTemplate(opts.DestTemplate); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if opts.Flatten && opts.DestTemplate != "" {
+		fmt.Fprintln(os.Stderr, "--flatten and --dest-template cannot be combined")
+		os.Exit(1)
+	}
 
-	last = time.Now().Add(-interval)
+	if err = validPatterns(append(opts.Include, opts.Exclude...)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = applyRoutes(jobs, opts.Route); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err = validConflict(opts.Conflict); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if opts.Mirror {
+		renamed := opts.DestTemplate != "" || opts.Flatten || opts.Rename != "" || opts.RenameRegex != ""
+		for _, j := range jobs {
+			renamed = renamed || j.DestTemplate != "" || len(j.Rename) > 0
+		}
+		if renamed || opts.Move || opts.TwoWay || opts.Archive != "" || opts.Output != "" {
+			fmt.Fprintln(os.Stderr, "--mirror needs each file at its own path and cannot be combined with --move, --two-way, --archive, --output, --dest-template, --flatten or --rename")
+			os.Exit(1)
+		}
+	}
+	if opts.Mirror || opts.Snapshots {
+		if a, b, shared := sharedDest(jobs); shared {
+			fmt.Fprintln(os.Stderr, "jobs", a.Name, "and", b.Name, "share the destination", b.Dest+"; --mirror and --snapshots would remove each other's files")
+			os.Exit(1)
+		}
+	}
+	if opts.Snapshots && (opts.TwoWay || opts.Archive != "" || opts.Output != "") {
+		fmt.Fprintln(os.Stderr, "--snapshots needs a local destination and cannot be combined with --two-way, --archive or --output")
+		os.Exit(1)
+	}
+	if opts.TwoWay {
+		if opts.Move || opts.Archive != "" || opts.Output != "" || opts.ReadOnlySource || transformed() || opts.DestTemplate != "" || opts.Flatten || len(opts.Fallback) > 0 {
+			fmt.Fprintln(os.Stderr, "--two-way keeps plain copies on both sides and cannot be combined with --move, --archive, --output, --read-only-source, --compress, --encrypt, --dest-template, --flatten or --fallback")
+			os.Exit(1)
+		}
+		if jobs, err = addTwoWayJobs(jobs); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.Move && opts.Archive != "" {
+		fmt.Fprintln(os.Stderr, "--move cannot verify archive entries, use it without --archive")
+		os.Exit(1)
+	}
+	if opts.Move && len(jobs) > 1 {
+		sources := make(map[string]bool)
+		for _, j := range jobs {
+			if sources[filepath.Clean(j.Source)] {
+				fmt.Fprintln(os.Stderr, "--move would take the file away from the other destinations of", j.Source)
+				os.Exit(1)
+			}
+			sources[filepath.Clean(j.Source)] = true
+		}
+	}
+
+	if opts.BwLimit != "" {
+		rate, err := parseSize(opts.BwLimit)
+		if err != nil || rate <= 0 {
+			fmt.Fprintln(os.Stderr, "invalid --bwlimit", opts.BwLimit)
+			os.Exit(1)
+		}
+		bandwidth = newTokenBucket(rate)
+	}
+	if fullSpeed, err = parseWindows(opts.FullSpeedWindow); err != nil {
+		fmt.Fprintln(os.Stderr, "--full-speed-window:", err)
+		os.Exit(1)
+	}
+	if _, err = parseWindows(opts.PauseWindow); err != nil {
+		fmt.Fprintln(os.Stderr, "--pause-window:", err)
+		os.Exit(1)
+	}
+
+	if opts.QueuePolicy != "block" && opts.QueuePolicy != "drop-oldest" {
+		fmt.Fprintln(os.Stderr, "invalid --queue-policy", opts.QueuePolicy)
+		os.Exit(1)
+	}
+	if opts.Retries < 0 {
+		fmt.Fprintln(os.Stderr, "invalid --retries", opts.Retries)
+		os.Exit(1)
+	}
+	if err = validOutput(opts.Output); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if opts.Output != "" {
+		for _, j := range jobs {
+			if j.Dest != "" {
+				fmt.Fprintln(os.Stderr, "job", j.Name, "--output replaces the destination, drop", j.Dest)
+				os.Exit(1)
+			}
+		}
+		if opts.Archive != "" {
+			fmt.Fprintln(os.Stderr, "--output and --archive cannot be combined")
+			os.Exit(1)
+		}
+		if output, err = openOutput(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.EventContent != "" {
+		if eventContent, err = parseSize(opts.EventContent); err != nil {
+			fmt.Fprintln(os.Stderr, "--event-content:", err)
+			os.Exit(1)
+		}
+	}
+
+	if progressMin, err = parseSize(opts.ProgressMin); err != nil {
+		fmt.Fprintln(os.Stderr, "--progress-min:", err)
+		os.Exit(1)
+	}
+
+	if opts.Syslog != "" {
+		if syslogOut, err = openSyslog(opts.Syslog); err != nil {
+			fmt.Fprintln(os.Stderr, "--syslog:", err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.Catalog != "" {
+		if catalogDB, err = openCatalog(opts.Catalog); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.AuditLog != "" {
+		max, err := parseSize(opts.AuditMaxSize)
+		if err != nil || max < 0 || opts.AuditKeep < 0 {
+			fmt.Fprintln(os.Stderr, "invalid --audit-max-size or --audit-keep")
+			os.Exit(1)
+		}
+		if audit, err = openAudit(opts.AuditLog, max, opts.AuditKeep); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.DesktopNotify {
+		notifiers = append(notifiers, newDesktopNotifier())
+	}
+
+	if len(opts.EmailTo) > 0 {
+		interval, err := time.ParseDuration(opts.EmailInterval)
+		if err != nil || interval < 0 {
+			fmt.Fprintln(os.Stderr, "invalid --email-interval", opts.EmailInterval)
+			os.Exit(1)
+		}
+		if opts.SMTP == "" {
+			fmt.Fprintln(os.Stderr, "--email-to needs --smtp")
+			os.Exit(1)
+		}
+		if mailer, err = openEmail(opts.SMTP, opts.EmailFrom, opts.EmailTo, interval); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		notifiers = append(notifiers, mailer)
+	}
+
+	if len(opts.Chat) > 0 {
+		kinds, err := parseChatOn(opts.ChatOn)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		text, err := template.New("chat").Parse(opts.ChatTemplate)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "--chat-template:", err)
+			os.Exit(1)
+		}
+		for _, webhook := range opts.Chat {
+			c, err := openChat(webhook, kinds, text)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			notifiers = append(notifiers, c)
+		}
+	}
+	if len(opts.Webhook) > 0 {
+		events, err := parseWebhookOn(opts.WebhookOn)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		var body *template.Template
+		if opts.WebhookTemplate != "" {
+			if body, err = template.New("webhook").Funcs(webhookFuncs).Parse(opts.WebhookTemplate); err != nil {
+				fmt.Fprintln(os.Stderr, "--webhook-template:", err)
+				os.Exit(1)
+			}
+		}
+		for _, target := range opts.Webhook {
+			w, err := openWebhook(target, events, body, webhookSecret())
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			webhooks = append(webhooks, w)
+			notifiers = append(notifiers, w)
+		}
+	}
+	batchNotice = opts.NotifyBatch
+
+	if opts.OTLP != "" {
+		if tracer, err = openTracer(opts.OTLP); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.History != "" {
+		if err = guardSource(opts.History); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if history, err = openStore(opts.History); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.Publish != "" {
+		if bus, err = openBus(opts.Publish); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.FailoverAfter < 1 {
+		fmt.Fprintln(os.Stderr, "invalid --failover-after", opts.FailoverAfter)
+		os.Exit(1)
+	}
+
+	if err = validateReadOnlySource(jobs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if opts.HashIndex != "" {
+		if err = guardSource(opts.HashIndex); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		hashIndex, err = openStore(opts.HashIndex)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	for _, j := range jobs {
+		if err = j.prepare(len(jobs)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if len(j.paths) == 0 {
+				fmt.Fprint(os.Stderr, usage, optionsUsage(&opts))
+				os.Exit(2)
+			}
+			os.Exit(1)
+		}
+	}
+}
+
+// prepare Give the job the options it doesn't set itself, and its queue,
+// hooks and destination. jobCount is how many jobs run, which decides where
+// their sync state goes. A job without its source's paths gets an error
+// with j.paths empty.
+func (j *job) prepare(jobCount int) error {
+	var err error
+	if len(j.Fallback) == 0 {
+		j.Fallback = opts.Fallback
+	}
+	if len(j.Include) == 0 {
+		j.Include = opts.Include
+	}
+	if len(j.Exclude) == 0 {
+		j.Exclude = opts.Exclude
+	}
+	if j.Schedule == "" {
+		j.Schedule = opts.Schedule
+	}
+	if len(j.PauseWindows) == 0 {
+		j.PauseWindows = opts.PauseWindow
+	}
+	if err = j.setHooks(); err != nil {
+		return fmt.Errorf("job %s %v", j.Name, err)
+	}
+	// validated with the config and options already
+	j.pauses, _ = parseWindows(j.PauseWindows)
+	if j.Schedule != "" {
+		if j.schedule, err = parseCron(j.Schedule); err != nil {
+			return fmt.Errorf("job %s %v", j.Name, err)
+		}
+	}
+	if err = j.connectShares(); err != nil {
+		return fmt.Errorf("job %s %v", j.Name, err)
+	}
+	// a source on a share can only be looked at once it is connected
+	j.rootDir = sourceRoot(j.Source)
+
+	j.queue = newCopyQueue(opts.QueueSize, opts.QueuePolicy)
+	j.queue.name, j.queue.pauses = j.Name, j.pauses
+	j.paths, err = ResolvePaths([]string{j.Source})
+	if len(j.paths) <= 0 {
+		return fmt.Errorf("job %s %v", j.Name, err)
+	}
+
+	if output != nil {
+		j.sink = output
+		if err = j.checkMove(); err != nil {
+			return err
+		}
+		if err = j.compileRename(); err != nil {
+			return fmt.Errorf("job %s %v", j.Name, err)
+		}
+		return nil
+	}
+
+	if len(j.Fallback) > 0 {
+		// a file that went to a fallback is copied again from its source
+		if opts.Archive != "" || opts.Move {
+			return fmt.Errorf("job %s fallbacks cannot be combined with --archive or --move", j.Name)
+		}
+		if j.sink, err = j.openFailover(); err != nil {
+			return fmt.Errorf("job %s %v", j.Name, err)
+		}
+		if err = j.compileRename(); err != nil {
+			return fmt.Errorf("job %s %v", j.Name, err)
+		}
+		return nil
+	}
+
+	if isRemote(j.Dest) {
+		if opts.Archive != "" {
+			return fmt.Errorf("job %s --archive needs a local destination", j.Name)
+		}
+		if opts.Snapshots {
+			return fmt.Errorf("job %s --snapshots needs a local destination", j.Name)
+		}
+		if j.sink, err = openSink(j.Dest); err != nil {
+			return fmt.Errorf("job %s %v", j.Name, err)
+		}
+		if err = j.checkMove(); err != nil {
+			return err
+		}
+		if err = j.compileRename(); err != nil {
+			return fmt.Errorf("job %s %v", j.Name, err)
+		}
+		return nil
+	}
+
+	if len(j.Dest) == 0 || !IsDir(j.Dest) {
+		fmt.Fprintln(os.Stderr, "copy target dir is not exists", j.Dest)
+		return nil
+	}
+
+	if err = j.compileRename(); err != nil {
+		return fmt.Errorf("job %s %v", j.Name, err)
+	}
+
+	if err = j.checkStaging(); err != nil {
+		return fmt.Errorf("job %s %v", j.Name, err)
+	}
+	j.cleanStaging()
+	j.cleanParts()
+	if opts.Snapshots {
+		if err = j.openSnapshots(); err != nil {
+			return fmt.Errorf("job %s %v", j.Name, err)
+		}
+	}
+	if j.twoWay == nil && j.keepsState() {
+		if j.state, err = openStore(stateFile(j, jobCount)); err != nil {
+			return fmt.Errorf("job %s %v", j.Name, err)
+		}
+	}
+
+	if !opts.NoProbe {
+		j.probe()
+	}
+	if err = j.openNames(); err != nil {
+		return fmt.Errorf("job %s %v", j.Name, err)
+	}
+	return nil
 }
 
 func main() {
+	start()
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	activeWatcher = watcher
 	done := make(chan bool)
 
-	// clean-up watcher on interrupt (^C)
+	// clean-up watcher on interrupt (^C), and after copying what is queued
+	// on SIGTERM, as service managers stop services
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-interrupt
-		if !opts.Quiet {
-			fmt.Fprintln(os.Stdout, "Interrupted. Cleaning up before exiting...")
+		sig := <-interrupt
+		sdNotify("STOPPING=1")
+		if sig == syscall.SIGTERM {
+			infof("Terminated. Copying what is queued before exiting...")
+			if !drainQueues(drainTimeout) {
+				warnf("copies still queued after --drain-timeout %s, exiting anyway", opts.DrainTimeout)
+			}
+		}
+		infof("Interrupted. Cleaning up before exiting...")
+		if opts.Verify || opts.VerifySample > 0 {
+			infof("%s", verifyCoverage())
+		}
+		if len(jobs) > 1 {
+			reportJobs()
 		}
+		infof("%s", summary())
 		watcher.Close()
+		closeOutputs()
 		os.Exit(0)
 	}()
 
+	go summaryOnQuit()
+	go resyncOnHangup()
+
+	for _, j := range jobs {
+		j.queue.startWorkers(opts.Workers)
+	}
+
+	if socket := controlSocket(); socket != "" {
+		if err = startControl(socket); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.EventSocket != "" {
+		if err = startEventSocket(opts.EventSocket); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.HTTP != "" {
+		setAPIToken()
+		if err = startHTTP(opts.HTTP); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if dir := registryDir(); dir != "" {
+		if err = register(dir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
 	// process watcher events
+	raw := make(chan fileEvent, 64)
 	go func() {
 		for {
 			select {
 			case ev := <-watcher.Event:
-				if !opts.Quiet {
-					fmt.Fprintln(os.Stdout, ev)
-				}
-
-				//只处理新增和写入结束
-				if ev.IsCreate() || ev.IsAttrib() {
-					if err := sync(ev.GetFile()); err != nil {
-						fmt.Fprintln(os.Stderr, err)
-					}
-				}
+				raw <- newFileEvent(ev)
 			case err := <-watcher.Error:
-				fmt.Fprintln(os.Stderr, err)
+				reportError(err)
 				if opts.Halt {
 					os.Exit(1)
 				}
@@ -120,33 +921,99 @@ func main() {
 		}
 	}()
 
-	// add paths to be watched
-	for _, p := range paths {
-		err = watcher.Watch(p)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+	events := raw
+	if chaos != nil {
+		chaotic := make(chan fileEvent, 64)
+		go chaosEvents(*chaos, raw, chaotic)
+		events = chaotic
+	}
+
+	go func() {
+		for {
+			select {
+			case ev := <-events:
+				handleEvent(ev)
+			case eventLoopAlive <- struct{}{}:
+			}
+		}
+	}()
+
+	if opts.Replay != "" {
+		go func() {
+			if err := replayEvents(opts.Replay, raw); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}()
+	}
+
+	// add paths to be watched, once even when several jobs share them
+	watched := make(map[string]bool)
+	for _, j := range jobs {
+		for _, p := range j.paths {
+			if watched[p] {
+				continue
+			}
+			watched[p] = true
+			err = watchRoot(watcher, p)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
 		}
 	}
 
+	go runInitialSyncs(jobs)
+	for _, j := range jobs {
+		if j.schedule != nil {
+			go j.runSchedule()
+		}
+	}
+	go watchShares(watcher)
+	if progressMin > 0 {
+		go showProgress()
+	}
+	if opts.Run != "" {
+		startRun()
+	}
+	if sdNotify("READY=1") {
+		startWatchdog()
+	}
+
 	// wait and watch
 	<-done
 }
 
-func ExecCommand() error {
-	if opts.OnChange == "" {
-		return nil
-	} else {
-		args := strings.Split(opts.OnChange, " ")
-		cmd := exec.Command(args[0], args[1:]...)
-
-		if !opts.Quiet {
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-		}
-		cmd.Stdin = os.Stdin
-
-		return cmd.Run()
+// closeOutputs Finish archives, streams and event consumers on exit.
+func closeOutputs() {
+	unregister()
+	stopRun(true)
+	closeArchives()
+	if output != nil {
+		output.close()
+	}
+	if catalogDB != nil {
+		catalogDB.close()
+	}
+	if audit != nil {
+		audit.close()
+	}
+	if history != nil {
+		history.Close()
+	}
+	if tracer != nil {
+		tracer.close()
+	}
+	if mailer != nil {
+		mailer.close()
+	}
+	for _, w := range webhooks {
+		w.close()
+	}
+	if bus != nil {
+		bus.close()
+	}
+	if syslogOut != nil {
+		syslogOut.close()
 	}
 }
 
@@ -194,45 +1061,158 @@ func ResolvePaths(args []string) ([]string, error) {
 	return resolved, nil
 }
 
-func sync(filePath string) error {
-	if len(copyDir) == 0 || !IsDir(copyDir) {
+func handleEvent(ev fileEvent) {
+	atomic.AddInt64(&stats.Events, 1)
+	printEvent(ev)
+	emit(eventMessage{Time: ev.Time, Op: ev.Op, Path: ev.Path})
+	defer changeHandled(ev)
+
+	// two-way jobs reconcile the path whatever happened to it
+	if found := jobsFor(ev.Path); len(found) > 0 && found[0].twoWay != nil {
+		for _, j := range found {
+			j.twoWay.schedule(j, ev.Path)
+		}
+		return
+	}
+
+	if opts.Mirror && (ev.Op == "delete" || ev.Op == "rename") {
+		for _, j := range jobsFor(ev.Path) {
+			if deferRemoval(j, ev.Path) {
+				continue
+			}
+			if err := j.mirrorRemove(ev.Path); err != nil {
+				reportError(err)
+			}
+		}
+		return
+	}
+
+	//只处理新增和写入结束
+	if ev.Op != "create" && ev.Op != "attrib" {
+		return
+	}
+
+	for _, j := range jobsFor(ev.Path) {
+		if IsFile(ev.Path) && !j.wants(ev.Path) {
+			tracef(ev.Path, "job %s: not routed here", j.Name)
+			j.auditDecision("filtered", ev.Path, "", "not matched by the job's include, exclude or route")
+			continue
+		}
+		if err := syncFile(j, ev.Path); err != nil {
+			reportError(err)
+		}
+	}
+}
+
+// destPath Map a source file to its place under the job's destination: the
+// same path relative to the watched root.
+func (j *job) destPath(filePath string) string {
+	return filepath.Join(j.target(), j.relDest(filePath))
+}
+
+// relDest The destination path of a source file relative to the
+// destination root, after templates and renaming.
+func (j *job) relDest(filePath string) string {
+	rel, err := filepath.Rel(j.root(), filePath)
+	if err != nil {
+		// one path absolute, the other relative
+		root, _ := filepath.Abs(j.root())
+		abs, _ := filepath.Abs(filePath)
+		rel, err = filepath.Rel(root, abs)
+	}
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = filepath.Base(filePath)
+	}
+	if template := j.destTemplate(); template != "" {
+		rel = j.expandTemplate(template, filePath, rel)
+	}
+	return j.destRel(rel)
+}
+
+// fileDest The destination of a source file, with collision and
+// compression handling applied.
+func (j *job) fileDest(filePath string) string {
+	if j.sink != nil {
+		return j.remotePath(filePath)
+	}
+	return j.caseGuard(j.destPath(filePath), filePath) + compressSuffix() + encryptSuffix()
+}
+
+// rawDest The destination of a source file before caseGuard has its say,
+// for while maintenance keeps the destination off limits.
+func (j *job) rawDest(filePath string) string {
+	if j.sink != nil {
+		return j.remotePath(filePath)
+	}
+	return j.destPath(filePath) + compressSuffix() + encryptSuffix()
+}
+
+func syncFile(j *job, filePath string) error {
+	if j.sink != nil {
+		if IsFile(filePath) {
+			j.queue.push(&copyTask{job: j, src: filePath, dst: j.fileDest(filePath), due: time.Now().Add(time.Second * time.Duration(sleep)), seen: time.Now()})
+		}
 		return nil
 	}
 
-	newPath := filePath
-	if runtime.GOOS == "windows" {
-		newPath = strings.Replace(filePath, filePath[0:2], copyDir, 1)
-	} else {
-		newPath = copyDir + filePath
+	if len(j.Dest) == 0 {
+		return nil
+	}
+
+	// the destination may be unmounted during maintenance: queue without
+	// touching it, the copy creates the folders it needs
+	if on, _ := inMaintenance(); on {
+		if IsFile(filePath) {
+			t := &copyTask{job: j, src: filePath, dst: j.rawDest(filePath), due: time.Now().Add(time.Second * time.Duration(sleep)), seen: time.Now(), unguarded: true}
+			if opts.Archive != "" {
+				t.dst, t.unguarded = filePath, false
+			}
+			j.queue.push(t)
+		} else if IsDir(filePath) && opts.Archive == "" {
+			deferFolder(j, filePath)
+		}
+		return nil
+	}
+
+	if !IsDir(j.Dest) && !reconnectShare(j.Dest) {
+		// watchShares resyncs the job once the destination is back
+		if atomic.CompareAndSwapInt32(&j.destLost, 0, 1) {
+			warnf("job %s: destination %s is gone, resyncing once it is back", j.Name, j.Dest)
+		}
+		return nil
+	}
+
+	newPath := j.destPath(filePath)
+
+	if opts.Archive != "" {
+		if IsFile(filePath) {
+			j.queue.push(&copyTask{job: j, src: filePath, dst: filePath, due: time.Now().Add(time.Second * time.Duration(sleep)), seen: time.Now()})
+		}
+		return nil
 	}
 
 	if IsDir(filePath) {
+		// templated destinations only get the folders their files need
+		if j.destTemplate() != "" {
+			return nil
+		}
 		if IsDir(newPath) {
-			fmt.Fprintln(os.Stdout, "dir exists", newPath)
+			debugf("dir exists %s", newPath)
 			return nil
 		}
 		return mkdirAll(newPath)
 	}
 
 	if IsFile(filePath) {
+		newPath = j.fileDest(filePath)
 		dirName := filepath.Dir(newPath)
 		err := mkdirAll(dirName)
 		if err != nil {
 			return err
 		}
 
-		fmt.Fprintf(os.Stdout, "copy file from %s to %s in %d secend\n", filePath, newPath, sleep)
-		time.AfterFunc(time.Second*time.Duration(sleep), func() {
-			// 文件被删除则不处理
-			if IsFile(filePath) {
-				_, err = copyFile(newPath, filePath)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
-				} else {
-					fmt.Fprintln(os.Stdout, "file copy success", newPath)
-				}
-			}
-		})
+		infof("copy file from %s to %s in %d secend", filePath, newPath, sleep)
+		j.queue.push(&copyTask{job: j, src: filePath, dst: newPath, due: time.Now().Add(time.Second * time.Duration(sleep)), seen: time.Now()})
 
 		return err
 	}
@@ -249,35 +1229,59 @@ func IsDir(path string) bool {
 }
 
 func IsFile(path string) bool {
-	return !IsDir(path)
+	s, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return !s.IsDir()
 }
 
 func mkdirAll(path string) error {
+	if err := guardSource(path); err != nil {
+		return err
+	}
 	return os.MkdirAll(path, os.ModePerm)
 }
 
 func copyFile(dstFileName string, srcFileName string) (written int64, err error) {
 	srcFile, err := os.Open(srcFileName)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		return
 	}
 	defer srcFile.Close()
 
-	//通过srcFile，获取到READER
-	reader := bufio.NewReader(srcFile)
+	// 不限速时交给系统复制
+	if bandwidth == nil {
+		if stat, err := srcFile.Stat(); err == nil && (opts.NoSparse || !sparse(stat)) {
+			if n, ok := systemCopy(dstFileName, srcFileName); ok {
+				return n, nil
+			}
+		}
+	}
 
 	//打开dstFileName
-	dstFile, err := os.OpenFile(dstFileName, os.O_WRONLY|os.O_CREATE, 0666)
+	dstFile, err := os.OpenFile(dstFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
 
-	//通过dstFile，获取到WRITER
-	writer := bufio.NewWriter(dstFile)
-	//writer.Flush()
-
 	defer dstFile.Close()
 
-	return io.Copy(writer, reader)
+	// 稀疏文件只复制数据区
+	if stat, err := srcFile.Stat(); err == nil && !opts.NoSparse && sparse(stat) {
+		return copySparse(dstFile, srcFile, stat.Size())
+	}
+
+	if bandwidth == nil {
+		return copyData(dstFile, srcFile)
+	}
+	return bufferedCopy(dstFile, throttle(srcFile))
+}
+
+// bufferedCopy Copy through one --buffer-size buffer. Both ends are wrapped
+// so neither ReadFrom nor WriteTo can bypass the buffer with a small one of
+// their own.
+func bufferedCopy(dst io.Writer, src io.Reader) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, copyBufferSize))
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webdavSink webdav://host/path over HTTPS, webdav+http://host/path without
+// TLS. user:password@ in the URL (or WEBDAV_PASSWORD) logs in with basic
+// auth; WEBDAV_TOKEN is sent as a bearer token instead.
+type webdavSink struct {
+	client *http.Client
+	base   *url.URL
+	user   string
+	pass   string
+	token  string
+
+	mu   sync.Mutex
+	dirs map[string]bool
+}
+
+func newWebDAVSink(u *url.URL) (Sink, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: missing host", u.Redacted())
+	}
+
+	base := *u
+	base.Scheme = "https"
+	if u.Scheme == "webdav+http" {
+		base.Scheme = "http"
+	}
+	base.User = nil
+	base.Path = strings.TrimSuffix(u.Path, "/")
+	base.RawPath = ""
+
+	s := &webdavSink{
+		client: &http.Client{Timeout: 10 * time.Minute},
+		base:   &base,
+		token:  os.Getenv("WEBDAV_TOKEN"),
+		dirs:   make(map[string]bool),
+	}
+	if u.User != nil {
+		s.user = u.User.Username()
+		s.pass, _ = u.User.Password()
+		if s.pass == "" {
+			s.pass = os.Getenv("WEBDAV_PASSWORD")
+		}
+	}
+	return s, nil
+}
+
+func (s *webdavSink) url(name string) string {
+	u := *s.base
+	u.Path = path.Join(s.base.Path, name)
+	if strings.HasSuffix(name, "/") {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+func (s *webdavSink) do(method string, name string, body func() (io.Reader, int64), header http.Header) (*http.Response, error) {
+	return sinkRequest(s.client, func() (*http.Request, error) {
+		req, err := newBodyRequest(method, s.url(name), body)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if s.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.token)
+		} else if s.user != "" {
+			req.SetBasicAuth(s.user, s.pass)
+		}
+		return req, nil
+	})
+}
+
+// EnsureDir MKCOL every missing level; 405 means the collection exists.
+func (s *webdavSink) EnsureDir(dir string) error {
+	parts := strings.Split(dir, "/")
+	for i := range parts {
+		sub := strings.Join(parts[:i+1], "/")
+
+		s.mu.Lock()
+		known := s.dirs[sub]
+		s.mu.Unlock()
+		if known {
+			continue
+		}
+
+		resp, err := s.do("MKCOL", sub+"/", nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("webdav MKCOL %s: %s", sub, resp.Status)
+		}
+
+		s.mu.Lock()
+		s.dirs[sub] = true
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// WriteFile PUT to a hidden temp name and MOVE it over the target, so
+// collaborators never open a partial file.
+func (s *webdavSink) WriteFile(name string, src string) error {
+	tmp := path.Join(path.Dir(name), ".watch-"+strconv.Itoa(os.Getpid())+"-"+path.Base(name)+stagingSuffix)
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	body := func() (io.Reader, int64) { return throttle(io.NewSectionReader(f, 0, stat.Size())), stat.Size() }
+	resp, err := s.do("PUT", tmp, body, http.Header{"Content-Type": {contentType(f, name)}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webdav PUT %s: %s", name, resp.Status)
+	}
+
+	resp, err = s.do("MOVE", tmp, nil, http.Header{"Destination": {s.url(name)}, "Overwrite": {"T"}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		s.Remove(tmp)
+		return fmt.Errorf("webdav MOVE %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+func (s *webdavSink) Remove(name string) error {
+	resp, err := s.do("DELETE", name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("webdav DELETE %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+func (s *webdavSink) Stat(name string) (sinkStat, error) {
+	resp, err := s.do("HEAD", name, nil, nil)
+	if err != nil {
+		return sinkStat{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return sinkStat{}, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return sinkStat{}, fmt.Errorf("webdav HEAD %s: %s", name, resp.Status)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return sinkStat{Size: resp.ContentLength, ModTime: modTime}, nil
+}
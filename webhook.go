@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// webhookEvents What --webhook-on can pick: finished copies, and every kind
+// of notice.
+var webhookEvents = append([]string{"copied"}, noticeKinds...)
+
+// webhookPayload What a webhook is told, as JSON, or what --webhook-template
+// builds its body from.
+type webhookPayload struct {
+	eventMeta
+
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Path    string    `json:"path,omitempty"`
+	Dest    string    `json:"dest,omitempty"`
+	Size    int64     `json:"size,omitempty"`
+	Title   string    `json:"title,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Count   int       `json:"count,omitempty"`
+}
+
+// webhook --webhook: a POST per copy or notice to drive other automation.
+// Payloads are sent in order from a buffer in the background, each retried
+// after network errors and 5xx answers, and dropped when the buffer is full.
+// With a secret the body is signed: X-Watch-Signature is sha256= and the hex
+// HMAC-SHA256 of the X-Watch-Timestamp, a dot and the body.
+type webhook struct {
+	target   string // the URL without its secrets, for messages
+	url      string
+	events   map[string]bool
+	body     *template.Template
+	secret   []byte
+	client   *http.Client
+	payloads chan webhookPayload
+	done     chan struct{}
+	mu       sync.Mutex // guards closed and sending on payloads
+	closed   bool
+}
+
+var webhooks []*webhook
+
+// webhookFuncs Helpers for --webhook-template: json quotes a value.
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+func openWebhook(target string, events []string, body *template.Template, secret string) (*webhook, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid --webhook %q, expected an http:// or https:// URL", target)
+	}
+	w := &webhook{target: u.Scheme + "://" + u.Host + u.Path, url: target, events: make(map[string]bool),
+		body: body, client: &http.Client{Timeout: 30 * time.Second},
+		payloads: make(chan webhookPayload, 4096), done: make(chan struct{})}
+	for _, e := range events {
+		w.events[e] = true
+	}
+	if secret != "" {
+		w.secret = []byte(secret)
+	}
+	go w.run()
+	return w, nil
+}
+
+// parseWebhookOn --webhook-on, a comma separated list of events.
+func parseWebhookOn(list string) ([]string, error) {
+	var events []string
+	for _, e := range strings.Split(list, ",") {
+		e = strings.TrimSpace(e)
+		if !contains(webhookEvents, e) {
+			return nil, fmt.Errorf("invalid --webhook-on %q, use some of %s", e, strings.Join(webhookEvents, ", "))
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// sendWebhooks Pass a finished copy on to the webhooks that want it.
+func sendWebhooks(msg eventMessage) {
+	if msg.Op != "copied" {
+		return
+	}
+	p := webhookPayload{Event: "copied", Time: msg.Time, eventMeta: metaOf(msg.Job), Path: msg.Path, Dest: msg.Dest, Size: msg.Size}
+	for _, w := range webhooks {
+		w.queue(p)
+	}
+}
+
+func (w *webhook) notify(n notice) {
+	w.queue(webhookPayload{Event: n.Kind, Time: n.Time, eventMeta: n.eventMeta, Path: n.Path, Title: n.Title, Message: n.Message, Count: n.Count})
+}
+
+func (w *webhook) queue(p webhookPayload) {
+	if !w.events[p.Event] {
+		return
+	}
+	// copy workers still finishing may queue after close
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.payloads <- p:
+	default:
+		debugf("webhook %s: buffer full, dropped %s %s", w.target, p.Event, p.Path)
+	}
+}
+
+func (w *webhook) run() {
+	defer close(w.done)
+	for p := range w.payloads {
+		if err := w.post(p); err != nil {
+			warnf("webhook %s: %s %s: %v", w.target, p.Event, p.Path, err)
+		}
+	}
+}
+
+func (w *webhook) post(p webhookPayload) error {
+	var body []byte
+	if w.body == nil {
+		body, _ = json.Marshal(p)
+	} else {
+		var b bytes.Buffer
+		if err := w.body.Execute(&b, p); err != nil {
+			return fmt.Errorf("--webhook-template: %v", err)
+		}
+		body = b.Bytes()
+	}
+	stamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	resp, err := sinkRequest(w.client, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "watch/"+version)
+		req.Header.Set("X-Watch-Event", p.Event)
+		if w.secret != nil {
+			mac := hmac.New(sha256.New, w.secret)
+			mac.Write([]byte(stamp + "."))
+			mac.Write(body)
+			req.Header.Set("X-Watch-Timestamp", stamp)
+			req.Header.Set("X-Watch-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		return req, nil
+	})
+	if err != nil {
+		// the URL may hold a token
+		return fmt.Errorf("%s", strings.ReplaceAll(err.Error(), w.url, w.target))
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// close Send what is buffered, on shutdown.
+func (w *webhook) close() {
+	w.mu.Lock()
+	w.closed = true
+	close(w.payloads)
+	w.mu.Unlock()
+	select {
+	case <-w.done:
+	case <-time.After(busTimeout):
+	}
+}
+
+// webhookSecret --webhook-secret, or WATCH_WEBHOOK_SECRET so it stays out of
+// the process list.
+func webhookSecret() string {
+	if opts.WebhookSecret != "" {
+		return opts.WebhookSecret
+	}
+	return os.Getenv("WATCH_WEBHOOK_SECRET")
+}
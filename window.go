@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeWindow A weekly time window such as "mon-fri 08:00-18:00", in local
+// time. One ending at or before its start runs past midnight into the next
+// day.
+type timeWindow struct {
+	days       uint8 // bit per time.Weekday
+	start, end int   // minutes into the day
+}
+
+// fullSpeed --full-speed-window: --bwlimit doesn't apply inside these.
+var fullSpeed []timeWindow
+
+func parseWindows(list []string) ([]timeWindow, error) {
+	var windows []timeWindow
+	for _, s := range list {
+		w, err := parseWindow(s)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// parseWindow [days ]HH:MM-HH:MM, days being a list of names or ranges like
+// mon-fri,sun. Without days the window is every day.
+func parseWindow(s string) (timeWindow, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return timeWindow{}, fmt.Errorf("invalid window %q, use [mon-fri] HH:MM-HH:MM", s)
+	}
+
+	w := timeWindow{days: 0x7f}
+	if len(fields) == 2 {
+		bits, err := cronField(fields[0], 0, 6, cronDays)
+		if err != nil {
+			return timeWindow{}, fmt.Errorf("window %q: %v", s, err)
+		}
+		w.days = uint8(bits)
+	}
+
+	from, to, ok := strings.Cut(fields[len(fields)-1], "-")
+	if !ok {
+		return timeWindow{}, fmt.Errorf("invalid window %q, use [mon-fri] HH:MM-HH:MM", s)
+	}
+	var err error
+	if w.start, err = clockMinutes(from); err != nil {
+		return timeWindow{}, fmt.Errorf("window %q: %v", s, err)
+	}
+	if w.end, err = clockMinutes(to); err != nil {
+		return timeWindow{}, fmt.Errorf("window %q: %v", s, err)
+	}
+	if w.start == w.end {
+		return timeWindow{}, fmt.Errorf("window %q is empty", s)
+	}
+	return w, nil
+}
+
+// clockMinutes HH:MM as minutes since midnight; 24:00 is the end of the day.
+func clockMinutes(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return hour*60 + minute, nil
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	now := t.Hour()*60 + t.Minute()
+	today := w.days&(1<<uint(t.Weekday())) != 0
+	if w.start < w.end {
+		return today && now >= w.start && now < w.end
+	}
+	yesterday := w.days&(1<<uint((t.Weekday()+6)%7)) != 0
+	return (today && now >= w.start) || (yesterday && now < w.end)
+}
+
+func inWindows(windows []timeWindow, t time.Time) bool {
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// windowsEnd When t, inside windows, first falls outside all of them.
+func windowsEnd(windows []timeWindow, t time.Time) time.Time {
+	t = t.Truncate(time.Minute)
+	for limit := t.AddDate(0, 0, 8); t.Before(limit); {
+		t = t.Add(time.Minute)
+		if !inWindows(windows, t) {
+			return t
+		}
+	}
+	// windows covering the whole week never end
+	return time.Time{}
+}
+
+// waitWindow Block while the job is inside one of its pause windows, or
+// during maintenance. Events keep being queued meanwhile and are copied once
+// the window closes.
+func (j *job) waitWindow() {
+	waitMaintenance()
+	for inWindows(j.pauses, time.Now()) {
+		until := windowsEnd(j.pauses, time.Now())
+		if until.IsZero() {
+			until = time.Now().Add(time.Hour)
+		}
+		infof("job %s: paused until %s", j.Name, until.Format("Mon 15:04"))
+		time.Sleep(time.Until(until))
+	}
+}
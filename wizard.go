@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runWizard Ask for source and destination on the console, optionally save
+// them as a config (and register it to start at login), and return the
+// arguments to start watching with.
+func runWizard() ([]string, bool) {
+	if !isInteractive() {
+		return nil, false
+	}
+
+	r := stdin
+	fmt.Fprintln(os.Stdout, "watch", version, "- copy new and changed files from one folder to another")
+	fmt.Fprintln(os.Stdout)
+
+	source := ask(r, "Folder to watch", "")
+	if !IsDir(source) {
+		fmt.Fprintln(os.Stderr, "not a folder:", source)
+		return nil, false
+	}
+	dest := ask(r, "Copy files to", "")
+	if err := mkdirAll(dest); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, false
+	}
+
+	args := []string{source, dest}
+
+	exe, _ := os.Executable()
+	if parseBool(ask(r, "Save these settings? [y/N]", "n")) {
+		path := ask(r, "Config file", filepath.Join(filepath.Dir(exe), "watch.json"))
+		if err := saveConfig(path, config{Jobs: []*job{newJob(defaultJob, source, dest)}}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, false
+		}
+		fmt.Fprintln(os.Stdout, "saved", path)
+		args = []string{"--config", path}
+
+		if parseBool(ask(r, "Start automatically at login? [y/N]", "n")) {
+			if err := registerAutostart(exe, path); err != nil {
+				fmt.Fprintln(os.Stderr, "autostart:", err)
+			} else {
+				fmt.Fprintln(os.Stdout, "registered to start at login")
+			}
+		}
+	}
+
+	if !parseBool(ask(r, "Start watching now? [Y/n]", "y")) {
+		os.Exit(0)
+	}
+	return args, true
+}
+
+func ask(r *bufio.Reader, question string, def string) string {
+	if def != "" && !strings.HasSuffix(question, "]") {
+		question += " [" + def + "]"
+	}
+	fmt.Fprint(os.Stdout, question, ": ")
+
+	line, _ := r.ReadString('\n')
+	line = strings.Trim(strings.TrimSpace(line), `"`)
+	if line == "" {
+		return def
+	}
+	return line
+}
+
+func saveConfig(path string, c config) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
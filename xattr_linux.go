@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+// copyXattrs Copy every extended attribute, which on Linux includes the POSIX
+// ACLs (system.posix_acl_*). Attributes the destination filesystem or our
+// privileges do not allow, like security.* labels as non-root, are skipped.
+func copyXattrs(dstFileName string, srcFileName string) error {
+	size, err := syscall.Listxattr(srcFileName, nil)
+	if err != nil || size == 0 {
+		return ignoreXattrErr(err)
+	}
+
+	names := make([]byte, size)
+	size, err = syscall.Listxattr(srcFileName, names)
+	if err != nil {
+		return ignoreXattrErr(err)
+	}
+
+	for _, name := range strings.Split(string(names[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		vsize, err := syscall.Getxattr(srcFileName, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, vsize)
+		if vsize, err = syscall.Getxattr(srcFileName, name, value); err != nil {
+			continue
+		}
+
+		if err = syscall.Setxattr(dstFileName, name, value[:vsize], 0); ignoreXattrErr(err) != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ignoreXattrErr(err error) error {
+	if err == syscall.ENOTSUP || err == syscall.EPERM || err == syscall.EACCES {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+
+package main
+
+var xattrWarned bool
+
+func copyXattrs(dstFileName string, srcFileName string) error {
+	if !xattrWarned {
+		xattrWarned = true
+		warnf("--xattrs is not supported on this platform, skipping")
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	seFileObject            = 1
+	daclSecurityInformation = 0x4
+)
+
+var (
+	advapi32                  = syscall.NewLazyDLL("advapi32.dll")
+	procGetNamedSecurityInfoW = advapi32.NewProc("GetNamedSecurityInfoW")
+	procSetNamedSecurityInfoW = advapi32.NewProc("SetNamedSecurityInfoW")
+	procLocalFree             = syscall.NewLazyDLL("kernel32.dll").NewProc("LocalFree")
+)
+
+// copyXattrs Copy the DACL, which is what Windows ACLs amount to on a file.
+func copyXattrs(dstFileName string, srcFileName string) error {
+	src, err := syscall.UTF16PtrFromString(srcFileName)
+	if err != nil {
+		return err
+	}
+	dst, err := syscall.UTF16PtrFromString(dstFileName)
+	if err != nil {
+		return err
+	}
+
+	var dacl, sd uintptr
+	r, _, _ := procGetNamedSecurityInfoW.Call(uintptr(unsafe.Pointer(src)), seFileObject, daclSecurityInformation,
+		0, 0, uintptr(unsafe.Pointer(&dacl)), 0, uintptr(unsafe.Pointer(&sd)))
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	defer procLocalFree.Call(sd)
+
+	r, _, _ = procSetNamedSecurityInfoW.Call(uintptr(unsafe.Pointer(dst)), seFileObject, daclSecurityInformation,
+		0, 0, dacl, 0)
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}